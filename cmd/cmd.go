@@ -2,11 +2,16 @@ package cmd
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/musix/backhaul/internal/client"
 	"github.com/musix/backhaul/internal/config"
 	"github.com/musix/backhaul/internal/server"
 	"github.com/musix/backhaul/internal/utils"
+	"github.com/musix/backhaul/internal/web"
 
 	"github.com/BurntSushi/toml"
 )
@@ -25,36 +30,202 @@ func Run(configPath string, ctx context.Context) {
 	// Apply default values to the configuration
 	applyDefaults(cfg)
 
-	// Determine whether to run as a server or client
-	switch {
-	case cfg.Server.BindAddr != "":
-		srv := server.NewServer(&cfg.Server, ctx) // server
-		go srv.Start()
-
-		// Wait for shutdown signal
-		<-ctx.Done()
-		srv.Stop()
-		logger.Println("shutting down server...")
-	case cfg.Client.RemoteAddr != "":
-		clnt := client.NewClient(&cfg.Client, ctx) // client
+	// Opt-in tuning of the host, the previous values are restored once the tunnels are stopped
+	tuning := applyTuning(cfg.Tuning)
+
+	// Shared admin endpoint for all tunnels in this process
+	var admin *web.Admin
+	if cfg.Admin.Listen != "" {
+		admin = web.NewAdmin(cfg.Admin.Listen, cfg.Admin.PPROF, ctx, logger)
+		go admin.Start()
+	}
+
+	var wg sync.WaitGroup
+	tunnels := 0
+
+	// Start every configured server
+	for i := range cfg.Servers {
+		if cfg.Servers[i].BindAddr == "" {
+			logger.Warnf("server %q has no bind_addr, skipping", cfg.Servers[i].Name)
+			continue
+		}
+
+		// Additional listeners run as separate servers sharing the ports of the tunnel
+		group := make([]*server.Server, 0, len(cfg.Servers[i].Listeners)+1)
+		for _, srvCfg := range listenerConfigs(&cfg.Servers[i]) {
+			srv := server.NewServer(srvCfg, ctx) // server
+			if admin != nil {
+				admin.Register(web.TunnelInfo{Name: srvCfg.Name, Role: "server", Transport: string(srvCfg.Transport), Address: srvCfg.BindAddr, WebPort: srvCfg.WebPort, Status: srv.Status})
+			}
+			go srv.Start()
+			group = append(group, srv)
+			tunnels++
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				// Wait for shutdown signal
+				<-ctx.Done()
+				srv.Stop()
+				logger.Printf("shutting down server %s...", srvCfg.Name)
+			}()
+		}
+
+		if len(group) > 1 {
+			go listenerHandover(ctx, group)
+		}
+	}
+
+	// Start every configured client
+	for i := range cfg.Clients {
+		clntCfg := &cfg.Clients[i]
+		if clntCfg.RemoteAddr == "" {
+			logger.Warnf("client %q has no remote_addr, skipping", clntCfg.Name)
+			continue
+		}
+
+		clnt := client.NewClient(clntCfg, ctx) // client
+		if admin != nil {
+			admin.Register(web.TunnelInfo{Name: clntCfg.Name, Role: "client", Transport: string(clntCfg.Transport), Address: clntCfg.RemoteAddr, WebPort: clntCfg.WebPort, Status: clnt.Status})
+		}
 		go clnt.Start()
+		tunnels++
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
 
-		// Wait for shutdown signal
-		<-ctx.Done()
-		clnt.Stop()
-		logger.Println("shutting down client...")
+			// Wait for shutdown signal
+			<-ctx.Done()
+			clnt.Stop()
+			logger.Printf("shutting down client %s...", clntCfg.Name)
+		}()
+	}
 
-	default:
+	if tunnels == 0 {
 		logger.Fatalf("neither server nor client configuration is properly set.")
+	}
+
+	wg.Wait()
 
+	// Run returns once the host is back to its previous values, a reload applies its tuning after that
+	tuning.restore()
+}
+
+// listenerConfigs returns the server config followed by one copy per additional listener.
+// Copies only differ in transport and bind address, the web interface stays with the main listener.
+func listenerConfigs(srvCfg *config.ServerConfig) []*config.ServerConfig {
+	configs := []*config.ServerConfig{srvCfg}
+
+	for _, listener := range srvCfg.Listeners {
+		listenerCfg := *srvCfg
+		listenerCfg.Listeners = nil
+		listenerCfg.Transport = listener.Transport
+		listenerCfg.BindAddr = listener.BindAddr
+		listenerCfg.WebPort = 0
+		listenerCfg.Name = string(listener.Transport)
+		if srvCfg.Name != "" {
+			listenerCfg.Name = fmt.Sprintf("%s-%s", srvCfg.Name, listener.Transport)
+		}
+
+		configs = append(configs, &listenerCfg)
+	}
+
+	return configs
+}
+
+// listenerHandover restarts the previously connected listener of a tunnel once the client
+// established a control channel on another one, so the tunnel ports are released right away
+// instead of waiting for the old control channel to time out.
+func listenerHandover(ctx context.Context, group []*server.Server) {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	active := -1
+	connected := make([]bool, len(group))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			for i, srv := range group {
+				wasConnected := connected[i]
+				connected[i] = strings.HasPrefix(srv.Status(), "Connected")
+
+				// only a listener that just got its control channel takes over the tunnel
+				if !connected[i] || wasConnected || i == active {
+					continue
+				}
+
+				if active >= 0 && connected[active] {
+					logger.Infof("control channel moved to %s listener, releasing the previous one", srv.Transport())
+					go group[active].Restart()
+				}
+				active = i
+			}
+		}
 	}
 }
 
 // loadConfig loads and parses the TOML configuration file.
+// The [server] and [client] sections are accepted both as a single table and as an array of tables.
 func loadConfig(configPath string) (*config.Config, error) {
 	var cfg config.Config
-	if _, err := toml.DecodeFile(configPath, &cfg); err != nil {
+	var raw map[string]toml.Primitive
+
+	md, err := toml.DecodeFile(configPath, &raw)
+	if err != nil {
 		return &cfg, err
 	}
+
+	if section, ok := raw["server"]; ok {
+		switch md.Type("server") {
+		case "Hash":
+			var srv config.ServerConfig
+			if err := md.PrimitiveDecode(section, &srv); err != nil {
+				return &cfg, err
+			}
+			cfg.Servers = append(cfg.Servers, srv)
+		case "ArrayHash":
+			if err := md.PrimitiveDecode(section, &cfg.Servers); err != nil {
+				return &cfg, err
+			}
+		default:
+			return &cfg, fmt.Errorf("invalid type for server section: %s", md.Type("server"))
+		}
+	}
+
+	if section, ok := raw["client"]; ok {
+		switch md.Type("client") {
+		case "Hash":
+			var clnt config.ClientConfig
+			if err := md.PrimitiveDecode(section, &clnt); err != nil {
+				return &cfg, err
+			}
+			cfg.Clients = append(cfg.Clients, clnt)
+		case "ArrayHash":
+			if err := md.PrimitiveDecode(section, &cfg.Clients); err != nil {
+				return &cfg, err
+			}
+		default:
+			return &cfg, fmt.Errorf("invalid type for client section: %s", md.Type("client"))
+		}
+	}
+
+	if section, ok := raw["admin"]; ok {
+		if err := md.PrimitiveDecode(section, &cfg.Admin); err != nil {
+			return &cfg, err
+		}
+	}
+
+	if section, ok := raw["tuning"]; ok {
+		if err := md.PrimitiveDecode(section, &cfg.Tuning); err != nil {
+			return &cfg, err
+		}
+	}
+
 	return &cfg, nil
 }
@@ -1,7 +1,10 @@
 package cmd
 
 import (
+	"fmt"
+
 	"github.com/musix/backhaul/internal/config"
+	"github.com/musix/backhaul/internal/utils"
 
 	"github.com/sirupsen/logrus"
 )
@@ -23,110 +26,414 @@ const ( // Default values
 	defaultMaxStreamBuffer  = 65536   // 256KB
 	defaultSnifferLog       = "backhaul.json"
 	defaultMuxCon           = 8
+	// related to client failover
+	defaultFailbackInterval = 60 // 60 seconds
+	// related to transport fallback
+	defaultFallbackProbeInterval = 120 // 120 seconds
+	// related to backend pools
+	defaultPoolStrategy        = "round_robin"
+	defaultHealthCheckInterval = 10 // 10 seconds
+	defaultMaxFails            = 3
+	defaultEjectTime           = 30 // 30 seconds
+	// related to kcp
+	defaultKcpInterval  = 40 // 40 ms
+	defaultKcpWindow    = 1024
+	defaultKcpMTU       = 1350
+	defaultKcpDataShard = 10
+	// related to udp fec
+	defaultFecDataShards   = 10
+	defaultFecGroupTimeout = 20 // 20 ms
+	// related to grpc
+	defaultGrpcService = "TunnelService"
+	// related to split http
+	defaultSplitPacketSize  = 524288 // 512KB
+	defaultSplitConcurrency = 8
+	// related to tls
+	defaultTLSCertFile = "backhaul.crt"
+	defaultTLSKeyFile  = "backhaul.key"
+	// related to udp sessions
+	defaultUDPDropPolicy = "drop-newest"
+	// related to half-closed connections
+	defaultHalfCloseLinger = 30 // 30 seconds
+	// related to system tuning
+	defaultTuningProfile = "none"
 )
 
 func applyDefaults(cfg *config.Config) {
-	// Token
-	if cfg.Server.Token == "" {
-		cfg.Server.Token = defaultToken
+	tunnels := len(cfg.Servers) + len(cfg.Clients)
+	for _, srv := range cfg.Servers {
+		tunnels += len(srv.Listeners) // every additional listener runs as its own server
+	}
+	multiple := tunnels > 1
+
+	// System tuning is off unless a profile is selected
+	if cfg.Tuning.Profile == "" {
+		cfg.Tuning.Profile = defaultTuningProfile
 	}
-	if cfg.Client.Token == "" {
-		cfg.Client.Token = defaultToken
+	if _, ok := tuningProfiles[cfg.Tuning.Profile]; !ok {
+		logger.Fatalf("invalid tuning profile %q, expected none, connections, throughput or full", cfg.Tuning.Profile)
+	}
+
+	for i := range cfg.Servers {
+		// Name tunnels so logs and the admin endpoint can tell them apart
+		if cfg.Servers[i].Name == "" && multiple {
+			cfg.Servers[i].Name = fmt.Sprintf("server-%d", i+1)
+		}
+		applyServerDefaults(&cfg.Servers[i])
+	}
+
+	for i := range cfg.Clients {
+		if cfg.Clients[i].Name == "" && multiple {
+			cfg.Clients[i].Name = fmt.Sprintf("client-%d", i+1)
+		}
+		applyClientDefaults(&cfg.Clients[i])
+	}
+
+	// Web ports are per tunnel, warn about collisions between tunnels
+	webPorts := make(map[int]string)
+	for _, srv := range cfg.Servers {
+		if prev, ok := webPorts[srv.WebPort]; ok && srv.WebPort > 0 {
+			logger.Warnf("web_port %d is used by both %s and %s", srv.WebPort, prev, srv.Name)
+		}
+		webPorts[srv.WebPort] = srv.Name
+	}
+	for _, clnt := range cfg.Clients {
+		if prev, ok := webPorts[clnt.WebPort]; ok && clnt.WebPort > 0 {
+			logger.Warnf("web_port %d is used by both %s and %s", clnt.WebPort, prev, clnt.Name)
+		}
+		webPorts[clnt.WebPort] = clnt.Name
+	}
+}
+
+func applyServerDefaults(cfg *config.ServerConfig) {
+	// Token
+	if cfg.Token == "" {
+		cfg.Token = defaultToken
 	}
 
 	// Nodelay default is false if not valid value found
 
 	// Channel size
-	if cfg.Server.ChannelSize <= 0 {
-		cfg.Server.ChannelSize = defaultChannelSize
+	if cfg.ChannelSize <= 0 {
+		cfg.ChannelSize = defaultChannelSize
 	}
 
 	// Loglevel
-	if _, err := logrus.ParseLevel(cfg.Client.LogLevel); err != nil {
-		cfg.Client.LogLevel = defaultLogLevel
+	if _, err := logrus.ParseLevel(cfg.LogLevel); err != nil {
+		cfg.LogLevel = defaultLogLevel
 	}
 
-	if _, err := logrus.ParseLevel(cfg.Server.LogLevel); err != nil {
-		cfg.Server.LogLevel = defaultLogLevel
+	// Mux Session
+	if cfg.MuxSession <= 0 {
+		cfg.MuxSession = defaultMuxSession
+	}
+
+	// PPROF default is false if not valid value found
+
+	// keep alive
+	if cfg.Keepalive <= 0 {
+		cfg.Keepalive = defaultKeepAlive
+	}
+
+	// Mux version
+	if cfg.MuxVersion <= 0 || cfg.MuxVersion > 2 {
+		cfg.MuxVersion = defaultMuxVersion
+	}
+	// MaxFrameSize
+	if cfg.MaxFrameSize <= 0 {
+		cfg.MaxFrameSize = defaultMaxFrameSize
+	}
+	// MaxReceiveBuffer
+	if cfg.MaxReceiveBuffer <= 0 {
+		cfg.MaxReceiveBuffer = defaultMaxReceiveBuffer
+	}
+	// MaxStreamBuffer
+	if cfg.MaxStreamBuffer <= 0 {
+		cfg.MaxStreamBuffer = defaultMaxStreamBuffer
+	}
+	// WebPort returns 0 if not exists
+
+	// SnifferLog
+	if cfg.SnifferLog == "" {
+		cfg.SnifferLog = defaultSnifferLog
+	}
+	// Heartbeat
+	if cfg.Heartbeat < 1 { // Minimum accepted interval is 1 second
+		cfg.Heartbeat = deafultHeartbeat
+	}
+
+	// Mux concurrancy
+	if cfg.MuxCon < 1 {
+		cfg.MuxCon = defaultMuxCon
+	}
+	// KCP, the same values have to be used on the client
+	if cfg.KcpInterval <= 0 {
+		cfg.KcpInterval = defaultKcpInterval
+	}
+	if cfg.KcpSndWnd <= 0 {
+		cfg.KcpSndWnd = defaultKcpWindow
+	}
+	if cfg.KcpRcvWnd <= 0 {
+		cfg.KcpRcvWnd = defaultKcpWindow
+	}
+	if cfg.KcpMTU <= 0 {
+		cfg.KcpMTU = defaultKcpMTU
+	}
+	if cfg.KcpParityShard > 0 && cfg.KcpDataShard <= 0 {
+		cfg.KcpDataShard = defaultKcpDataShard
+	}
+	if cfg.KcpParityShard <= 0 { // FEC disabled
+		cfg.KcpDataShard = 0
+		cfg.KcpParityShard = 0
+	}
+	// UDP FEC, negotiated with the client
+	if cfg.FecParityShards > 0 && cfg.FecDataShards <= 0 {
+		cfg.FecDataShards = defaultFecDataShards
+	}
+	if cfg.FecParityShards > 0 && cfg.FecGroupTimeout <= 0 {
+		cfg.FecGroupTimeout = defaultFecGroupTimeout
+	}
+	if cfg.FecParityShards <= 0 { // FEC disabled
+		cfg.FecDataShards = 0
+		cfg.FecParityShards = 0
+	}
+	if cfg.FecDataShards+cfg.FecParityShards > utils.FECMaxShards {
+		logger.Fatalf("fec_data_shards and fec_parity_shards must not exceed %d shards in total", utils.FECMaxShards)
+	}
+	if cfg.FecParityShards > 0 && cfg.Transport != config.UDP {
+		logger.Warnf("fec is only supported by the udp transport, ignoring it for %s", cfg.Transport)
+	}
+
+	// gRPC service name, the same value has to be used on the client
+	if cfg.GrpcService == "" {
+		cfg.GrpcService = defaultGrpcService
+	}
+
+	// Split HTTP, uploads larger than the packet size are refused
+	if cfg.SplitPacketSize <= 0 {
+		cfg.SplitPacketSize = defaultSplitPacketSize
+	}
+	if cfg.SplitConcurrency <= 0 {
+		cfg.SplitConcurrency = defaultSplitConcurrency
+	}
+
+	// TLS certificate, generated on first start when the files do not exist
+	if cfg.TLSCertFile == "" {
+		cfg.TLSCertFile = defaultTLSCertFile
+	}
+	if cfg.TLSKeyFile == "" {
+		cfg.TLSKeyFile = defaultTLSKeyFile
+	}
+
+	// Mutual TLS, the client certificates are required unless it is set to optional
+	if cfg.TLSClientCA != "" && cfg.TLSClientAuth == "" {
+		cfg.TLSClientAuth = "required"
+	}
+	if cfg.TLSClientAuth != "" && cfg.TLSClientAuth != "required" && cfg.TLSClientAuth != "optional" {
+		logger.Fatalf("invalid tls_client_auth %q, expected required or optional", cfg.TLSClientAuth)
+	}
+	if len(cfg.Tenants) > 0 && cfg.TLSClientCA == "" {
+		logger.Warnf("tenants are only selected by verified client certificates, ignoring them without tls_client_ca")
+	}
+	for _, tenant := range cfg.Tenants {
+		if tenant.Identity == "" {
+			logger.Fatalf("tenant %q has no identity", tenant.Name)
+		}
+	}
+
+	// UDP sessions of the local ports, one per client address. The idle timeout and the buffer size are
+	// left to the defaults of the transports when they are not set.
+	if cfg.UDPMaxSessions < 0 || cfg.UDPMaxPerSource < 0 {
+		logger.Fatalf("udp_max_sessions and udp_max_sessions_per_source must not be negative")
+	}
+	if cfg.UDPDropPolicy == "" {
+		cfg.UDPDropPolicy = defaultUDPDropPolicy
+	}
+	if cfg.UDPDropPolicy != "drop-newest" && cfg.UDPDropPolicy != "drop-oldest" {
+		logger.Fatalf("invalid udp_drop_policy %q, expected drop-newest or drop-oldest", cfg.UDPDropPolicy)
+	}
+
+	// Half-closed connections, a negative linger disables half-close
+	if cfg.HalfCloseLinger == 0 {
+		cfg.HalfCloseLinger = defaultHalfCloseLinger
+	}
+
+	// Only the tcpmux transport accepts multipath tunnel connections
+	if cfg.Multipath && cfg.Transport != config.TCPMUX && cfg.Transport != config.TCPMUXTLS {
+		logger.Warnf("multipath is only supported by the tcpmux transport, ignoring it for %s", cfg.Transport)
+	}
+}
+
+func applyClientDefaults(cfg *config.ClientConfig) {
+	// Token
+	if cfg.Token == "" {
+		cfg.Token = defaultToken
+	}
+
+	// Loglevel
+	if _, err := logrus.ParseLevel(cfg.LogLevel); err != nil {
+		cfg.LogLevel = defaultLogLevel
 	}
 
 	// Retry interval
-	if cfg.Client.RetryInterval <= 0 {
-		cfg.Client.RetryInterval = defaultRetryInterval
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = defaultRetryInterval
 	}
 
 	// Connection pool
-	if cfg.Client.ConnectionPool <= 0 {
-		cfg.Client.ConnectionPool = defaultConnectionPool
+	if cfg.ConnectionPool <= 0 {
+		cfg.ConnectionPool = defaultConnectionPool
 	}
 
 	// Mux Session
-	if cfg.Server.MuxSession <= 0 {
-		cfg.Server.MuxSession = defaultMuxSession
+	if cfg.MuxSession <= 0 {
+		cfg.MuxSession = defaultMuxSession
 	}
-	if cfg.Client.MuxSession <= 0 {
-		cfg.Client.MuxSession = defaultMuxSession
+
+	// keep alive
+	if cfg.Keepalive <= 0 {
+		cfg.Keepalive = defaultKeepAlive
 	}
 
-	// PPROF default is false if not valid value found
+	// Mux version
+	if cfg.MuxVersion <= 0 || cfg.MuxVersion > 2 {
+		cfg.MuxVersion = defaultMuxVersion
+	}
+	// MaxFrameSize
+	if cfg.MaxFrameSize <= 0 {
+		cfg.MaxFrameSize = defaultMaxFrameSize
+	}
+	// MaxReceiveBuffer
+	if cfg.MaxReceiveBuffer <= 0 {
+		cfg.MaxReceiveBuffer = defaultMaxReceiveBuffer
+	}
+	// MaxStreamBuffer
+	if cfg.MaxStreamBuffer <= 0 {
+		cfg.MaxStreamBuffer = defaultMaxStreamBuffer
+	}
 
-	// keep alive
-	if cfg.Server.Keepalive <= 0 {
-		cfg.Server.Keepalive = defaultKeepAlive
+	// SnifferLog
+	if cfg.SnifferLog == "" {
+		cfg.SnifferLog = defaultSnifferLog
 	}
-	if cfg.Client.Keepalive <= 0 {
-		cfg.Client.Keepalive = defaultKeepAlive
+
+	// Timeout
+	if cfg.DialTimeout < 1 { // Minimum accepted value is 1 second
+		cfg.DialTimeout = defaultDialTimeout
 	}
 
-	// Mux version
-	if cfg.Server.MuxVersion <= 0 || cfg.Server.MuxVersion > 2 {
-		cfg.Server.MuxVersion = defaultMuxVersion
+	// Transport fallback, the first entry is used as the main transport and remote address
+	if len(cfg.TransportFallback) > 0 {
+		if cfg.Transport == "" {
+			cfg.Transport = cfg.TransportFallback[0].Transport
+		}
+		if cfg.RemoteAddr == "" && len(cfg.RemoteServers) == 0 {
+			cfg.RemoteAddr = cfg.TransportFallback[0].RemoteAddr
+		}
 	}
-	if cfg.Client.MuxVersion <= 0 || cfg.Client.MuxVersion > 2 {
-		cfg.Client.MuxVersion = defaultMuxVersion
+
+	// Fallback probe interval
+	if cfg.FallbackProbeInterval <= 0 {
+		cfg.FallbackProbeInterval = defaultFallbackProbeInterval
 	}
-	// MaxFrameSize
-	if cfg.Server.MaxFrameSize <= 0 {
-		cfg.Server.MaxFrameSize = defaultMaxFrameSize
+
+	// Remote address defaults to the preferred remote server when only remote_servers is set
+	if cfg.RemoteAddr == "" && len(cfg.RemoteServers) > 0 {
+		preferred := cfg.RemoteServers[0]
+		for _, remote := range cfg.RemoteServers[1:] {
+			if remote.Priority < preferred.Priority {
+				preferred = remote
+			}
+		}
+		cfg.RemoteAddr = preferred.Addr
 	}
-	if cfg.Client.MaxFrameSize <= 0 {
-		cfg.Client.MaxFrameSize = defaultMaxFrameSize
+
+	// Failback interval
+	if cfg.FailbackInterval <= 0 {
+		cfg.FailbackInterval = defaultFailbackInterval
 	}
-	// MaxReceiveBuffer
-	if cfg.Server.MaxReceiveBuffer <= 0 {
-		cfg.Server.MaxReceiveBuffer = defaultMaxReceiveBuffer
+
+	// Half-closed connections, a negative linger disables half-close
+	if cfg.HalfCloseLinger == 0 {
+		cfg.HalfCloseLinger = defaultHalfCloseLinger
 	}
-	if cfg.Client.MaxReceiveBuffer <= 0 {
-		cfg.Client.MaxReceiveBuffer = defaultMaxReceiveBuffer
+
+	// Backend pools, a negative health check interval disables active health checks
+	for i := range cfg.BackendPools {
+		pool := &cfg.BackendPools[i]
+		if pool.Strategy == "" {
+			pool.Strategy = defaultPoolStrategy
+		}
+		if pool.HealthCheckInterval == 0 {
+			pool.HealthCheckInterval = defaultHealthCheckInterval
+		}
+		if pool.MaxFails <= 0 {
+			pool.MaxFails = defaultMaxFails
+		}
+		if pool.EjectTime <= 0 {
+			pool.EjectTime = defaultEjectTime
+		}
 	}
-	// MaxStreamBuffer
-	if cfg.Server.MaxStreamBuffer <= 0 {
-		cfg.Server.MaxStreamBuffer = defaultMaxStreamBuffer
+	// KCP, the same values have to be used on the server
+	if cfg.KcpInterval <= 0 {
+		cfg.KcpInterval = defaultKcpInterval
 	}
-	if cfg.Client.MaxStreamBuffer <= 0 {
-		cfg.Client.MaxStreamBuffer = defaultMaxStreamBuffer
+	if cfg.KcpSndWnd <= 0 {
+		cfg.KcpSndWnd = defaultKcpWindow
+	}
+	if cfg.KcpRcvWnd <= 0 {
+		cfg.KcpRcvWnd = defaultKcpWindow
+	}
+	if cfg.KcpMTU <= 0 {
+		cfg.KcpMTU = defaultKcpMTU
+	}
+	if cfg.KcpParityShard > 0 && cfg.KcpDataShard <= 0 {
+		cfg.KcpDataShard = defaultKcpDataShard
+	}
+	if cfg.KcpParityShard <= 0 { // FEC disabled
+		cfg.KcpDataShard = 0
+		cfg.KcpParityShard = 0
+	}
+	// UDP FEC, negotiated with the server
+	if cfg.FecParityShards > 0 && cfg.FecDataShards <= 0 {
+		cfg.FecDataShards = defaultFecDataShards
+	}
+	if cfg.FecParityShards > 0 && cfg.FecGroupTimeout <= 0 {
+		cfg.FecGroupTimeout = defaultFecGroupTimeout
+	}
+	if cfg.FecParityShards <= 0 { // FEC disabled
+		cfg.FecDataShards = 0
+		cfg.FecParityShards = 0
+	}
+	if cfg.FecDataShards+cfg.FecParityShards > utils.FECMaxShards {
+		logger.Fatalf("fec_data_shards and fec_parity_shards must not exceed %d shards in total", utils.FECMaxShards)
+	}
+	if cfg.FecParityShards > 0 && cfg.Transport != config.UDP {
+		logger.Warnf("fec is only supported by the udp transport, ignoring it for %s", cfg.Transport)
 	}
-	// WebPort returns 0 if not exists
 
-	// SnifferLog
-	if cfg.Server.SnifferLog == "" {
-		cfg.Server.SnifferLog = defaultSnifferLog
+	// gRPC service name
+	if cfg.GrpcService == "" {
+		cfg.GrpcService = defaultGrpcService
 	}
-	if cfg.Client.SnifferLog == "" {
-		cfg.Client.SnifferLog = defaultSnifferLog
+
+	// Split HTTP, the packet size must not be larger than on the server
+	if cfg.SplitPacketSize <= 0 {
+		cfg.SplitPacketSize = defaultSplitPacketSize
 	}
-	// Heartbeat
-	if cfg.Server.Heartbeat < 1 { // Minimum accepted interval is 1 second
-		cfg.Server.Heartbeat = deafultHeartbeat
+	if cfg.SplitConcurrency <= 0 {
+		cfg.SplitConcurrency = defaultSplitConcurrency
 	}
 
-	// Timeout
-	if cfg.Client.DialTimeout < 1 { // Minimum accepted value is 1 second
-		cfg.Client.DialTimeout = defaultDialTimeout
+	// Server certificate verification, the pins replace the CA check when both are set
+	if cfg.TLSInsecure && len(cfg.TLSPins) > 0 {
+		logger.Warnf("tls_insecure is ignored, the server certificate is checked against tls_pins")
+	} else if cfg.TLSInsecure {
+		logger.Warnf("tls_insecure is set, the server certificate is not verified")
 	}
 
-	// Mux concurrancy
-	if cfg.Server.MuxCon < 1 {
-		cfg.Server.MuxCon = defaultMuxCon
+	// Only the tcpmux transport bonds its connections over several uplinks
+	if len(cfg.MultipathAddrs) > 0 && cfg.Transport != config.TCPMUX && cfg.Transport != config.TCPMUXTLS {
+		logger.Warnf("multipath_addrs is only supported by the tcpmux transport, ignoring it for %s", cfg.Transport)
 	}
 }
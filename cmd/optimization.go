@@ -1,63 +1,214 @@
 package cmd
 
 import (
-	"os/exec"
+	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"syscall"
+
+	"github.com/musix/backhaul/internal/config"
 )
 
-// applyTCPTuning applies temporary TCP optimizations for Linux to handle massive connections
-func ApplyTCPTuning() {
-	if runtime.GOOS == "linux" {
-		logger.Info("Applying TCP optimizations for Linux...")
-
-		// Commands for optimizing TCP parameters
-		commands := [][]string{
-			{"sysctl", "-w", "net.ipv4.ip_local_port_range=1024 65535"}, // Increase ephemeral ports
-			{"sysctl", "-w", "net.ipv4.tcp_tw_reuse=1"},                 // Reuse TIME_WAIT sockets
-			{"sysctl", "-w", "net.ipv4.tcp_fin_timeout=15"},             // Reduce TCP FIN timeout
-			{"sysctl", "-w", "net.core.somaxconn=4096"},                 // Increase max queue length of incoming connections
-			{"sysctl", "-w", "net.ipv4.tcp_max_syn_backlog=8192"},       // Increase SYN request backlog
-			{"sysctl", "-w", "net.ipv4.tcp_window_scaling=1"},           // Enable TCP window scaling
-			{"sysctl", "-w", "net.ipv4.tcp_fastopen=3"},                 // Enable TCP Fast Open
-			{"sysctl", "-w", "net.ipv4.tcp_rmem=16384 262144 1048576"},  // Maximum of 1MB of TCP read buffer memory
-			{"sysctl", "-w", "net.ipv4.tcp_wmem=16384 262144 1048576"},  // Maximum of 1MB TCP write buffer memory
-			{"sysctl", "-w", "net.ipv4.tcp_notsent_lowat=4096"},         // WE DO NOT LET more than 4096 bytes of data goes to buffer if the unsended data still is in the buffer
-			{"sysctl", "-w", "net.core.rmem_default=262144"},            // Set Default Receive Memory in order to receive data with better pace and not start with minimum of 16k
-			{"sysctl", "-w", "net.core.wmem_default=262144"},
-			{"sysctl", "-w", "net.core.wmem_max = 67108864"}, // 64MB: Maxmimum Send Buffer Size Allowed For User To Set In Custom Socket
-			{"sysctl", "-w", "net.core.rmem_max = 67108864"}, // 64MB: Maxmimum Receive Buffer Size Allowed For User To Set In Custom Socket
+// sysctl is a kernel setting of a tuning profile, or the previous value of a changed one
+type sysctl struct {
+	name  string // dotted name, as given to the sysctl command
+	value string
+}
+
+// tuningProfile is a set of host settings applied together
+type tuningProfile struct {
+	sysctls []sysctl
+	nofile  uint64 // RLIMIT_NOFILE of the process, 0 keeps it
+}
+
+// Settings for massive numbers of connections
+var connectionsTuning = []sysctl{
+	{"net.ipv4.ip_local_port_range", "1024 65535"}, // Increase ephemeral ports
+	{"net.ipv4.tcp_tw_reuse", "1"},                 // Reuse TIME_WAIT sockets
+	{"net.ipv4.tcp_fin_timeout", "15"},             // Reduce TCP FIN timeout
+	{"net.core.somaxconn", "4096"},                 // Increase max queue length of incoming connections
+	{"net.ipv4.tcp_max_syn_backlog", "8192"},       // Increase SYN request backlog
+}
+
+// Settings for the bandwidth and the latency of the connections
+var throughputTuning = []sysctl{
+	{"net.ipv4.tcp_window_scaling", "1"},          // Enable TCP window scaling
+	{"net.ipv4.tcp_fastopen", "3"},                // Enable TCP Fast Open
+	{"net.ipv4.tcp_rmem", "16384 262144 1048576"}, // Maximum of 1MB of TCP read buffer memory
+	{"net.ipv4.tcp_wmem", "16384 262144 1048576"}, // Maximum of 1MB TCP write buffer memory
+	{"net.ipv4.tcp_notsent_lowat", "4096"},        // WE DO NOT LET more than 4096 bytes of data goes to buffer if the unsended data still is in the buffer
+	{"net.core.rmem_default", "262144"},           // Set Default Receive Memory in order to receive data with better pace and not start with minimum of 16k
+	{"net.core.wmem_default", "262144"},           // Same for the send memory
+	{"net.core.wmem_max", "67108864"},             // 64MB: Maxmimum Send Buffer Size Allowed For User To Set In Custom Socket
+	{"net.core.rmem_max", "67108864"},             // 64MB: Maxmimum Receive Buffer Size Allowed For User To Set In Custom Socket
+}
+
+// tuningProfiles are the profiles of the tuning section, the host is left untouched with none
+var tuningProfiles = map[string]tuningProfile{
+	"none":        {},
+	"connections": {sysctls: connectionsTuning, nofile: 1048576},
+	"throughput":  {sysctls: throughputTuning},
+	"full":        {sysctls: append(append([]sysctl{}, connectionsTuning...), throughputTuning...), nofile: 1048576},
+}
+
+// hostTuning keeps the previous values of the settings changed by a profile, to restore them on exit
+type hostTuning struct {
+	saved []sysctl
+}
+
+// applyTuning applies the tuning profile of the configuration and reports the result of every setting.
+// With dry_run the intended changes are only logged.
+func applyTuning(cfg config.TuningConfig) *hostTuning {
+	tuning := &hostTuning{}
+
+	profile := tuningProfiles[cfg.Profile]
+	if len(profile.sysctls) == 0 && profile.nofile == 0 {
+		return tuning
+	}
+
+	if runtime.GOOS != "linux" {
+		logger.Warnf("tuning profile %s is only supported on linux, skipping", cfg.Profile)
+		return tuning
+	}
+
+	if cfg.DryRun {
+		logger.Infof("dry run of tuning profile %s, nothing is changed", cfg.Profile)
+	} else {
+		logger.Infof("applying tuning profile %s, the previous values are restored on exit", cfg.Profile)
+	}
+
+	changed, unchanged, failed := 0, 0, 0
+	for _, setting := range profile.sysctls {
+		current, err := readSysctl(setting.name)
+		if err != nil {
+			logger.Errorf("tuning %s: %v", setting.name, err)
+			failed++
+			continue
 		}
 
-		// Execute the sysctl commands
-		for _, cmd := range commands {
-			err := exec.Command(cmd[0], cmd[1:]...).Run()
-			if err != nil {
-				logger.Errorf("Failed to apply TCP tuning: %s", cmd)
-			} else {
-				logger.Debugf("Successfully applied: %s", cmd)
-			}
+		if current == normalizeSysctl(setting.value) {
+			logger.Infof("tuning %s: already %q", setting.name, current)
+			unchanged++
+			continue
 		}
 
-		// Set file descriptor limit programmatically
-		var rLimit syscall.Rlimit
-		err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rLimit)
-		if err != nil {
-			logger.Errorf("Error getting Rlimit: %v", err)
-		} else {
-			logger.Debugf("Current file descriptor limit: %d", rLimit.Cur)
-
-			// Set the maximum and current file descriptor limits to 1048576
-			rLimit.Max = 1048576
-			rLimit.Cur = 1048576
-			err = syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rLimit)
-			if err != nil {
-				logger.Errorf("Error setting Rlimit: %v", err)
-			} else {
-				logger.Debugf("Successfully set file descriptor limit to: %d", rLimit.Cur)
-			}
+		if cfg.DryRun {
+			logger.Infof("tuning %s: would change %q to %q", setting.name, current, setting.value)
+			changed++
+			continue
 		}
+
+		if err := writeSysctl(setting.name, setting.value); err != nil {
+			logger.Errorf("tuning %s: failed to change %q to %q: %v", setting.name, current, setting.value, err)
+			failed++
+			continue
+		}
+
+		tuning.saved = append(tuning.saved, sysctl{name: setting.name, value: current})
+		logger.Infof("tuning %s: changed %q to %q", setting.name, current, setting.value)
+		changed++
+	}
+
+	if profile.nofile > 0 {
+		raised, err := raiseNoFile(profile.nofile, cfg.DryRun)
+		switch {
+		case err != nil:
+			failed++
+		case raised:
+			changed++
+		default:
+			unchanged++
+		}
+	}
+
+	if cfg.DryRun {
+		logger.Infof("dry run of tuning profile %s: %d to change, %d already set, %d failed", cfg.Profile, changed, unchanged, failed)
 	} else {
-		logger.Info("Non-Linux system detected, skipping TCP optimizations.")
+		logger.Infof("tuning profile %s: %d changed, %d already set, %d failed", cfg.Profile, changed, unchanged, failed)
+	}
+
+	return tuning
+}
+
+// restore writes back the previous values of the changed settings, in reverse order
+func (t *hostTuning) restore() {
+	for i := len(t.saved) - 1; i >= 0; i-- {
+		setting := t.saved[i]
+		if err := writeSysctl(setting.name, setting.value); err != nil {
+			logger.Errorf("tuning %s: failed to restore %q: %v", setting.name, setting.value, err)
+			continue
+		}
+		logger.Infof("tuning %s: restored %q", setting.name, setting.value)
 	}
+	t.saved = nil
+}
+
+// sysctlRoot is the directory of the sysctl files, replaced by the tests
+var sysctlRoot = "/proc/sys"
+
+// sysctlPath returns the file of a setting under sysctlRoot
+func sysctlPath(name string) string {
+	return filepath.Join(sysctlRoot, strings.ReplaceAll(name, ".", "/"))
+}
+
+// normalizeSysctl joins the fields of a value with single spaces, the kernel separates them with tabs
+func normalizeSysctl(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
+
+func readSysctl(name string) (string, error) {
+	data, err := os.ReadFile(sysctlPath(name))
+	if err != nil {
+		return "", err
+	}
+	return normalizeSysctl(string(data)), nil
+}
+
+func writeSysctl(name string, value string) error {
+	return os.WriteFile(sysctlPath(name), []byte(value), 0644)
+}
+
+// raiseNoFile raises the file descriptor limit of the process, the hard limit can only be raised with
+// CAP_SYS_RESOURCE, the soft one is then raised up to the hard limit. The limit only applies to this
+// process, it is not restored. raised is false when the limit was already high enough.
+func raiseNoFile(limit uint64, dryRun bool) (raised bool, err error) {
+	var rLimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rLimit); err != nil {
+		logger.Errorf("tuning RLIMIT_NOFILE: %v", err)
+		return false, err
+	}
+
+	if rLimit.Cur >= limit {
+		logger.Infof("tuning RLIMIT_NOFILE: already %d", rLimit.Cur)
+		return false, nil
+	}
+
+	if dryRun {
+		logger.Infof("tuning RLIMIT_NOFILE: would raise %d to %d", rLimit.Cur, limit)
+		return true, nil
+	}
+
+	previous := rLimit.Cur
+	wanted := rLimit
+	wanted.Cur = limit
+	if wanted.Max < limit {
+		wanted.Max = limit
+	}
+
+	err = syscall.Setrlimit(syscall.RLIMIT_NOFILE, &wanted)
+	if err != nil && rLimit.Max > rLimit.Cur {
+		// without the privilege to raise the hard limit, use all of it
+		logger.Warnf("tuning RLIMIT_NOFILE: failed to raise the hard limit to %d: %v", limit, err)
+		wanted = rLimit
+		wanted.Cur = rLimit.Max
+		err = syscall.Setrlimit(syscall.RLIMIT_NOFILE, &wanted)
+	}
+	if err != nil {
+		logger.Errorf("tuning RLIMIT_NOFILE: failed to raise %d to %d: %v", previous, limit, err)
+		return false, err
+	}
+
+	logger.Infof("tuning RLIMIT_NOFILE: raised %d to %d", previous, wanted.Cur)
+	return true, nil
 }
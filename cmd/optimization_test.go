@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/musix/backhaul/internal/config"
+)
+
+// fakeSysctls points the sysctl files to a temporary directory holding the given values
+func fakeSysctls(t *testing.T, values map[string]string) {
+	root := t.TempDir()
+	previous := sysctlRoot
+	sysctlRoot = root
+	t.Cleanup(func() { sysctlRoot = previous })
+
+	for name, value := range values {
+		path := sysctlPath(name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(value+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func sysctlValue(t *testing.T, name string) string {
+	value, err := readSysctl(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func testProfile(t *testing.T, sysctls ...sysctl) string {
+	tuningProfiles["test"] = tuningProfile{sysctls: sysctls}
+	t.Cleanup(func() { delete(tuningProfiles, "test") })
+	return "test"
+}
+
+func TestTuningApplyRestore(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("tuning profiles are only applied on linux")
+	}
+	logger.SetOutput(io.Discard)
+
+	fakeSysctls(t, map[string]string{
+		"net.core.somaxconn":           "128",
+		"net.ipv4.tcp_fin_timeout":     "15",
+		"net.ipv4.tcp_rmem":            "4096\t131072\t6291456",
+		"net.ipv4.tcp_tw_reuse":        "2",
+		"net.ipv4.ip_local_port_range": "32768\t60999",
+	})
+
+	profile := testProfile(t,
+		sysctl{"net.core.somaxconn", "4096"},
+		sysctl{"net.ipv4.tcp_fin_timeout", "15"},              // already set
+		sysctl{"net.ipv4.tcp_rmem", "16384 262144 1048576"},   // the kernel separates the fields with tabs
+		sysctl{"net.ipv4.tcp_mtu_probing", "1"},               // missing, fails
+		sysctl{"net.ipv4.tcp_tw_reuse", "0"},                  // changed twice, the value before the
+		sysctl{"net.ipv4.tcp_tw_reuse", "1"},                  // first change is restored last
+		sysctl{"net.ipv4.ip_local_port_range", "32768 60999"}, // already set with other separators
+	)
+
+	tuning := applyTuning(config.TuningConfig{Profile: profile})
+
+	for _, c := range []struct {
+		name    string
+		applied string
+	}{
+		{"net.core.somaxconn", "4096"},
+		{"net.ipv4.tcp_fin_timeout", "15"},
+		{"net.ipv4.tcp_rmem", "16384 262144 1048576"},
+		{"net.ipv4.tcp_tw_reuse", "1"},
+		{"net.ipv4.ip_local_port_range", "32768 60999"},
+	} {
+		if value := sysctlValue(t, c.name); value != c.applied {
+			t.Errorf("%s applied as %q, expected %q", c.name, value, c.applied)
+		}
+	}
+	if len(tuning.saved) != 4 {
+		t.Errorf("saved %d previous values, expected 4", len(tuning.saved))
+	}
+	if _, err := os.Stat(sysctlPath("net.ipv4.tcp_mtu_probing")); !os.IsNotExist(err) {
+		t.Errorf("missing setting created: %v", err)
+	}
+
+	tuning.restore()
+
+	for _, c := range []struct {
+		name     string
+		restored string
+	}{
+		{"net.core.somaxconn", "128"},
+		{"net.ipv4.tcp_fin_timeout", "15"},
+		{"net.ipv4.tcp_rmem", "4096 131072 6291456"},
+		{"net.ipv4.tcp_tw_reuse", "2"},
+		{"net.ipv4.ip_local_port_range", "32768 60999"},
+	} {
+		if value := sysctlValue(t, c.name); value != c.restored {
+			t.Errorf("%s restored as %q, expected %q", c.name, value, c.restored)
+		}
+	}
+	if len(tuning.saved) != 0 {
+		t.Error("previous values kept after the restore")
+	}
+}
+
+func TestTuningDryRun(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("tuning profiles are only applied on linux")
+	}
+	logger.SetOutput(io.Discard)
+
+	fakeSysctls(t, map[string]string{"net.core.somaxconn": "128"})
+	profile := testProfile(t, sysctl{"net.core.somaxconn", "4096"})
+
+	tuning := applyTuning(config.TuningConfig{Profile: profile, DryRun: true})
+	if value := sysctlValue(t, "net.core.somaxconn"); value != "128" {
+		t.Errorf("dry run changed the setting to %q", value)
+	}
+	if len(tuning.saved) != 0 {
+		t.Errorf("dry run saved %d values to restore", len(tuning.saved))
+	}
+}
@@ -2,9 +2,13 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/musix/backhaul/internal/utils"
+	"github.com/musix/backhaul/internal/web"
 
 	"github.com/musix/backhaul/internal/config"
 
@@ -18,19 +22,25 @@ import (
 
 // Client encapsulates the client configuration and state
 type Client struct {
-	config *config.ClientConfig
-	ctx    context.Context
-	cancel context.CancelFunc
-	logger *logrus.Logger
+	config   *config.ClientConfig
+	ctx      context.Context
+	cancel   context.CancelFunc
+	logger   *logrus.Logger
+	status   atomic.Pointer[web.TunnelStatus] // tunnel status of the running transport
+	backends *transport.BackendRegistry
+	dial     *transport.DialOptions // egress of the tunnel connections
 }
 
+// pprof listens on a fixed port, so only the first tunnel of the process starts it
+var pprofOnce sync.Once
+
 func NewClient(cfg *config.ClientConfig, parentCtx context.Context) *Client {
 	ctx, cancel := context.WithCancel(parentCtx)
 	return &Client{
 		config: cfg,
 		ctx:    ctx,
 		cancel: cancel,
-		logger: utils.NewLogger(cfg.LogLevel),
+		logger: utils.NewTunnelLogger(cfg.LogLevel, cfg.Name),
 	}
 }
 
@@ -38,36 +48,98 @@ func NewClient(cfg *config.ClientConfig, parentCtx context.Context) *Client {
 func (c *Client) Start() {
 	// for pprof
 	if c.config.PPROF {
-		go func() {
-			c.logger.Info("pprof started at port 6061")
-			http.ListenAndServe("0.0.0.0:6061", nil)
-		}()
+		pprofOnce.Do(func() {
+			go func() {
+				c.logger.Info("pprof started at port 6061")
+				http.ListenAndServe("0.0.0.0:6061", nil)
+			}()
+		})
 	}
 
 	c.logger.Infof("client with remote address %s started successfully", c.config.RemoteAddr)
 
-	if c.config.Transport == config.TCP {
+	// remotes for failover, remote_addr is used alone when no remote_servers are set
+	endpoints := []transport.RemoteEndpoint{{Addr: c.config.RemoteAddr}}
+	if len(c.config.RemoteServers) > 0 {
+		endpoints = endpoints[:0]
+		for _, remote := range c.config.RemoteServers {
+			endpoints = append(endpoints, transport.RemoteEndpoint{Addr: remote.Addr, Priority: remote.Priority})
+		}
+	}
+	remotes := transport.NewRemoteSelector(endpoints, time.Duration(c.config.FailbackInterval)*time.Second, c.logger)
+
+	// tcp socket options of the tunnel and local connections
+	socket := c.socketOptions()
+
+	// backend pools are shared by all transports and outlive transport restarts
+	pools := make([]transport.BackendPoolConfig, 0, len(c.config.BackendPools))
+	for _, pool := range c.config.BackendPools {
+		pools = append(pools, transport.BackendPoolConfig{
+			Name:                pool.Name,
+			Strategy:            pool.Strategy,
+			Targets:             pool.Targets,
+			HealthCheckInterval: time.Duration(pool.HealthCheckInterval) * time.Second,
+			MaxFails:            pool.MaxFails,
+			EjectTime:           time.Duration(pool.EjectTime) * time.Second,
+			Dial:                dialOptions(pool.SourceAddr, pool.Interface, pool.Fwmark, socket),
+		})
+	}
+	backends, err := transport.NewBackendRegistry(c.ctx, pools, dialOptions("", "", 0, socket), time.Duration(c.config.DialTimeout)*time.Second, c.logger)
+	if err != nil {
+		c.logger.Fatalf("failed to create backend pools: %v", err)
+	}
+	c.backends = backends
+	c.dial = dialOptions(c.config.SourceAddr, c.config.Interface, c.config.Fwmark, socket)
+
+	if len(c.config.TransportFallback) > 0 {
+		go c.transportFallback(endpoints)
+	} else {
+		c.status.Store(c.startTransport(c.ctx, c.config.Transport, remotes))
+	}
+
+	<-c.ctx.Done()
+
+	c.logger.Info("all workers stopped successfully")
+
+	// suppress other logs
+	c.logger.SetLevel(logrus.FatalLevel)
+}
+
+// startTransport starts the given transport under ctx and returns its tunnel status
+func (c *Client) startTransport(ctx context.Context, transportType config.TransportType, remotes *transport.RemoteSelector) *web.TunnelStatus {
+	var status *web.TunnelStatus
+
+	if transportType == config.TCP || transportType == config.TCPTLS {
 		tcpConfig := &transport.TcpConfig{
-			RemoteAddr:     c.config.RemoteAddr,
-			Nodelay:        c.config.Nodelay,
-			KeepAlive:      time.Duration(c.config.Keepalive) * time.Second,
-			RetryInterval:  time.Duration(c.config.RetryInterval) * time.Second,
-			DialTimeOut:    time.Duration(c.config.DialTimeout) * time.Second,
-			ConnPoolSize:   c.config.ConnectionPool,
-			Token:          c.config.Token,
-			Sniffer:        c.config.Sniffer,
-			WebPort:        c.config.WebPort,
-			SnifferLog:     c.config.SnifferLog,
-			AggressivePool: c.config.AggressivePool,
+			RemoteAddr:      c.config.RemoteAddr,
+			Nodelay:         c.config.Nodelay,
+			KeepAlive:       time.Duration(c.config.Keepalive) * time.Second,
+			HalfCloseLinger: time.Duration(c.config.HalfCloseLinger) * time.Second,
+			RetryInterval:   time.Duration(c.config.RetryInterval) * time.Second,
+			DialTimeOut:     time.Duration(c.config.DialTimeout) * time.Second,
+			ConnPoolSize:    c.config.ConnectionPool,
+			Token:           c.config.Token,
+			Sniffer:         c.config.Sniffer,
+			WebPort:         c.config.WebPort,
+			SnifferLog:      c.config.SnifferLog,
+			AggressivePool:  c.config.AggressivePool,
+			Remotes:         remotes,
+			Backends:        c.backends,
+			Dial:            c.dial,
+		}
+		if transportType == config.TCPTLS {
+			tcpConfig.TLS = c.tlsOptions()
 		}
-		tcpClient := transport.NewTCPClient(c.ctx, tcpConfig, c.logger)
+		status = &tcpConfig.TunnelStatus
+		tcpClient := transport.NewTCPClient(ctx, tcpConfig, c.logger)
 		go tcpClient.Start()
 
-	} else if c.config.Transport == config.TCPMUX {
+	} else if transportType == config.TCPMUX || transportType == config.TCPMUXTLS {
 		tcpMuxConfig := &transport.TcpMuxConfig{
 			RemoteAddr:       c.config.RemoteAddr,
 			Nodelay:          c.config.Nodelay,
 			KeepAlive:        time.Duration(c.config.Keepalive) * time.Second,
+			HalfCloseLinger:  time.Duration(c.config.HalfCloseLinger) * time.Second,
 			RetryInterval:    time.Duration(c.config.RetryInterval) * time.Second,
 			DialTimeOut:      time.Duration(c.config.DialTimeout) * time.Second,
 			ConnPoolSize:     c.config.ConnectionPool,
@@ -80,34 +152,51 @@ func (c *Client) Start() {
 			WebPort:          c.config.WebPort,
 			SnifferLog:       c.config.SnifferLog,
 			AggressivePool:   c.config.AggressivePool,
+			Remotes:          remotes,
+			Backends:         c.backends,
+			Dial:             c.dial,
+			Paths:            c.config.MultipathAddrs,
 		}
-		tcpMuxClient := transport.NewMuxClient(c.ctx, tcpMuxConfig, c.logger)
+		if transportType == config.TCPMUXTLS {
+			tcpMuxConfig.TLS = c.tlsOptions()
+		}
+		status = &tcpMuxConfig.TunnelStatus
+		tcpMuxClient := transport.NewMuxClient(ctx, tcpMuxConfig, c.logger)
 		go tcpMuxClient.Start()
 
-	} else if c.config.Transport == config.WS || c.config.Transport == config.WSS {
+	} else if transportType == config.WS || transportType == config.WSS {
 		WsConfig := &transport.WsConfig{
-			RemoteAddr:     c.config.RemoteAddr,
-			Nodelay:        c.config.Nodelay,
-			KeepAlive:      time.Duration(c.config.Keepalive) * time.Second,
-			RetryInterval:  time.Duration(c.config.RetryInterval) * time.Second,
-			DialTimeOut:    time.Duration(c.config.DialTimeout) * time.Second,
-			ConnPoolSize:   c.config.ConnectionPool,
-			Token:          c.config.Token,
-			Sniffer:        c.config.Sniffer,
-			WebPort:        c.config.WebPort,
-			SnifferLog:     c.config.SnifferLog,
-			Mode:           c.config.Transport,
-			AggressivePool: c.config.AggressivePool,
-			EdgeIP:         c.config.EdgeIP,
+			RemoteAddr:      c.config.RemoteAddr,
+			Nodelay:         c.config.Nodelay,
+			KeepAlive:       time.Duration(c.config.Keepalive) * time.Second,
+			HalfCloseLinger: time.Duration(c.config.HalfCloseLinger) * time.Second,
+			RetryInterval:   time.Duration(c.config.RetryInterval) * time.Second,
+			DialTimeOut:     time.Duration(c.config.DialTimeout) * time.Second,
+			ConnPoolSize:    c.config.ConnectionPool,
+			Token:           c.config.Token,
+			Sniffer:         c.config.Sniffer,
+			WebPort:         c.config.WebPort,
+			SnifferLog:      c.config.SnifferLog,
+			Mode:            transportType,
+			AggressivePool:  c.config.AggressivePool,
+			Remotes:         remotes,
+			Backends:        c.backends,
+			Dial:            c.dial,
+			EdgeIP:          c.config.EdgeIP,
+		}
+		if transportType == config.WSS {
+			WsConfig.TLS = c.tlsOptions()
 		}
-		WsClient := transport.NewWSClient(c.ctx, WsConfig, c.logger)
+		status = &WsConfig.TunnelStatus
+		WsClient := transport.NewWSClient(ctx, WsConfig, c.logger)
 		go WsClient.Start()
 
-	} else if c.config.Transport == config.WSMUX || c.config.Transport == config.WSSMUX {
+	} else if transportType == config.WSMUX || transportType == config.WSSMUX {
 		wsMuxConfig := &transport.WsMuxConfig{
 			RemoteAddr:       c.config.RemoteAddr,
 			Nodelay:          c.config.Nodelay,
 			KeepAlive:        time.Duration(c.config.Keepalive) * time.Second,
+			HalfCloseLinger:  time.Duration(c.config.HalfCloseLinger) * time.Second,
 			RetryInterval:    time.Duration(c.config.RetryInterval) * time.Second,
 			DialTimeOut:      time.Duration(c.config.DialTimeout) * time.Second,
 			ConnPoolSize:     c.config.ConnectionPool,
@@ -119,31 +208,163 @@ func (c *Client) Start() {
 			Sniffer:          c.config.Sniffer,
 			WebPort:          c.config.WebPort,
 			SnifferLog:       c.config.SnifferLog,
-			Mode:             c.config.Transport,
+			Mode:             transportType,
 			AggressivePool:   c.config.AggressivePool,
+			Remotes:          remotes,
+			Backends:         c.backends,
+			Dial:             c.dial,
 			EdgeIP:           c.config.EdgeIP,
 		}
-		wsMuxClient := transport.NewWSMuxClient(c.ctx, wsMuxConfig, c.logger)
+		if transportType == config.WSSMUX {
+			wsMuxConfig.TLS = c.tlsOptions()
+		}
+		status = &wsMuxConfig.TunnelStatus
+		wsMuxClient := transport.NewWSMuxClient(ctx, wsMuxConfig, c.logger)
 		go wsMuxClient.Start()
 
-	} else if c.config.Transport == config.QUIC {
+	} else if transportType == config.H2 || transportType == config.H2C {
+		h2Config := &transport.H2Config{
+			RemoteAddr:      c.config.RemoteAddr,
+			Nodelay:         c.config.Nodelay,
+			KeepAlive:       time.Duration(c.config.Keepalive) * time.Second,
+			HalfCloseLinger: time.Duration(c.config.HalfCloseLinger) * time.Second,
+			RetryInterval:   time.Duration(c.config.RetryInterval) * time.Second,
+			DialTimeOut:     time.Duration(c.config.DialTimeout) * time.Second,
+			ConnPoolSize:    c.config.ConnectionPool,
+			Token:           c.config.Token,
+			Sniffer:         c.config.Sniffer,
+			WebPort:         c.config.WebPort,
+			SnifferLog:      c.config.SnifferLog,
+			Mode:            transportType,
+			AggressivePool:  c.config.AggressivePool,
+			Remotes:         remotes,
+			Backends:        c.backends,
+			Dial:            c.dial,
+			EdgeIP:          c.config.EdgeIP,
+		}
+		if transportType == config.H2 {
+			h2Config.TLS = c.tlsOptions()
+		}
+		status = &h2Config.TunnelStatus
+		h2Client := transport.NewH2Client(ctx, h2Config, c.logger)
+		go h2Client.Start()
+
+	} else if transportType == config.GRPC {
+		grpcConfig := &transport.GrpcConfig{
+			RemoteAddr:      c.config.RemoteAddr,
+			Nodelay:         c.config.Nodelay,
+			KeepAlive:       time.Duration(c.config.Keepalive) * time.Second,
+			HalfCloseLinger: time.Duration(c.config.HalfCloseLinger) * time.Second,
+			RetryInterval:   time.Duration(c.config.RetryInterval) * time.Second,
+			DialTimeOut:     time.Duration(c.config.DialTimeout) * time.Second,
+			ConnPoolSize:    c.config.ConnectionPool,
+			Token:           c.config.Token,
+			Sniffer:         c.config.Sniffer,
+			WebPort:         c.config.WebPort,
+			SnifferLog:      c.config.SnifferLog,
+			Mode:            transportType,
+			AggressivePool:  c.config.AggressivePool,
+			Remotes:         remotes,
+			Backends:        c.backends,
+			Dial:            c.dial,
+			EdgeIP:          c.config.EdgeIP,
+			ServiceName:     c.config.GrpcService,
+		}
+		if c.config.GrpcTLS {
+			grpcConfig.TLS = c.tlsOptions()
+		}
+		status = &grpcConfig.TunnelStatus
+		grpcClient := transport.NewGrpcClient(ctx, grpcConfig, c.logger)
+		go grpcClient.Start()
+
+	} else if transportType == config.SPLITHTTP || transportType == config.SPLITHTTPS {
+		splitConfig := &transport.SplitHTTPConfig{
+			RemoteAddr:      c.config.RemoteAddr,
+			Nodelay:         c.config.Nodelay,
+			KeepAlive:       time.Duration(c.config.Keepalive) * time.Second,
+			HalfCloseLinger: time.Duration(c.config.HalfCloseLinger) * time.Second,
+			RetryInterval:   time.Duration(c.config.RetryInterval) * time.Second,
+			DialTimeOut:     time.Duration(c.config.DialTimeout) * time.Second,
+			ConnPoolSize:    c.config.ConnectionPool,
+			Token:           c.config.Token,
+			Sniffer:         c.config.Sniffer,
+			WebPort:         c.config.WebPort,
+			SnifferLog:      c.config.SnifferLog,
+			Mode:            transportType,
+			AggressivePool:  c.config.AggressivePool,
+			Remotes:         remotes,
+			Backends:        c.backends,
+			Dial:            c.dial,
+			EdgeIP:          c.config.EdgeIP,
+			PacketSize:      c.config.SplitPacketSize,
+			Concurrency:     c.config.SplitConcurrency,
+		}
+		if transportType == config.SPLITHTTPS {
+			splitConfig.TLS = c.tlsOptions()
+		}
+		status = &splitConfig.TunnelStatus
+		splitClient := transport.NewSplitHTTPClient(ctx, splitConfig, c.logger)
+		go splitClient.Start()
+
+	} else if transportType == config.KCP {
+		kcpConfig := &transport.KcpConfig{
+			RemoteAddr:       c.config.RemoteAddr,
+			Nodelay:          c.config.Nodelay,
+			KeepAlive:        time.Duration(c.config.Keepalive) * time.Second,
+			HalfCloseLinger:  time.Duration(c.config.HalfCloseLinger) * time.Second,
+			RetryInterval:    time.Duration(c.config.RetryInterval) * time.Second,
+			DialTimeOut:      time.Duration(c.config.DialTimeout) * time.Second,
+			ConnPoolSize:     c.config.ConnectionPool,
+			Token:            c.config.Token,
+			MuxVersion:       c.config.MuxVersion,
+			MaxFrameSize:     c.config.MaxFrameSize,
+			MaxReceiveBuffer: c.config.MaxReceiveBuffer,
+			MaxStreamBuffer:  c.config.MaxStreamBuffer,
+			Sniffer:          c.config.Sniffer,
+			WebPort:          c.config.WebPort,
+			SnifferLog:       c.config.SnifferLog,
+			AggressivePool:   c.config.AggressivePool,
+			Remotes:          remotes,
+			Backends:         c.backends,
+			Dial:             c.dial,
+			KcpNodelay:       c.config.KcpNodelay,
+			Interval:         c.config.KcpInterval,
+			Resend:           c.config.KcpResend,
+			NoCongestion:     c.config.KcpNoCongestion,
+			SndWnd:           c.config.KcpSndWnd,
+			RcvWnd:           c.config.KcpRcvWnd,
+			MTU:              c.config.KcpMTU,
+			DataShard:        c.config.KcpDataShard,
+			ParityShard:      c.config.KcpParityShard,
+		}
+		status = &kcpConfig.TunnelStatus
+		kcpClient := transport.NewKcpClient(ctx, kcpConfig, c.logger)
+		go kcpClient.Start()
+
+	} else if transportType == config.QUIC {
 		quicConfig := &transport.QuicConfig{
-			RemoteAddr:     c.config.RemoteAddr,
-			Nodelay:        c.config.Nodelay,
-			KeepAlive:      time.Duration(c.config.Keepalive) * time.Second,
-			RetryInterval:  time.Duration(c.config.RetryInterval) * time.Second,
-			DialTimeOut:    time.Duration(c.config.DialTimeout) * time.Second,
-			ConnectionPool: c.config.ConnectionPool,
-			Token:          c.config.Token,
-			Sniffer:        c.config.Sniffer,
-			WebPort:        c.config.WebPort,
-			SnifferLog:     c.config.SnifferLog,
-			AggressivePool: c.config.AggressivePool,
+			RemoteAddr:      c.config.RemoteAddr,
+			Nodelay:         c.config.Nodelay,
+			KeepAlive:       time.Duration(c.config.Keepalive) * time.Second,
+			HalfCloseLinger: time.Duration(c.config.HalfCloseLinger) * time.Second,
+			RetryInterval:   time.Duration(c.config.RetryInterval) * time.Second,
+			DialTimeOut:     time.Duration(c.config.DialTimeout) * time.Second,
+			ConnectionPool:  c.config.ConnectionPool,
+			Token:           c.config.Token,
+			Sniffer:         c.config.Sniffer,
+			WebPort:         c.config.WebPort,
+			SnifferLog:      c.config.SnifferLog,
+			AggressivePool:  c.config.AggressivePool,
+			Remotes:         remotes,
+			Backends:        c.backends,
+			Dial:            c.dial,
+			TLS:             c.tlsOptions(),
 		}
-		quicClient := transport.NewQuicClient(c.ctx, quicConfig, c.logger)
+		status = &quicConfig.TunnelStatus
+		quicClient := transport.NewQuicClient(ctx, quicConfig, c.logger)
 		go quicClient.ChannelDialer(true)
 
-	} else if c.config.Transport == config.UDP {
+	} else if transportType == config.UDP {
 		udpConfig := &transport.UdpConfig{
 			RemoteAddr:     c.config.RemoteAddr,
 			RetryInterval:  time.Duration(c.config.RetryInterval) * time.Second,
@@ -154,23 +375,107 @@ func (c *Client) Start() {
 			WebPort:        c.config.WebPort,
 			SnifferLog:     c.config.SnifferLog,
 			AggressivePool: c.config.AggressivePool,
+			Remotes:        remotes,
+			Backends:       c.backends,
+			Dial:           c.dial,
+			FEC:            fecConfig(c.config.FecDataShards, c.config.FecParityShards, c.config.FecGroupTimeout),
 		}
-		udpClient := transport.NewUDPClient(c.ctx, udpConfig, c.logger)
+		status = &udpConfig.TunnelStatus
+		udpClient := transport.NewUDPClient(ctx, udpConfig, c.logger)
 		go udpClient.Start()
 
 	} else {
-		c.logger.Fatal("invalid transport type: ", c.config.Transport)
+		c.logger.Fatal("invalid transport type: ", transportType)
 	}
 
-	<-c.ctx.Done()
-
-	c.logger.Info("all workers stopped successfully")
-
-	// suppress other logs
-	c.logger.SetLevel(logrus.FatalLevel)
+	return status
 }
+
 func (c *Client) Stop() {
 	if c.cancel != nil {
 		c.cancel()
 	}
 }
+
+// Status returns the tunnel status reported by the running transport
+func (c *Client) Status() string {
+	status := c.status.Load()
+	if status == nil {
+		return ""
+	}
+	return status.Get()
+}
+
+// fecConfig returns the UDP FEC parameters, nil when FEC is disabled
+func fecConfig(dataShards, parityShards, groupTimeout int) *utils.FECConfig {
+	if parityShards <= 0 {
+		return nil
+	}
+
+	return &utils.FECConfig{
+		DataShards:   dataShards,
+		ParityShards: parityShards,
+		GroupTimeout: time.Duration(groupTimeout) * time.Millisecond,
+	}
+}
+
+// dialOptions returns the egress and socket options of a dial, nil when none is set
+func dialOptions(sourceAddr string, iface string, mark int, socket *utils.SocketOptions) *transport.DialOptions {
+	if sourceAddr == "" && iface == "" && mark == 0 && socket == nil {
+		return nil
+	}
+
+	return &transport.DialOptions{
+		LocalAddr: sourceAddr,
+		Interface: iface,
+		Mark:      mark,
+		Socket:    socket,
+	}
+}
+
+// socketOptions returns the tcp socket options of the tunnel, nil when none is set
+func (c *Client) socketOptions() *utils.SocketOptions {
+	socket := &utils.SocketOptions{
+		Congestion:   c.config.TCPCongestion,
+		NotSentLowat: c.config.TCPNotSentLowat,
+		UserTimeout:  time.Duration(c.config.TCPUserTimeout) * time.Second,
+		DSCP:         c.config.DSCP,
+	}
+	if *socket == (utils.SocketOptions{}) {
+		return nil
+	}
+	if err := socket.Validate(); err != nil {
+		c.logger.Fatalf("invalid socket options: %v", err)
+	}
+	return socket
+}
+
+// tlsOptions returns the client TLS settings of the tls transports
+func (c *Client) tlsOptions() *transport.TLSOptions {
+	opts := &transport.TLSOptions{
+		ServerName: c.config.TLSServerName,
+		Insecure:   c.config.TLSInsecure,
+	}
+	if c.config.TLSCAFile != "" {
+		pool, err := transport.LoadCAFile(c.config.TLSCAFile)
+		if err != nil {
+			c.logger.Fatalf("failed to load tls_ca: %v", err)
+		}
+		opts.RootCAs = pool
+	}
+	if c.config.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.config.TLSCertFile, c.config.TLSKeyFile)
+		if err != nil {
+			c.logger.Fatalf("failed to load client certificate: %v", err)
+		}
+		opts.ClientCert = &cert
+	}
+	for _, pin := range c.config.TLSPins {
+		b, err := transport.ParsePin(pin)
+		if err != nil {
+			c.logger.Fatalf("invalid tls_pins entry: %v", err)
+		}
+		opts.Pins = append(opts.Pins, b)
+	}
+	return opts
+}
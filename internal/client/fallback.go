@@ -0,0 +1,129 @@
+package client
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/musix/backhaul/internal/client/transport"
+	"github.com/musix/backhaul/internal/config"
+	"github.com/musix/backhaul/internal/web"
+)
+
+// transportFallback tries the transports of transport_fallback in order and keeps the first one
+// that completes the handshake. While a less preferred transport is in use, the preferred ones
+// are probed periodically and the client moves back as soon as one of them is reachable.
+func (c *Client) transportFallback(endpoints []transport.RemoteEndpoint) {
+	candidates := c.config.TransportFallback
+	dialTimeout := time.Duration(c.config.DialTimeout) * time.Second
+	probeInterval := time.Duration(c.config.FallbackProbeInterval) * time.Second
+
+	// the dialers retry 3 times with a 1s and a 2s backoff before the retry interval kicks in
+	handshakeTimeout := 3*dialTimeout + 3*time.Second + time.Duration(c.config.RetryInterval)*time.Second
+
+	index := 0
+	for {
+		candidate := candidates[index]
+		remotes := transport.NewRemoteSelector(c.fallbackEndpoints(candidate, endpoints), time.Duration(c.config.FailbackInterval)*time.Second, c.logger)
+
+		c.logger.Infof("trying transport %s (%d/%d)", candidate.Transport, index+1, len(candidates))
+
+		ctx, cancel := context.WithCancel(c.ctx)
+		status := c.startTransport(ctx, candidate.Transport, remotes)
+		c.status.Store(status)
+
+		next := c.superviseTransport(ctx, status, index, endpoints, handshakeTimeout, dialTimeout, probeInterval)
+		cancel()
+
+		if next < 0 {
+			return
+		}
+		index = next
+
+		// give the stopped transport time to close its control channel
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// superviseTransport watches the running transport and returns the index of the transport to
+// switch to, or -1 once the client is stopped
+func (c *Client) superviseTransport(ctx context.Context, status *web.TunnelStatus, index int, endpoints []transport.RemoteEndpoint, handshakeTimeout time.Duration, dialTimeout time.Duration, probeInterval time.Duration) int {
+	candidates := c.config.TransportFallback
+	current := candidates[index].Transport
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	connected := false
+	lastConnected := time.Now()
+	lastProbe := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return -1
+
+		case <-ticker.C:
+			if strings.HasPrefix(status.Get(), "Connected") {
+				if !connected {
+					c.logger.Infof("transport %s connected successfully", current)
+					connected = true
+				}
+				lastConnected = time.Now()
+			} else if time.Since(lastConnected) > handshakeTimeout {
+				next := (index + 1) % len(candidates)
+				c.logger.Warnf("transport %s is not connected after %v, falling back to %s", current, handshakeTimeout, candidates[next].Transport)
+				return next
+			}
+
+			// re-probe the preferred transports
+			if !connected || index == 0 || probeInterval <= 0 || time.Since(lastProbe) < probeInterval {
+				continue
+			}
+			lastProbe = time.Now()
+
+			for i := 0; i < index; i++ {
+				// kcp has no handshake to probe, it is only tried again once the current transport fails
+				if candidates[i].Transport == config.KCP {
+					continue
+				}
+
+				addr := transport.NewRemoteSelector(c.fallbackEndpoints(candidates[i], endpoints), 0, c.logger).Current()
+
+				// the handshake of the transport is probed, a blocked TLS or websocket handshake would
+				// otherwise switch back to a transport that can not connect
+				probe := transport.HandshakeProbe(candidates[i].Transport, dialTimeout, c.dial, c.probeTLS(candidates[i].Transport), c.config.EdgeIP)
+
+				if err := probe(ctx, addr); err != nil {
+					c.logger.Debugf("preferred transport %s at %s is still unreachable: %v", candidates[i].Transport, addr, err)
+					continue
+				}
+
+				c.logger.Infof("preferred transport %s at %s is reachable again, switching back", candidates[i].Transport, addr)
+				return i
+			}
+		}
+	}
+}
+
+// probeTLS returns the TLS options of a transport for its handshake probe, nil when it does not use TLS
+func (c *Client) probeTLS(transportType config.TransportType) *transport.TLSOptions {
+	switch transportType {
+	case config.TCPTLS, config.TCPMUXTLS, config.WSS, config.WSSMUX, config.H2, config.SPLITHTTPS:
+		return c.tlsOptions()
+	case config.GRPC:
+		if c.config.GrpcTLS {
+			return c.tlsOptions()
+		}
+	}
+	return nil
+}
+
+// fallbackEndpoints returns the remotes of a fallback transport, the client remotes are used
+// when the entry has no remote_addr of its own
+func (c *Client) fallbackEndpoints(candidate config.TransportFallback, endpoints []transport.RemoteEndpoint) []transport.RemoteEndpoint {
+	if candidate.RemoteAddr != "" {
+		return []transport.RemoteEndpoint{{Addr: candidate.RemoteAddr}}
+	}
+	return endpoints
+}
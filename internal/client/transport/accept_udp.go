@@ -3,24 +3,26 @@ package transport
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 	"net"
 	"time"
 
+	"github.com/musix/backhaul/internal/utils"
 	"github.com/musix/backhaul/internal/web"
 	"github.com/sirupsen/logrus"
 )
 
 const BufferSize = 16 * 1024
 
-func UDPDialer(tcp net.Conn, remoteAddr string, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
+func UDPDialer(tcp net.Conn, remoteAddr string, opts *DialOptions, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
 	remoteUDPAddr, err := net.ResolveUDPAddr("udp", remoteAddr)
 	if err != nil {
 		logger.Fatalf("failed to resolve remote address: %v", err)
 	}
 
 	// Dial the remote UDP server
-	remoteConn, err := net.DialUDP("udp", nil, remoteUDPAddr)
+	remoteConn, err := DialUDP(remoteUDPAddr.String(), opts)
 	if err != nil {
 		logger.Fatalf("failed to dial remote UDP address: %v", err)
 	}
@@ -30,17 +32,20 @@ func UDPDialer(tcp net.Conn, remoteAddr string, logger *logrus.Logger, usage *we
 	done := make(chan struct{})
 
 	go func() {
-		go tcpToUDP(tcp, remoteConn, logger, usage, remotePort, sniffer)
+		tcpToUDP(tcp, remoteConn, logger, usage, remotePort, sniffer)
+		remoteConn.Close() // stops udpToTCP once the tunnel side is closed
 		done <- struct{}{}
 	}()
 
 	udpToTCP(tcp, remoteConn, logger, usage, remotePort, sniffer)
+	tcp.Close() // stops tcpToUDP once the local side failed
 
 	<-done
 }
 
 func tcpToUDP(tcp net.Conn, udp *net.UDPConn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
-	buf := make([]byte, BufferSize)
+	buf := utils.GetBuffer(BufferSize)
+	defer utils.PutBuffer(buf)
 	lenBuf := make([]byte, 2) // 2-byte header for packet size
 
 	for {
@@ -90,17 +95,24 @@ func tcpToUDP(tcp net.Conn, udp *net.UDPConn, logger *logrus.Logger, usage *web.
 }
 
 func udpToTCP(tcp net.Conn, udp *net.UDPConn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
-	buf := make([]byte, BufferSize-6) // reserved for 5 bytes header
+	buf := utils.GetBuffer(BufferSize - 6) // reserved for 5 bytes header
+	defer utils.PutBuffer(buf)
 
 	// Pre-allocate headers
-	header := make([]byte, 2)                                    // 2-byte header for packet size
-	timestampHeader := make([]byte, 4)                           // 4-byte header for timestamp
-	packetBuffer := bytes.NewBuffer(make([]byte, 0, BufferSize)) // Pre-allocated buffer for packets
+	header := make([]byte, 2)              // 2-byte header for packet size
+	timestampHeader := make([]byte, 4)     // 4-byte header for timestamp
+	backing := utils.GetBuffer(BufferSize) // Pre-allocated buffer for packets
+	defer utils.PutBuffer(backing)
+	packetBuffer := bytes.NewBuffer(backing[:0])
 
 	for {
 		r, err := udp.Read(buf)
 		if err != nil {
-			logger.Errorf("failed to read from UDP connection: %v", err)
+			if errors.Is(err, net.ErrClosed) {
+				logger.Debug("UDP connection closed.")
+			} else {
+				logger.Errorf("failed to read from UDP connection: %v", err)
+			}
 			return
 		}
 
@@ -0,0 +1,75 @@
+package transport
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// startTestUDPEcho answers every packet with the same packet
+func startTestUDPEcho(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, BufferSize)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+func TestUDPDialer(t *testing.T) {
+	echo := startTestUDPEcho(t)
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	stream, tunnel := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		UDPDialer(stream, echo.LocalAddr().String(), nil, logger, nil, 0, false)
+		close(done)
+	}()
+
+	for _, packet := range []string{"first", "second", string(make([]byte, 1200))} {
+		// the server frames the packets with their size
+		frame := binary.BigEndian.AppendUint16(nil, uint16(len(packet)))
+		if _, err := tunnel.Write(append(frame, packet...)); err != nil {
+			t.Fatal(err)
+		}
+
+		// the answers are framed with a timestamp and their size
+		tunnel.SetReadDeadline(time.Now().Add(5 * time.Second))
+		header := make([]byte, 6)
+		if _, err := io.ReadFull(tunnel, header); err != nil {
+			t.Fatalf("read answer header: %v", err)
+		}
+		if age := time.Now().UnixMilli()%(10*60*1000) - int64(binary.BigEndian.Uint32(header)); age < 0 || age > 1000 {
+			t.Errorf("answer timestamp %d ms old", age)
+		}
+		answer := make([]byte, binary.BigEndian.Uint16(header[4:]))
+		if _, err := io.ReadFull(tunnel, answer); err != nil || string(answer) != packet {
+			t.Errorf("answer of %d bytes %v, expected the %d sent", len(answer), err, len(packet))
+		}
+	}
+
+	// the end of the stream closes the local socket
+	tunnel.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dialer still running after the end of the stream")
+	}
+}
@@ -0,0 +1,331 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Load balancing strategies of a backend pool
+const (
+	RoundRobin       = "round_robin"
+	LeastConnections = "least_conn"
+	SourceHash       = "hash"
+)
+
+// the server appends the address of the original client to the target after this separator
+const sourceSeparator = "#"
+
+// comma separated targets are balanced with these settings
+var listPoolConfig = BackendPoolConfig{
+	Strategy:            RoundRobin,
+	HealthCheckInterval: 10 * time.Second,
+	MaxFails:            3,
+	EjectTime:           30 * time.Second,
+}
+
+// BackendPoolConfig describes a named pool of backends a mapping can forward to
+type BackendPoolConfig struct {
+	Name                string
+	Strategy            string
+	Targets             []string
+	HealthCheckInterval time.Duration // 0 disables active health checks
+	MaxFails            int           // consecutive dial failures before a backend is ejected
+	EjectTime           time.Duration
+	Dial                *DialOptions // egress of the connections to the backends
+}
+
+type backend struct {
+	addr         string
+	port         int
+	healthy      bool
+	fails        int
+	ejectedUntil time.Time
+	active       int32 // open connections
+}
+
+type backendPool struct {
+	config   BackendPoolConfig
+	mu       sync.Mutex
+	backends []*backend
+	next     uint32 // round robin counter
+}
+
+// BackendRegistry resolves the targets received from the server. A target is either a single
+// address (or port), the name of a configured pool or a comma separated list of addresses which
+// is handled as a round robin pool. A single address that is the only target of a configured
+// pool is handled by that pool, so that it gets the egress of the pool.
+type BackendRegistry struct {
+	ctx     context.Context
+	logger  *logrus.Logger
+	timeout time.Duration
+	dial    *DialOptions // options of the connections to single addresses
+	mu      sync.Mutex
+	pools   map[string]*backendPool
+	targets map[string]*backendPool // pools with a single target, by the address of the target
+}
+
+func NewBackendRegistry(ctx context.Context, pools []BackendPoolConfig, dial *DialOptions, timeout time.Duration, logger *logrus.Logger) (*BackendRegistry, error) {
+	registry := &BackendRegistry{
+		ctx:     ctx,
+		logger:  logger,
+		timeout: timeout,
+		dial:    dial,
+		pools:   make(map[string]*backendPool),
+		targets: make(map[string]*backendPool),
+	}
+
+	for _, poolConfig := range pools {
+		if _, ok := registry.pools[poolConfig.Name]; ok {
+			return nil, fmt.Errorf("duplicate backend pool name: %s", poolConfig.Name)
+		}
+
+		pool, err := registry.newPool(poolConfig)
+		if err != nil {
+			return nil, err
+		}
+		registry.pools[poolConfig.Name] = pool
+
+		if len(pool.backends) == 1 {
+			addr := pool.backends[0].addr
+			if other, ok := registry.targets[addr]; ok {
+				return nil, fmt.Errorf("backend pools %s and %s have the same single target %s", other.config.Name, poolConfig.Name, addr)
+			}
+			registry.targets[addr] = pool
+		}
+	}
+
+	return registry, nil
+}
+
+func (r *BackendRegistry) newPool(config BackendPoolConfig) (*backendPool, error) {
+	switch config.Strategy {
+	case RoundRobin, LeastConnections, SourceHash:
+	default:
+		return nil, fmt.Errorf("invalid strategy %q for backend pool %s", config.Strategy, config.Name)
+	}
+
+	if len(config.Targets) == 0 {
+		return nil, fmt.Errorf("backend pool %s has no targets", config.Name)
+	}
+
+	pool := &backendPool{config: config}
+	for _, target := range config.Targets {
+		port, addr, err := ResolveRemoteAddr(strings.TrimSpace(target))
+		if err != nil {
+			return nil, fmt.Errorf("backend pool %s: %v", config.Name, err)
+		}
+		pool.backends = append(pool.backends, &backend{addr: addr, port: port, healthy: true})
+	}
+
+	if config.HealthCheckInterval > 0 {
+		go r.healthCheck(pool)
+	}
+
+	return pool, nil
+}
+
+// lookup returns the pool for a target, or nil when the target is a single address
+func (r *BackendRegistry) lookup(target string) (*backendPool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if pool, ok := r.pools[target]; ok {
+		return pool, nil
+	}
+
+	if !strings.Contains(target, ",") {
+		if _, addr, err := ResolveRemoteAddr(target); err == nil {
+			return r.targets[addr], nil
+		}
+		return nil, nil
+	}
+
+	// comma separated targets get their own pool on first use
+	config := listPoolConfig
+	config.Name = target
+	config.Targets = strings.Split(target, ",")
+	config.Dial = r.dial
+
+	pool, err := r.newPool(config)
+	if err != nil {
+		return nil, err
+	}
+	r.pools[target] = pool
+
+	return pool, nil
+}
+
+// Resolve picks a backend for a target without tracking the connection, it is used for udp
+// where there is no dial to report on.
+func (r *BackendRegistry) Resolve(target string) (int, string, *DialOptions, error) {
+	target, source := splitSource(target)
+
+	pool, err := r.lookup(target)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	if pool == nil {
+		port, addr, err := ResolveRemoteAddr(target)
+		return port, addr, r.dial, err
+	}
+
+	b := pool.pick(source, nil)
+	return b.port, b.addr, pool.config.Dial, nil
+}
+
+// DialTCP dials a backend for the target. Failed dials are reported for passive ejection and the
+// next backend of the pool is tried. release must be called once the connection is closed.
+func (r *BackendRegistry) DialTCP(target string, dial func(addr string, opts *DialOptions) (*net.TCPConn, error)) (*net.TCPConn, int, func(), error) {
+	target, source := splitSource(target)
+
+	pool, err := r.lookup(target)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	if pool == nil {
+		port, addr, err := ResolveRemoteAddr(target)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		conn, err := dial(addr, r.dial)
+		return conn, port, func() {}, err
+	}
+
+	tried := make(map[*backend]bool)
+	for len(tried) < len(pool.backends) {
+		b := pool.pick(source, tried)
+		tried[b] = true
+
+		atomic.AddInt32(&b.active, 1)
+		conn, err := dial(b.addr, pool.config.Dial)
+		if err != nil {
+			atomic.AddInt32(&b.active, -1)
+			pool.reportFailure(b, r.logger)
+			r.logger.Warnf("backend %s of pool %s: %v", b.addr, pool.config.Name, err)
+			continue
+		}
+
+		pool.reportSuccess(b)
+		return conn, b.port, func() { atomic.AddInt32(&b.active, -1) }, nil
+	}
+
+	return nil, 0, nil, fmt.Errorf("no backend of pool %s is reachable", pool.config.Name)
+}
+
+// pick selects a backend among the healthy ones, all backends are candidates when none is healthy
+func (p *backendPool) pick(source string, exclude map[*backend]bool) *backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	candidates := make([]*backend, 0, len(p.backends))
+	for _, b := range p.backends {
+		if b.healthy && now.After(b.ejectedUntil) && !exclude[b] {
+			candidates = append(candidates, b)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, b := range p.backends {
+			if !exclude[b] {
+				candidates = append(candidates, b)
+			}
+		}
+	}
+
+	switch {
+	case p.config.Strategy == LeastConnections:
+		selected := candidates[0]
+		for _, b := range candidates[1:] {
+			if atomic.LoadInt32(&b.active) < atomic.LoadInt32(&selected.active) {
+				selected = b
+			}
+		}
+		return selected
+
+	case p.config.Strategy == SourceHash && source != "":
+		h := fnv.New32a()
+		h.Write([]byte(source))
+		return candidates[h.Sum32()%uint32(len(candidates))]
+
+	default: // round robin, also used for hash when the server does not forward the source
+		p.next++
+		return candidates[p.next%uint32(len(candidates))]
+	}
+}
+
+func (p *backendPool) reportFailure(b *backend, logger *logrus.Logger) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	b.fails++
+	if b.fails >= p.config.MaxFails {
+		b.fails = 0
+		b.ejectedUntil = time.Now().Add(p.config.EjectTime)
+		logger.Warnf("backend %s of pool %s ejected for %v", b.addr, p.config.Name, p.config.EjectTime)
+	}
+}
+
+func (p *backendPool) reportSuccess(b *backend) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	b.fails = 0
+}
+
+// healthCheck probes every backend of the pool with a tcp connect
+func (r *BackendRegistry) healthCheck(pool *backendPool) {
+	ticker := time.NewTicker(pool.config.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+
+		case <-ticker.C:
+			for _, b := range pool.backends {
+				conn, err := attemptTcpDialer(r.ctx, b.addr, r.timeout, 0, true, 0, 0, pool.config.Dial)
+				if err == nil {
+					conn.Close()
+				}
+
+				pool.mu.Lock()
+				healthy := err == nil
+				if healthy != b.healthy {
+					if healthy {
+						b.fails = 0
+						b.ejectedUntil = time.Time{}
+						r.logger.Infof("backend %s of pool %s is healthy again", b.addr, pool.config.Name)
+					} else {
+						r.logger.Warnf("backend %s of pool %s failed health check: %v", b.addr, pool.config.Name, err)
+					}
+				}
+				b.healthy = healthy
+				pool.mu.Unlock()
+			}
+		}
+	}
+}
+
+// splitSource separates the target from the client address forwarded by the server
+func splitSource(target string) (string, string) {
+	target, source, found := strings.Cut(target, sourceSeparator)
+	if !found {
+		return target, ""
+	}
+
+	// only the ip is relevant for hashing
+	if host, _, err := net.SplitHostPort(source); err == nil {
+		source = host
+	}
+	return target, source
+}
@@ -0,0 +1,241 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestRegistry(t *testing.T, pools []BackendPoolConfig, dial *DialOptions) (*BackendRegistry, error) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return NewBackendRegistry(ctx, pools, dial, time.Second, logger)
+}
+
+func TestBackendRegistrySingleTarget(t *testing.T) {
+	direct := &DialOptions{LocalAddr: "192.168.1.10"}
+	lan := &DialOptions{Interface: "eth0"}
+	local := &DialOptions{Mark: 200}
+	registry, err := newTestRegistry(t, []BackendPoolConfig{
+		{Name: "lan", Strategy: RoundRobin, Targets: []string{"10.0.0.5:443"}, Dial: lan},
+		{Name: "local", Strategy: RoundRobin, Targets: []string{"8080"}, Dial: local},
+		{Name: "web", Strategy: RoundRobin, Targets: []string{"10.0.0.1:443", "10.0.0.2:443"}, Dial: lan},
+	}, direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		target string
+		addr   string
+		dial   *DialOptions
+	}{
+		{"lan", "10.0.0.5:443", lan},
+		{"10.0.0.5:443", "10.0.0.5:443", lan},
+		{"10.0.0.5:443#203.0.113.7:5000", "10.0.0.5:443", lan},
+		{"8080", "127.0.0.1:8080", local},
+		{"127.0.0.1:8080", "127.0.0.1:8080", local},
+		{"10.0.0.6:443", "10.0.0.6:443", direct},
+		{"10.0.0.1:443", "10.0.0.1:443", direct}, // not the only target of its pool
+	} {
+		_, addr, dial, err := registry.Resolve(c.target)
+		if err != nil || addr != c.addr || dial != c.dial {
+			t.Errorf("%s: resolved to %s %+v %v, expected %s %+v", c.target, addr, dial, err, c.addr, c.dial)
+		}
+	}
+
+	_, err = newTestRegistry(t, []BackendPoolConfig{
+		{Name: "a", Strategy: RoundRobin, Targets: []string{"10.0.0.5:443"}, Dial: lan},
+		{Name: "b", Strategy: RoundRobin, Targets: []string{"10.0.0.5:443"}, Dial: local},
+	}, direct)
+	if err == nil {
+		t.Error("pools with the same single target accepted")
+	}
+}
+
+func testPool(strategy string, addrs ...string) *backendPool {
+	pool := &backendPool{config: BackendPoolConfig{Name: "test", Strategy: strategy, MaxFails: 2, EjectTime: time.Minute}}
+	for _, addr := range addrs {
+		pool.backends = append(pool.backends, &backend{addr: addr, healthy: true})
+	}
+	return pool
+}
+
+func TestBackendPoolPick(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		strategy string
+		prepare  func(backends []*backend)
+		source   string
+		expected []string
+	}{
+		{"round robin", RoundRobin, nil, "", []string{"b", "c", "a", "b"}},
+		{"unhealthy backend", RoundRobin, func(b []*backend) { b[1].healthy = false }, "", []string{"c", "a", "c"}},
+		{"ejected backend", RoundRobin, func(b []*backend) { b[2].ejectedUntil = time.Now().Add(time.Minute) }, "", []string{"b", "a", "b"}},
+		{"expired ejection", RoundRobin, func(b []*backend) { b[2].ejectedUntil = time.Now().Add(-time.Second) }, "", []string{"b", "c", "a"}},
+		{"all unhealthy", RoundRobin, func(b []*backend) {
+			for _, backend := range b {
+				backend.healthy = false
+			}
+		}, "", []string{"b", "c", "a"}},
+		{"least connections", LeastConnections, func(b []*backend) { b[0].active, b[1].active, b[2].active = 3, 1, 2 }, "", []string{"b", "b"}},
+		{"least connections tie", LeastConnections, func(b []*backend) { b[0].active, b[1].active, b[2].active = 2, 1, 1 }, "", []string{"b"}},
+		{"hash", SourceHash, nil, "203.0.113.7", []string{"c", "c", "c"}},
+		{"hash of another source", SourceHash, nil, "198.51.100.2", []string{"b", "b"}},
+		{"hash without source", SourceHash, nil, "", []string{"b", "c", "a"}},
+	} {
+		pool := testPool(c.strategy, "a", "b", "c")
+		if c.prepare != nil {
+			c.prepare(pool.backends)
+		}
+
+		for i, expected := range c.expected {
+			if b := pool.pick(c.source, nil); b.addr != expected {
+				t.Errorf("%s: pick %d returned %s, expected %s", c.name, i, b.addr, expected)
+			}
+		}
+	}
+
+	// the backends already tried are excluded, even when they are the only healthy ones
+	pool := testPool(RoundRobin, "a", "b")
+	pool.backends[1].healthy = false
+	if b := pool.pick("", map[*backend]bool{pool.backends[0]: true}); b.addr != "b" {
+		t.Errorf("pick returned %s after a, expected b", b.addr)
+	}
+}
+
+func TestBackendRegistryDialTCP(t *testing.T) {
+	lan := &DialOptions{Interface: "eth0"}
+	registry, err := newTestRegistry(t, []BackendPoolConfig{
+		{Name: "web", Strategy: RoundRobin, Targets: []string{"10.0.0.1:80", "10.0.0.2:80"}, MaxFails: 2, EjectTime: time.Minute, Dial: lan},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first backend refuses the connections
+	var dials []string
+	dial := func(addr string, opts *DialOptions) (*net.TCPConn, error) {
+		dials = append(dials, addr)
+		if opts != lan {
+			t.Errorf("dial of %s without the egress of the pool", addr)
+		}
+		if addr == "10.0.0.1:80" {
+			return nil, errors.New("connection refused")
+		}
+		return nil, nil
+	}
+
+	for i := 0; i < 4; i++ {
+		_, port, release, err := registry.DialTCP("web", dial)
+		if err != nil || port != 80 {
+			t.Fatalf("dial %d returned port %d %v", i, port, err)
+		}
+		release()
+	}
+
+	// the first backend is ejected after two failures, the last dial goes straight to the second
+	expected := []string{"10.0.0.2:80", "10.0.0.1:80", "10.0.0.2:80", "10.0.0.1:80", "10.0.0.2:80", "10.0.0.2:80"}
+	if len(dials) != len(expected) {
+		t.Fatalf("dialed %v, expected %v", dials, expected)
+	}
+	for i := range expected {
+		if dials[i] != expected[i] {
+			t.Fatalf("dialed %v, expected %v", dials, expected)
+		}
+	}
+
+	pool, _ := registry.lookup("web")
+	for _, b := range pool.backends {
+		if active := atomic.LoadInt32(&b.active); active != 0 {
+			t.Errorf("backend %s has %d active connections after the release", b.addr, active)
+		}
+	}
+
+	_, _, _, err = registry.DialTCP("web", func(string, *DialOptions) (*net.TCPConn, error) {
+		return nil, errors.New("connection refused")
+	})
+	if err == nil {
+		t.Error("dial succeeded with no reachable backend")
+	}
+}
+
+func TestBackendHealthCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// a port nothing listens on
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := closed.Addr().String()
+	closed.Close()
+
+	registry, err := newTestRegistry(t, []BackendPoolConfig{
+		{Name: "web", Strategy: RoundRobin, Targets: []string{listener.Addr().String(), down}, HealthCheckInterval: 10 * time.Millisecond, MaxFails: 1, EjectTime: time.Minute},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, _ := registry.lookup("web")
+	pool.backends[0].ejectedUntil = time.Now().Add(time.Minute)
+
+	healthy := func() (bool, bool) {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		return pool.backends[0].healthy && pool.backends[0].ejectedUntil.IsZero(), pool.backends[1].healthy
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if up, downHealthy := healthy(); !downHealthy {
+			// the passing check lifts the ejection of a backend that was unhealthy
+			pool.mu.Lock()
+			pool.backends[0].healthy = false
+			pool.mu.Unlock()
+			for ; time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				if up, _ = healthy(); up {
+					return
+				}
+			}
+			t.Fatal("ejection of the reachable backend not lifted by the health check")
+		}
+	}
+	t.Fatal("unreachable backend not marked unhealthy by the health check")
+}
+
+func TestSplitSource(t *testing.T) {
+	for _, c := range []struct {
+		target   string
+		expected string
+		source   string
+	}{
+		{"web", "web", ""},
+		{"10.0.0.1:80#203.0.113.7:5000", "10.0.0.1:80", "203.0.113.7"},
+		{"web#[2001:db8::1]:5000", "web", "2001:db8::1"},
+		{"web#203.0.113.7", "web", "203.0.113.7"},
+	} {
+		if target, source := splitSource(c.target); target != c.expected || source != c.source {
+			t.Errorf("%s: split into %q %q, expected %q %q", c.target, target, source, c.expected, c.source)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/musix/backhaul/internal/config"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+)
+
+// number of failed control channel attempts before switching to the next remote
+const remoteFailoverThreshold = 2
+
+// RemoteEndpoint is a tunnel server the client can connect to, lower priority is preferred
+type RemoteEndpoint struct {
+	Addr     string
+	Priority int
+}
+
+type remoteState struct {
+	endpoint    RemoteEndpoint
+	failures    int
+	lastFailure time.Time
+	lastSuccess time.Time
+}
+
+// RemoteSelector keeps track of the health of every remote and selects the one
+// the control channel and the pool should use
+type RemoteSelector struct {
+	mu               sync.Mutex
+	remotes          []*remoteState
+	current          int
+	failbackInterval time.Duration
+	logger           *logrus.Logger
+}
+
+func NewRemoteSelector(endpoints []RemoteEndpoint, failbackInterval time.Duration, logger *logrus.Logger) *RemoteSelector {
+	sorted := make([]RemoteEndpoint, len(endpoints))
+	copy(sorted, endpoints)
+
+	// stable sort keeps the config order for remotes with the same priority
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+
+	remotes := make([]*remoteState, 0, len(sorted))
+	for _, endpoint := range sorted {
+		remotes = append(remotes, &remoteState{endpoint: endpoint})
+	}
+
+	return &RemoteSelector{
+		remotes:          remotes,
+		current:          0,
+		failbackInterval: failbackInterval,
+		logger:           logger,
+	}
+}
+
+// Current returns the address of the selected remote
+func (r *RemoteSelector) Current() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.remotes[r.current].endpoint.Addr
+}
+
+// ReportSuccess resets the failure counter of the remote once a control channel is established
+func (r *RemoteSelector) ReportSuccess(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, remote := range r.remotes {
+		if remote.endpoint.Addr == addr {
+			remote.failures = 0
+			remote.lastSuccess = time.Now()
+		}
+	}
+}
+
+// ReportFailure records a failed attempt and moves to the next remote (in priority order)
+// once the current one reached the failover threshold
+func (r *RemoteSelector) ReportFailure(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	remote := r.remotes[r.current]
+	if remote.endpoint.Addr != addr {
+		// stale report, we already switched away from this remote
+		return
+	}
+
+	remote.failures++
+	remote.lastFailure = time.Now()
+
+	if len(r.remotes) < 2 || remote.failures < remoteFailoverThreshold {
+		return
+	}
+
+	remote.failures = 0
+	r.current = (r.current + 1) % len(r.remotes)
+	r.logger.Warnf("remote %s is unreachable, failing over to %s", addr, r.remotes[r.current].endpoint.Addr)
+}
+
+// Failback periodically probes the remotes preferred over the current one and switches back to
+// the first healthy one, restart is called so the control channel and the pool reconnect.
+func (r *RemoteSelector) Failback(ctx context.Context, probe func(ctx context.Context, addr string) error, restart func()) {
+	if len(r.remotes) < 2 || r.failbackInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(r.failbackInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			r.mu.Lock()
+			current := r.current
+			preferred := make([]RemoteEndpoint, 0, current)
+			for i := 0; i < current; i++ {
+				preferred = append(preferred, r.remotes[i].endpoint)
+			}
+			r.mu.Unlock()
+
+			for i, endpoint := range preferred {
+				if err := probe(ctx, endpoint.Addr); err != nil {
+					r.logger.Debugf("failback probe to %s failed: %v", endpoint.Addr, err)
+					continue
+				}
+
+				r.mu.Lock()
+				if r.current != current {
+					// the selection changed while probing, try again on the next tick
+					r.mu.Unlock()
+					break
+				}
+				r.current = i
+				r.remotes[i].failures = 0
+				r.mu.Unlock()
+
+				r.logger.Infof("preferred remote %s is reachable again, failing back", endpoint.Addr)
+				go restart()
+				return
+			}
+		}
+	}
+}
+
+// TcpProbe checks that a remote accepts tcp connections
+func TcpProbe(timeout time.Duration, opts *DialOptions) func(ctx context.Context, addr string) error {
+	return func(ctx context.Context, addr string) error {
+		conn, err := attemptTcpDialer(ctx, addr, timeout, 0, true, 0, 0, opts)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// HandshakeProbe checks that a remote completes the handshake of a transport without starting a client,
+// so that a transport whose handshake is blocked is not mistaken for a reachable one. The TLS transports
+// complete the TLS handshake with the options of the client, and the websocket transports send their
+// upgrade request, without the token so that no tunnel is opened: the server must answer it with 401
+// Unauthorized. The token exchange of the other transports would open a control channel, their probe ends
+// after the TLS handshake, or the tcp connection when they do not use TLS. tlsOpts is nil for the
+// transports without TLS, and edgeIP is dialed instead of the remote by the http based transports.
+func HandshakeProbe(mode config.TransportType, timeout time.Duration, opts *DialOptions, tlsOpts *TLSOptions, edgeIP string) func(ctx context.Context, addr string) error {
+	if mode == config.QUIC {
+		return QuicProbe(timeout, opts)
+	}
+
+	return func(ctx context.Context, addr string) error {
+		dialAddr := addr
+		switch mode {
+		case config.WS, config.WSS, config.WSMUX, config.WSSMUX, config.H2, config.H2C, config.GRPC, config.SPLITHTTP, config.SPLITHTTPS:
+			if edgeIP != "" {
+				if _, port, err := net.SplitHostPort(addr); err == nil {
+					dialAddr = net.JoinHostPort(edgeIP, port)
+				}
+			}
+		}
+
+		tcpConn, err := attemptTcpDialer(ctx, dialAddr, timeout, 0, true, 0, 0, opts)
+		if err != nil {
+			return err
+		}
+		defer tcpConn.Close()
+
+		var conn net.Conn = tcpConn
+		if tlsOpts != nil {
+			tlsConfig := tlsOpts.Config(addr)
+			if mode == config.H2 || mode == config.GRPC {
+				tlsConfig.NextProtos = []string{http2.NextProtoTLS}
+			}
+
+			tlsConn := tls.Client(tcpConn, tlsConfig)
+			handshakeCtx, cancel := context.WithTimeout(ctx, timeout)
+			err := tlsConn.HandshakeContext(handshakeCtx)
+			cancel()
+			if err != nil {
+				return fmt.Errorf("tls handshake with %s failed: %w", addr, err)
+			}
+			conn = tlsConn
+		}
+
+		if mode == config.WS || mode == config.WSS || mode == config.WSMUX || mode == config.WSSMUX {
+			return websocketProbe(conn, addr, timeout)
+		}
+		return nil
+	}
+}
+
+// websocketProbe sends a websocket upgrade request without credentials and expects the 401 of the server
+func websocketProbe(conn net.Conn, addr string, timeout time.Duration) error {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/channel", addr), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+	req.Header.Set("User-Agent", randomUserAgent())
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := req.Write(conn); err != nil {
+		return fmt.Errorf("failed to send the upgrade request to %s: %w", addr, err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return fmt.Errorf("no answer to the upgrade request from %s: %w", addr, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("unexpected answer to the upgrade request from %s: %s", addr, resp.Status)
+	}
+	return nil
+}
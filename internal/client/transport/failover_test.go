@@ -0,0 +1,191 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/musix/backhaul/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+// resetListener accepts tcp connections and closes them at once, like a network blocking a handshake
+func resetListener(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestHandshakeProbe(t *testing.T) {
+	// the websocket servers refuse the upgrade requests without the token
+	unauthorized := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+	wsServer := httptest.NewServer(unauthorized)
+	defer wsServer.Close()
+	wssServer := httptest.NewTLSServer(unauthorized)
+	defer wssServer.Close()
+
+	// a web server that is not a tunnel server
+	otherServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer otherServer.Close()
+
+	blocked := resetListener(t)
+	insecure := &TLSOptions{Insecure: true}
+	pinned := &TLSOptions{Pins: [][]byte{SPKIPin(wssServer.Certificate())}}
+	wrongPin := &TLSOptions{Pins: [][]byte{make([]byte, 32)}}
+
+	for _, c := range []struct {
+		name      string
+		mode      config.TransportType
+		tlsOpts   *TLSOptions
+		addr      string
+		reachable bool
+	}{
+		{"ws", config.WS, nil, wsServer.Listener.Addr().String(), true},
+		{"wsmux", config.WSMUX, nil, wsServer.Listener.Addr().String(), true},
+		{"ws blocked", config.WS, nil, blocked, false},
+		{"ws not a tunnel server", config.WS, nil, otherServer.Listener.Addr().String(), false},
+		{"wss", config.WSS, insecure, wssServer.Listener.Addr().String(), true},
+		{"wss pinned", config.WSSMUX, pinned, wssServer.Listener.Addr().String(), true},
+		{"wss wrong pin", config.WSS, wrongPin, wssServer.Listener.Addr().String(), false},
+		{"wss blocked", config.WSS, insecure, blocked, false},
+		{"tcptls", config.TCPTLS, insecure, wssServer.Listener.Addr().String(), true},
+		{"tcptls blocked", config.TCPTLS, insecure, blocked, false},
+		{"h2 blocked", config.H2, insecure, blocked, false},
+		{"tcp", config.TCP, nil, blocked, true}, // only the tcp connect is probed
+	} {
+		err := HandshakeProbe(c.mode, time.Second, nil, c.tlsOpts, "")(context.Background(), c.addr)
+		if (err == nil) != c.reachable {
+			t.Errorf("%s: probe returned %v, expected reachable %v", c.name, err, c.reachable)
+		}
+	}
+}
+
+func TestHandshakeProbeEdgeIP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the request is for the remote, sent to the edge
+		if host, _, _ := net.SplitHostPort(r.Host); host != "tunnel.example.com" {
+			http.Error(w, "unknown host", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	probe := HandshakeProbe(config.WS, time.Second, nil, nil, "127.0.0.1")
+	if err := probe(context.Background(), net.JoinHostPort("tunnel.example.com", port)); err != nil {
+		t.Errorf("probe through the edge ip: %v", err)
+	}
+}
+
+func newTestSelector(failbackInterval time.Duration, endpoints ...RemoteEndpoint) *RemoteSelector {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return NewRemoteSelector(endpoints, failbackInterval, logger)
+}
+
+func TestRemoteSelectorFailover(t *testing.T) {
+	endpoints := []RemoteEndpoint{{"backup:3080", 2}, {"primary:3080", 1}, {"second:3080", 2}}
+
+	for _, c := range []struct {
+		name      string
+		endpoints []RemoteEndpoint
+		reports   []string // failures, or successes prefixed with +
+		expected  string
+	}{
+		{"priority order", endpoints, nil, "primary:3080"},
+		{"below the threshold", endpoints, []string{"primary:3080"}, "primary:3080"},
+		{"threshold", endpoints, []string{"primary:3080", "primary:3080"}, "backup:3080"},
+		{"success resets the failures", endpoints, []string{"primary:3080", "+primary:3080", "primary:3080"}, "primary:3080"},
+		{"stale report", endpoints, []string{"primary:3080", "primary:3080", "primary:3080", "primary:3080"}, "backup:3080"},
+		{"next of the same priority", endpoints, []string{"primary:3080", "primary:3080", "backup:3080", "backup:3080"}, "second:3080"},
+		{"wraps around", endpoints, []string{"primary:3080", "primary:3080", "backup:3080", "backup:3080", "second:3080", "second:3080"}, "primary:3080"},
+		{"single remote", []RemoteEndpoint{{"primary:3080", 0}}, []string{"primary:3080", "primary:3080", "primary:3080"}, "primary:3080"},
+	} {
+		r := newTestSelector(0, c.endpoints...)
+		for _, addr := range c.reports {
+			if success, ok := strings.CutPrefix(addr, "+"); ok {
+				r.ReportSuccess(success)
+			} else {
+				r.ReportFailure(addr)
+			}
+		}
+
+		if current := r.Current(); current != c.expected {
+			t.Errorf("%s: current remote %s, expected %s", c.name, current, c.expected)
+		}
+	}
+}
+
+func TestRemoteSelectorFailback(t *testing.T) {
+	r := newTestSelector(10*time.Millisecond, RemoteEndpoint{"primary:3080", 1}, RemoteEndpoint{"second:3080", 2}, RemoteEndpoint{"backup:3080", 3})
+	for _, addr := range []string{"primary:3080", "primary:3080", "second:3080", "second:3080"} {
+		r.ReportFailure(addr)
+	}
+	if current := r.Current(); current != "backup:3080" {
+		t.Fatalf("current remote %s, expected backup:3080", current)
+	}
+
+	// the primary stays down, the second remote is reachable again
+	var mu sync.Mutex
+	probed := make(map[string]int)
+	probe := func(ctx context.Context, addr string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		probed[addr]++
+		if addr == "second:3080" && probed[addr] > 1 {
+			return nil
+		}
+		return errors.New("unreachable")
+	}
+	restarted := make(chan struct{}, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r.Failback(ctx, probe, func() { restarted <- struct{}{} })
+
+	select {
+	case <-restarted:
+	case <-ctx.Done():
+		t.Fatal("failback did not restart the tunnel")
+	}
+	if current := r.Current(); current != "second:3080" {
+		t.Errorf("failed back to %s, expected second:3080", current)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if probed["backup:3080"] != 0 {
+		t.Error("current remote probed for a failback")
+	}
+
+	// the failback stops once the preferred remote is selected
+	first := newTestSelector(10*time.Millisecond, RemoteEndpoint{"primary:3080", 1}, RemoteEndpoint{"backup:3080", 2})
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	first.Failback(ctx, func(context.Context, string) error {
+		t.Error("preferred remote probed while selected")
+		return nil
+	}, func() {})
+}
@@ -0,0 +1,478 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/musix/backhaul/internal/config"
+	"github.com/musix/backhaul/internal/utils"
+	"github.com/musix/backhaul/internal/web"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+type GrpcTransport struct {
+	config          *GrpcConfig
+	parentctx       context.Context
+	ctx             context.Context
+	cancel          context.CancelFunc
+	logger          *logrus.Logger
+	controlChannel  *utils.GrpcConn
+	grpcConn        *grpc.ClientConn // carries the control channel and the tunnel streams
+	restartMutex    sync.Mutex
+	usageMonitor    *web.Usage
+	poolConnections int32
+	loadConnections int32
+	controlFlow     chan struct{}
+}
+type GrpcConfig struct {
+	RemoteAddr      string
+	Token           string
+	SnifferLog      string
+	TunnelStatus    web.TunnelStatus
+	Nodelay         bool
+	Sniffer         bool
+	KeepAlive       time.Duration
+	HalfCloseLinger time.Duration
+	RetryInterval   time.Duration
+	DialTimeOut     time.Duration
+	ConnPoolSize    int
+	WebPort         int
+	Mode            config.TransportType
+	AggressivePool  bool
+	Remotes         *RemoteSelector
+	Backends        *BackendRegistry
+	Dial            *DialOptions // egress of the tunnel connections
+	EdgeIP          string
+	ServiceName     string      // gRPC service the streams are opened on
+	TLS             *TLSOptions // use gRPC over TLS, nil for plaintext
+}
+
+func NewGrpcClient(parentCtx context.Context, config *GrpcConfig, logger *logrus.Logger) *GrpcTransport {
+	// Create a derived context from the parent context
+	ctx, cancel := context.WithCancel(parentCtx)
+
+	// Initialize the GrpcTransport struct
+	client := &GrpcTransport{
+		config:          config,
+		parentctx:       parentCtx,
+		ctx:             ctx,
+		cancel:          cancel,
+		logger:          logger,
+		controlChannel:  nil, // will be set when a control connection is established
+		usageMonitor:    web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
+		poolConnections: 0,
+		loadConnections: 0,
+		controlFlow:     make(chan struct{}, 100),
+	}
+
+	return client
+}
+
+func (c *GrpcTransport) Start() {
+	// for  webui
+	if c.config.WebPort > 0 {
+		go c.usageMonitor.Monitor()
+	}
+
+	c.config.TunnelStatus.Set(fmt.Sprintf("Disconnected (%s)", c.config.Mode))
+
+	go c.channelDialer()
+	go c.config.Remotes.Failback(c.ctx, HandshakeProbe(c.config.Mode, c.config.DialTimeOut, c.config.Dial, c.config.TLS, c.config.EdgeIP), c.Restart)
+
+}
+func (c *GrpcTransport) Restart() {
+	if !c.restartMutex.TryLock() {
+		c.logger.Warn("client is already restarting")
+		return
+	}
+	defer c.restartMutex.Unlock()
+
+	c.logger.Info("restarting client...")
+
+	// for removing timeout logs
+	level := c.logger.Level
+	c.logger.SetLevel(logrus.FatalLevel)
+
+	if c.cancel != nil {
+		c.cancel()
+	}
+
+	// close control channel connection
+	if c.controlChannel != nil {
+		c.controlChannel.Close()
+	}
+
+	time.Sleep(2 * time.Second)
+
+	// the streams are gone with the context, drop the grpc connection as well
+	if c.grpcConn != nil {
+		c.grpcConn.Close()
+	}
+
+	ctx, cancel := context.WithCancel(c.parentctx)
+	c.ctx = ctx
+	c.cancel = cancel
+
+	// Re-initialize variables
+	c.controlChannel = nil
+	c.grpcConn = nil
+	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger)
+	c.config.TunnelStatus.Set("")
+	c.poolConnections = 0
+	c.loadConnections = 0
+	c.controlFlow = make(chan struct{}, 100)
+
+	// set the log level again
+	c.logger.SetLevel(level)
+
+	go c.Start()
+}
+
+func (c *GrpcTransport) channelDialer() {
+	c.logger.Info("attempting to establish a new grpc control channel connection")
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		default:
+			// pick the remote selected by the failover logic
+			c.config.RemoteAddr = c.config.Remotes.Current()
+			if c.grpcConn != nil {
+				c.grpcConn.Close()
+			}
+			grpcConn, err := c.newGrpcConn(c.config.RemoteAddr)
+			if err != nil {
+				c.logger.Errorf("control channel dialer: %v", err)
+				time.Sleep(c.config.RetryInterval)
+				continue
+			}
+			c.grpcConn = grpcConn
+
+			tunnelConn, err := c.openStream("Channel")
+			if err != nil {
+				c.logger.Errorf("control channel dialer: %v", err)
+				c.config.Remotes.ReportFailure(c.config.RemoteAddr)
+				time.Sleep(c.config.RetryInterval)
+				continue
+			}
+			c.controlChannel = tunnelConn
+			c.config.Remotes.ReportSuccess(c.config.RemoteAddr)
+			c.logger.Info("control channel established successfully")
+
+			c.config.TunnelStatus.Set(fmt.Sprintf("Connected (%s)", c.config.Mode))
+
+			go c.poolMaintainer()
+			go c.channelHandler()
+
+			return
+		}
+	}
+}
+
+func (c *GrpcTransport) poolMaintainer() {
+	for i := 0; i < c.config.ConnPoolSize; i++ { //initial pool filling
+		go c.tunnelDialer()
+	}
+
+	// factors
+	a := 4
+	b := 5
+	x := 3
+	y := 4.0
+
+	if c.config.AggressivePool {
+		c.logger.Info("aggressive pool management enabled")
+		a = 1
+		b = 2
+		x = 0
+		y = 0.75
+	}
+
+	tickerPool := time.NewTicker(time.Second * 1)
+	defer tickerPool.Stop()
+
+	tickerLoad := time.NewTicker(time.Second * 10)
+	defer tickerLoad.Stop()
+
+	newPoolSize := c.config.ConnPoolSize // intial value
+	var poolConnectionsSum int32 = 0
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+
+		case <-tickerPool.C:
+			// Accumulate pool connections over time (every second)
+			atomic.AddInt32(&poolConnectionsSum, atomic.LoadInt32(&c.poolConnections))
+
+		case <-tickerLoad.C:
+			// Calculate the loadConnections over the last 10 seconds
+			loadConnections := (int(atomic.LoadInt32(&c.loadConnections)) + 9) / 10 // +9 for ceil-like logic
+			atomic.StoreInt32(&c.loadConnections, 0)                                // Reset
+
+			// Calculate the average pool connections over the last 10 seconds
+			poolConnectionsAvg := (int(atomic.LoadInt32(&poolConnectionsSum)) + 9) / 10 // +9 for ceil-like logic
+			atomic.StoreInt32(&poolConnectionsSum, 0)                                   // Reset
+
+			// Dynamically adjust the pool size based on current connections
+			if (loadConnections + a) > poolConnectionsAvg*b {
+				c.logger.Debugf("increasing pool size: %d -> %d, avg pool conn: %d, avg load conn: %d", newPoolSize, newPoolSize+1, poolConnectionsAvg, loadConnections)
+				newPoolSize++
+
+				// Add a new connection to the pool
+				go c.tunnelDialer()
+			} else if float64(loadConnections+x) < float64(poolConnectionsAvg)*y && newPoolSize > c.config.ConnPoolSize {
+				c.logger.Debugf("decreasing pool size: %d -> %d, avg pool conn: %d, avg load conn: %d", newPoolSize, newPoolSize-1, poolConnectionsAvg, loadConnections)
+				newPoolSize--
+
+				// send a signal to controlFlow
+				c.controlFlow <- struct{}{}
+			}
+		}
+	}
+
+}
+
+func (c *GrpcTransport) channelHandler() {
+	msgChan := make(chan byte, 1000)
+
+	// Goroutine to handle the blocking ReceiveBinaryString
+	go func() {
+		for {
+			select {
+			case <-c.ctx.Done():
+				return
+
+			default:
+				msg, err := utils.ReceiveBinaryByte(c.controlChannel)
+				if err != nil {
+					if c.cancel != nil {
+						c.logger.Error("failed to read from channel connection. ", err)
+						go c.Restart()
+					}
+					return
+				}
+
+				msgChan <- msg
+			}
+		}
+	}()
+
+	// Main loop to listen for context cancellation or received messages
+	for {
+		select {
+		case <-c.ctx.Done():
+			_ = utils.SendBinaryByte(c.controlChannel, utils.SG_Closed)
+			return
+
+		case msg := <-msgChan:
+			switch msg {
+			case utils.SG_Chan:
+				atomic.AddInt32(&c.loadConnections, 1)
+				select {
+				case <-c.controlFlow: // Do nothing
+
+				default:
+					c.logger.Debug("channel signal received, initiating tunnel dialer")
+					go c.tunnelDialer()
+				}
+
+			case utils.SG_HB:
+				c.logger.Debug("heartbeat signal received successfully")
+				// send heartbeat back
+				err := utils.SendBinaryByte(c.controlChannel, utils.SG_HB)
+				if err != nil {
+					c.logger.Errorf("failed to send heartbeat: %v", msg)
+					go c.Restart()
+					return
+				}
+				c.logger.Trace("heartbeat signal sent successfully")
+
+			case utils.SG_Closed:
+				c.logger.Warn("control channel has been closed by the server")
+				go c.Restart()
+				return
+
+			default:
+				c.logger.Errorf("unexpected response from channel: %v", msg)
+				go c.Restart()
+				return
+			}
+		}
+	}
+}
+
+func (c *GrpcTransport) tunnelDialer() {
+	c.logger.Debugf("initiating new grpc tunnel stream to address %s", c.config.RemoteAddr)
+
+	// Open a new stream to the tunnel server
+	tunnelConn, err := c.openStream("Tunnel")
+	if err != nil {
+		c.logger.Errorf("tunnel server dialer: %v", err)
+
+		return
+	}
+
+	// Increment active connections counter
+	atomic.AddInt32(&c.poolConnections, 1)
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			tunnelConn.Close()
+			return
+		default:
+			signal, err := utils.ReceiveBinaryByte(tunnelConn)
+			if err != nil {
+				c.logger.Debugf("unable to get port from grpc stream %s: %v", tunnelConn.RemoteAddr().String(), err)
+				tunnelConn.Close()
+
+				// Decrement active connections on failure
+				atomic.AddInt32(&c.poolConnections, -1)
+
+				return
+			}
+
+			if signal == utils.SG_Ping {
+				c.logger.Trace("ping received from the server")
+				continue
+			}
+
+			// Decrement active connections
+			atomic.AddInt32(&c.poolConnections, -1)
+
+			if signal != utils.SG_TCP {
+				c.logger.Error("undefined transport. close the connection.")
+				tunnelConn.Close()
+				return
+			}
+
+			remoteAddr, err := utils.ReceiveBinaryString(tunnelConn)
+			if err != nil {
+				c.logger.Debugf("unable to get port from grpc stream %s: %v", tunnelConn.RemoteAddr().String(), err)
+				tunnelConn.Close()
+				return
+			}
+
+			c.localDialer(tunnelConn, remoteAddr)
+			return
+		}
+	}
+}
+
+func (c *GrpcTransport) localDialer(tunnelConn *utils.GrpcConn, remoteAddr string) {
+	localConn, port, release, err := c.config.Backends.DialTCP(remoteAddr, func(addr string, opts *DialOptions) (*net.TCPConn, error) {
+		return TcpDialer(c.ctx, addr, c.config.DialTimeOut, c.config.KeepAlive, true, 1, 32*1024, 32*1024, opts)
+	})
+	if err != nil {
+		c.logger.Errorf("local dialer: %v", err)
+		tunnelConn.Close()
+		return
+	}
+	defer release()
+	c.logger.Debugf("connected to local address %s successfully", remoteAddr)
+
+	utils.TCPConnectionHandler(tunnelConn, localConn, c.logger, c.usageMonitor, int(port), c.config.Sniffer, c.config.HalfCloseLinger)
+}
+
+// newGrpcConn returns the grpc client of a remote, every stream shares its connection
+func (c *GrpcTransport) newGrpcConn(addr string) (*grpc.ClientConn, error) {
+	// Handle edgeIP assignment, the remote address of the target is still used as the authority
+	dialAddr := addr
+	if c.config.EdgeIP != "" {
+		if _, port, err := net.SplitHostPort(addr); err == nil {
+			dialAddr = net.JoinHostPort(c.config.EdgeIP, port)
+		}
+	}
+
+	creds := insecure.NewCredentials()
+	if c.config.TLS != nil {
+		creds = credentials.NewTLS(c.config.TLS.Config(addr))
+	}
+
+	return grpc.NewClient("passthrough:///"+addr,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithUserAgent(randomUserAgent()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(utils.GrpcCodec{})),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			// Based on calculations 1MB of buffer on 80ms RTT will have about 100Mbit Bandwidth per connection,
+			// all the streams share this connection
+			return TcpDialer(ctx, dialAddr, c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, 3, 1024*1024, 1024*1024, c.config.Dial)
+		}),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                c.config.KeepAlive, // send grpc pings on idle connections
+			Timeout:             15 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	)
+}
+
+// openStream opens a bidirectional stream on the given method of the tunnel service
+func (c *GrpcTransport) openStream(method string) (*utils.GrpcConn, error) {
+	ctx, cancel := context.WithCancel(c.ctx)
+
+	// Setup metadata with authorization and a random x-user-id
+	ctx = metadata.AppendToOutgoingContext(ctx,
+		"authorization", fmt.Sprintf("Bearer %v", c.config.Token),
+		"x-user-id", strconv.Itoa(int(rand.Int31())),
+	)
+
+	desc := &grpc.StreamDesc{StreamName: method, ServerStreams: true, ClientStreams: true}
+	stream, err := c.grpcConn.NewStream(ctx, desc, fmt.Sprintf("/%s/%s", c.config.ServiceName, method))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// the server answers with the headers once it accepted the stream
+	timer := time.AfterFunc(c.config.DialTimeOut, cancel)
+	md, err := stream.Header()
+	if err == nil && md == nil {
+		// the stream was refused without headers, the status is returned by the next receive
+		var msg []byte
+		if err = stream.RecvMsg(&msg); err == nil || err == io.EOF {
+			err = fmt.Errorf("stream closed by the server")
+		}
+	}
+	if !timer.Stop() && err == nil {
+		err = fmt.Errorf("timeout while waiting for the stream to be accepted")
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// keep the addresses of the connection the stream is opened on
+	var localAddr, remoteAddr net.Addr = &net.TCPAddr{}, &net.TCPAddr{}
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		if p.Addr != nil {
+			remoteAddr = p.Addr
+		}
+		if p.LocalAddr != nil {
+			localAddr = p.LocalAddr
+		}
+	}
+
+	closeStream := func() {
+		stream.CloseSend()
+		cancel()
+	}
+
+	return utils.NewGrpcConn(stream, closeStream, localAddr, remoteAddr), nil
+}
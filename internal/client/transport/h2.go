@@ -0,0 +1,509 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/musix/backhaul/internal/config"
+	"github.com/musix/backhaul/internal/utils"
+	"github.com/musix/backhaul/internal/web"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+)
+
+// h2DrainTimeout is how long a closed stream waits for the server to end it
+const h2DrainTimeout = 10 * time.Second
+
+type H2Transport struct {
+	config          *H2Config
+	parentctx       context.Context
+	ctx             context.Context
+	cancel          context.CancelFunc
+	logger          *logrus.Logger
+	controlChannel  *utils.H2Conn
+	h2Transport     *http2.Transport // carries the control channel and the tunnel streams
+	restartMutex    sync.Mutex
+	usageMonitor    *web.Usage
+	poolConnections int32
+	loadConnections int32
+	controlFlow     chan struct{}
+}
+type H2Config struct {
+	RemoteAddr      string
+	Token           string
+	SnifferLog      string
+	TunnelStatus    web.TunnelStatus
+	Nodelay         bool
+	Sniffer         bool
+	KeepAlive       time.Duration
+	HalfCloseLinger time.Duration
+	RetryInterval   time.Duration
+	DialTimeOut     time.Duration
+	ConnPoolSize    int
+	WebPort         int
+	Mode            config.TransportType // h2 or h2c
+	AggressivePool  bool
+	Remotes         *RemoteSelector
+	Backends        *BackendRegistry
+	Dial            *DialOptions // egress of the tunnel connections
+	TLS             *TLSOptions  // verification of the server certificate in the tls modes
+	EdgeIP          string
+}
+
+func NewH2Client(parentCtx context.Context, config *H2Config, logger *logrus.Logger) *H2Transport {
+	// Create a derived context from the parent context
+	ctx, cancel := context.WithCancel(parentCtx)
+
+	// Initialize the H2Transport struct
+	client := &H2Transport{
+		config:          config,
+		parentctx:       parentCtx,
+		ctx:             ctx,
+		cancel:          cancel,
+		logger:          logger,
+		controlChannel:  nil, // will be set when a control connection is established
+		usageMonitor:    web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
+		poolConnections: 0,
+		loadConnections: 0,
+		controlFlow:     make(chan struct{}, 100),
+	}
+
+	return client
+}
+
+func (c *H2Transport) Start() {
+	// for  webui
+	if c.config.WebPort > 0 {
+		go c.usageMonitor.Monitor()
+	}
+
+	c.config.TunnelStatus.Set(fmt.Sprintf("Disconnected (%s)", c.config.Mode))
+
+	go c.channelDialer()
+	go c.config.Remotes.Failback(c.ctx, HandshakeProbe(c.config.Mode, c.config.DialTimeOut, c.config.Dial, c.config.TLS, c.config.EdgeIP), c.Restart)
+
+}
+func (c *H2Transport) Restart() {
+	if !c.restartMutex.TryLock() {
+		c.logger.Warn("client is already restarting")
+		return
+	}
+	defer c.restartMutex.Unlock()
+
+	c.logger.Info("restarting client...")
+
+	// for removing timeout logs
+	level := c.logger.Level
+	c.logger.SetLevel(logrus.FatalLevel)
+
+	if c.cancel != nil {
+		c.cancel()
+	}
+
+	// close control channel connection
+	if c.controlChannel != nil {
+		c.controlChannel.Close()
+	}
+
+	time.Sleep(2 * time.Second)
+
+	// the streams are gone with the context, drop the http/2 connection as well
+	if c.h2Transport != nil {
+		c.h2Transport.CloseIdleConnections()
+	}
+
+	ctx, cancel := context.WithCancel(c.parentctx)
+	c.ctx = ctx
+	c.cancel = cancel
+
+	// Re-initialize variables
+	c.controlChannel = nil
+	c.h2Transport = nil
+	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger)
+	c.config.TunnelStatus.Set("")
+	c.poolConnections = 0
+	c.loadConnections = 0
+	c.controlFlow = make(chan struct{}, 100)
+
+	// set the log level again
+	c.logger.SetLevel(level)
+
+	go c.Start()
+}
+
+func (c *H2Transport) channelDialer() {
+	c.logger.Info("attempting to establish a new http/2 control channel connection")
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		default:
+			// pick the remote selected by the failover logic
+			c.config.RemoteAddr = c.config.Remotes.Current()
+			if c.h2Transport != nil {
+				c.h2Transport.CloseIdleConnections()
+			}
+			c.h2Transport = c.newH2Transport(c.config.RemoteAddr)
+
+			tunnelConn, err := c.openStream("/channel")
+			if err != nil {
+				c.logger.Errorf("control channel dialer: %v", err)
+				c.config.Remotes.ReportFailure(c.config.RemoteAddr)
+				time.Sleep(c.config.RetryInterval)
+				continue
+			}
+			c.controlChannel = tunnelConn
+			c.config.Remotes.ReportSuccess(c.config.RemoteAddr)
+			c.logger.Info("control channel established successfully")
+
+			c.config.TunnelStatus.Set(fmt.Sprintf("Connected (%s)", c.config.Mode))
+
+			go c.poolMaintainer()
+			go c.channelHandler()
+
+			return
+		}
+	}
+}
+
+func (c *H2Transport) poolMaintainer() {
+	for i := 0; i < c.config.ConnPoolSize; i++ { //initial pool filling
+		go c.tunnelDialer()
+	}
+
+	// factors
+	a := 4
+	b := 5
+	x := 3
+	y := 4.0
+
+	if c.config.AggressivePool {
+		c.logger.Info("aggressive pool management enabled")
+		a = 1
+		b = 2
+		x = 0
+		y = 0.75
+	}
+
+	tickerPool := time.NewTicker(time.Second * 1)
+	defer tickerPool.Stop()
+
+	tickerLoad := time.NewTicker(time.Second * 10)
+	defer tickerLoad.Stop()
+
+	newPoolSize := c.config.ConnPoolSize // intial value
+	var poolConnectionsSum int32 = 0
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+
+		case <-tickerPool.C:
+			// Accumulate pool connections over time (every second)
+			atomic.AddInt32(&poolConnectionsSum, atomic.LoadInt32(&c.poolConnections))
+
+		case <-tickerLoad.C:
+			// Calculate the loadConnections over the last 10 seconds
+			loadConnections := (int(atomic.LoadInt32(&c.loadConnections)) + 9) / 10 // +9 for ceil-like logic
+			atomic.StoreInt32(&c.loadConnections, 0)                                // Reset
+
+			// Calculate the average pool connections over the last 10 seconds
+			poolConnectionsAvg := (int(atomic.LoadInt32(&poolConnectionsSum)) + 9) / 10 // +9 for ceil-like logic
+			atomic.StoreInt32(&poolConnectionsSum, 0)                                   // Reset
+
+			// Dynamically adjust the pool size based on current connections
+			if (loadConnections + a) > poolConnectionsAvg*b {
+				c.logger.Debugf("increasing pool size: %d -> %d, avg pool conn: %d, avg load conn: %d", newPoolSize, newPoolSize+1, poolConnectionsAvg, loadConnections)
+				newPoolSize++
+
+				// Add a new connection to the pool
+				go c.tunnelDialer()
+			} else if float64(loadConnections+x) < float64(poolConnectionsAvg)*y && newPoolSize > c.config.ConnPoolSize {
+				c.logger.Debugf("decreasing pool size: %d -> %d, avg pool conn: %d, avg load conn: %d", newPoolSize, newPoolSize-1, poolConnectionsAvg, loadConnections)
+				newPoolSize--
+
+				// send a signal to controlFlow
+				c.controlFlow <- struct{}{}
+			}
+		}
+	}
+
+}
+
+func (c *H2Transport) channelHandler() {
+	msgChan := make(chan byte, 1000)
+
+	// Goroutine to handle the blocking ReceiveBinaryString
+	go func() {
+		for {
+			select {
+			case <-c.ctx.Done():
+				return
+
+			default:
+				msg, err := utils.ReceiveBinaryByte(c.controlChannel)
+				if err != nil {
+					if c.cancel != nil {
+						c.logger.Error("failed to read from channel connection. ", err)
+						go c.Restart()
+					}
+					return
+				}
+
+				msgChan <- msg
+			}
+		}
+	}()
+
+	// Main loop to listen for context cancellation or received messages
+	for {
+		select {
+		case <-c.ctx.Done():
+			_ = utils.SendBinaryByte(c.controlChannel, utils.SG_Closed)
+			return
+
+		case msg := <-msgChan:
+			switch msg {
+			case utils.SG_Chan:
+				atomic.AddInt32(&c.loadConnections, 1)
+				select {
+				case <-c.controlFlow: // Do nothing
+
+				default:
+					c.logger.Debug("channel signal received, initiating tunnel dialer")
+					go c.tunnelDialer()
+				}
+
+			case utils.SG_HB:
+				c.logger.Debug("heartbeat signal received successfully")
+				// send heartbeat back
+				err := utils.SendBinaryByte(c.controlChannel, utils.SG_HB)
+				if err != nil {
+					c.logger.Errorf("failed to send heartbeat: %v", msg)
+					go c.Restart()
+					return
+				}
+				c.logger.Trace("heartbeat signal sent successfully")
+
+			case utils.SG_Closed:
+				c.logger.Warn("control channel has been closed by the server")
+				go c.Restart()
+				return
+
+			default:
+				c.logger.Errorf("unexpected response from channel: %v", msg)
+				go c.Restart()
+				return
+			}
+		}
+	}
+}
+
+func (c *H2Transport) tunnelDialer() {
+	c.logger.Debugf("initiating new http/2 tunnel stream to address %s", c.config.RemoteAddr)
+
+	// Open a new stream to the tunnel server
+	tunnelConn, err := c.openStream(fmt.Sprintf("/tunnel/%d", rand.Int31()))
+	if err != nil {
+		c.logger.Errorf("tunnel server dialer: %v", err)
+
+		return
+	}
+
+	// Increment active connections counter
+	atomic.AddInt32(&c.poolConnections, 1)
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			tunnelConn.Close()
+			return
+		default:
+			signal, err := utils.ReceiveBinaryByte(tunnelConn)
+			if err != nil {
+				c.logger.Debugf("unable to get port from http/2 stream %s: %v", tunnelConn.RemoteAddr().String(), err)
+				tunnelConn.Close()
+
+				// Decrement active connections on failure
+				atomic.AddInt32(&c.poolConnections, -1)
+
+				return
+			}
+
+			if signal == utils.SG_Ping {
+				c.logger.Trace("ping received from the server")
+				continue
+			}
+
+			// Decrement active connections
+			atomic.AddInt32(&c.poolConnections, -1)
+
+			if signal != utils.SG_TCP {
+				c.logger.Error("undefined transport. close the connection.")
+				tunnelConn.Close()
+				return
+			}
+
+			remoteAddr, err := utils.ReceiveBinaryString(tunnelConn)
+			if err != nil {
+				c.logger.Debugf("unable to get port from http/2 stream %s: %v", tunnelConn.RemoteAddr().String(), err)
+				tunnelConn.Close()
+				return
+			}
+
+			c.localDialer(tunnelConn, remoteAddr)
+			return
+		}
+	}
+}
+
+func (c *H2Transport) localDialer(tunnelConn *utils.H2Conn, remoteAddr string) {
+	localConn, port, release, err := c.config.Backends.DialTCP(remoteAddr, func(addr string, opts *DialOptions) (*net.TCPConn, error) {
+		return TcpDialer(c.ctx, addr, c.config.DialTimeOut, c.config.KeepAlive, true, 1, 32*1024, 32*1024, opts)
+	})
+	if err != nil {
+		c.logger.Errorf("local dialer: %v", err)
+		tunnelConn.Close()
+		return
+	}
+	defer release()
+	c.logger.Debugf("connected to local address %s successfully", remoteAddr)
+
+	utils.TCPConnectionHandler(tunnelConn, localConn, c.logger, c.usageMonitor, int(port), c.config.Sniffer, c.config.HalfCloseLinger)
+}
+
+// newH2Transport returns the http/2 client of a remote, every stream shares its connection
+func (c *H2Transport) newH2Transport(addr string) *http2.Transport {
+	// Handle edgeIP assignment, the remote address is still used as the authority
+	dialAddr := addr
+	if c.config.EdgeIP != "" {
+		if _, port, err := net.SplitHostPort(addr); err == nil {
+			dialAddr = net.JoinHostPort(c.config.EdgeIP, port)
+		}
+	}
+
+	// The server certificate is verified as set by the tls client options
+	tlsConfig := c.config.TLS.Config(addr)
+	tlsConfig.NextProtos = []string{http2.NextProtoTLS}
+
+	return &http2.Transport{
+		AllowHTTP:       c.config.Mode == config.H2C,
+		TLSClientConfig: tlsConfig,
+		DialTLSContext: func(ctx context.Context, network, _ string, tlsConfig *tls.Config) (net.Conn, error) {
+			// Based on calculations 1MB of buffer on 80ms RTT will have about 100Mbit Bandwidth per connection,
+			// all the streams share this connection
+			conn, err := TcpDialer(ctx, dialAddr, c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, 3, 1024*1024, 1024*1024, c.config.Dial)
+			if err != nil {
+				return nil, err
+			}
+			if c.config.Mode == config.H2C {
+				return conn, nil
+			}
+
+			tlsConn := tls.Client(conn, tlsConfig)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		},
+		ReadIdleTimeout: c.config.KeepAlive, // send http/2 pings on idle connections
+		PingTimeout:     15 * time.Second,
+	}
+}
+
+// openStream sends a POST request whose request and response bodies form a new stream
+func (c *H2Transport) openStream(path string) (*utils.H2Conn, error) {
+	scheme := "https"
+	if c.config.Mode == config.H2C {
+		scheme = "http"
+	}
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	reader, writer := io.Pipe()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s://%s%s", scheme, c.config.RemoteAddr, path), reader)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %v", c.config.Token))
+	req.Header.Set("X-User-Id", strconv.Itoa(int(rand.Int31())))
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	// keep the addresses of the connection the stream is opened on
+	var localAddr, remoteAddr net.Addr
+	req = req.WithContext(httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			localAddr = info.Conn.LocalAddr()
+			remoteAddr = info.Conn.RemoteAddr()
+		},
+	}))
+
+	// the server answers once it accepted the stream
+	timer := time.AfterFunc(c.config.DialTimeOut, cancel)
+	resp, err := c.h2Transport.RoundTrip(req)
+	if !timer.Stop() && err == nil {
+		resp.Body.Close()
+		err = fmt.Errorf("timeout while waiting for the stream to be accepted")
+	}
+	if err != nil {
+		writer.Close()
+		cancel()
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		writer.Close()
+		cancel()
+		return nil, fmt.Errorf("unexpected response from the server: %s", resp.Status)
+	}
+
+	body := &h2ResponseBody{ReadCloser: resp.Body, request: writer, cancel: cancel}
+
+	return utils.NewH2Conn(body, h2RequestBody{writer}, nil, nil, localAddr, remoteAddr), nil
+}
+
+// h2RequestBody is the data sent on a stream, closing its writes ends the request body with END_STREAM
+type h2RequestBody struct {
+	*io.PipeWriter
+}
+
+func (w h2RequestBody) CloseWrite() error {
+	return w.Close()
+}
+
+// h2ResponseBody is the data received on a stream. Closing it ends the request body after the data
+// already written and releases the stream once the server ended the response, for h2DrainTimeout at
+// most, as a stream released right away is reset with the last data in flight.
+type h2ResponseBody struct {
+	io.ReadCloser
+	request *io.PipeWriter
+	cancel  context.CancelFunc
+}
+
+func (b *h2ResponseBody) Close() error {
+	b.request.Close()
+
+	go func() {
+		timer := time.AfterFunc(h2DrainTimeout, b.cancel)
+		io.Copy(io.Discard, b.ReadCloser)
+		timer.Stop()
+		b.cancel()
+	}()
+	return nil
+}
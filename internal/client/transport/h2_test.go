@@ -0,0 +1,83 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/musix/backhaul/internal/config"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestH2CStream(t *testing.T) {
+	// the server reads the whole request before answering and ending the stream
+	received := make(chan []byte, 1)
+	server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		data, _ := io.ReadAll(r.Body)
+		received <- data
+		w.Write([]byte("done"))
+	}), &http2.Server{}))
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := &H2Transport{
+		config: &H2Config{RemoteAddr: addr, Mode: config.H2C, DialTimeOut: time.Second, KeepAlive: time.Minute},
+		ctx:    ctx,
+	}
+	client.h2Transport = client.newH2Transport(addr)
+
+	payload := make([]byte, 1<<20+123)
+	rand.Read(payload)
+
+	for _, c := range []struct {
+		name       string
+		closeWrite bool
+	}{
+		{"close write", true},
+		{"close", false},
+	} {
+		conn, err := client.openStream("/tunnel")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < len(payload); i += 16 * 1024 {
+			if _, err := conn.Write(payload[i:min(i+16*1024, len(payload))]); err != nil {
+				t.Fatalf("%s: write: %v", c.name, err)
+			}
+		}
+
+		if c.closeWrite {
+			// the answer still arrives on the half-closed stream
+			if err := conn.CloseWrite(); err != nil {
+				t.Fatalf("%s: close write: %v", c.name, err)
+			}
+			answer, err := io.ReadAll(conn)
+			if err != nil || string(answer) != "done" {
+				t.Errorf("%s: read %q %v after the close write, expected done", c.name, answer, err)
+			}
+		}
+		conn.Close()
+
+		select {
+		case data := <-received:
+			if !bytes.Equal(data, payload) {
+				t.Errorf("%s: server received %d bytes, expected the %d written", c.name, len(data), len(payload))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: end of the request not received", c.name)
+		}
+	}
+}
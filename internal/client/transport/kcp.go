@@ -0,0 +1,475 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/musix/backhaul/internal/utils"
+	"github.com/musix/backhaul/internal/web"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+type KcpTransport struct {
+	config          *KcpConfig
+	smuxConfig      *smux.Config
+	parentctx       context.Context
+	ctx             context.Context
+	cancel          context.CancelFunc
+	logger          *logrus.Logger
+	controlChannel  net.Conn
+	usageMonitor    *web.Usage
+	restartMutex    sync.Mutex
+	poolConnections int32
+	loadConnections int32
+	controlFlow     chan struct{}
+}
+
+type KcpConfig struct {
+	RemoteAddr       string
+	Token            string
+	SnifferLog       string
+	TunnelStatus     web.TunnelStatus
+	Nodelay          bool
+	Sniffer          bool
+	KeepAlive        time.Duration
+	HalfCloseLinger  time.Duration
+	RetryInterval    time.Duration
+	DialTimeOut      time.Duration
+	MuxVersion       int
+	MaxFrameSize     int
+	MaxReceiveBuffer int
+	MaxStreamBuffer  int
+	ConnPoolSize     int
+	WebPort          int
+	AggressivePool   bool
+	Remotes          *RemoteSelector
+	Backends         *BackendRegistry
+	Dial             *DialOptions // egress of the tunnel connections
+	KcpNodelay       bool         // fast retransmission mode
+	Interval         int          // internal update interval in ms
+	Resend           int          // fast resend after this many skipped acks, 0 disables
+	NoCongestion     bool         // disable the congestion window
+	SndWnd           int          // send window in packets
+	RcvWnd           int          // receive window in packets
+	MTU              int
+	DataShard        int // FEC data shards
+	ParityShard      int // FEC parity shards, 0 disables FEC
+}
+
+func NewKcpClient(parentCtx context.Context, config *KcpConfig, logger *logrus.Logger) *KcpTransport {
+	// Create a derived context from the parent context
+	ctx, cancel := context.WithCancel(parentCtx)
+
+	// Initialize the TcpTransport struct
+	client := &KcpTransport{
+		smuxConfig: &smux.Config{
+			Version:           config.MuxVersion,
+			KeepAliveInterval: 20 * time.Second,
+			KeepAliveTimeout:  40 * time.Second,
+			MaxFrameSize:      config.MaxFrameSize,
+			MaxReceiveBuffer:  config.MaxReceiveBuffer,
+			MaxStreamBuffer:   config.MaxStreamBuffer,
+		},
+		config:          config,
+		parentctx:       parentCtx,
+		ctx:             ctx,
+		cancel:          cancel,
+		logger:          logger,
+		controlChannel:  nil, // will be set when a control connection is established
+		usageMonitor:    web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
+		poolConnections: 0,
+		loadConnections: 0,
+		controlFlow:     make(chan struct{}, 100),
+	}
+
+	return client
+}
+
+func (c *KcpTransport) Start() {
+	if c.config.WebPort > 0 {
+		go c.usageMonitor.Monitor()
+	}
+
+	c.config.TunnelStatus.Set("Disconnected (KCP)")
+
+	// kcp has no handshake of its own to probe, failback only happens through failover
+	go c.channelDialer()
+}
+
+func (c *KcpTransport) Restart() {
+	if !c.restartMutex.TryLock() {
+		c.logger.Warn("client is already restarting")
+		return
+	}
+	defer c.restartMutex.Unlock()
+
+	c.logger.Info("restarting client...")
+
+	// for removing timeout logs
+	level := c.logger.Level
+	c.logger.SetLevel(logrus.FatalLevel)
+
+	if c.cancel != nil {
+		c.cancel()
+	}
+
+	// close control channel connection
+	if c.controlChannel != nil {
+		c.controlChannel.Close()
+	}
+
+	time.Sleep(2 * time.Second)
+
+	ctx, cancel := context.WithCancel(c.parentctx)
+	c.ctx = ctx
+	c.cancel = cancel
+
+	// Re-initialize variables
+	c.controlChannel = nil
+	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger)
+	c.config.TunnelStatus.Set("")
+	c.poolConnections = 0
+	c.loadConnections = 0
+	c.controlFlow = make(chan struct{}, 100)
+
+	// set the log level again
+	c.logger.SetLevel(level)
+
+	go c.Start()
+
+}
+
+func (c *KcpTransport) channelDialer() {
+	c.logger.Info("attempting to establish a new kcp control channel connection...")
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		default:
+			// pick the remote selected by the failover logic
+			c.config.RemoteAddr = c.config.Remotes.Current()
+			tunnelConn, err := c.kcpDialer(c.config.RemoteAddr)
+			if err != nil {
+				c.logger.Errorf("channel dialer: %v", err)
+				c.config.Remotes.ReportFailure(c.config.RemoteAddr)
+				time.Sleep(c.config.RetryInterval)
+				continue
+			}
+
+			// Sending security token
+			err = utils.SendBinaryTransportString(tunnelConn, c.config.Token, utils.SG_Chan)
+			if err != nil {
+				c.logger.Errorf("failed to send security token: %v", err)
+				tunnelConn.Close()
+				continue
+			}
+
+			// Set a read deadline for the token response
+			if err := tunnelConn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+				c.logger.Errorf("failed to set read deadline: %v", err)
+				tunnelConn.Close()
+				continue
+			}
+			// Receive response
+			message, signal, err := utils.ReceiveBinaryTransportString(tunnelConn)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					c.logger.Warn("timeout while waiting for control channel response")
+				} else {
+					c.logger.Errorf("failed to receive control channel response: %v", err)
+				}
+				tunnelConn.Close() // Close connection on error or timeout
+				c.config.Remotes.ReportFailure(c.config.RemoteAddr)
+				time.Sleep(c.config.RetryInterval)
+				continue
+			}
+			// Resetting the deadline (removes any existing deadline)
+			tunnelConn.SetReadDeadline(time.Time{})
+
+			if message == c.config.Token {
+				// the server advertises the half-close framing with the signal of its answer
+				if signal == utils.SG_Framed && c.config.HalfCloseLinger > 0 {
+					if err := utils.SendBinaryByte(tunnelConn, utils.SG_Framed); err != nil {
+						c.logger.Errorf("failed to confirm the half-close framing: %v", err)
+						tunnelConn.Close()
+						continue
+					}
+				}
+				c.controlChannel = tunnelConn
+				c.config.Remotes.ReportSuccess(c.config.RemoteAddr)
+				c.logger.Info("control channel established successfully")
+
+				c.config.TunnelStatus.Set("Connected (KCP)")
+
+				go c.poolMaintainer()
+				go c.channelHandler()
+
+				return
+			} else {
+				c.logger.Errorf("invalid token received. Expected: %s, Received: %s. Retrying...", c.config.Token, message)
+				tunnelConn.Close() // Close connection if the token is invalid
+				c.config.Remotes.ReportFailure(c.config.RemoteAddr)
+				time.Sleep(c.config.RetryInterval)
+				continue
+			}
+		}
+	}
+
+}
+
+func (c *KcpTransport) poolMaintainer() {
+	for i := 0; i < c.config.ConnPoolSize; i++ { //initial pool filling
+		go c.tunnelDialer()
+	}
+
+	// factors
+	a := 4
+	b := 5
+	x := 3
+	y := 4.0
+
+	if c.config.AggressivePool {
+		c.logger.Info("aggressive pool management enabled")
+		a = 1
+		b = 2
+		x = 0
+		y = 0.75
+	}
+
+	tickerPool := time.NewTicker(time.Second * 1)
+	defer tickerPool.Stop()
+
+	tickerLoad := time.NewTicker(time.Second * 10)
+	defer tickerLoad.Stop()
+
+	newPoolSize := c.config.ConnPoolSize // intial value
+	var poolConnectionsSum int32 = 0
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+
+		case <-tickerPool.C:
+			// Accumulate pool connections over time (every second)
+			atomic.AddInt32(&poolConnectionsSum, atomic.LoadInt32(&c.poolConnections))
+
+		case <-tickerLoad.C:
+			// Calculate the loadConnections over the last 10 seconds
+			loadConnections := (int(atomic.LoadInt32(&c.loadConnections)) + 9) / 10 // +9 for ceil-like logic
+			atomic.StoreInt32(&c.loadConnections, 0)                                // Reset
+
+			// Calculate the average pool connections over the last 10 seconds
+			poolConnectionsAvg := (int(atomic.LoadInt32(&poolConnectionsSum)) + 9) / 10 // +9 for ceil-like logic
+			atomic.StoreInt32(&poolConnectionsSum, 0)                                   // Reset
+
+			// Dynamically adjust the pool size based on current connections
+			if (loadConnections + a) > poolConnectionsAvg*b {
+				c.logger.Debugf("increasing pool size: %d -> %d, avg pool conn: %d, avg load conn: %d", newPoolSize, newPoolSize+1, poolConnectionsAvg, loadConnections)
+				newPoolSize++
+
+				// Add a new connection to the pool
+				go c.tunnelDialer()
+			} else if float64(loadConnections+x) < float64(poolConnectionsAvg)*y && newPoolSize > c.config.ConnPoolSize {
+				c.logger.Debugf("decreasing pool size: %d -> %d, avg pool conn: %d, avg load conn: %d", newPoolSize, newPoolSize-1, poolConnectionsAvg, loadConnections)
+				newPoolSize--
+
+				// send a signal to controlFlow
+				c.controlFlow <- struct{}{}
+			}
+		}
+	}
+
+}
+
+func (c *KcpTransport) channelHandler() {
+	msgChan := make(chan byte, 1000)
+
+	// Goroutine to handle the blocking ReceiveBinaryString
+	go func() {
+		for {
+			select {
+			case <-c.ctx.Done():
+				return
+			default:
+				msg, err := utils.ReceiveBinaryByte(c.controlChannel)
+				if err != nil {
+					if c.cancel != nil {
+						c.logger.Error("failed to read from control channel. ", err)
+						go c.Restart()
+					}
+					return
+				}
+				msgChan <- msg
+			}
+		}
+	}()
+
+	// Main loop to listen for context cancellation or received messages
+	for {
+		select {
+		case <-c.ctx.Done():
+			_ = utils.SendBinaryByte(c.controlChannel, utils.SG_Closed)
+			return
+
+		case msg := <-msgChan:
+			switch msg {
+			case utils.SG_Chan:
+				atomic.AddInt32(&c.loadConnections, 1)
+
+				select {
+				case <-c.controlFlow: // Do nothing
+
+				default:
+					c.logger.Debug("channel signal received, initiating tunnel dialer")
+					go c.tunnelDialer()
+				}
+
+			case utils.SG_HB:
+				c.logger.Debug("heartbeat signal received successfully")
+
+			case utils.SG_Closed:
+				c.logger.Warn("control channel has been closed by the server")
+				go c.Restart()
+				return
+
+			default:
+				c.logger.Errorf("unexpected response from channel: %v.", msg)
+				go c.Restart()
+				return
+			}
+
+		}
+	}
+}
+
+func (c *KcpTransport) tunnelDialer() {
+	c.logger.Debugf("initiating new tunnel connection to address %s", c.config.RemoteAddr)
+
+	// Dial to the tunnel server
+	tunnelConn, err := c.kcpDialer(c.config.RemoteAddr)
+	if err != nil {
+		c.logger.Errorf("tunnel server dialer: %v", err)
+
+		return
+	}
+
+	// The server only accepts a kcp session once a packet arrives, smux sends nothing before the first stream
+	if err := utils.SendBinaryByte(tunnelConn, utils.SG_Chan); err != nil {
+		c.logger.Errorf("failed to announce the tunnel connection: %v", err)
+		tunnelConn.Close()
+		return
+	}
+
+	// Increment active connections counter
+	atomic.AddInt32(&c.poolConnections, 1)
+
+	c.handleSession(tunnelConn)
+}
+
+func (c *KcpTransport) handleSession(tunnelConn net.Conn) {
+	defer func() {
+		atomic.AddInt32(&c.poolConnections, -1)
+	}()
+
+	// SMUX server
+	session, err := smux.Server(tunnelConn, c.smuxConfig)
+	if err != nil {
+		c.logger.Errorf("failed to create mux session: %v", err)
+		return
+	}
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		default:
+			stream, err := session.AcceptStream()
+			if err != nil {
+				c.logger.Trace("session is closed: ", err)
+				session.Close()
+				return
+			}
+
+			remoteAddr, err := utils.ReceiveBinaryString(stream)
+			if err != nil {
+				c.logger.Errorf("unable to get port from stream connection %s: %v", tunnelConn.RemoteAddr().String(), err)
+				stream.Close()
+				continue
+			}
+
+			// the server marks the streams it frames
+			remoteAddr, framed := utils.ParseHalfCloseMark(remoteAddr)
+			go c.localDialer(stream, remoteAddr, framed)
+		}
+	}
+}
+
+func (c *KcpTransport) localDialer(stream *smux.Stream, remoteAddr string, framed bool) {
+	localConnection, port, release, err := c.config.Backends.DialTCP(remoteAddr, func(addr string, opts *DialOptions) (*net.TCPConn, error) {
+		return TcpDialer(c.ctx, addr, c.config.DialTimeOut, c.config.KeepAlive, true, 1, 32*1024, 32*1024, opts)
+	})
+	if err != nil {
+		c.logger.Errorf("local dialer: %v", err)
+		stream.Close()
+		return
+	}
+	defer release()
+
+	c.logger.Debugf("connected to local address %s successfully", remoteAddr)
+
+	// the data is framed so that the stream can be half-closed, when both ends support it
+	conn, linger := utils.MuxStreamConn(stream, framed, c.config.HalfCloseLinger)
+	utils.TCPConnectionHandler(conn, localConnection, c.logger, c.usageMonitor, int(port), c.config.Sniffer, linger)
+}
+
+// kcpConn closes the udp socket of a session dialed by kcpDialer along with the session
+type kcpConn struct {
+	*kcp.UDPSession
+	conn net.PacketConn
+}
+
+func (k *kcpConn) Close() error {
+	err := k.UDPSession.Close()
+	k.conn.Close()
+	return err
+}
+
+// kcpDialer opens a kcp session to the server over a udp socket bound to the egress options
+func (c *KcpTransport) kcpDialer(address string) (net.Conn, error) {
+	udpConn, err := ListenUDP(c.config.Dial)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on UDP: %v", err)
+	}
+
+	session, err := kcp.NewConn(address, nil, c.config.DataShard, c.config.ParityShard, udpConn)
+	if err != nil {
+		udpConn.Close()
+		return nil, fmt.Errorf("failed to dial KCP session: %v", err)
+	}
+
+	// KCP tuning, both sides should use the same values
+	session.SetStreamMode(true)
+	session.SetWriteDelay(false)
+	session.SetNoDelay(boolToInt(c.config.KcpNodelay), c.config.Interval, c.config.Resend, boolToInt(c.config.NoCongestion))
+	session.SetWindowSize(c.config.SndWnd, c.config.RcvWnd)
+	session.SetMtu(c.config.MTU)
+	session.SetACKNoDelay(c.config.KcpNodelay)
+
+	return &kcpConn{UDPSession: session, conn: udpConn}, nil
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
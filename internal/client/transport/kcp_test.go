@@ -0,0 +1,101 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/musix/backhaul/internal/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/xtaci/kcp-go/v5"
+)
+
+func newTestKcpClient(t *testing.T) (*KcpTransport, *kcp.Listener) {
+	listener, err := kcp.ListenWithOptions("127.0.0.1:0", nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return NewKcpClient(ctx, &KcpConfig{
+		RemoteAddr:       listener.Addr().String(),
+		Token:            "secret",
+		MuxVersion:       2,
+		MaxFrameSize:     32768,
+		MaxReceiveBuffer: 4194304,
+		MaxStreamBuffer:  2097152,
+		DialTimeOut:      time.Second,
+		KcpNodelay:       true,
+		Interval:         10,
+		Resend:           2,
+		NoCongestion:     true,
+		SndWnd:           1024,
+		RcvWnd:           1024,
+		MTU:              1350,
+		DataShard:        10,
+		ParityShard:      3,
+	}, logger), listener
+}
+
+func acceptTestKcp(t *testing.T, listener *kcp.Listener) *kcp.UDPSession {
+	listener.SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := listener.AcceptKCP()
+	if err != nil {
+		t.Fatalf("kcp session not accepted: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestKcpDialer(t *testing.T) {
+	client, listener := newTestKcpClient(t)
+
+	conn, err := client.kcpDialer(client.config.RemoteAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("request"))
+
+	// the fec shards and the tuning of both sides match
+	server := acceptTestKcp(t, listener)
+	buf := make([]byte, 16)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := io.ReadAtLeast(server, buf, len("request")); err != nil || string(buf[:n]) != "request" {
+		t.Fatalf("server read %q %v, expected request", buf[:n], err)
+	}
+	server.Write([]byte("answer"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := io.ReadAtLeast(conn, buf, len("answer")); err != nil || string(buf[:n]) != "answer" {
+		t.Fatalf("client read %q %v, expected answer", buf[:n], err)
+	}
+
+	// closing the session releases its udp socket
+	conn.Close()
+	if _, err := conn.(*kcpConn).conn.WriteTo([]byte("late"), listener.Addr()); err == nil {
+		t.Error("udp socket still open after the close")
+	}
+}
+
+func TestKcpTunnelDialer(t *testing.T) {
+	client, listener := newTestKcpClient(t)
+	go client.tunnelDialer()
+
+	// the tunnel connection announces itself before the mux session
+	server := acceptTestKcp(t, listener)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if signal, err := utils.ReceiveBinaryByte(server); err != nil || signal != utils.SG_Chan {
+		t.Fatalf("tunnel connection started with %d %v, expected %d", signal, err, utils.SG_Chan)
+	}
+
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&client.poolConnections) != 1; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel connection not counted in the pool")
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package transport
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// how long an uplink is skipped after a failed dial
+const pathDownTime = 30 * time.Second
+
+// pathSelector spreads the tunnel connections of a bonded tunnel over the uplinks, each one is a local
+// source address or the name of an interface
+type pathSelector struct {
+	mu        sync.Mutex
+	addrs     []string
+	downUntil []time.Time
+	next      int
+}
+
+func newPathSelector(addrs []string) *pathSelector {
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	return &pathSelector{
+		addrs:     addrs,
+		downUntil: make([]time.Time, len(addrs)),
+	}
+}
+
+// pick returns the next uplink in round robin order, skipping the ones that recently failed.
+// When every uplink is down the one that failed first is retried.
+func (p *pathSelector) pick() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for i := 0; i < len(p.addrs); i++ {
+		index := (p.next + i) % len(p.addrs)
+		if now.After(p.downUntil[index]) {
+			p.next = index + 1
+			return p.addrs[index]
+		}
+	}
+
+	oldest := 0
+	for i := range p.addrs {
+		if p.downUntil[i].Before(p.downUntil[oldest]) {
+			oldest = i
+		}
+	}
+	return p.addrs[oldest]
+}
+
+func (p *pathSelector) reportFailure(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range p.addrs {
+		if p.addrs[i] == addr {
+			p.downUntil[i] = time.Now().Add(pathDownTime)
+		}
+	}
+}
+
+// pathOptions returns the dial options of an uplink: a source address, or an interface the connections are
+// bound to with SO_BINDTODEVICE
+func pathOptions(opts *DialOptions, path string) *DialOptions {
+	if net.ParseIP(path) != nil {
+		return opts.WithLocalAddr(path)
+	}
+	return opts.WithInterface(path)
+}
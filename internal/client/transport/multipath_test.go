@@ -0,0 +1,64 @@
+package transport
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPathSelector(t *testing.T) {
+	if newPathSelector(nil) != nil {
+		t.Error("selector created without source addresses")
+	}
+
+	addrs := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	for _, c := range []struct {
+		name     string
+		failures []string
+		expected []string
+	}{
+		{"round robin", nil, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.1"}},
+		{"failed uplink", []string{"10.0.0.2"}, []string{"10.0.0.1", "10.0.0.3", "10.0.0.1", "10.0.0.3"}},
+		{"unknown uplink", []string{"10.0.0.9"}, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.1"}},
+		// when every uplink is down the one that failed first is retried
+		{"all down", []string{"10.0.0.2", "10.0.0.3", "10.0.0.1"}, []string{"10.0.0.2", "10.0.0.2"}},
+	} {
+		p := newPathSelector(addrs)
+		for _, addr := range c.failures {
+			p.reportFailure(addr)
+			time.Sleep(time.Millisecond) // keep the failures in order
+		}
+
+		for i, expected := range c.expected {
+			if addr := p.pick(); addr != expected {
+				t.Errorf("%s: pick %d returned %s, expected %s", c.name, i, addr, expected)
+			}
+		}
+	}
+}
+
+func TestPathOptions(t *testing.T) {
+	base := &DialOptions{LocalAddr: "192.168.1.10", Interface: "eth0", Mark: 7}
+	for _, c := range []struct {
+		name      string
+		opts      *DialOptions
+		path      string
+		localAddr string
+		iface     string
+		mark      int
+	}{
+		{"source address", base, "10.0.0.1", "10.0.0.1", "eth0", 7},
+		{"ipv6 source address", base, "fd00::1", "fd00::1", "eth0", 7},
+		{"interface", base, "wwan0", "", "wwan0", 7},
+		{"interface without egress options", nil, "wwan0", "", "wwan0", 0},
+	} {
+		opts := pathOptions(c.opts, c.path)
+		if opts.LocalAddr != c.localAddr || opts.Interface != c.iface || opts.Mark != c.mark {
+			t.Errorf("%s: source %q interface %q mark %d, expected %q %q %d", c.name, opts.LocalAddr, opts.Interface, opts.Mark, c.localAddr, c.iface, c.mark)
+		}
+	}
+
+	// the egress options of the tunnel are left as they are
+	if *base != (DialOptions{LocalAddr: "192.168.1.10", Interface: "eth0", Mark: 7}) {
+		t.Errorf("egress options changed to %+v", *base)
+	}
+}
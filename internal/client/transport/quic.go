@@ -5,9 +5,8 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
-	"strconv"
-	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/musix/backhaul/internal/utils"
@@ -28,6 +27,7 @@ type QuicTransport struct {
 	usageMonitor      *web.Usage
 	activeMu          sync.Mutex
 	restartMutex      sync.Mutex
+	udpFlows          sync.Map // UDP flows opened by the server, by flow id
 	activeConnections int
 }
 
@@ -35,10 +35,11 @@ type QuicConfig struct {
 	RemoteAddr       string
 	Token            string
 	SnifferLog       string
-	TunnelStatus     string
+	TunnelStatus     web.TunnelStatus
 	Nodelay          bool
 	Sniffer          bool
 	KeepAlive        time.Duration
+	HalfCloseLinger  time.Duration
 	RetryInterval    time.Duration
 	DialTimeOut      time.Duration
 	MuxVersion       int
@@ -47,7 +48,11 @@ type QuicConfig struct {
 	MaxStreamBuffer  int
 	ConnectionPool   int
 	WebPort          int
-	AggressivePool bool
+	AggressivePool   bool
+	Remotes          *RemoteSelector
+	Backends         *BackendRegistry
+	Dial             *DialOptions // egress of the tunnel connections
+	TLS              *TLSOptions  // verification of the server certificate
 }
 
 func NewQuicClient(parentCtx context.Context, config *QuicConfig, logger *logrus.Logger) *QuicTransport {
@@ -60,6 +65,7 @@ func NewQuicClient(parentCtx context.Context, config *QuicConfig, logger *logrus
 			Allow0RTT:       true,
 			KeepAlivePeriod: 20 * time.Second,
 			MaxIdleTimeout:  1600 * time.Second,
+			EnableDatagrams: true, // UDP flows, streams are used when the server does not support them
 		},
 		config:            config,
 		parentctx:         parentCtx,
@@ -99,7 +105,7 @@ func (c *QuicTransport) Restart() {
 	// Re-initialize variables
 	c.controlChannel = nil
 	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger)
-	c.config.TunnelStatus = ""
+	c.config.TunnelStatus.Set("")
 	c.activeConnections = 0
 	c.activeMu = sync.Mutex{}
 
@@ -111,7 +117,10 @@ func (c *QuicTransport) ChannelDialer(coldStart bool) {
 	if coldStart && c.config.WebPort > 0 {
 		go c.usageMonitor.Monitor()
 	}
-	c.config.TunnelStatus = "Disconnected (Quic)"
+	if coldStart {
+		go c.config.Remotes.Failback(c.ctx, c.quicProbe, c.Restart)
+	}
+	c.config.TunnelStatus.Set("Disconnected (Quic)")
 	c.logger.Info("attempting to establish a new quic control channel connection...")
 
 	for {
@@ -119,9 +128,12 @@ func (c *QuicTransport) ChannelDialer(coldStart bool) {
 		case <-c.ctx.Done():
 			return
 		default:
+			// pick the remote selected by the failover logic
+			c.config.RemoteAddr = c.config.Remotes.Current()
 			qConn, err := c.quicDialer(c.config.RemoteAddr)
 			if err != nil {
 				c.logger.Errorf("quic channel dialer: error dialing remote address %s: %v", c.config.RemoteAddr, err)
+				c.config.Remotes.ReportFailure(c.config.RemoteAddr)
 				time.Sleep(c.config.RetryInterval)
 				continue
 			}
@@ -158,6 +170,7 @@ func (c *QuicTransport) ChannelDialer(coldStart bool) {
 				}
 				stream.Close()
 				qConn.CloseWithError(1, "close on timeout/response deadline")
+				c.config.Remotes.ReportFailure(c.config.RemoteAddr)
 				time.Sleep(c.config.RetryInterval)
 				continue
 			}
@@ -166,14 +179,16 @@ func (c *QuicTransport) ChannelDialer(coldStart bool) {
 
 			if message == c.config.Token {
 				c.controlChannel = qConn
+				c.config.Remotes.ReportSuccess(c.config.RemoteAddr)
 				c.logger.Info("quic control channel established successfully")
 
 				// close stream
 				stream.Close()
 
-				c.config.TunnelStatus = "Connected (Quic)"
+				c.config.TunnelStatus.Set("Connected (Quic)")
 
 				go c.channelListener()
+				go c.udpFlowListener(qConn)
 
 				if coldStart {
 					go c.poolChecker()
@@ -184,6 +199,7 @@ func (c *QuicTransport) ChannelDialer(coldStart bool) {
 				c.logger.Errorf("invalid token received. Expected: %s, Received: %s. Retrying...", c.config.Token, message)
 				stream.Close()
 				qConn.CloseWithError(1, "invalid token error")
+				c.config.Remotes.ReportFailure(c.config.RemoteAddr)
 				continue
 			}
 		}
@@ -337,38 +353,19 @@ func (c *QuicTransport) handleTunnelConn(session quic.Connection) {
 }
 
 func (c *QuicTransport) localDialer(stream quic.Stream, remoteAddr string) {
-	// Extract the port
-	parts := strings.Split(remoteAddr, ":")
-	var port int
-	var err error
-	if len(parts) < 2 {
-		port, err = strconv.Atoi(parts[0])
-		if err != nil {
-			c.logger.Info("failed to find the remote port, ", err)
-			stream.Close()
-			return
-		}
-		remoteAddr = fmt.Sprintf("127.0.0.1:%d", port)
-	} else {
-		port, err = strconv.Atoi(parts[1])
-		if err != nil {
-			c.logger.Info("failed to find the remote port, ", err)
-			stream.Close()
-			return
-		}
-	}
-	localConnection, err := c.tcpDialer(remoteAddr)
+	localConnection, port, release, err := c.config.Backends.DialTCP(remoteAddr, c.tcpDialer)
 	if err != nil {
-		c.logger.Errorf("connecting to local address %s is not possible", remoteAddr)
+		c.logger.Errorf("connecting to local address %s is not possible: %v", remoteAddr, err)
 		stream.Close()
 		return
 	}
+	defer release()
 
 	c.logger.Debugf("connected to local address %s successfully", remoteAddr)
-	utils.QConnectionHandler(localConnection, stream, c.logger, c.usageMonitor, int(port), c.config.Sniffer)
+	utils.QConnectionHandler(localConnection, stream, c.logger, c.usageMonitor, int(port), c.config.Sniffer, c.config.HalfCloseLinger)
 }
 
-func (c *QuicTransport) tcpDialer(address string) (*net.TCPConn, error) {
+func (c *QuicTransport) tcpDialer(address string, opts *DialOptions) (*net.TCPConn, error) {
 	// Resolve the address to a TCP address
 	tcpAddr, err := net.ResolveTCPAddr("tcp", address)
 	if err != nil {
@@ -379,6 +376,17 @@ func (c *QuicTransport) tcpDialer(address string) (*net.TCPConn, error) {
 	dialer := &net.Dialer{
 		Timeout:   c.config.DialTimeOut, // Set the connection timeout
 		KeepAlive: c.config.KeepAlive,   // Set the keep-alive duration
+		Control: func(network, address string, s syscall.RawConn) error {
+			return opts.control(network, s)
+		},
+	}
+
+	localIP, err := opts.localIP()
+	if err != nil {
+		return nil, err
+	}
+	if localIP != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: localIP}
 	}
 
 	// Dial the TCP connection with a timeout
@@ -430,12 +438,11 @@ func (c *QuicTransport) poolChecker() {
 
 }
 
-func (c *QuicTransport) generateClientTLSConfig() *tls.Config {
-	// Skip certificate verification for simplicity (not recommended for production)
-	return &tls.Config{
-		InsecureSkipVerify: true,
-		NextProtos:         []string{"h3"}, // Set your supported protocol here
-	}
+func (c *QuicTransport) generateClientTLSConfig(addr string) *tls.Config {
+	// The server certificate is verified as set by the tls client options
+	tlsConfig := c.config.TLS.Config(addr)
+	tlsConfig.NextProtos = []string{"h3"} // Set your supported protocol here
+	return tlsConfig
 }
 
 // quicDialer establishes a QUIC connection to a given address
@@ -447,7 +454,7 @@ func (c *QuicTransport) quicDialer(address string) (quic.Connection, error) {
 	}
 
 	// Create a UDP connection for QUIC to use
-	udpConn, err := net.ListenUDP("udp", nil)
+	udpConn, err := ListenUDP(c.config.Dial)
 	if err != nil {
 		return nil, fmt.Errorf("failed to listen on UDP: %v", err)
 	}
@@ -460,7 +467,7 @@ func (c *QuicTransport) quicDialer(address string) (quic.Connection, error) {
 	}
 
 	// Dial the QUIC connection
-	tlsConfig := c.generateClientTLSConfig()
+	tlsConfig := c.generateClientTLSConfig(address)
 	quicConn, err := quic.Dial(context.Background(), udpConn, udpAddr, tlsConfig, c.quicConfig)
 	if err != nil {
 		udpConn.Close()
@@ -469,3 +476,21 @@ func (c *QuicTransport) quicDialer(address string) (quic.Connection, error) {
 
 	return quicConn, nil
 }
+
+// quicProbe checks that a remote completes the quic handshake
+func (c *QuicTransport) quicProbe(ctx context.Context, addr string) error {
+	qConn, err := c.quicDialer(addr)
+	if err != nil {
+		return err
+	}
+	return qConn.CloseWithError(0, "probe")
+}
+
+// QuicProbe checks that a remote completes the quic handshake without starting a client
+func QuicProbe(timeout time.Duration, opts *DialOptions) func(ctx context.Context, addr string) error {
+	probe := &QuicTransport{
+		config:     &QuicConfig{DialTimeOut: timeout, Dial: opts},
+		quicConfig: &quic.Config{},
+	}
+	return probe.quicProbe
+}
@@ -0,0 +1,167 @@
+package transport
+
+import (
+	"errors"
+	"net"
+
+	"github.com/musix/backhaul/internal/utils"
+	"github.com/quic-go/quic-go"
+)
+
+// quicUDPFlow is a UDP mapping opened by the server on the control connection, dialed to its local service
+type quicUDPFlow struct {
+	id         uint32
+	conn       *net.UDPConn
+	remotePort int
+}
+
+// udpFlowListener accepts the flows the server opens on the control connection for its UDP mappings
+func (c *QuicTransport) udpFlowListener(conn quic.Connection) {
+	go c.udpDatagramReader(conn)
+
+	for {
+		stream, err := conn.AcceptStream(c.ctx)
+		if err != nil {
+			c.logger.Tracef("stopped accepting UDP flows: %v", err)
+			return
+		}
+
+		go c.handleUDPFlow(conn, stream)
+	}
+}
+
+// handleUDPFlow dials the local service of a flow and forwards its packets until the server closes the stream
+func (c *QuicTransport) handleUDPFlow(conn quic.Connection, stream quic.Stream) {
+	defer stream.Close()
+
+	id, err := utils.ReceiveFlowID(stream)
+	if err != nil {
+		c.logger.Errorf("unable to open UDP flow: %v", err)
+		stream.CancelRead(0)
+		return
+	}
+
+	remoteAddr, err := utils.ReceiveBinaryString(stream)
+	if err != nil {
+		c.logger.Errorf("unable to get address of UDP flow %d: %v", id, err)
+		stream.CancelRead(0)
+		return
+	}
+
+	port, resolvedAddr, opts, err := c.config.Backends.Resolve(remoteAddr)
+	if err != nil {
+		c.logger.Infof("failed to resolve remote port: %v", err)
+		stream.CancelRead(0)
+		return
+	}
+
+	udpConn, err := DialUDP(resolvedAddr, opts)
+	if err != nil {
+		c.logger.Errorf("failed to dial remote UDP address %s: %v", resolvedAddr, err)
+		stream.CancelRead(0)
+		return
+	}
+	defer udpConn.Close()
+
+	flow := &quicUDPFlow{
+		id:         id,
+		conn:       udpConn,
+		remotePort: port,
+	}
+
+	// datagrams of the flow are dispatched by the datagram reader of the control connection
+	c.udpFlows.Store(id, flow)
+	defer c.udpFlows.Delete(id)
+
+	if err := utils.SendFlowReady(stream); err != nil {
+		c.logger.Errorf("failed to confirm UDP flow %d: %v", id, err)
+		stream.CancelRead(0)
+		return
+	}
+
+	c.logger.Debugf("connected UDP flow %d to local address %s", id, resolvedAddr)
+
+	// packets sent on the stream, when datagrams are not available. The stream is closed by the server
+	// once the flow is idle, which closes the local socket as well.
+	go func() {
+		buf := utils.GetBuffer(BufferSize)
+		defer utils.PutBuffer(buf)
+		for {
+			n, err := utils.ReceiveFlowFrame(stream, buf)
+			if err != nil {
+				c.logger.Tracef("UDP flow %d stream closed: %v", id, err)
+				udpConn.Close()
+				return
+			}
+			c.writeUDPFlow(flow, buf[:n])
+		}
+	}()
+
+	buf := utils.GetBuffer(BufferSize)
+	defer utils.PutBuffer(buf)
+	scratch := utils.GetBuffer(BufferSize + 4)
+	defer utils.PutBuffer(scratch)
+	for {
+		r, err := udpConn.Read(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				c.logger.Errorf("failed to read from UDP connection: %v", err)
+			}
+			stream.CancelRead(0)
+			return
+		}
+
+		if err := utils.SendFlowPacket(conn, stream, id, buf[:r], scratch, true); err != nil {
+			c.logger.Errorf("failed to send UDP packet over flow %d: %v", id, err)
+			stream.CancelRead(0)
+			return
+		}
+
+		if c.config.Sniffer {
+			c.usageMonitor.AddOrUpdatePort(port, uint64(r))
+		}
+		c.logger.Tracef("read %d bytes from UDP, sent over flow %d", r, id)
+	}
+}
+
+// udpDatagramReader dispatches the datagrams of the control connection to their flows
+func (c *QuicTransport) udpDatagramReader(conn quic.Connection) {
+	// SupportsDatagrams only tells that the server accepts them, the packets it sends may still arrive here
+	if !conn.ConnectionState().SupportsDatagrams {
+		c.logger.Info("QUIC datagrams not supported by the server, UDP packets are sent on streams")
+	}
+
+	for {
+		datagram, err := conn.ReceiveDatagram(c.ctx)
+		if err != nil {
+			c.logger.Tracef("stopped receiving datagrams: %v", err)
+			return
+		}
+
+		id, data, err := utils.ParseFlowDatagram(datagram)
+		if err != nil {
+			c.logger.Debugf("discarding datagram: %v", err)
+			continue
+		}
+
+		value, ok := c.udpFlows.Load(id)
+		if !ok {
+			c.logger.Tracef("discarding datagram of unknown UDP flow %d", id)
+			continue
+		}
+		c.writeUDPFlow(value.(*quicUDPFlow), data)
+	}
+}
+
+// writeUDPFlow forwards a packet of the tunnel to the local service of the flow
+func (c *QuicTransport) writeUDPFlow(flow *quicUDPFlow, data []byte) {
+	w, err := flow.conn.Write(data)
+	if err != nil {
+		c.logger.Debugf("failed to write to UDP connection of flow %d: %v", flow.id, err)
+		return
+	}
+
+	if c.config.Sniffer {
+		c.usageMonitor.AddOrUpdatePort(flow.remotePort, uint64(w))
+	}
+}
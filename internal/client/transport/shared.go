@@ -2,7 +2,6 @@ package transport
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
@@ -14,6 +13,7 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/musix/backhaul/internal/config"
+	"github.com/musix/backhaul/internal/utils"
 	"golang.org/x/exp/rand"
 )
 
@@ -43,7 +43,141 @@ func ResolveRemoteAddr(remoteAddr string) (int, string, error) {
 	return port, remoteAddr, nil
 }
 
-func TcpDialer(ctx context.Context, address string, timeout time.Duration, keepAlive time.Duration, nodelay bool, retry int, SO_RCVBUF int, SO_SNDBUF int) (*net.TCPConn, error) {
+// DialOptions selects the egress of a dialed connection, nil keeps the system defaults
+type DialOptions struct {
+	LocalAddr string               // source ip
+	Interface string               // SO_BINDTODEVICE, linux only
+	Mark      int                  // SO_MARK (fwmark) for policy routing, linux only
+	Socket    *utils.SocketOptions // tcp socket options like the congestion control, linux only
+}
+
+// WithLocalAddr returns a copy of the options with another source ip
+func (o *DialOptions) WithLocalAddr(addr string) *DialOptions {
+	opts := DialOptions{}
+	if o != nil {
+		opts = *o
+	}
+	opts.LocalAddr = addr
+	return &opts
+}
+
+// WithInterface returns a copy of the options bound to another interface, the source ip is then chosen by
+// the interface
+func (o *DialOptions) WithInterface(name string) *DialOptions {
+	opts := DialOptions{}
+	if o != nil {
+		opts = *o
+	}
+	opts.LocalAddr = ""
+	opts.Interface = name
+	return &opts
+}
+
+// localIP parses the source ip, nil means any
+func (o *DialOptions) localIP() (net.IP, error) {
+	if o == nil || o.LocalAddr == "" {
+		return nil, nil
+	}
+
+	localIP := net.ParseIP(o.LocalAddr)
+	if localIP == nil {
+		return nil, fmt.Errorf("invalid local address: %s", o.LocalAddr)
+	}
+	return localIP, nil
+}
+
+// control binds the socket to the interface, sets the fwmark and the tcp socket options of the options
+func (o *DialOptions) control(network string, s syscall.RawConn) error {
+	if o == nil {
+		return nil
+	}
+
+	if err := o.Socket.ControlDial(network, "", s); err != nil {
+		return err
+	}
+
+	if o.Interface == "" && o.Mark == 0 {
+		return nil
+	}
+
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("interface and fwmark binding are only supported on linux")
+	}
+
+	var controlErr error
+	err := s.Control(func(fd uintptr) {
+		if o.Interface != "" {
+			if err := syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, 0x19 /* SO_BINDTODEVICE */, o.Interface); err != nil {
+				controlErr = fmt.Errorf("failed to bind to interface %s: %v", o.Interface, err)
+				return
+			}
+		}
+
+		if o.Mark != 0 {
+			if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, 0x24 /* SO_MARK */, o.Mark); err != nil {
+				controlErr = fmt.Errorf("failed to set SO_MARK %d: %v", o.Mark, err)
+				return
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return controlErr
+}
+
+// DialUDP dials a udp address through the egress of the options
+func DialUDP(address string, opts *DialOptions) (*net.UDPConn, error) {
+	localIP, err := opts.localIP()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Control: func(network, address string, s syscall.RawConn) error {
+			return opts.control(network, s)
+		},
+	}
+	if localIP != nil {
+		dialer.LocalAddr = &net.UDPAddr{IP: localIP}
+	}
+
+	conn, err := dialer.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*net.UDPConn), nil
+}
+
+// ListenUDP opens an unconnected udp socket on the egress of the options
+func ListenUDP(opts *DialOptions) (*net.UDPConn, error) {
+	localIP, err := opts.localIP()
+	if err != nil {
+		return nil, err
+	}
+
+	listenConfig := &net.ListenConfig{
+		Control: func(network, address string, s syscall.RawConn) error {
+			return opts.control(network, s)
+		},
+	}
+
+	address := ":0"
+	if localIP != nil {
+		address = net.JoinHostPort(localIP.String(), "0")
+	}
+
+	conn, err := listenConfig.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*net.UDPConn), nil
+}
+
+func TcpDialer(ctx context.Context, address string, timeout time.Duration, keepAlive time.Duration, nodelay bool, retry int, SO_RCVBUF int, SO_SNDBUF int, opts *DialOptions) (*net.TCPConn, error) {
 	var tcpConn *net.TCPConn
 	var err error
 
@@ -52,7 +186,7 @@ func TcpDialer(ctx context.Context, address string, timeout time.Duration, keepA
 
 	for i := 0; i < retries; i++ {
 		// Attempt to establish a TCP connection
-		tcpConn, err = attemptTcpDialer(ctx, address, timeout, keepAlive, nodelay, SO_RCVBUF, SO_SNDBUF)
+		tcpConn, err = attemptTcpDialer(ctx, address, timeout, keepAlive, nodelay, SO_RCVBUF, SO_SNDBUF, opts)
 		if err == nil {
 			// Connection successful
 			return tcpConn, nil
@@ -71,7 +205,7 @@ func TcpDialer(ctx context.Context, address string, timeout time.Duration, keepA
 	return nil, err
 }
 
-func attemptTcpDialer(ctx context.Context, address string, timeout time.Duration, keepAlive time.Duration, nodelay bool, SO_RCVBUF int, SO_SNDBUF int) (*net.TCPConn, error) {
+func attemptTcpDialer(ctx context.Context, address string, timeout time.Duration, keepAlive time.Duration, nodelay bool, SO_RCVBUF int, SO_SNDBUF int, opts *DialOptions) (*net.TCPConn, error) {
 	//Resolve the address to a TCP address
 	tcpAddr, err := net.ResolveTCPAddr("tcp", address)
 	if err != nil {
@@ -104,14 +238,27 @@ func attemptTcpDialer(ctx context.Context, address string, timeout time.Duration
 					}
 				})
 			}
+			if err != nil {
+				return err
+			}
 
-			return err
+			// Interface and fwmark for policy routing
+			return opts.control(network, s)
 
 		},
 		Timeout:   timeout,   // Set the connection timeout
 		KeepAlive: keepAlive, // Set the keep-alive duration
 	}
 
+	// Bind the source address, used to pin a connection to an uplink
+	localIP, err := opts.localIP()
+	if err != nil {
+		return nil, err
+	}
+	if localIP != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: localIP}
+	}
+
 	// Dial the TCP connection with a timeout
 	conn, err := dialer.DialContext(ctx, "tcp", tcpAddr.String())
 	if err != nil {
@@ -163,7 +310,7 @@ func ReusePortControl(network, address string, s syscall.RawConn) error {
 	return controlErr
 }
 
-func WebSocketDialer(ctx context.Context, addr string, edgeIP string, path string, timeout time.Duration, keepalive time.Duration, nodelay bool, token string, mode config.TransportType, retry int, SO_RCVBUF int, SO_SNDBUF int) (*websocket.Conn, error) {
+func WebSocketDialer(ctx context.Context, addr string, edgeIP string, path string, timeout time.Duration, keepalive time.Duration, nodelay bool, token string, subprotocols []string, mode config.TransportType, retry int, SO_RCVBUF int, SO_SNDBUF int, opts *DialOptions, tlsOpts *TLSOptions) (*websocket.Conn, error) {
 	var tunnelWSConn *websocket.Conn
 	var err error
 
@@ -172,7 +319,7 @@ func WebSocketDialer(ctx context.Context, addr string, edgeIP string, path strin
 
 	for i := 0; i < retries; i++ {
 		// Attempt to dial the WebSocket
-		tunnelWSConn, err = attemptDialWebSocket(ctx, addr, edgeIP, path, timeout, keepalive, nodelay, token, mode, SO_RCVBUF, SO_SNDBUF)
+		tunnelWSConn, err = attemptDialWebSocket(ctx, addr, edgeIP, path, timeout, keepalive, nodelay, token, subprotocols, mode, SO_RCVBUF, SO_SNDBUF, opts, tlsOpts)
 		if err == nil {
 			// If successful, return the connection
 			return tunnelWSConn, nil
@@ -191,52 +338,13 @@ func WebSocketDialer(ctx context.Context, addr string, edgeIP string, path strin
 	return nil, err
 }
 
-func attemptDialWebSocket(ctx context.Context, addr string, edgeIP string, path string, timeout time.Duration, keepalive time.Duration, nodelay bool, token string, mode config.TransportType, SO_RCVBUF int, SO_SNDBUF int) (*websocket.Conn, error) {
+func attemptDialWebSocket(ctx context.Context, addr string, edgeIP string, path string, timeout time.Duration, keepalive time.Duration, nodelay bool, token string, subprotocols []string, mode config.TransportType, SO_RCVBUF int, SO_SNDBUF int, opts *DialOptions, tlsOpts *TLSOptions) (*websocket.Conn, error) {
 	// Generate a random X-user-id
 	rand.Seed(uint64(time.Now().UnixNano()))
 	randomUserID := rand.Int31() // Generate a random int64 number
 
-	// List of 30 diverse User-Agent strings from various browsers and platforms
-	userAgents := []string{
-		// Chrome
-		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/114.0.0.0 Safari/537.36",
-		"Mozilla/5.0 (Macintosh; Intel Mac OS X 11_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/113.0.0.0 Safari/537.36",
-		"Mozilla/5.0 (Linux; Android 12; Pixel 5) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/115.0.0.0 Mobile Safari/537.36",
-		"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/113.0.0.0 Safari/537.36",
-		"Mozilla/5.0 (Linux; Android 9; SM-G960F) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/108.0.5359.128 Mobile Safari/537.36",
-		// Firefox
-		"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:114.0) Gecko/20100101 Firefox/114.0",
-		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:102.0) Gecko/20100101 Firefox/102.0",
-		"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:115.0) Gecko/20100101 Firefox/115.0",
-		"Mozilla/5.0 (Linux; Android 10; Pixel 4 XL) Gecko/20100101 Firefox/96.0",
-		"Mozilla/5.0 (iPhone; CPU iPhone OS 14_6 like Mac OS X) Gecko/20100101 Firefox/90.0",
-		// Safari
-		"Mozilla/5.0 (Macintosh; Intel Mac OS X 11_4_1) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.0 Safari/605.1.15",
-		"Mozilla/5.0 (iPhone; CPU iPhone OS 15_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.1 Mobile/15E148 Safari/604.1",
-		"Mozilla/5.0 (iPad; CPU OS 14_7 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.0 Mobile/15E148 Safari/604.1",
-		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_14_6) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.1.2 Safari/605.1.15",
-		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36",
-		// Edge
-		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36 Edg/91.0.864.64",
-		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/95.0.4638.69 Safari/537.36 Edg/95.0.1020.40",
-		"Mozilla/5.0 (Linux; Android 11; SM-G998U) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/90.0.4430.210 Mobile Safari/537.36 EdgA/46.3.4.5155",
-		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/111.0.0.0 Safari/537.36 Edg/111.0.1661.44",
-		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/115.0.0.0 Safari/537.36 Edg/115.0.1901.183",
-		// Opera
-		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/112.0.0.0 Safari/537.36 OPR/97.0.4719.63",
-		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/114.0.0.0 Safari/537.36 OPR/98.0.4759.15",
-		"Mozilla/5.0 (Linux; Android 10; SM-N975F) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/113.0.0.0 Mobile Safari/537.36 OPR/65.2.3381.61420",
-		"Mozilla/5.0 (Linux; Android 11; SM-G998U) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/114.0.5735.196 Mobile Safari/537.36 OPR/71.2.3767.68577",
-		"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/116.0.0.0 Safari/537.36 OPR/99.0.4759.21",
-		// Older Browsers
-		"Mozilla/4.0 (compatible; MSIE 9.0; Windows NT 6.1; Trident/5.0)",
-		"Mozilla/4.0 (compatible; MSIE 6.0; Windows NT 5.1; SV1)",
-		"Mozilla/5.0 (Windows NT 6.1; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/89.0.4389.82 Safari/537.36",
-		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_12_6) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/87.0.4280.88 Safari/537.36",
-	}
-
 	// Pick a random User-Agent
-	randomUserAgent := userAgents[rand.Intn(len(userAgents))]
+	randomUserAgent := randomUserAgent()
 
 	// Setup headers with authorization and X-user-id
 	headers := http.Header{}
@@ -271,7 +379,7 @@ func attemptDialWebSocket(ctx context.Context, addr string, edgeIP string, path
 			EnableCompression: true,
 			HandshakeTimeout:  45 * time.Second, // default handshake timeout
 			NetDial: func(_, addr string) (net.Conn, error) {
-				conn, err := TcpDialer(ctx, edgeIP, timeout, keepalive, nodelay, 1, SO_RCVBUF, SO_SNDBUF)
+				conn, err := TcpDialer(ctx, edgeIP, timeout, keepalive, nodelay, 1, SO_RCVBUF, SO_SNDBUF, opts)
 				if err != nil {
 					return nil, err
 				}
@@ -281,17 +389,15 @@ func attemptDialWebSocket(ctx context.Context, addr string, edgeIP string, path
 	} else if mode == config.WSS || mode == config.WSSMUX {
 		wsURL = fmt.Sprintf("wss://%s%s", addr, path)
 
-		// Create a TLS configuration that allows insecure connections
-		tlsConfig := &tls.Config{
-			InsecureSkipVerify: true, // Skip server certificate verification
-		}
+		// The server certificate is verified as set by the tls client options
+		tlsConfig := tlsOpts.Config(addr)
 
 		dialer = websocket.Dialer{
 			EnableCompression: true,
-			TLSClientConfig:   tlsConfig,        // Pass the insecure TLS config here
+			TLSClientConfig:   tlsConfig,        // Pass the TLS config here
 			HandshakeTimeout:  45 * time.Second, // default handshake timeout
 			NetDial: func(_, addr string) (net.Conn, error) {
-				conn, err := TcpDialer(ctx, edgeIP, timeout, keepalive, nodelay, 1, SO_RCVBUF, SO_SNDBUF)
+				conn, err := TcpDialer(ctx, edgeIP, timeout, keepalive, nodelay, 1, SO_RCVBUF, SO_SNDBUF, opts)
 				if err != nil {
 					return nil, err
 				}
@@ -300,6 +406,9 @@ func attemptDialWebSocket(ctx context.Context, addr string, edgeIP string, path
 		}
 	}
 
+	// the subprotocols offer the optional features of the tunnel, the server picks the ones it supports
+	dialer.Subprotocols = subprotocols
+
 	// Dial to the WebSocket server
 	tunnelWSConn, _, err := dialer.Dial(wsURL, headers)
 	if err != nil {
@@ -307,3 +416,47 @@ func attemptDialWebSocket(ctx context.Context, addr string, edgeIP string, path
 	}
 	return tunnelWSConn, nil
 }
+
+// List of 30 diverse User-Agent strings from various browsers and platforms
+var userAgents = []string{
+	// Chrome
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/114.0.0.0 Safari/537.36",
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 11_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/113.0.0.0 Safari/537.36",
+	"Mozilla/5.0 (Linux; Android 12; Pixel 5) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/115.0.0.0 Mobile Safari/537.36",
+	"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/113.0.0.0 Safari/537.36",
+	"Mozilla/5.0 (Linux; Android 9; SM-G960F) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/108.0.5359.128 Mobile Safari/537.36",
+	// Firefox
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:114.0) Gecko/20100101 Firefox/114.0",
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:102.0) Gecko/20100101 Firefox/102.0",
+	"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:115.0) Gecko/20100101 Firefox/115.0",
+	"Mozilla/5.0 (Linux; Android 10; Pixel 4 XL) Gecko/20100101 Firefox/96.0",
+	"Mozilla/5.0 (iPhone; CPU iPhone OS 14_6 like Mac OS X) Gecko/20100101 Firefox/90.0",
+	// Safari
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 11_4_1) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.0 Safari/605.1.15",
+	"Mozilla/5.0 (iPhone; CPU iPhone OS 15_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.1 Mobile/15E148 Safari/604.1",
+	"Mozilla/5.0 (iPad; CPU OS 14_7 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.0 Mobile/15E148 Safari/604.1",
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_14_6) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.1.2 Safari/605.1.15",
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36",
+	// Edge
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36 Edg/91.0.864.64",
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/95.0.4638.69 Safari/537.36 Edg/95.0.1020.40",
+	"Mozilla/5.0 (Linux; Android 11; SM-G998U) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/90.0.4430.210 Mobile Safari/537.36 EdgA/46.3.4.5155",
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/111.0.0.0 Safari/537.36 Edg/111.0.1661.44",
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/115.0.0.0 Safari/537.36 Edg/115.0.1901.183",
+	// Opera
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/112.0.0.0 Safari/537.36 OPR/97.0.4719.63",
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/114.0.0.0 Safari/537.36 OPR/98.0.4759.15",
+	"Mozilla/5.0 (Linux; Android 10; SM-N975F) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/113.0.0.0 Mobile Safari/537.36 OPR/65.2.3381.61420",
+	"Mozilla/5.0 (Linux; Android 11; SM-G998U) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/114.0.5735.196 Mobile Safari/537.36 OPR/71.2.3767.68577",
+	"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/116.0.0.0 Safari/537.36 OPR/99.0.4759.21",
+	// Older Browsers
+	"Mozilla/4.0 (compatible; MSIE 9.0; Windows NT 6.1; Trident/5.0)",
+	"Mozilla/4.0 (compatible; MSIE 6.0; Windows NT 5.1; SV1)",
+	"Mozilla/5.0 (Windows NT 6.1; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/89.0.4389.82 Safari/537.36",
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_12_6) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/87.0.4280.88 Safari/537.36",
+}
+
+// randomUserAgent picks a User-Agent for the http based transports
+func randomUserAgent() string {
+	return userAgents[rand.Intn(len(userAgents))]
+}
@@ -0,0 +1,496 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/musix/backhaul/internal/config"
+	"github.com/musix/backhaul/internal/utils"
+	"github.com/musix/backhaul/internal/web"
+
+	"github.com/sirupsen/logrus"
+)
+
+type SplitHTTPTransport struct {
+	config          *SplitHTTPConfig
+	parentctx       context.Context
+	ctx             context.Context
+	cancel          context.CancelFunc
+	logger          *logrus.Logger
+	controlChannel  *utils.H2Conn
+	httpTransport   *http.Transport // carries the downloads and uploads of every session
+	restartMutex    sync.Mutex
+	usageMonitor    *web.Usage
+	poolConnections int32
+	loadConnections int32
+	controlFlow     chan struct{}
+}
+type SplitHTTPConfig struct {
+	RemoteAddr      string
+	Token           string
+	SnifferLog      string
+	TunnelStatus    web.TunnelStatus
+	Nodelay         bool
+	Sniffer         bool
+	KeepAlive       time.Duration
+	HalfCloseLinger time.Duration
+	RetryInterval   time.Duration
+	DialTimeOut     time.Duration
+	ConnPoolSize    int
+	WebPort         int
+	Mode            config.TransportType // splithttp or splithttps
+	AggressivePool  bool
+	Remotes         *RemoteSelector
+	Backends        *BackendRegistry
+	Dial            *DialOptions // egress of the tunnel connections
+	TLS             *TLSOptions  // verification of the server certificate in the tls modes
+	EdgeIP          string
+	PacketSize      int // max size of an upload POST
+	Concurrency     int // uploads of a session in flight at the same time
+}
+
+func NewSplitHTTPClient(parentCtx context.Context, config *SplitHTTPConfig, logger *logrus.Logger) *SplitHTTPTransport {
+	// Create a derived context from the parent context
+	ctx, cancel := context.WithCancel(parentCtx)
+
+	// Initialize the SplitHTTPTransport struct
+	client := &SplitHTTPTransport{
+		config:          config,
+		parentctx:       parentCtx,
+		ctx:             ctx,
+		cancel:          cancel,
+		logger:          logger,
+		controlChannel:  nil, // will be set when a control connection is established
+		usageMonitor:    web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
+		poolConnections: 0,
+		loadConnections: 0,
+		controlFlow:     make(chan struct{}, 100),
+	}
+
+	return client
+}
+
+func (c *SplitHTTPTransport) Start() {
+	// for  webui
+	if c.config.WebPort > 0 {
+		go c.usageMonitor.Monitor()
+	}
+
+	c.config.TunnelStatus.Set(fmt.Sprintf("Disconnected (%s)", c.config.Mode))
+
+	go c.channelDialer()
+	go c.config.Remotes.Failback(c.ctx, HandshakeProbe(c.config.Mode, c.config.DialTimeOut, c.config.Dial, c.config.TLS, c.config.EdgeIP), c.Restart)
+
+}
+func (c *SplitHTTPTransport) Restart() {
+	if !c.restartMutex.TryLock() {
+		c.logger.Warn("client is already restarting")
+		return
+	}
+	defer c.restartMutex.Unlock()
+
+	c.logger.Info("restarting client...")
+
+	// for removing timeout logs
+	level := c.logger.Level
+	c.logger.SetLevel(logrus.FatalLevel)
+
+	if c.cancel != nil {
+		c.cancel()
+	}
+
+	// close control channel connection
+	if c.controlChannel != nil {
+		c.controlChannel.Close()
+	}
+
+	time.Sleep(2 * time.Second)
+
+	// the sessions are gone with the context, drop the idle connections as well
+	if c.httpTransport != nil {
+		c.httpTransport.CloseIdleConnections()
+	}
+
+	ctx, cancel := context.WithCancel(c.parentctx)
+	c.ctx = ctx
+	c.cancel = cancel
+
+	// Re-initialize variables
+	c.controlChannel = nil
+	c.httpTransport = nil
+	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger)
+	c.config.TunnelStatus.Set("")
+	c.poolConnections = 0
+	c.loadConnections = 0
+	c.controlFlow = make(chan struct{}, 100)
+
+	// set the log level again
+	c.logger.SetLevel(level)
+
+	go c.Start()
+}
+
+func (c *SplitHTTPTransport) channelDialer() {
+	c.logger.Info("attempting to establish a new split http control channel connection")
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		default:
+			// pick the remote selected by the failover logic
+			c.config.RemoteAddr = c.config.Remotes.Current()
+			if c.httpTransport != nil {
+				c.httpTransport.CloseIdleConnections()
+			}
+			c.httpTransport = c.newHTTPTransport(c.config.RemoteAddr)
+
+			tunnelConn, err := c.openSession("channel")
+			if err != nil {
+				c.logger.Errorf("control channel dialer: %v", err)
+				c.config.Remotes.ReportFailure(c.config.RemoteAddr)
+				time.Sleep(c.config.RetryInterval)
+				continue
+			}
+			c.controlChannel = tunnelConn
+			c.config.Remotes.ReportSuccess(c.config.RemoteAddr)
+			c.logger.Info("control channel established successfully")
+
+			c.config.TunnelStatus.Set(fmt.Sprintf("Connected (%s)", c.config.Mode))
+
+			go c.poolMaintainer()
+			go c.channelHandler()
+
+			return
+		}
+	}
+}
+
+func (c *SplitHTTPTransport) poolMaintainer() {
+	for i := 0; i < c.config.ConnPoolSize; i++ { //initial pool filling
+		go c.tunnelDialer()
+	}
+
+	// factors
+	a := 4
+	b := 5
+	x := 3
+	y := 4.0
+
+	if c.config.AggressivePool {
+		c.logger.Info("aggressive pool management enabled")
+		a = 1
+		b = 2
+		x = 0
+		y = 0.75
+	}
+
+	tickerPool := time.NewTicker(time.Second * 1)
+	defer tickerPool.Stop()
+
+	tickerLoad := time.NewTicker(time.Second * 10)
+	defer tickerLoad.Stop()
+
+	newPoolSize := c.config.ConnPoolSize // intial value
+	var poolConnectionsSum int32 = 0
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+
+		case <-tickerPool.C:
+			// Accumulate pool connections over time (every second)
+			atomic.AddInt32(&poolConnectionsSum, atomic.LoadInt32(&c.poolConnections))
+
+		case <-tickerLoad.C:
+			// Calculate the loadConnections over the last 10 seconds
+			loadConnections := (int(atomic.LoadInt32(&c.loadConnections)) + 9) / 10 // +9 for ceil-like logic
+			atomic.StoreInt32(&c.loadConnections, 0)                                // Reset
+
+			// Calculate the average pool connections over the last 10 seconds
+			poolConnectionsAvg := (int(atomic.LoadInt32(&poolConnectionsSum)) + 9) / 10 // +9 for ceil-like logic
+			atomic.StoreInt32(&poolConnectionsSum, 0)                                   // Reset
+
+			// Dynamically adjust the pool size based on current connections
+			if (loadConnections + a) > poolConnectionsAvg*b {
+				c.logger.Debugf("increasing pool size: %d -> %d, avg pool conn: %d, avg load conn: %d", newPoolSize, newPoolSize+1, poolConnectionsAvg, loadConnections)
+				newPoolSize++
+
+				// Add a new connection to the pool
+				go c.tunnelDialer()
+			} else if float64(loadConnections+x) < float64(poolConnectionsAvg)*y && newPoolSize > c.config.ConnPoolSize {
+				c.logger.Debugf("decreasing pool size: %d -> %d, avg pool conn: %d, avg load conn: %d", newPoolSize, newPoolSize-1, poolConnectionsAvg, loadConnections)
+				newPoolSize--
+
+				// send a signal to controlFlow
+				c.controlFlow <- struct{}{}
+			}
+		}
+	}
+
+}
+
+func (c *SplitHTTPTransport) channelHandler() {
+	msgChan := make(chan byte, 1000)
+
+	// Goroutine to handle the blocking ReceiveBinaryString
+	go func() {
+		for {
+			select {
+			case <-c.ctx.Done():
+				return
+
+			default:
+				msg, err := utils.ReceiveBinaryByte(c.controlChannel)
+				if err != nil {
+					if c.cancel != nil {
+						c.logger.Error("failed to read from channel connection. ", err)
+						go c.Restart()
+					}
+					return
+				}
+
+				msgChan <- msg
+			}
+		}
+	}()
+
+	// Main loop to listen for context cancellation or received messages
+	for {
+		select {
+		case <-c.ctx.Done():
+			_ = utils.SendBinaryByte(c.controlChannel, utils.SG_Closed)
+			return
+
+		case msg := <-msgChan:
+			switch msg {
+			case utils.SG_Chan:
+				atomic.AddInt32(&c.loadConnections, 1)
+				select {
+				case <-c.controlFlow: // Do nothing
+
+				default:
+					c.logger.Debug("channel signal received, initiating tunnel dialer")
+					go c.tunnelDialer()
+				}
+
+			case utils.SG_HB:
+				c.logger.Debug("heartbeat signal received successfully")
+				// send heartbeat back
+				err := utils.SendBinaryByte(c.controlChannel, utils.SG_HB)
+				if err != nil {
+					c.logger.Errorf("failed to send heartbeat: %v", msg)
+					go c.Restart()
+					return
+				}
+				c.logger.Trace("heartbeat signal sent successfully")
+
+			case utils.SG_Closed:
+				c.logger.Warn("control channel has been closed by the server")
+				go c.Restart()
+				return
+
+			default:
+				c.logger.Errorf("unexpected response from channel: %v", msg)
+				go c.Restart()
+				return
+			}
+		}
+	}
+}
+
+func (c *SplitHTTPTransport) tunnelDialer() {
+	c.logger.Debugf("initiating new split http tunnel session to address %s", c.config.RemoteAddr)
+
+	// Open a new session to the tunnel server
+	tunnelConn, err := c.openSession("tunnel")
+	if err != nil {
+		c.logger.Errorf("tunnel server dialer: %v", err)
+
+		return
+	}
+
+	// Increment active connections counter
+	atomic.AddInt32(&c.poolConnections, 1)
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			tunnelConn.Close()
+			return
+		default:
+			signal, err := utils.ReceiveBinaryByte(tunnelConn)
+			if err != nil {
+				c.logger.Debugf("unable to get port from split http session %s: %v", tunnelConn.RemoteAddr().String(), err)
+				tunnelConn.Close()
+
+				// Decrement active connections on failure
+				atomic.AddInt32(&c.poolConnections, -1)
+
+				return
+			}
+
+			if signal == utils.SG_Ping {
+				c.logger.Trace("ping received from the server")
+				continue
+			}
+
+			// Decrement active connections
+			atomic.AddInt32(&c.poolConnections, -1)
+
+			if signal != utils.SG_TCP {
+				c.logger.Error("undefined transport. close the connection.")
+				tunnelConn.Close()
+				return
+			}
+
+			remoteAddr, err := utils.ReceiveBinaryString(tunnelConn)
+			if err != nil {
+				c.logger.Debugf("unable to get port from split http session %s: %v", tunnelConn.RemoteAddr().String(), err)
+				tunnelConn.Close()
+				return
+			}
+
+			c.localDialer(tunnelConn, remoteAddr)
+			return
+		}
+	}
+}
+
+func (c *SplitHTTPTransport) localDialer(tunnelConn *utils.H2Conn, remoteAddr string) {
+	localConn, port, release, err := c.config.Backends.DialTCP(remoteAddr, func(addr string, opts *DialOptions) (*net.TCPConn, error) {
+		return TcpDialer(c.ctx, addr, c.config.DialTimeOut, c.config.KeepAlive, true, 1, 32*1024, 32*1024, opts)
+	})
+	if err != nil {
+		c.logger.Errorf("local dialer: %v", err)
+		tunnelConn.Close()
+		return
+	}
+	defer release()
+	c.logger.Debugf("connected to local address %s successfully", remoteAddr)
+
+	utils.TCPConnectionHandler(tunnelConn, localConn, c.logger, c.usageMonitor, int(port), c.config.Sniffer, c.config.HalfCloseLinger)
+}
+
+// newHTTPTransport returns the http client of a remote, the downloads keep a connection each
+// and the uploads share the idle ones
+func (c *SplitHTTPTransport) newHTTPTransport(addr string) *http.Transport {
+	// Handle edgeIP assignment, the remote address is still used as the host
+	dialAddr := addr
+	if c.config.EdgeIP != "" {
+		if _, port, err := net.SplitHostPort(addr); err == nil {
+			dialAddr = net.JoinHostPort(c.config.EdgeIP, port)
+		}
+	}
+
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return TcpDialer(ctx, dialAddr, c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, 3, 32*1024, 32*1024, c.config.Dial)
+		},
+		TLSClientConfig: c.config.TLS.Config(addr), // verified as set by the tls client options
+		// HTTP/1.1 only, every proxy passes it
+		TLSNextProto:        map[string]func(string, *tls.Conn) http.RoundTripper{},
+		MaxIdleConnsPerHost: c.config.Concurrency * 4,
+		IdleConnTimeout:     90 * time.Second,
+		DisableCompression:  true,
+	}
+}
+
+// openSession starts the streaming download of a new session and returns it with the uploads as a connection
+func (c *SplitHTTPTransport) openSession(kind string) (*utils.H2Conn, error) {
+	scheme := "http"
+	if c.config.Mode == config.SPLITHTTPS {
+		scheme = "https"
+	}
+	url := fmt.Sprintf("%s://%s/%s/%016x%016x", scheme, c.config.RemoteAddr, kind, rand.Uint64(), rand.Uint64())
+	userAgent := randomUserAgent()
+
+	ctx, cancel := context.WithCancel(c.ctx)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %v", c.config.Token))
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Cache-Control", "no-cache")
+
+	// keep the addresses of the connection the download is opened on
+	var localAddr, remoteAddr net.Addr
+	req = req.WithContext(httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			localAddr = info.Conn.LocalAddr()
+			remoteAddr = info.Conn.RemoteAddr()
+		},
+	}))
+
+	// the server answers once it accepted the session
+	timer := time.AfterFunc(c.config.DialTimeOut, cancel)
+	resp, err := c.httpTransport.RoundTrip(req)
+	if !timer.Stop() && err == nil {
+		resp.Body.Close()
+		err = fmt.Errorf("timeout while waiting for the session to be accepted")
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("unexpected response from the server: %s", resp.Status)
+	}
+
+	post := func(seq uint64, data []byte) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/%d", url, seq), bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %v", c.config.Token))
+		req.Header.Set("User-Agent", userAgent)
+		req.Header.Set("Content-Type", "application/octet-stream")
+
+		resp, err := c.httpTransport.RoundTrip(req)
+		if err != nil {
+			return err
+		}
+		// drain the body so the connection is reused by the next uploads
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected response to upload %d: %s", seq, resp.Status)
+		}
+		return nil
+	}
+	uploader := utils.NewSplitUploader(c.config.PacketSize, c.config.Concurrency, post)
+
+	// the last uploads are sent before the end of the download closes the session on the server
+	download := &sessionDownload{ReadCloser: resp.Body, uploader: uploader}
+
+	return utils.NewH2Conn(download, uploader, nil, cancel, localAddr, remoteAddr), nil
+}
+
+// sessionDownload is the download of a session, closing it sends the rest of the uploads first
+type sessionDownload struct {
+	io.ReadCloser
+	uploader *utils.SplitUploader
+}
+
+func (d *sessionDownload) Close() error {
+	d.uploader.Close()
+	return d.ReadCloser.Close()
+}
@@ -8,6 +8,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/musix/backhaul/internal/config"
 	"github.com/musix/backhaul/internal/utils"
 	"github.com/musix/backhaul/internal/web"
 
@@ -28,18 +29,23 @@ type TcpTransport struct {
 	controlFlow     chan struct{}
 }
 type TcpConfig struct {
-	RemoteAddr     string
-	Token          string
-	SnifferLog     string
-	TunnelStatus   string
-	KeepAlive      time.Duration
-	RetryInterval  time.Duration
-	DialTimeOut    time.Duration
-	ConnPoolSize   int
-	WebPort        int
-	Nodelay        bool
-	Sniffer        bool
-	AggressivePool bool
+	RemoteAddr      string
+	Token           string
+	SnifferLog      string
+	TunnelStatus    web.TunnelStatus
+	KeepAlive       time.Duration
+	HalfCloseLinger time.Duration
+	RetryInterval   time.Duration
+	DialTimeOut     time.Duration
+	ConnPoolSize    int
+	WebPort         int
+	Nodelay         bool
+	Sniffer         bool
+	AggressivePool  bool
+	Remotes         *RemoteSelector
+	Backends        *BackendRegistry
+	Dial            *DialOptions // egress of the tunnel connections
+	TLS             *TLSOptions  // wraps the tunnel connections in TLS, nil for plain tcp
 }
 
 func NewTCPClient(parentCtx context.Context, config *TcpConfig, logger *logrus.Logger) *TcpTransport {
@@ -68,9 +74,16 @@ func (c *TcpTransport) Start() {
 		go c.usageMonitor.Monitor()
 	}
 
-	c.config.TunnelStatus = "Disconnected (TCP)"
+	c.config.TunnelStatus.Set("Disconnected (TCP)")
 
 	go c.channelDialer()
+
+	// the tls mode is probed with the tls handshake of the client
+	mode := config.TCP
+	if c.config.TLS != nil {
+		mode = config.TCPTLS
+	}
+	go c.config.Remotes.Failback(c.ctx, HandshakeProbe(mode, c.config.DialTimeOut, c.config.Dial, c.config.TLS, ""), c.Restart)
 }
 func (c *TcpTransport) Restart() {
 	if !c.restartMutex.TryLock() {
@@ -103,7 +116,7 @@ func (c *TcpTransport) Restart() {
 	// Re-initialize variables
 	c.controlChannel = nil
 	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger)
-	c.config.TunnelStatus = ""
+	c.config.TunnelStatus.Set("")
 	c.poolConnections = 0
 	c.loadConnections = 0
 	c.controlFlow = make(chan struct{}, 100)
@@ -123,9 +136,21 @@ func (c *TcpTransport) channelDialer() {
 			return
 		default:
 			//set default behaviour of control channel to nodelay, also using default buffer parameters
-			tunnelTCPConn, err := TcpDialer(c.ctx, c.config.RemoteAddr, c.config.DialTimeOut, c.config.KeepAlive, true, 3, 0, 0)
+			// pick the remote selected by the failover logic
+			c.config.RemoteAddr = c.config.Remotes.Current()
+			tcpConn, err := TcpDialer(c.ctx, c.config.RemoteAddr, c.config.DialTimeOut, c.config.KeepAlive, true, 3, 0, 0, c.config.Dial)
 			if err != nil {
 				c.logger.Errorf("channel dialer: %v", err)
+				c.config.Remotes.ReportFailure(c.config.RemoteAddr)
+				time.Sleep(c.config.RetryInterval)
+				continue
+			}
+
+			// the token is sent after the TLS handshake in tcptls mode
+			tunnelTCPConn, err := tlsClient(tcpConn, c.config.TLS, c.config.RemoteAddr, c.config.DialTimeOut)
+			if err != nil {
+				c.logger.Errorf("channel dialer: %v", err)
+				c.config.Remotes.ReportFailure(c.config.RemoteAddr)
 				time.Sleep(c.config.RetryInterval)
 				continue
 			}
@@ -154,6 +179,7 @@ func (c *TcpTransport) channelDialer() {
 					c.logger.Errorf("failed to receive control channel response: %v", err)
 				}
 				tunnelTCPConn.Close() // Close connection on error or timeout
+				c.config.Remotes.ReportFailure(c.config.RemoteAddr)
 				time.Sleep(c.config.RetryInterval)
 				continue
 			}
@@ -162,9 +188,10 @@ func (c *TcpTransport) channelDialer() {
 
 			if message == c.config.Token {
 				c.controlChannel = tunnelTCPConn
+				c.config.Remotes.ReportSuccess(c.config.RemoteAddr)
 				c.logger.Info("control channel established successfully")
 
-				c.config.TunnelStatus = "Connected (TCP)"
+				c.config.TunnelStatus.Set("Connected (TCP)")
 				go c.poolMaintainer()
 				go c.channelHandler()
 
@@ -173,6 +200,7 @@ func (c *TcpTransport) channelDialer() {
 			} else {
 				c.logger.Errorf("invalid token received. Expected: %s, Received: %s. Retrying...", c.config.Token, message)
 				tunnelTCPConn.Close() // Close connection if the token is invalid
+				c.config.Remotes.ReportFailure(c.config.RemoteAddr)
 				time.Sleep(c.config.RetryInterval)
 				continue
 			}
@@ -320,7 +348,15 @@ func (c *TcpTransport) tunnelDialer() {
 	// Dial to the tunnel server
 	// Based on calculations 1MB of buffer on 80ms RTT will have about 100Mbit Bandwidth per connection,
 	// this is enough to get 800Mbit/s on speedtest and also not having too much buffer to bufferbloat
-	tcpConn, err := TcpDialer(c.ctx, c.config.RemoteAddr, c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, 3, 1024*1024, 1024*1024)
+	conn, err := TcpDialer(c.ctx, c.config.RemoteAddr, c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, 3, 1024*1024, 1024*1024, c.config.Dial)
+	if err != nil {
+		c.logger.Error("tunnel server dialer: ", err)
+
+		return
+	}
+
+	// pooled connections complete the TLS handshake before they wait for the server
+	tcpConn, err := tlsClient(conn, c.config.TLS, c.config.RemoteAddr, c.config.DialTimeOut)
 	if err != nil {
 		c.logger.Error("tunnel server dialer: ", err)
 
@@ -342,21 +378,21 @@ func (c *TcpTransport) tunnelDialer() {
 		return
 	}
 
-	// Extract the port from the received address
-	port, resolvedAddr, err := ResolveRemoteAddr(remoteAddr)
-	if err != nil {
-		c.logger.Infof("failed to resolve remote port: %v", err)
-		tcpConn.Close() // Close the connection on error
-		return
-	}
-
 	switch transport {
 	case utils.SG_TCP:
 		// Dial local server using the received address
-		c.localDialer(tcpConn, resolvedAddr, port)
+		c.localDialer(tcpConn, remoteAddr)
 
 	case utils.SG_UDP:
-		UDPDialer(tcpConn, resolvedAddr, c.logger, c.usageMonitor, port, c.config.Sniffer)
+		// Extract the port from the received address
+		port, resolvedAddr, opts, err := c.config.Backends.Resolve(remoteAddr)
+		if err != nil {
+			c.logger.Infof("failed to resolve remote port: %v", err)
+			tcpConn.Close() // Close the connection on error
+			return
+		}
+
+		UDPDialer(tcpConn, resolvedAddr, opts, c.logger, c.usageMonitor, port, c.config.Sniffer)
 
 	default:
 		c.logger.Error("undefined transport. close the connection.")
@@ -364,16 +400,19 @@ func (c *TcpTransport) tunnelDialer() {
 	}
 }
 
-func (c *TcpTransport) localDialer(tcpConn net.Conn, remoteAddr string, port int) {
+func (c *TcpTransport) localDialer(tcpConn net.Conn, remoteAddr string) {
 	// Set Default S,R buffer to 32kb also enabling nodelay on send side of local network ( receive side should be handled by xray)
-	localConnection, err := TcpDialer(c.ctx, remoteAddr, c.config.DialTimeOut, c.config.KeepAlive, true, 1, 32*1024, 32*1024)
+	localConnection, port, release, err := c.config.Backends.DialTCP(remoteAddr, func(addr string, opts *DialOptions) (*net.TCPConn, error) {
+		return TcpDialer(c.ctx, addr, c.config.DialTimeOut, c.config.KeepAlive, true, 1, 32*1024, 32*1024, opts)
+	})
 	if err != nil {
 		c.logger.Errorf("local dialer: %v", err)
 		tcpConn.Close()
 		return
 	}
+	defer release()
 
 	c.logger.Debugf("connected to local address %s successfully", remoteAddr)
 
-	utils.TCPConnectionHandler(tcpConn, localConnection, c.logger, c.usageMonitor, port, c.config.Sniffer)
+	utils.TCPConnectionHandler(tcpConn, localConnection, c.logger, c.usageMonitor, port, c.config.Sniffer, c.config.HalfCloseLinger)
 }
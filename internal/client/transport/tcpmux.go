@@ -8,6 +8,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/musix/backhaul/internal/config"
 	"github.com/musix/backhaul/internal/utils"
 	"github.com/musix/backhaul/internal/web"
 
@@ -28,16 +29,18 @@ type TcpMuxTransport struct {
 	poolConnections int32
 	loadConnections int32
 	controlFlow     chan struct{}
+	paths           *pathSelector
 }
 
 type TcpMuxConfig struct {
 	RemoteAddr       string
 	Token            string
 	SnifferLog       string
-	TunnelStatus     string
+	TunnelStatus     web.TunnelStatus
 	Nodelay          bool
 	Sniffer          bool
 	KeepAlive        time.Duration
+	HalfCloseLinger  time.Duration
 	RetryInterval    time.Duration
 	DialTimeOut      time.Duration
 	MuxVersion       int
@@ -47,6 +50,11 @@ type TcpMuxConfig struct {
 	ConnPoolSize     int
 	WebPort          int
 	AggressivePool   bool
+	Remotes          *RemoteSelector
+	Backends         *BackendRegistry
+	Dial             *DialOptions // egress of the tunnel connections
+	Paths            []string     // uplinks the tunnel connections are bonded over, source addresses or interfaces
+	TLS              *TLSOptions  // wraps the tunnel connections in TLS, nil for plain tcpmux
 }
 
 func NewMuxClient(parentCtx context.Context, config *TcpMuxConfig, logger *logrus.Logger) *TcpMuxTransport {
@@ -73,6 +81,7 @@ func NewMuxClient(parentCtx context.Context, config *TcpMuxConfig, logger *logru
 		poolConnections: 0,
 		loadConnections: 0,
 		controlFlow:     make(chan struct{}, 100),
+		paths:           newPathSelector(config.Paths),
 	}
 
 	return client
@@ -83,9 +92,16 @@ func (c *TcpMuxTransport) Start() {
 		go c.usageMonitor.Monitor()
 	}
 
-	c.config.TunnelStatus = "Disconnected (TCPMUX)"
+	c.config.TunnelStatus.Set("Disconnected (TCPMUX)")
 
 	go c.channelDialer()
+
+	// the tls mode is probed with the tls handshake of the client
+	mode := config.TCPMUX
+	if c.config.TLS != nil {
+		mode = config.TCPMUXTLS
+	}
+	go c.config.Remotes.Failback(c.ctx, HandshakeProbe(mode, c.config.DialTimeOut, c.config.Dial, c.config.TLS, ""), c.Restart)
 }
 
 func (c *TcpMuxTransport) Restart() {
@@ -119,7 +135,7 @@ func (c *TcpMuxTransport) Restart() {
 	// Re-initialize variables
 	c.controlChannel = nil
 	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger)
-	c.config.TunnelStatus = ""
+	c.config.TunnelStatus.Set("")
 	c.poolConnections = 0
 	c.loadConnections = 0
 	c.controlFlow = make(chan struct{}, 100)
@@ -139,9 +155,21 @@ func (c *TcpMuxTransport) channelDialer() {
 		case <-c.ctx.Done():
 			return
 		default:
-			tunnelConn, err := TcpDialer(c.ctx, c.config.RemoteAddr, c.config.DialTimeOut, c.config.KeepAlive, true, 3, 0, 0)
+			// pick the remote selected by the failover logic
+			c.config.RemoteAddr = c.config.Remotes.Current()
+			tcpConn, err := TcpDialer(c.ctx, c.config.RemoteAddr, c.config.DialTimeOut, c.config.KeepAlive, true, 3, 0, 0, c.config.Dial)
+			if err != nil {
+				c.logger.Errorf("channel dialer: %v", err)
+				c.config.Remotes.ReportFailure(c.config.RemoteAddr)
+				time.Sleep(c.config.RetryInterval)
+				continue
+			}
+
+			// the token is sent after the TLS handshake in tcpmuxtls mode
+			tunnelConn, err := tlsClient(tcpConn, c.config.TLS, c.config.RemoteAddr, c.config.DialTimeOut)
 			if err != nil {
 				c.logger.Errorf("channel dialer: %v", err)
+				c.config.Remotes.ReportFailure(c.config.RemoteAddr)
 				time.Sleep(c.config.RetryInterval)
 				continue
 			}
@@ -161,7 +189,7 @@ func (c *TcpMuxTransport) channelDialer() {
 				continue
 			}
 			// Receive response
-			message, _, err := utils.ReceiveBinaryTransportString(tunnelConn)
+			message, signal, err := utils.ReceiveBinaryTransportString(tunnelConn)
 			if err != nil {
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					c.logger.Warn("timeout while waiting for control channel response")
@@ -169,6 +197,7 @@ func (c *TcpMuxTransport) channelDialer() {
 					c.logger.Errorf("failed to receive control channel response: %v", err)
 				}
 				tunnelConn.Close() // Close connection on error or timeout
+				c.config.Remotes.ReportFailure(c.config.RemoteAddr)
 				time.Sleep(c.config.RetryInterval)
 				continue
 			}
@@ -176,10 +205,19 @@ func (c *TcpMuxTransport) channelDialer() {
 			tunnelConn.SetReadDeadline(time.Time{})
 
 			if message == c.config.Token {
+				// the server advertises the half-close framing with the signal of its answer
+				if signal == utils.SG_Framed && c.config.HalfCloseLinger > 0 {
+					if err := utils.SendBinaryByte(tunnelConn, utils.SG_Framed); err != nil {
+						c.logger.Errorf("failed to confirm the half-close framing: %v", err)
+						tunnelConn.Close()
+						continue
+					}
+				}
 				c.controlChannel = tunnelConn
+				c.config.Remotes.ReportSuccess(c.config.RemoteAddr)
 				c.logger.Info("control channel established successfully")
 
-				c.config.TunnelStatus = "Connected (TCPMux)"
+				c.config.TunnelStatus.Set("Connected (TCPMux)")
 
 				go c.poolMaintainer()
 				go c.channelHandler()
@@ -188,6 +226,7 @@ func (c *TcpMuxTransport) channelDialer() {
 			} else {
 				c.logger.Errorf("invalid token received. Expected: %s, Received: %s. Retrying...", c.config.Token, message)
 				tunnelConn.Close() // Close connection if the token is invalid
+				c.config.Remotes.ReportFailure(c.config.RemoteAddr)
 				time.Sleep(c.config.RetryInterval)
 				continue
 			}
@@ -325,15 +364,47 @@ func (c *TcpMuxTransport) channelHandler() {
 func (c *TcpMuxTransport) tunnelDialer() {
 	c.logger.Debugf("initiating new tunnel connection to address %s", c.config.RemoteAddr)
 
+	// in multipath mode every tunnel connection leaves through the next uplink
+	opts := c.config.Dial
+	var path string
+	if c.paths != nil {
+		path = c.paths.pick()
+		opts = pathOptions(c.config.Dial, path)
+	}
+
 	// Dial to the tunnel server
 	// in case of mux we set 2M which is good for 200mbit per connection
-	tunnelConn, err := TcpDialer(c.ctx, c.config.RemoteAddr, c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, 3, 2*1024*1024, 2*1024*1024)
+	tcpConn, err := TcpDialer(c.ctx, c.config.RemoteAddr, c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, 3, 2*1024*1024, 2*1024*1024, opts)
 	if err != nil {
 		c.logger.Errorf("tunnel server dialer: %v", err)
+		if c.paths != nil {
+			c.paths.reportFailure(path)
+		}
 
 		return
 	}
 
+	// the smux session starts after the TLS handshake in tcpmuxtls mode
+	tunnelConn, err := tlsClient(tcpConn, c.config.TLS, c.config.RemoteAddr, c.config.DialTimeOut)
+	if err != nil {
+		c.logger.Errorf("tunnel server dialer: %v", err)
+		if c.paths != nil {
+			c.paths.reportFailure(path)
+		}
+
+		return
+	}
+
+	// the server accepts paths from any address, so they are authenticated with the token
+	if c.paths != nil {
+		if err := utils.SendBinaryTransportString(tunnelConn, c.config.Token, utils.SG_Path); err != nil {
+			c.logger.Errorf("failed to send path token over %s: %v", path, err)
+			c.paths.reportFailure(path)
+			tunnelConn.Close()
+			return
+		}
+	}
+
 	// Increment active connections counter
 	atomic.AddInt32(&c.poolConnections, 1)
 
@@ -364,35 +435,52 @@ func (c *TcpMuxTransport) handleSession(tunnelConn net.Conn) {
 				return
 			}
 
-			remoteAddr, err := utils.ReceiveBinaryString(stream)
+			remoteAddr, transport, err := utils.ReceiveBinaryTransportString(stream)
 			if err != nil {
 				c.logger.Errorf("unable to get port from stream connection %s: %v", tunnelConn.RemoteAddr().String(), err)
 				stream.Close()
 				continue
 			}
 
-			go c.localDialer(stream, remoteAddr)
+			switch transport {
+			case utils.SG_TCP:
+				// the server marks the streams it frames
+				remoteAddr, framed := utils.ParseHalfCloseMark(remoteAddr)
+				go c.localDialer(stream, remoteAddr, framed)
+
+			case utils.SG_UDP:
+				// a UDP client of accept_udp, the packets are framed on the stream
+				port, resolvedAddr, opts, err := c.config.Backends.Resolve(remoteAddr)
+				if err != nil {
+					c.logger.Infof("failed to resolve remote port: %v", err)
+					stream.Close()
+					continue
+				}
+
+				go UDPDialer(stream, resolvedAddr, opts, c.logger, c.usageMonitor, port, c.config.Sniffer)
+
+			default:
+				c.logger.Error("undefined transport. close the stream.")
+				stream.Close()
+			}
 		}
 	}
 }
 
-func (c *TcpMuxTransport) localDialer(stream *smux.Stream, remoteAddr string) {
-	// Extract the port from the received address
-	port, resolvedAddr, err := ResolveRemoteAddr(remoteAddr)
-	if err != nil {
-		c.logger.Infof("failed to resolve remote port: %v", err)
-		stream.Close()
-		return
-	}
-
-	localConnection, err := TcpDialer(c.ctx, resolvedAddr, c.config.DialTimeOut, c.config.KeepAlive, true, 1, 32*1024, 32*1024)
+func (c *TcpMuxTransport) localDialer(stream *smux.Stream, remoteAddr string, framed bool) {
+	localConnection, port, release, err := c.config.Backends.DialTCP(remoteAddr, func(addr string, opts *DialOptions) (*net.TCPConn, error) {
+		return TcpDialer(c.ctx, addr, c.config.DialTimeOut, c.config.KeepAlive, true, 1, 32*1024, 32*1024, opts)
+	})
 	if err != nil {
 		c.logger.Errorf("local dialer: %v", err)
 		stream.Close()
 		return
 	}
+	defer release()
 
 	c.logger.Debugf("connected to local address %s successfully", remoteAddr)
 
-	utils.TCPConnectionHandler(stream, localConnection, c.logger, c.usageMonitor, int(port), c.config.Sniffer)
+	// the data is framed so that the stream can be half-closed, when both ends support it
+	conn, linger := utils.MuxStreamConn(stream, framed, c.config.HalfCloseLinger)
+	utils.TCPConnectionHandler(conn, localConnection, c.logger, c.usageMonitor, int(port), c.config.Sniffer, linger)
 }
@@ -0,0 +1,131 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// TLSOptions are the client settings of the TLS transports. The server certificate is verified
+// against RootCAs, or the system roots when nil. Pins replace that verification, so self-signed
+// certificates can be pinned, and Insecure turns any verification off.
+type TLSOptions struct {
+	ServerName string           // SNI and expected server name, the host of the remote address when empty
+	Pins       [][]byte         // SHA-256 of the SubjectPublicKeyInfo of accepted server certificates
+	RootCAs    *x509.CertPool   // CA bundle the server certificate is verified against
+	Insecure   bool             // accept whatever certificate is presented
+	ClientCert *tls.Certificate // presented to servers requiring mutual TLS
+}
+
+// LoadCAFile reads a PEM bundle of the certificate authorities to trust
+func LoadCAFile(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// ParsePin decodes a SHA-256 SPKI pin given as hex or base64, optionally prefixed by "sha256/"
+func ParsePin(pin string) ([]byte, error) {
+	pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+
+	if b, err := hex.DecodeString(strings.ReplaceAll(pin, ":", "")); err == nil && len(b) == sha256.Size {
+		return b, nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(pin); err == nil && len(b) == sha256.Size {
+		return b, nil
+	}
+	return nil, fmt.Errorf("invalid sha256 pin: %s", pin)
+}
+
+// SPKIPin returns the SHA-256 pin of a certificate
+func SPKIPin(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return sum[:]
+}
+
+// Config returns the TLS configuration used to dial addr, nil options verify the server
+// certificate against the system roots
+func (o *TLSOptions) Config(addr string) *tls.Config {
+	if o == nil {
+		o = &TLSOptions{}
+	}
+
+	serverName := o.ServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		serverName = host
+	}
+
+	config := &tls.Config{
+		ServerName: serverName,
+		RootCAs:    o.RootCAs,
+	}
+	if o.ClientCert != nil {
+		config.Certificates = []tls.Certificate{*o.ClientCert}
+	}
+
+	if o.Insecure && len(o.Pins) == 0 {
+		config.InsecureSkipVerify = true // explicitly requested, skip server certificate verification
+	}
+
+	if len(o.Pins) > 0 {
+		config.InsecureSkipVerify = true // the pins are checked instead of the certificate chain
+		pins := o.Pins
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("no server certificate presented")
+			}
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return fmt.Errorf("failed to parse server certificate: %w", err)
+			}
+
+			pin := SPKIPin(cert)
+			for _, expected := range pins {
+				if bytes.Equal(pin, expected) {
+					return nil
+				}
+			}
+			return fmt.Errorf("server certificate does not match any pin, got sha256/%s", base64.StdEncoding.EncodeToString(pin))
+		}
+	}
+
+	return config
+}
+
+// tlsClient wraps a tunnel connection in TLS and completes the handshake, the connection is
+// returned as it is when opts is nil
+func tlsClient(conn *net.TCPConn, opts *TLSOptions, addr string, timeout time.Duration) (net.Conn, error) {
+	if opts == nil { // plain tcp
+		return conn, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	tlsConn := tls.Client(conn, opts.Config(addr))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("tls handshake with %s failed: %w", addr, err)
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,95 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParsePin(t *testing.T) {
+	sum := sha256.Sum256([]byte("backhaul"))
+	pin := sum[:]
+
+	colons := make([]string, len(pin))
+	for i, b := range pin {
+		colons[i] = hex.EncodeToString([]byte{b})
+	}
+
+	for _, c := range []struct {
+		name  string
+		pin   string
+		valid bool
+	}{
+		{"hex", hex.EncodeToString(pin), true},
+		{"upper case hex", strings.ToUpper(hex.EncodeToString(pin)), true},
+		{"hex with colons", strings.Join(colons, ":"), true},
+		{"base64", base64.StdEncoding.EncodeToString(pin), true},
+		{"prefixed base64", "sha256/" + base64.StdEncoding.EncodeToString(pin), true},
+		{"surrounding spaces", " " + hex.EncodeToString(pin) + "\n", true},
+		{"short hex", hex.EncodeToString(pin[:16]), false},
+		{"short base64", base64.StdEncoding.EncodeToString(pin[:16]), false},
+		{"not a pin", "backhaul", false},
+	} {
+		parsed, err := ParsePin(c.pin)
+		if (err == nil) != c.valid {
+			t.Errorf("%s: parsed with %v, expected valid %v", c.name, err, c.valid)
+			continue
+		}
+		if c.valid && !bytes.Equal(parsed, pin) {
+			t.Errorf("%s: parsed as %x", c.name, parsed)
+		}
+	}
+}
+
+func TestTLSOptionsConfig(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Config.ErrorLog = log.New(io.Discard, "", 0) // the refused handshakes
+	server.StartTLS()
+	defer server.Close()
+	addr := server.Listener.Addr().String()
+
+	// the test certificate is valid for 127.0.0.1 and example.com
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	pin := SPKIPin(server.Certificate())
+	otherPin := make([]byte, sha256.Size)
+
+	for _, c := range []struct {
+		name     string
+		opts     *TLSOptions
+		verified bool
+	}{
+		{"system roots", nil, false},
+		{"ca bundle", &TLSOptions{RootCAs: roots}, true},
+		{"server name", &TLSOptions{RootCAs: roots, ServerName: "example.com"}, true},
+		{"wrong server name", &TLSOptions{RootCAs: roots, ServerName: "tunnel.example.org"}, false},
+		{"pin", &TLSOptions{Pins: [][]byte{pin}}, true},
+		{"one of the pins", &TLSOptions{Pins: [][]byte{otherPin, pin}}, true},
+		{"wrong pin", &TLSOptions{Pins: [][]byte{otherPin}}, false},
+		{"pin of another name", &TLSOptions{Pins: [][]byte{pin}, ServerName: "tunnel.example.org"}, true}, // the pin replaces the chain and name checks
+		{"wrong pin with a valid chain", &TLSOptions{Pins: [][]byte{otherPin}, RootCAs: roots}, false},
+		{"insecure", &TLSOptions{Insecure: true}, true},
+		{"pin checked when insecure", &TLSOptions{Insecure: true, Pins: [][]byte{otherPin}}, false},
+	} {
+		conn, err := tls.Dial("tcp", addr, c.opts.Config(addr))
+		if err == nil {
+			conn.Close()
+		}
+		if (err == nil) != c.verified {
+			t.Errorf("%s: handshake returned %v, expected verified %v", c.name, err, c.verified)
+		}
+	}
+
+	if name := (&TLSOptions{}).Config("tunnel.example.com:443").ServerName; name != "tunnel.example.com" {
+		t.Errorf("server name %q taken from the remote address, expected tunnel.example.com", name)
+	}
+}
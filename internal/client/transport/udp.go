@@ -25,18 +25,23 @@ type UdpTransport struct {
 	poolConnections int32
 	loadConnections int32
 	controlFlow     chan struct{}
+	fec             *utils.FECConfig // negotiated with the server, nil when disabled
 }
 type UdpConfig struct {
 	RemoteAddr     string
 	Token          string
 	SnifferLog     string
-	TunnelStatus   string
+	TunnelStatus   web.TunnelStatus
 	RetryInterval  time.Duration
 	DialTimeOut    time.Duration
 	ConnPoolSize   int
 	WebPort        int
 	Sniffer        bool
 	AggressivePool bool
+	Remotes        *RemoteSelector
+	Backends       *BackendRegistry
+	Dial           *DialOptions     // egress of the tunnel connections
+	FEC            *utils.FECConfig // nil disables forward error correction on the tunnel
 }
 
 func NewUDPClient(parentCtx context.Context, config *UdpConfig, logger *logrus.Logger) *UdpTransport {
@@ -65,9 +70,10 @@ func (c *UdpTransport) Start() {
 		go c.usageMonitor.Monitor()
 	}
 
-	c.config.TunnelStatus = "Disconnected (UDP)"
+	c.config.TunnelStatus.Set("Disconnected (UDP)")
 
 	go c.channelDialer()
+	go c.config.Remotes.Failback(c.ctx, TcpProbe(c.config.DialTimeOut, c.config.Dial), c.Restart)
 }
 
 func (c *UdpTransport) Restart() {
@@ -101,10 +107,11 @@ func (c *UdpTransport) Restart() {
 	// Re-initialize variables
 	c.controlChannel = nil
 	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger)
-	c.config.TunnelStatus = ""
+	c.config.TunnelStatus.Set("")
 	c.poolConnections = 0
 	c.loadConnections = 0
 	c.controlFlow = make(chan struct{}, 100)
+	c.fec = nil
 
 	// set the log level again
 	c.logger.SetLevel(level)
@@ -121,15 +128,22 @@ func (c *UdpTransport) channelDialer() {
 		case <-c.ctx.Done():
 			return
 		default:
-			tunnelTCPConn, err := TcpDialer(c.ctx, c.config.RemoteAddr, c.config.DialTimeOut, 30, true, 3, 0, 0)
+			// pick the remote selected by the failover logic
+			c.config.RemoteAddr = c.config.Remotes.Current()
+			tunnelTCPConn, err := TcpDialer(c.ctx, c.config.RemoteAddr, c.config.DialTimeOut, 30, true, 3, 0, 0, c.config.Dial)
 			if err != nil {
 				c.logger.Errorf("channel dialer: %v", err)
+				c.config.Remotes.ReportFailure(c.config.RemoteAddr)
 				time.Sleep(c.config.RetryInterval)
 				continue
 			}
 
-			// Sending security token
-			err = utils.SendBinaryTransportString(tunnelTCPConn, c.config.Token, utils.SG_Chan)
+			// Sending security token, with the FEC parameters when FEC is enabled
+			token := c.config.Token
+			if c.config.FEC != nil {
+				token = c.config.FEC.Offer(c.config.Token)
+			}
+			err = utils.SendBinaryTransportString(tunnelTCPConn, token, utils.SG_Chan)
 			if err != nil {
 				c.logger.Errorf("failed to send security token: %v", err)
 				tunnelTCPConn.Close()
@@ -152,17 +166,35 @@ func (c *UdpTransport) channelDialer() {
 					c.logger.Errorf("failed to receive control channel response: %v", err)
 				}
 				tunnelTCPConn.Close() // Close connection on error or timeout
+				c.config.Remotes.ReportFailure(c.config.RemoteAddr)
 				time.Sleep(c.config.RetryInterval)
 				continue
 			}
 			// Resetting the deadline (removes any existing deadline)
 			tunnelTCPConn.SetReadDeadline(time.Time{})
 
+			// the server answers with its FEC parameters when it accepted FEC
+			message, fec, err := utils.ParseFECOffer(message)
+			if err != nil {
+				c.logger.Errorf("failed to parse FEC parameters of the server: %v", err)
+				tunnelTCPConn.Close()
+				time.Sleep(c.config.RetryInterval)
+				continue
+			}
+
 			if message == c.config.Token {
+				c.fec = fec
+				if fec != nil {
+					c.logger.Infof("FEC enabled on the tunnel: %d data shards, %d parity shards, group timeout %v", fec.DataShards, fec.ParityShards, fec.GroupTimeout)
+				} else if c.config.FEC != nil {
+					c.logger.Warn("FEC is not enabled on the server, continuing without it")
+				}
+
 				c.controlChannel = tunnelTCPConn
+				c.config.Remotes.ReportSuccess(c.config.RemoteAddr)
 				c.logger.Info("control channel established successfully")
 
-				c.config.TunnelStatus = "Connected (UDP)"
+				c.config.TunnelStatus.Set("Connected (UDP)")
 
 				go c.poolMaintainer()
 				go c.channelHandler()
@@ -172,6 +204,7 @@ func (c *UdpTransport) channelDialer() {
 			} else {
 				c.logger.Errorf("invalid token received. Expected: %s, Received: %s. Retrying...", c.config.Token, message)
 				tunnelTCPConn.Close() // Close connection if the token is invalid
+				c.config.Remotes.ReportFailure(c.config.RemoteAddr)
 				time.Sleep(c.config.RetryInterval)
 				continue
 			}
@@ -321,7 +354,7 @@ func (c *UdpTransport) tunnelDialer() {
 		return
 	}
 
-	tunConn, err := net.DialUDP("udp", nil, remoteAddr)
+	tunConn, err := DialUDP(remoteAddr.String(), c.config.Dial)
 	if err != nil {
 		c.logger.Error("failed to connect to server:", err)
 		return
@@ -374,7 +407,7 @@ func (c *UdpTransport) handleTunnelConn(tunConn *net.UDPConn) {
 			continue
 		}
 
-		port, remoteAddr, err := ResolveRemoteAddr(string(buffer[:n]))
+		port, remoteAddr, opts, err := c.config.Backends.Resolve(string(buffer[:n]))
 
 		// Decrement active connections after successful or failed connection
 		atomic.AddInt32(&c.poolConnections, -1)
@@ -384,14 +417,14 @@ func (c *UdpTransport) handleTunnelConn(tunConn *net.UDPConn) {
 			return
 		}
 
-		c.localDialer(remoteAddr, port, tunConn)
+		c.localDialer(remoteAddr, port, opts, tunConn)
 
 		break
 	}
 
 }
 
-func (c *UdpTransport) localDialer(remoteAddr string, port int, tunConn *net.UDPConn) {
+func (c *UdpTransport) localDialer(remoteAddr string, port int, opts *DialOptions, tunConn *net.UDPConn) {
 	remoteResolvedAddr, err := net.ResolveUDPAddr("udp", remoteAddr)
 	if err != nil {
 		c.logger.Error("failed to resolve remote address:", err)
@@ -399,29 +432,94 @@ func (c *UdpTransport) localDialer(remoteAddr string, port int, tunConn *net.UDP
 	}
 
 	// Dial the remote UDP server
-	remoteConn, err := net.DialUDP("udp", nil, remoteResolvedAddr)
+	remoteConn, err := DialUDP(remoteResolvedAddr.String(), opts)
 	if err != nil {
 		c.logger.Errorf("failed to dial remote UDP address: %v", err)
 	}
 
 	defer remoteConn.Close()
 
+	// Datagrams are read and written in batches. On the tunnel the packets are coalesced with GSO and
+	// received coalesced with GRO, when the kernel supports them.
+	tunBatch := utils.NewUDPBatch(tunConn, 16*1024)
+	gso, gro := tunBatch.EnableOffload()
+	c.logger.Tracef("UDP offload on tunnel %s: GSO %v, GRO %v", tunConn.LocalAddr(), gso, gro)
+	remoteBatch := utils.NewUDPBatch(remoteConn, 16*1024)
+
+	// Packets are written as they are, unless FEC was negotiated
+	tunWriter := tunBatch.Writer()
+	toTunnel := func(packets [][]byte) error {
+		_, err := tunWriter.WriteTo(packets, nil)
+		return err
+	}
+	remoteWriter := remoteBatch.Writer()
+	toRemote := func(packets [][]byte) error {
+		_, err := remoteWriter.WriteTo(packets, nil)
+		return err
+	}
+
+	if fec := c.fec; fec != nil {
+		encoder, err := utils.NewFECEncoder(*fec, func(data []byte) error {
+			_, err := tunConn.Write(data)
+			return err
+		})
+		if err != nil {
+			c.logger.Errorf("failed to create FEC encoder: %v", err)
+			return
+		}
+		defer encoder.Close()
+		toTunnel = func(packets [][]byte) error {
+			for _, packet := range packets {
+				if err := encoder.Write(packet); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		decoder, err := utils.NewFECDecoder(*fec)
+		if err != nil {
+			c.logger.Errorf("failed to create FEC decoder: %v", err)
+			return
+		}
+		var decoded [][]byte
+		toRemote = func(packets [][]byte) error {
+			decoded = decoded[:0]
+			for _, packet := range packets {
+				payloads, err := decoder.Decode(packet)
+				if err != nil {
+					c.logger.Debugf("dropping tunnel packet: %v", err)
+					continue
+				}
+				decoded = append(decoded, payloads...)
+			}
+			c.usageMonitor.AddFECStats(decoder.TakeStats())
+			_, err := remoteWriter.WriteTo(decoded, nil)
+			return err
+		}
+	}
+
 	done := make(chan struct{})
 	c.logger.Debugf("start to copy from tunnel %s to local %s", tunConn.LocalAddr(), remoteAddr)
 	go func() {
-		c.udpCopy(remoteConn, tunConn, port)
+		c.udpCopy(remoteConn, remoteBatch, port, toTunnel)
 		done <- struct{}{}
 	}()
 
-	c.udpCopy(tunConn, remoteConn, port)
+	c.udpCopy(tunConn, tunBatch, port, toRemote)
 
 	<-done
 
 }
 
-func (c *UdpTransport) udpCopy(srcConn, dstConn *net.UDPConn, port int) {
-	buf := make([]byte, 16*1024)
+func (c *UdpTransport) udpCopy(srcConn *net.UDPConn, batch *utils.UDPBatch, port int, write func([][]byte) error) {
 	readTimeout := 60 * time.Second
+	packets := make([][]byte, 0, utils.UDPBatchSize)
+
+	// the packets of a batch stay in its buffers until the next read
+	collect := func(data []byte, addr *net.UDPAddr) {
+		packets = append(packets, data)
+	}
 
 	for {
 		// Set the read deadline to 60 seconds from now
@@ -432,8 +530,8 @@ func (c *UdpTransport) udpCopy(srcConn, dstConn *net.UDPConn, port int) {
 		}
 
 		// Read from the UDP source connection
-		n, _, err := srcConn.ReadFromUDP(buf)
-		if err != nil {
+		packets = packets[:0]
+		if err := batch.ReadBatch(collect); err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				c.logger.Debug("read from UDP timed out")
 				return // Exit on timeout
@@ -442,22 +540,22 @@ func (c *UdpTransport) udpCopy(srcConn, dstConn *net.UDPConn, port int) {
 			return
 		}
 
-		totalWritten := 0
-		// Write the read data to the destination UDP connection
-		for totalWritten < n {
-			w, err := dstConn.Write(buf[totalWritten:n])
-			if err != nil {
-				c.logger.Errorf("failed to write to UDP %s: %v", dstConn.RemoteAddr().String(), err)
-				return
-			}
-			totalWritten += w
+		n := 0
+		for _, packet := range packets {
+			n += len(packet)
+		}
+
+		// Write the read data to the destination
+		if err := write(packets); err != nil {
+			c.logger.Errorf("failed to write UDP packet from %s: %v", srcConn.RemoteAddr().String(), err)
+			return
 		}
 
 		// Optionally update the port usage stats if sniffing is enabled
 		if c.config.Sniffer {
-			c.usageMonitor.AddOrUpdatePort(port, uint64(totalWritten))
+			c.usageMonitor.AddOrUpdatePort(port, uint64(n))
 		}
 
-		c.logger.Debugf("forwarded %d bytes from %s to %s", n, srcConn.LocalAddr().String(), dstConn.RemoteAddr().String())
+		c.logger.Debugf("forwarded %d packets, %d bytes from %s", len(packets), n, srcConn.RemoteAddr().String())
 	}
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"net"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -30,20 +31,25 @@ type WsTransport struct {
 	controlFlow     chan struct{}
 }
 type WsConfig struct {
-	RemoteAddr     string
-	Token          string
-	SnifferLog     string
-	TunnelStatus   string
-	Nodelay        bool
-	Sniffer        bool
-	KeepAlive      time.Duration
-	RetryInterval  time.Duration
-	DialTimeOut    time.Duration
-	ConnPoolSize   int
-	WebPort        int
-	Mode           config.TransportType
-	AggressivePool bool
-	EdgeIP         string
+	RemoteAddr      string
+	Token           string
+	SnifferLog      string
+	TunnelStatus    web.TunnelStatus
+	Nodelay         bool
+	Sniffer         bool
+	KeepAlive       time.Duration
+	HalfCloseLinger time.Duration
+	RetryInterval   time.Duration
+	DialTimeOut     time.Duration
+	ConnPoolSize    int
+	WebPort         int
+	Mode            config.TransportType
+	AggressivePool  bool
+	Remotes         *RemoteSelector
+	Backends        *BackendRegistry
+	Dial            *DialOptions // egress of the tunnel connections
+	TLS             *TLSOptions  // verification of the server certificate in the tls modes
+	EdgeIP          string
 }
 
 func NewWSClient(parentCtx context.Context, config *WsConfig, logger *logrus.Logger) *WsTransport {
@@ -73,9 +79,10 @@ func (c *WsTransport) Start() {
 		go c.usageMonitor.Monitor()
 	}
 
-	c.config.TunnelStatus = fmt.Sprintf("Disconnected (%s)", c.config.Mode)
+	c.config.TunnelStatus.Set(fmt.Sprintf("Disconnected (%s)", c.config.Mode))
 
 	go c.channelDialer()
+	go c.config.Remotes.Failback(c.ctx, HandshakeProbe(c.config.Mode, c.config.DialTimeOut, c.config.Dial, c.config.TLS, c.config.EdgeIP), c.Restart)
 
 }
 func (c *WsTransport) Restart() {
@@ -109,7 +116,7 @@ func (c *WsTransport) Restart() {
 	// Re-initialize variables
 	c.controlChannel = nil
 	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger)
-	c.config.TunnelStatus = ""
+	c.config.TunnelStatus.Set("")
 	c.poolConnections = 0
 	c.loadConnections = 0
 	c.controlFlow = make(chan struct{}, 100)
@@ -128,16 +135,20 @@ func (c *WsTransport) channelDialer() {
 		case <-c.ctx.Done():
 			return
 		default:
-			tunnelWSConn, err := WebSocketDialer(c.ctx, c.config.RemoteAddr, c.config.EdgeIP, "/channel", c.config.DialTimeOut, c.config.KeepAlive, true, c.config.Token, c.config.Mode, 3, 0, 0)
+			// pick the remote selected by the failover logic
+			c.config.RemoteAddr = c.config.Remotes.Current()
+			tunnelWSConn, err := WebSocketDialer(c.ctx, c.config.RemoteAddr, c.config.EdgeIP, "/channel", c.config.DialTimeOut, c.config.KeepAlive, true, c.config.Token, nil, c.config.Mode, 3, 0, 0, c.config.Dial, c.config.TLS)
 			if err != nil {
 				c.logger.Errorf("control channel dialer: %v", err)
+				c.config.Remotes.ReportFailure(c.config.RemoteAddr)
 				time.Sleep(c.config.RetryInterval)
 				continue
 			}
 			c.controlChannel = tunnelWSConn
+			c.config.Remotes.ReportSuccess(c.config.RemoteAddr)
 			c.logger.Info("control channel established successfully")
 
-			c.config.TunnelStatus = fmt.Sprintf("Connected (%s)", c.config.Mode)
+			c.config.TunnelStatus.Set(fmt.Sprintf("Connected (%s)", c.config.Mode))
 
 			go c.poolMaintainer()
 			go c.channelHandler()
@@ -285,7 +296,7 @@ func (c *WsTransport) tunnelDialer() {
 	c.logger.Debugf("initiating new websocket tunnel connection to address %s", c.config.RemoteAddr)
 
 	// Dial to the tunnel server
-	tunnelConn, err := WebSocketDialer(c.ctx, c.config.RemoteAddr, c.config.EdgeIP, "/tunnel", c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, c.config.Token, c.config.Mode, 3, 1024*1024, 1024*1024)
+	tunnelConn, err := WebSocketDialer(c.ctx, c.config.RemoteAddr, c.config.EdgeIP, "/tunnel", c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, c.config.Token, nil, c.config.Mode, 3, 1024*1024, 1024*1024, c.config.Dial, c.config.TLS)
 	if err != nil {
 		c.logger.Errorf("tunnel server dialer: %v", err)
 
@@ -319,30 +330,42 @@ func (c *WsTransport) tunnelDialer() {
 			// Decrement active connections
 			atomic.AddInt32(&c.poolConnections, -1)
 
-			remoteAddr := string(remoteAddrBytes)
-
-			// Extract the port from the received address
-			port, resolvedAddr, err := ResolveRemoteAddr(remoteAddr)
-			if err != nil {
-				c.logger.Infof("failed to resolve remote port: %v", err)
-				tunnelConn.Close() // Close the connection on error
+			// a UDP client of accept_udp, the packets are framed over the websocket
+			if len(remoteAddrBytes) > 0 && remoteAddrBytes[0] == utils.SG_UDP {
+				c.udpDialer(tunnelConn, string(remoteAddrBytes[1:]))
 				return
 			}
 
-			c.localDialer(tunnelConn, resolvedAddr, port)
+			remoteAddr := string(remoteAddrBytes)
+
+			c.localDialer(tunnelConn, remoteAddr)
 			return
 		}
 	}
 }
 
-func (c *WsTransport) localDialer(tunnelCon *websocket.Conn, remoteAddr string, port int) {
-	localConn, err := TcpDialer(c.ctx, remoteAddr, c.config.DialTimeOut, c.config.KeepAlive, true, 1, 32*1024, 32*1024)
+func (c *WsTransport) udpDialer(tunnelCon *websocket.Conn, remoteAddr string) {
+	port, resolvedAddr, opts, err := c.config.Backends.Resolve(remoteAddr)
+	if err != nil {
+		c.logger.Infof("failed to resolve remote port: %v", err)
+		tunnelCon.Close()
+		return
+	}
+
+	UDPDialer(utils.NewWSConn(tunnelCon), resolvedAddr, opts, c.logger, c.usageMonitor, port, c.config.Sniffer)
+}
+
+func (c *WsTransport) localDialer(tunnelCon *websocket.Conn, remoteAddr string) {
+	localConn, port, release, err := c.config.Backends.DialTCP(remoteAddr, func(addr string, opts *DialOptions) (*net.TCPConn, error) {
+		return TcpDialer(c.ctx, addr, c.config.DialTimeOut, c.config.KeepAlive, true, 1, 32*1024, 32*1024, opts)
+	})
 	if err != nil {
 		c.logger.Errorf("local dialer: %v", err)
 		tunnelCon.Close()
 		return
 	}
+	defer release()
 	c.logger.Debugf("connected to local address %s successfully", remoteAddr)
 
-	utils.WSConnectionHandler(tunnelCon, localConn, c.logger, c.usageMonitor, int(port), c.config.Sniffer)
+	utils.WSConnectionHandler(tunnelCon, localConn, c.logger, c.usageMonitor, int(port), c.config.Sniffer, c.config.HalfCloseLinger)
 }
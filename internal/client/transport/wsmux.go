@@ -3,6 +3,7 @@ package transport
 import (
 	"context"
 	"fmt"
+	"net"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -29,15 +30,17 @@ type WsMuxTransport struct {
 	poolConnections int32
 	loadConnections int32
 	controlFlow     chan struct{}
+	halfClose       atomic.Bool // the streams are framed, negotiated with the server
 }
 type WsMuxConfig struct {
 	RemoteAddr       string
 	Token            string
 	SnifferLog       string
-	TunnelStatus     string
+	TunnelStatus     web.TunnelStatus
 	Nodelay          bool
 	Sniffer          bool
 	KeepAlive        time.Duration
+	HalfCloseLinger  time.Duration
 	RetryInterval    time.Duration
 	DialTimeOut      time.Duration
 	MuxVersion       int
@@ -48,6 +51,10 @@ type WsMuxConfig struct {
 	WebPort          int
 	Mode             config.TransportType
 	AggressivePool   bool
+	Remotes          *RemoteSelector
+	Backends         *BackendRegistry
+	Dial             *DialOptions // egress of the tunnel connections
+	TLS              *TLSOptions  // verification of the server certificate in the tls modes
 	EdgeIP           string
 }
 
@@ -85,9 +92,10 @@ func (c *WsMuxTransport) Start() {
 		go c.usageMonitor.Monitor()
 	}
 
-	c.config.TunnelStatus = fmt.Sprintf("Disconnected (%s)", c.config.Mode)
+	c.config.TunnelStatus.Set(fmt.Sprintf("Disconnected (%s)", c.config.Mode))
 
 	go c.channelDialer()
+	go c.config.Remotes.Failback(c.ctx, HandshakeProbe(c.config.Mode, c.config.DialTimeOut, c.config.Dial, c.config.TLS, c.config.EdgeIP), c.Restart)
 }
 
 func (c *WsMuxTransport) Restart() {
@@ -121,7 +129,7 @@ func (c *WsMuxTransport) Restart() {
 	// Re-initialize variables
 	c.controlChannel = nil
 	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger)
-	c.config.TunnelStatus = ""
+	c.config.TunnelStatus.Set("")
 	c.poolConnections = 0
 	c.loadConnections = 0
 	c.controlFlow = make(chan struct{}, 100)
@@ -141,16 +149,26 @@ func (c *WsMuxTransport) channelDialer() {
 			return
 		default:
 
-			tunnelWSConn, err := WebSocketDialer(c.ctx, c.config.RemoteAddr, c.config.EdgeIP, "/channel", c.config.DialTimeOut, c.config.KeepAlive, true, c.config.Token, c.config.Mode, 3, 0, 0)
+			// pick the remote selected by the failover logic
+			c.config.RemoteAddr = c.config.Remotes.Current()
+			// the control channel offers the half-close framing of the streams
+			var subprotocols []string
+			if c.config.HalfCloseLinger > 0 {
+				subprotocols = []string{utils.HalfCloseProtocol}
+			}
+			tunnelWSConn, err := WebSocketDialer(c.ctx, c.config.RemoteAddr, c.config.EdgeIP, "/channel", c.config.DialTimeOut, c.config.KeepAlive, true, c.config.Token, subprotocols, c.config.Mode, 3, 0, 0, c.config.Dial, c.config.TLS)
 			if err != nil {
 				c.logger.Errorf("control channel dialer: %v", err)
+				c.config.Remotes.ReportFailure(c.config.RemoteAddr)
 				time.Sleep(c.config.RetryInterval)
 				continue
 			}
+			c.halfClose.Store(tunnelWSConn.Subprotocol() == utils.HalfCloseProtocol)
 			c.controlChannel = tunnelWSConn
+			c.config.Remotes.ReportSuccess(c.config.RemoteAddr)
 			c.logger.Info("control channel established successfully")
 
-			c.config.TunnelStatus = fmt.Sprintf("Connected (%s)", c.config.Mode)
+			c.config.TunnelStatus.Set(fmt.Sprintf("Connected (%s)", c.config.Mode))
 
 			go c.poolMaintainer()
 			go c.channelHandler()
@@ -296,7 +314,7 @@ func (c *WsMuxTransport) tunnelDialer() {
 	c.logger.Debugf("initiating new %s tunnel connection to address %s", c.config.Mode, c.config.RemoteAddr)
 
 	// Dial to the tunnel server
-	tunnelWSConn, err := WebSocketDialer(c.ctx, c.config.RemoteAddr, c.config.EdgeIP, "/tunnel", c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, c.config.Token, c.config.Mode, 3, 2*1024*1024, 2*1024*1024)
+	tunnelWSConn, err := WebSocketDialer(c.ctx, c.config.RemoteAddr, c.config.EdgeIP, "/tunnel", c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, c.config.Token, nil, c.config.Mode, 3, 2*1024*1024, 2*1024*1024, c.config.Dial, c.config.TLS)
 	if err != nil {
 		c.logger.Errorf("tunnel server dialer: %v", err)
 
@@ -333,35 +351,50 @@ func (c *WsMuxTransport) handleSession(tunnelConn *websocket.Conn) {
 				return
 			}
 
-			remoteAddr, err := utils.ReceiveBinaryString(stream)
+			remoteAddr, transport, err := utils.ReceiveBinaryTransportString(stream)
 			if err != nil {
 				c.logger.Errorf("unable to get port from stream connection %s: %v", tunnelConn.RemoteAddr().String(), err)
 				stream.Close()
 				continue
 			}
 
-			go c.localDialer(stream, remoteAddr)
+			switch transport {
+			case utils.SG_TCP:
+				go c.localDialer(stream, remoteAddr)
+
+			case utils.SG_UDP:
+				// a UDP client of accept_udp, the packets are framed on the stream
+				port, resolvedAddr, opts, err := c.config.Backends.Resolve(remoteAddr)
+				if err != nil {
+					c.logger.Infof("failed to resolve remote port: %v", err)
+					stream.Close()
+					continue
+				}
+
+				go UDPDialer(stream, resolvedAddr, opts, c.logger, c.usageMonitor, port, c.config.Sniffer)
+
+			default:
+				c.logger.Error("undefined transport. close the stream.")
+				stream.Close()
+			}
 		}
 	}
 }
 
 func (c *WsMuxTransport) localDialer(stream *smux.Stream, remoteAddr string) {
-	// Extract the port from the received address
-	port, resolvedAddr, err := ResolveRemoteAddr(remoteAddr)
-	if err != nil {
-		c.logger.Infof("failed to resolve remote port: %v", err)
-		stream.Close()
-		return
-	}
-
-	localConnection, err := TcpDialer(c.ctx, resolvedAddr, c.config.DialTimeOut, c.config.KeepAlive, true, 1, 32*1024, 32*1024)
+	localConnection, port, release, err := c.config.Backends.DialTCP(remoteAddr, func(addr string, opts *DialOptions) (*net.TCPConn, error) {
+		return TcpDialer(c.ctx, addr, c.config.DialTimeOut, c.config.KeepAlive, true, 1, 32*1024, 32*1024, opts)
+	})
 	if err != nil {
 		c.logger.Errorf("local dialer: %v", err)
 		stream.Close()
 		return
 	}
+	defer release()
 
 	c.logger.Debugf("connected to local address %s successfully", remoteAddr)
 
-	utils.TCPConnectionHandler(stream, localConnection, c.logger, c.usageMonitor, int(port), c.config.Sniffer)
+	// the data is framed so that the stream can be half-closed, when both ends support it
+	conn, linger := utils.MuxStreamConn(stream, c.halfClose.Load(), c.config.HalfCloseLinger)
+	utils.TCPConnectionHandler(conn, localConnection, c.logger, c.usageMonitor, int(port), c.config.Sniffer, linger)
 }
@@ -4,68 +4,200 @@ package config
 type TransportType string
 
 const (
-	TCP    TransportType = "tcp"
-	TCPMUX TransportType = "tcpmux"
-	WS     TransportType = "ws"
-	WSS    TransportType = "wss"
-	WSMUX  TransportType = "wsmux"
-	WSSMUX TransportType = "wssmux"
-	QUIC   TransportType = "quic"
-	UDP    TransportType = "udp"
+	TCP        TransportType = "tcp"
+	TCPMUX     TransportType = "tcpmux"
+	WS         TransportType = "ws"
+	WSS        TransportType = "wss"
+	WSMUX      TransportType = "wsmux"
+	WSSMUX     TransportType = "wssmux"
+	QUIC       TransportType = "quic"
+	UDP        TransportType = "udp"
+	KCP        TransportType = "kcp"
+	H2         TransportType = "h2"
+	H2C        TransportType = "h2c"
+	GRPC       TransportType = "grpc"
+	SPLITHTTP  TransportType = "splithttp"
+	SPLITHTTPS TransportType = "splithttps"
+	TCPTLS     TransportType = "tcptls"
+	TCPMUXTLS  TransportType = "tcpmuxtls"
 )
 
 // ServerConfig represents the configuration for the server.
 type ServerConfig struct {
-	BindAddr         string        `toml:"bind_addr"`
-	Transport        TransportType `toml:"transport"`
-	Token            string        `toml:"token"`
-	Nodelay          bool          `toml:"nodelay"`
-	Keepalive        int           `toml:"keepalive_period"`
-	ChannelSize      int           `toml:"channel_size"`
-	LogLevel         string        `toml:"log_level"`
-	Ports            []string      `toml:"ports"`
-	PPROF            bool          `toml:"pprof"`
-	MuxSession       int           `toml:"mux_session"`
-	MuxVersion       int           `toml:"mux_version"`
-	MaxFrameSize     int           `toml:"mux_framesize"`
-	MaxReceiveBuffer int           `toml:"mux_recievebuffer"`
-	MaxStreamBuffer  int           `toml:"mux_streambuffer"`
-	Sniffer          bool          `toml:"sniffer"`
-	WebPort          int           `toml:"web_port"`
-	SnifferLog       string        `toml:"sniffer_log"`
-	TLSCertFile      string        `toml:"tls_cert"`
-	TLSKeyFile       string        `toml:"tls_key"`
-	Heartbeat        int           `toml:"heartbeat"`
-	MuxCon           int           `toml:"mux_con"`
-	AcceptUDP        bool          `toml:"accept_udp"`
+	Name             string           `toml:"name"`
+	BindAddr         string           `toml:"bind_addr"`
+	Transport        TransportType    `toml:"transport"`
+	Token            string           `toml:"token"`
+	Nodelay          bool             `toml:"nodelay"`
+	Keepalive        int              `toml:"keepalive_period"`
+	ChannelSize      int              `toml:"channel_size"`
+	LogLevel         string           `toml:"log_level"`
+	Ports            []string         `toml:"ports"`
+	PPROF            bool             `toml:"pprof"`
+	MuxSession       int              `toml:"mux_session"`
+	MuxVersion       int              `toml:"mux_version"`
+	MaxFrameSize     int              `toml:"mux_framesize"`
+	MaxReceiveBuffer int              `toml:"mux_recievebuffer"`
+	MaxStreamBuffer  int              `toml:"mux_streambuffer"`
+	Sniffer          bool             `toml:"sniffer"`
+	WebPort          int              `toml:"web_port"`
+	SnifferLog       string           `toml:"sniffer_log"`
+	TLSCertFile      string           `toml:"tls_cert"`
+	TLSKeyFile       string           `toml:"tls_key"`
+	Heartbeat        int              `toml:"heartbeat"`
+	MuxCon           int              `toml:"mux_con"`
+	AcceptUDP        bool             `toml:"accept_udp"`
+	Listeners        []ServerListener `toml:"listeners"`
+	ForwardSource    bool             `toml:"forward_source"`
+	Multipath        bool             `toml:"multipath"`
+	KcpNodelay       bool             `toml:"kcp_nodelay"`
+	KcpInterval      int              `toml:"kcp_interval"`
+	KcpResend        int              `toml:"kcp_resend"`
+	KcpNoCongestion  bool             `toml:"kcp_nc"`
+	KcpSndWnd        int              `toml:"kcp_sndwnd"`
+	KcpRcvWnd        int              `toml:"kcp_rcvwnd"`
+	KcpMTU           int              `toml:"kcp_mtu"`
+	KcpDataShard     int              `toml:"kcp_datashard"`
+	KcpParityShard   int              `toml:"kcp_parityshard"`
+	FecDataShards    int              `toml:"fec_data_shards"`
+	FecParityShards  int              `toml:"fec_parity_shards"`
+	FecGroupTimeout  int              `toml:"fec_group_timeout"`
+	GrpcService      string           `toml:"grpc_service"`
+	GrpcTLS          bool             `toml:"grpc_tls"`
+	SplitPacketSize  int              `toml:"split_packet_size"`
+	SplitConcurrency int              `toml:"split_concurrency"`
+	TLSClientCA      string           `toml:"tls_client_ca"`
+	TLSClientAuth    string           `toml:"tls_client_auth"` // required or optional
+	Tenants          []ServerTenant   `toml:"tenants"`
+	UDPIdleTimeout   int              `toml:"udp_idle_timeout"`
+	UDPMaxSessions   int              `toml:"udp_max_sessions"`
+	UDPMaxPerSource  int              `toml:"udp_max_sessions_per_source"`
+	UDPSessionBuffer int              `toml:"udp_session_buffer"`
+	UDPDropPolicy    string           `toml:"udp_drop_policy"` // drop-newest or drop-oldest
+	HalfCloseLinger  int              `toml:"half_close_linger"`
+	TCPCongestion    string           `toml:"tcp_congestion"`
+	TCPNotSentLowat  int              `toml:"tcp_notsent_lowat"`
+	TCPUserTimeout   int              `toml:"tcp_user_timeout"`
+	TCPFastOpen      bool             `toml:"tcp_fastopen"` // listeners only, the client does not dial with fast open
+	DSCP             int              `toml:"dscp"`
+}
+
+// ServerTenant is a client identified by its TLS certificate, it gets its own ports.
+type ServerTenant struct {
+	Name     string   `toml:"name"`
+	Identity string   `toml:"identity"` // common name or a SAN of the client certificate
+	Ports    []string `toml:"ports"`
+}
+
+// ServerListener is an additional transport the same server tunnel listens on.
+type ServerListener struct {
+	Transport TransportType `toml:"transport"`
+	BindAddr  string        `toml:"bind_addr"`
 }
 
 // ClientConfig represents the configuration for the client.
 type ClientConfig struct {
-	RemoteAddr       string        `toml:"remote_addr"`
-	Transport        TransportType `toml:"transport"`
-	Token            string        `toml:"token"`
-	ConnectionPool   int           `toml:"connection_pool"`
-	RetryInterval    int           `toml:"retry_interval"`
-	Nodelay          bool          `toml:"nodelay"`
-	Keepalive        int           `toml:"keepalive_period"`
-	LogLevel         string        `toml:"log_level"`
-	PPROF            bool          `toml:"pprof"`
-	MuxSession       int           `toml:"mux_session"`
-	MuxVersion       int           `toml:"mux_version"`
-	MaxFrameSize     int           `toml:"mux_framesize"`
-	MaxReceiveBuffer int           `toml:"mux_recievebuffer"`
-	MaxStreamBuffer  int           `toml:"mux_streambuffer"`
-	Sniffer          bool          `toml:"sniffer"`
-	WebPort          int           `toml:"web_port"`
-	SnifferLog       string        `toml:"sniffer_log"`
-	DialTimeout      int           `toml:"dial_timeout"`
-	AggressivePool   bool          `toml:"aggressive_pool"`
-	EdgeIP           string        `toml:"edge_ip"`
+	Name                  string              `toml:"name"`
+	RemoteAddr            string              `toml:"remote_addr"`
+	Transport             TransportType       `toml:"transport"`
+	Token                 string              `toml:"token"`
+	ConnectionPool        int                 `toml:"connection_pool"`
+	RetryInterval         int                 `toml:"retry_interval"`
+	Nodelay               bool                `toml:"nodelay"`
+	Keepalive             int                 `toml:"keepalive_period"`
+	LogLevel              string              `toml:"log_level"`
+	PPROF                 bool                `toml:"pprof"`
+	MuxSession            int                 `toml:"mux_session"`
+	MuxVersion            int                 `toml:"mux_version"`
+	MaxFrameSize          int                 `toml:"mux_framesize"`
+	MaxReceiveBuffer      int                 `toml:"mux_recievebuffer"`
+	MaxStreamBuffer       int                 `toml:"mux_streambuffer"`
+	Sniffer               bool                `toml:"sniffer"`
+	WebPort               int                 `toml:"web_port"`
+	SnifferLog            string              `toml:"sniffer_log"`
+	DialTimeout           int                 `toml:"dial_timeout"`
+	AggressivePool        bool                `toml:"aggressive_pool"`
+	EdgeIP                string              `toml:"edge_ip"`
+	RemoteServers         []RemoteServer      `toml:"remote_servers"`
+	FailbackInterval      int                 `toml:"failback_interval"`
+	TransportFallback     []TransportFallback `toml:"transport_fallback"`
+	FallbackProbeInterval int                 `toml:"fallback_probe_interval"`
+	BackendPools          []BackendPool       `toml:"backend_pools"`
+	MultipathAddrs        []string            `toml:"multipath_addrs"`
+	SourceAddr            string              `toml:"source_addr"`
+	Interface             string              `toml:"interface"`
+	Fwmark                int                 `toml:"fwmark"`
+	KcpNodelay            bool                `toml:"kcp_nodelay"`
+	KcpInterval           int                 `toml:"kcp_interval"`
+	KcpResend             int                 `toml:"kcp_resend"`
+	KcpNoCongestion       bool                `toml:"kcp_nc"`
+	KcpSndWnd             int                 `toml:"kcp_sndwnd"`
+	KcpRcvWnd             int                 `toml:"kcp_rcvwnd"`
+	KcpMTU                int                 `toml:"kcp_mtu"`
+	KcpDataShard          int                 `toml:"kcp_datashard"`
+	KcpParityShard        int                 `toml:"kcp_parityshard"`
+	FecDataShards         int                 `toml:"fec_data_shards"`
+	FecParityShards       int                 `toml:"fec_parity_shards"`
+	FecGroupTimeout       int                 `toml:"fec_group_timeout"`
+	GrpcService           string              `toml:"grpc_service"`
+	GrpcTLS               bool                `toml:"grpc_tls"`
+	SplitPacketSize       int                 `toml:"split_packet_size"`
+	SplitConcurrency      int                 `toml:"split_concurrency"`
+	TLSServerName         string              `toml:"tls_sni"`
+	TLSPins               []string            `toml:"tls_pins"`
+	TLSCAFile             string              `toml:"tls_ca"`
+	TLSInsecure           bool                `toml:"tls_insecure"`
+	TLSCertFile           string              `toml:"tls_cert"`
+	TLSKeyFile            string              `toml:"tls_key"`
+	HalfCloseLinger       int                 `toml:"half_close_linger"`
+	TCPCongestion         string              `toml:"tcp_congestion"`
+	TCPNotSentLowat       int                 `toml:"tcp_notsent_lowat"`
+	TCPUserTimeout        int                 `toml:"tcp_user_timeout"`
+	DSCP                  int                 `toml:"dscp"`
+}
+
+// BackendPool is a named group of backends a port mapping can forward to.
+type BackendPool struct {
+	Name                string   `toml:"name"`
+	Strategy            string   `toml:"strategy"` // round_robin, least_conn or hash
+	Targets             []string `toml:"targets"`
+	HealthCheckInterval int      `toml:"health_check_interval"`
+	MaxFails            int      `toml:"max_fails"`
+	EjectTime           int      `toml:"eject_time"`
+	SourceAddr          string   `toml:"source_addr"`
+	Interface           string   `toml:"interface"`
+	Fwmark              int      `toml:"fwmark"`
+}
+
+// TransportFallback is a transport the client tries, in order, until one completes the handshake.
+type TransportFallback struct {
+	Transport  TransportType `toml:"transport"`
+	RemoteAddr string        `toml:"remote_addr"`
+}
+
+// RemoteServer is one of the tunnel servers a client can fail over to, lower priority is preferred.
+type RemoteServer struct {
+	Addr     string `toml:"addr"`
+	Priority int    `toml:"priority"`
+}
+
+// AdminConfig represents the shared admin endpoint used by all tunnels of the process.
+type AdminConfig struct {
+	Listen string `toml:"listen"`
+	PPROF  bool   `toml:"pprof"`
+}
+
+// TuningConfig represents the opt-in tuning of the host, applied once for all the tunnels of the process.
+type TuningConfig struct {
+	Profile string `toml:"profile"` // none, connections, throughput or full
+	DryRun  bool   `toml:"dry_run"` // only log the changes of the profile
 }
 
 // Config represents the complete configuration, including both server and client settings.
+// Both [server] and [client] may be given once or as arrays of tables ([[server]], [[client]]).
 type Config struct {
-	Server ServerConfig `toml:"server"`
-	Client ClientConfig `toml:"client"`
+	Servers []ServerConfig
+	Clients []ClientConfig
+	Admin   AdminConfig  `toml:"admin"`
+	Tuning  TuningConfig `toml:"tuning"`
 }
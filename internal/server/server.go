@@ -4,64 +4,88 @@ import (
 	"context"
 	"net/http"
 	_ "net/http/pprof"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/musix/backhaul/internal/config"
 	"github.com/musix/backhaul/internal/server/transport"
 	"github.com/musix/backhaul/internal/utils"
+	"github.com/musix/backhaul/internal/web"
 
 	"github.com/sirupsen/logrus"
 )
 
 type Server struct {
-	config *config.ServerConfig
-	ctx    context.Context
-	cancel context.CancelFunc
-	logger *logrus.Logger
+	config  *config.ServerConfig
+	ctx     context.Context
+	cancel  context.CancelFunc
+	logger  *logrus.Logger
+	status  atomic.Pointer[web.TunnelStatus] // tunnel status of the running transport
+	restart func()                           // restarts the running transport
 }
 
+// pprof listens on a fixed port, so only the first tunnel of the process starts it
+var pprofOnce sync.Once
+
 func NewServer(cfg *config.ServerConfig, parentCtx context.Context) *Server {
 	ctx, cancel := context.WithCancel(parentCtx)
 	return &Server{
 		config: cfg,
 		ctx:    ctx,
 		cancel: cancel,
-		logger: utils.NewLogger(cfg.LogLevel),
+		logger: utils.NewTunnelLogger(cfg.LogLevel, cfg.Name),
 	}
 }
 
 func (s *Server) Start() {
 	// for pprof and debugging
 	if s.config.PPROF {
-		go func() {
-			s.logger.Info("pprof started at port 6060")
-			http.ListenAndServe("0.0.0.0:6060", nil)
-		}()
+		pprofOnce.Do(func() {
+			go func() {
+				s.logger.Info("pprof started at port 6060")
+				http.ListenAndServe("0.0.0.0:6060", nil)
+			}()
+		})
 	}
 
-	if s.config.Transport == config.TCP {
+	if s.config.Transport == config.TCP || s.config.Transport == config.TCPTLS {
 		tcpConfig := &transport.TcpConfig{
-			BindAddr:    s.config.BindAddr,
-			Nodelay:     s.config.Nodelay,
-			KeepAlive:   time.Duration(s.config.Keepalive) * time.Second,
-			Heartbeat:   time.Duration(s.config.Heartbeat) * time.Second,
-			Token:       s.config.Token,
-			ChannelSize: s.config.ChannelSize,
-			Ports:       s.config.Ports,
-			Sniffer:     s.config.Sniffer,
-			WebPort:     s.config.WebPort,
-			SnifferLog:  s.config.SnifferLog,
-			AcceptUDP:   s.config.AcceptUDP,
+			BindAddr:        s.config.BindAddr,
+			Nodelay:         s.config.Nodelay,
+			KeepAlive:       time.Duration(s.config.Keepalive) * time.Second,
+			HalfCloseLinger: time.Duration(s.config.HalfCloseLinger) * time.Second,
+			Socket:          s.socketOptions(),
+			Heartbeat:       time.Duration(s.config.Heartbeat) * time.Second,
+			Token:           s.config.Token,
+			ChannelSize:     s.config.ChannelSize,
+			Ports:           s.config.Ports,
+			Sniffer:         s.config.Sniffer,
+			WebPort:         s.config.WebPort,
+			SnifferLog:      s.config.SnifferLog,
+			AcceptUDP:       s.config.AcceptUDP,
+			ForwardSource:   s.config.ForwardSource,
+			UDPSessions:     s.udpSessions(),
+			Mode:            s.config.Transport,
+		}
+
+		if s.config.Transport == config.TCPTLS {
+			tcpConfig.Certs = s.certStore()
+			tcpConfig.ClientAuth = s.clientAuth()
 		}
 
+		s.status.Store(&tcpConfig.TunnelStatus)
 		tcpServer := transport.NewTCPServer(s.ctx, tcpConfig, s.logger)
+		s.restart = tcpServer.Restart
 		go tcpServer.Start()
 
-	} else if s.config.Transport == config.TCPMUX {
+	} else if s.config.Transport == config.TCPMUX || s.config.Transport == config.TCPMUXTLS {
 		tcpMuxConfig := &transport.TcpMuxConfig{
 			BindAddr:         s.config.BindAddr,
 			Nodelay:          s.config.Nodelay,
 			KeepAlive:        time.Duration(s.config.Keepalive) * time.Second,
+			HalfCloseLinger:  time.Duration(s.config.HalfCloseLinger) * time.Second,
+			Socket:           s.socketOptions(),
 			Heartbeat:        time.Duration(s.config.Heartbeat) * time.Second,
 			Token:            s.config.Token,
 			ChannelSize:      s.config.ChannelSize,
@@ -74,29 +98,51 @@ func (s *Server) Start() {
 			Sniffer:          s.config.Sniffer,
 			WebPort:          s.config.WebPort,
 			SnifferLog:       s.config.SnifferLog,
+			AcceptUDP:        s.config.AcceptUDP,
+			ForwardSource:    s.config.ForwardSource,
+			UDPSessions:      s.udpSessions(),
+			Multipath:        s.config.Multipath,
+			Mode:             s.config.Transport,
 		}
 
+		if s.config.Transport == config.TCPMUXTLS {
+			tcpMuxConfig.Certs = s.certStore()
+			tcpMuxConfig.ClientAuth = s.clientAuth()
+		}
+
+		s.status.Store(&tcpMuxConfig.TunnelStatus)
 		tcpMuxServer := transport.NewTcpMuxServer(s.ctx, tcpMuxConfig, s.logger)
+		s.restart = tcpMuxServer.Restart
 		go tcpMuxServer.Start()
 
 	} else if s.config.Transport == config.WS || s.config.Transport == config.WSS {
 		wsConfig := &transport.WsConfig{
-			BindAddr:    s.config.BindAddr,
-			Nodelay:     s.config.Nodelay,
-			KeepAlive:   time.Duration(s.config.Keepalive) * time.Second,
-			Heartbeat:   time.Duration(s.config.Heartbeat) * time.Second,
-			Token:       s.config.Token,
-			ChannelSize: s.config.ChannelSize,
-			Ports:       s.config.Ports,
-			Sniffer:     s.config.Sniffer,
-			WebPort:     s.config.WebPort,
-			SnifferLog:  s.config.SnifferLog,
-			Mode:        s.config.Transport,
-			TLSCertFile: s.config.TLSCertFile,
-			TLSKeyFile:  s.config.TLSKeyFile,
+			BindAddr:        s.config.BindAddr,
+			Nodelay:         s.config.Nodelay,
+			KeepAlive:       time.Duration(s.config.Keepalive) * time.Second,
+			HalfCloseLinger: time.Duration(s.config.HalfCloseLinger) * time.Second,
+			Socket:          s.socketOptions(),
+			Heartbeat:       time.Duration(s.config.Heartbeat) * time.Second,
+			Token:           s.config.Token,
+			ChannelSize:     s.config.ChannelSize,
+			Ports:           s.config.Ports,
+			Sniffer:         s.config.Sniffer,
+			WebPort:         s.config.WebPort,
+			SnifferLog:      s.config.SnifferLog,
+			Mode:            s.config.Transport,
+			AcceptUDP:       s.config.AcceptUDP,
+			ForwardSource:   s.config.ForwardSource,
+			UDPSessions:     s.udpSessions(),
 		}
 
+		if s.config.Transport == config.WSS {
+			wsConfig.Certs = s.certStore()
+			wsConfig.ClientAuth = s.clientAuth()
+		}
+
+		s.status.Store(&wsConfig.TunnelStatus)
 		wsServer := transport.NewWSServer(s.ctx, wsConfig, s.logger)
+		s.restart = wsServer.Restart
 		go wsServer.Start()
 
 	} else if s.config.Transport == config.WSMUX || s.config.Transport == config.WSSMUX {
@@ -104,6 +150,8 @@ func (s *Server) Start() {
 			BindAddr:         s.config.BindAddr,
 			Nodelay:          s.config.Nodelay,
 			KeepAlive:        time.Duration(s.config.Keepalive) * time.Second,
+			HalfCloseLinger:  time.Duration(s.config.HalfCloseLinger) * time.Second,
+			Socket:           s.socketOptions(),
 			Heartbeat:        time.Duration(s.config.Heartbeat) * time.Second,
 			Token:            s.config.Token,
 			ChannelSize:      s.config.ChannelSize,
@@ -117,31 +165,171 @@ func (s *Server) Start() {
 			WebPort:          s.config.WebPort,
 			SnifferLog:       s.config.SnifferLog,
 			Mode:             s.config.Transport,
-			TLSCertFile:      s.config.TLSCertFile,
-			TLSKeyFile:       s.config.TLSKeyFile,
+			AcceptUDP:        s.config.AcceptUDP,
+			ForwardSource:    s.config.ForwardSource,
+			UDPSessions:      s.udpSessions(),
+		}
+
+		if s.config.Transport == config.WSSMUX {
+			wsMuxConfig.Certs = s.certStore()
+			wsMuxConfig.ClientAuth = s.clientAuth()
 		}
 
+		s.status.Store(&wsMuxConfig.TunnelStatus)
 		wsMuxServer := transport.NewWSMuxServer(s.ctx, wsMuxConfig, s.logger)
+		s.restart = wsMuxServer.Restart
 		go wsMuxServer.Start()
 
+	} else if s.config.Transport == config.H2 || s.config.Transport == config.H2C {
+		h2Config := &transport.H2Config{
+			BindAddr:        s.config.BindAddr,
+			Nodelay:         s.config.Nodelay,
+			KeepAlive:       time.Duration(s.config.Keepalive) * time.Second,
+			HalfCloseLinger: time.Duration(s.config.HalfCloseLinger) * time.Second,
+			Socket:          s.socketOptions(),
+			Heartbeat:       time.Duration(s.config.Heartbeat) * time.Second,
+			Token:           s.config.Token,
+			ChannelSize:     s.config.ChannelSize,
+			Ports:           s.config.Ports,
+			Sniffer:         s.config.Sniffer,
+			WebPort:         s.config.WebPort,
+			SnifferLog:      s.config.SnifferLog,
+			Mode:            s.config.Transport,
+			ForwardSource:   s.config.ForwardSource,
+		}
+
+		if s.config.Transport == config.H2 {
+			h2Config.Certs = s.certStore()
+			h2Config.ClientAuth = s.clientAuth()
+		}
+
+		s.status.Store(&h2Config.TunnelStatus)
+		h2Server := transport.NewH2Server(s.ctx, h2Config, s.logger)
+		s.restart = h2Server.Restart
+		go h2Server.Start()
+
+	} else if s.config.Transport == config.GRPC {
+		grpcConfig := &transport.GrpcConfig{
+			BindAddr:        s.config.BindAddr,
+			Nodelay:         s.config.Nodelay,
+			KeepAlive:       time.Duration(s.config.Keepalive) * time.Second,
+			HalfCloseLinger: time.Duration(s.config.HalfCloseLinger) * time.Second,
+			Socket:          s.socketOptions(),
+			Heartbeat:       time.Duration(s.config.Heartbeat) * time.Second,
+			Token:           s.config.Token,
+			ChannelSize:     s.config.ChannelSize,
+			Ports:           s.config.Ports,
+			Sniffer:         s.config.Sniffer,
+			WebPort:         s.config.WebPort,
+			SnifferLog:      s.config.SnifferLog,
+			Mode:            s.config.Transport,
+			ForwardSource:   s.config.ForwardSource,
+			ServiceName:     s.config.GrpcService,
+			TLS:             s.config.GrpcTLS,
+		}
+
+		if s.config.GrpcTLS {
+			grpcConfig.Certs = s.certStore()
+			grpcConfig.ClientAuth = s.clientAuth()
+		}
+
+		s.status.Store(&grpcConfig.TunnelStatus)
+		grpcServer := transport.NewGrpcServer(s.ctx, grpcConfig, s.logger)
+		s.restart = grpcServer.Restart
+		go grpcServer.Start()
+
+	} else if s.config.Transport == config.SPLITHTTP || s.config.Transport == config.SPLITHTTPS {
+		splitConfig := &transport.SplitHTTPConfig{
+			BindAddr:        s.config.BindAddr,
+			Nodelay:         s.config.Nodelay,
+			KeepAlive:       time.Duration(s.config.Keepalive) * time.Second,
+			HalfCloseLinger: time.Duration(s.config.HalfCloseLinger) * time.Second,
+			Socket:          s.socketOptions(),
+			Heartbeat:       time.Duration(s.config.Heartbeat) * time.Second,
+			Token:           s.config.Token,
+			ChannelSize:     s.config.ChannelSize,
+			Ports:           s.config.Ports,
+			Sniffer:         s.config.Sniffer,
+			WebPort:         s.config.WebPort,
+			SnifferLog:      s.config.SnifferLog,
+			Mode:            s.config.Transport,
+			ForwardSource:   s.config.ForwardSource,
+			PacketSize:      s.config.SplitPacketSize,
+			Concurrency:     s.config.SplitConcurrency,
+		}
+
+		if s.config.Transport == config.SPLITHTTPS {
+			splitConfig.Certs = s.certStore()
+			splitConfig.ClientAuth = s.clientAuth()
+		}
+
+		s.status.Store(&splitConfig.TunnelStatus)
+		splitServer := transport.NewSplitHTTPServer(s.ctx, splitConfig, s.logger)
+		s.restart = splitServer.Restart
+		go splitServer.Start()
+
+	} else if s.config.Transport == config.KCP {
+		kcpConfig := &transport.KcpConfig{
+			BindAddr:         s.config.BindAddr,
+			Nodelay:          s.config.Nodelay,
+			KeepAlive:        time.Duration(s.config.Keepalive) * time.Second,
+			HalfCloseLinger:  time.Duration(s.config.HalfCloseLinger) * time.Second,
+			Socket:           s.socketOptions(),
+			Heartbeat:        time.Duration(s.config.Heartbeat) * time.Second,
+			Token:            s.config.Token,
+			ChannelSize:      s.config.ChannelSize,
+			Ports:            s.config.Ports,
+			MuxCon:           s.config.MuxCon,
+			MuxVersion:       s.config.MuxVersion,
+			MaxFrameSize:     s.config.MaxFrameSize,
+			MaxReceiveBuffer: s.config.MaxReceiveBuffer,
+			MaxStreamBuffer:  s.config.MaxStreamBuffer,
+			Sniffer:          s.config.Sniffer,
+			WebPort:          s.config.WebPort,
+			SnifferLog:       s.config.SnifferLog,
+			ForwardSource:    s.config.ForwardSource,
+			KcpNodelay:       s.config.KcpNodelay,
+			Interval:         s.config.KcpInterval,
+			Resend:           s.config.KcpResend,
+			NoCongestion:     s.config.KcpNoCongestion,
+			SndWnd:           s.config.KcpSndWnd,
+			RcvWnd:           s.config.KcpRcvWnd,
+			MTU:              s.config.KcpMTU,
+			DataShard:        s.config.KcpDataShard,
+			ParityShard:      s.config.KcpParityShard,
+		}
+
+		s.status.Store(&kcpConfig.TunnelStatus)
+		kcpServer := transport.NewKcpServer(s.ctx, kcpConfig, s.logger)
+		s.restart = kcpServer.Restart
+		go kcpServer.Start()
+
 	} else if s.config.Transport == config.QUIC {
 		quicConfig := &transport.QuicConfig{
-			BindAddr:    s.config.BindAddr,
-			Nodelay:     s.config.Nodelay,
-			KeepAlive:   time.Duration(s.config.Keepalive) * time.Second,
-			Heartbeat:   time.Duration(s.config.Heartbeat) * time.Second,
-			Token:       s.config.Token,
-			MuxCon:      s.config.MuxCon,
-			ChannelSize: s.config.ChannelSize,
-			Ports:       s.config.Ports,
-			Sniffer:     s.config.Sniffer,
-			WebPort:     s.config.WebPort,
-			SnifferLog:  s.config.SnifferLog,
-			TLSCertFile: s.config.TLSCertFile,
-			TLSKeyFile:  s.config.TLSKeyFile,
+			BindAddr:        s.config.BindAddr,
+			Nodelay:         s.config.Nodelay,
+			KeepAlive:       time.Duration(s.config.Keepalive) * time.Second,
+			HalfCloseLinger: time.Duration(s.config.HalfCloseLinger) * time.Second,
+			Socket:          s.socketOptions(),
+			Heartbeat:       time.Duration(s.config.Heartbeat) * time.Second,
+			Token:           s.config.Token,
+			MuxCon:          s.config.MuxCon,
+			ChannelSize:     s.config.ChannelSize,
+			Ports:           s.config.Ports,
+			Sniffer:         s.config.Sniffer,
+			WebPort:         s.config.WebPort,
+			SnifferLog:      s.config.SnifferLog,
+			ForwardSource:   s.config.ForwardSource,
+			AcceptUDP:       s.config.AcceptUDP,
+			UDPSessions:     s.udpSessions(),
 		}
 
+		quicConfig.Certs = s.certStore()
+		quicConfig.ClientAuth = s.clientAuth()
+
+		s.status.Store(&quicConfig.TunnelStatus)
 		quicServer := transport.NewQuicServer(s.ctx, quicConfig, s.logger)
+		s.restart = quicServer.Restart
 		go quicServer.TunnelListener()
 
 	} else if s.config.Transport == config.UDP {
@@ -154,9 +342,14 @@ func (s *Server) Start() {
 			Sniffer:     s.config.Sniffer,
 			WebPort:     s.config.WebPort,
 			SnifferLog:  s.config.SnifferLog,
+			FEC:         fecConfig(s.config.FecDataShards, s.config.FecParityShards, s.config.FecGroupTimeout),
+			UDPSessions: s.udpSessions(),
+			Socket:      s.socketOptions(),
 		}
 
+		s.status.Store(&udpConfig.TunnelStatus)
 		udpServer := transport.NewUDPServer(s.ctx, udpConfig, s.logger)
+		s.restart = udpServer.Restart
 		go udpServer.Start()
 
 	} else {
@@ -177,3 +370,101 @@ func (s *Server) Stop() {
 		s.cancel()
 	}
 }
+
+// Status returns the tunnel status reported by the running transport
+func (s *Server) Status() string {
+	status := s.status.Load()
+	if status == nil {
+		return ""
+	}
+	return status.Get()
+}
+
+// Restart drops the control channel of the running transport and waits for a new one
+func (s *Server) Restart() {
+	if s.restart != nil {
+		s.restart()
+	}
+}
+
+// Transport returns the transport type of the server
+func (s *Server) Transport() config.TransportType {
+	return s.config.Transport
+}
+
+// fecConfig returns the UDP FEC parameters, nil when FEC is disabled
+func fecConfig(dataShards, parityShards, groupTimeout int) *utils.FECConfig {
+	if parityShards <= 0 {
+		return nil
+	}
+
+	return &utils.FECConfig{
+		DataShards:   dataShards,
+		ParityShards: parityShards,
+		GroupTimeout: time.Duration(groupTimeout) * time.Millisecond,
+	}
+}
+
+// udpSessions returns the lifecycle settings of the UDP sessions of the local ports
+func (s *Server) udpSessions() *transport.UDPSessionOptions {
+	return &transport.UDPSessionOptions{
+		IdleTimeout:  time.Duration(s.config.UDPIdleTimeout) * time.Second,
+		MaxSessions:  s.config.UDPMaxSessions,
+		MaxPerSource: s.config.UDPMaxPerSource,
+		BufferSize:   s.config.UDPSessionBuffer,
+		DropOldest:   s.config.UDPDropPolicy == "drop-oldest",
+	}
+}
+
+// socketOptions returns the tcp socket options of the tunnel, nil when none is set
+func (s *Server) socketOptions() *utils.SocketOptions {
+	socket := &utils.SocketOptions{
+		Congestion:   s.config.TCPCongestion,
+		NotSentLowat: s.config.TCPNotSentLowat,
+		UserTimeout:  time.Duration(s.config.TCPUserTimeout) * time.Second,
+		FastOpen:     s.config.TCPFastOpen,
+		DSCP:         s.config.DSCP,
+	}
+	if *socket == (utils.SocketOptions{}) {
+		return nil
+	}
+	if err := socket.Validate(); err != nil {
+		s.logger.Fatalf("invalid socket options: %v", err)
+	}
+	return socket
+}
+
+// certStore returns the certificate of the tls transports, a self-signed one is generated
+// when tls_cert and tls_key do not exist
+func (s *Server) certStore() *transport.CertStore {
+	certs, err := transport.NewCertStore(s.ctx, s.config.TLSCertFile, s.config.TLSKeyFile, s.config.BindAddr, s.logger)
+	if err != nil {
+		s.logger.Fatalf("failed to load TLS certificate: %v", err)
+	}
+	return certs
+}
+
+// clientAuth returns the mutual TLS settings of the tls transports, nil when tls_client_ca is not set
+func (s *Server) clientAuth() *transport.ClientAuthOptions {
+	if s.config.TLSClientCA == "" {
+		return nil
+	}
+
+	pool, err := transport.LoadClientCAs(s.config.TLSClientCA)
+	if err != nil {
+		s.logger.Fatalf("failed to load tls_client_ca: %v", err)
+	}
+
+	opts := &transport.ClientAuthOptions{
+		ClientCAs: pool,
+		Required:  s.config.TLSClientAuth != "optional",
+	}
+	for _, tenant := range s.config.Tenants {
+		opts.Tenants = append(opts.Tenants, transport.Tenant{
+			Name:     tenant.Name,
+			Identity: tenant.Identity,
+			Ports:    tenant.Ports,
+		})
+	}
+	return opts
+}
@@ -1,10 +1,11 @@
 package transport
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"io"
 	"net"
-	"sync"
 	"time"
 
 	"github.com/musix/backhaul/internal/utils"
@@ -20,8 +21,11 @@ func (s *TcpTransport) udpListener(localAddr string, remoteAddr string) {
 		s.logger.Fatalf("failed to resolve local address: %v", err)
 	}
 
-	listener, err := net.ListenUDP("udp", localUDPAddr)
+	listener, err := listenUDP(s.ctx, localUDPAddr, s.logger)
 	if err != nil {
+		if errors.Is(err, context.Canceled) { // stopped while waiting for the address
+			return
+		}
 		s.logger.Fatalf("failed to listen on local UDP port: %v", err)
 	}
 
@@ -30,19 +34,49 @@ func (s *TcpTransport) udpListener(localAddr string, remoteAddr string) {
 	s.logger.Infof("UDP listener started successfully, listening on address: %s", listener.LocalAddr().String())
 
 	// Track active connections
-	activeConnections := map[string]*LocalAcceptUDPConn{}
+	sessions := newUDPSessionTable(s.config.UDPSessions, s.usageMonitor, s.logger)
 
-	// Buffer for UDP reads
-	buf := make([]byte, BufferSize-2) // 2 bytes reserved for header
+	// Datagrams are read in batches, 2 bytes of the buffer size are reserved for the header
+	batch := utils.NewUDPBatch(listener, BufferSize-2)
 
 	// make a new channel for recieve udp packets
 	udpChan := make(chan *LocalAcceptUDPConn, s.config.ChannelSize)
 
-	//mutex
-	mu := &sync.Mutex{}
-
 	// handle channel
-	go s.handleUDPLoop(udpChan, &activeConnections, mu)
+	go s.handleUDPLoop(udpChan)
+
+	handle := func(data []byte, addr *net.UDPAddr) {
+		// Send the payload to the session of the client, a congested session is replaced by a new one.
+		// The congested session keeps transferring its buffered packets until it is idle, closing it
+		// right away could abruptly disconnect the TCP connection and lose data.
+		if sessions.push(addr, data) {
+			return
+		}
+
+		newUDPConn := &LocalAcceptUDPConn{
+			udpSession:  sessions.add(addr, data),
+			timeCreated: time.Now().UnixNano(), // Just for debugging
+			remoteAddr:  remoteAddr,
+			listener:    listener,
+			clientAddr:  addr,
+			sessions:    sessions,
+		}
+
+		select {
+		case udpChan <- newUDPConn:
+			s.logger.Debugf("accepted UDP connection from %s", addr.String())
+
+			select {
+			case s.reqNewConnChan <- struct{}{}: // Successfully requested a new tcp connection
+			default: // The channel is full, do nothing
+				s.logger.Warn("channel is full, cannot request a new connection")
+			}
+
+		default:
+			s.logger.Warn("UDP channel is full, dropping packet.")
+			newUDPConn.release()
+		}
+	}
 
 	go func() {
 		for {
@@ -50,73 +84,11 @@ func (s *TcpTransport) udpListener(localAddr string, remoteAddr string) {
 			case <-s.ctx.Done():
 				return
 			default:
-				n, addr, err := listener.ReadFromUDP(buf)
-				if err != nil {
-					s.logger.Errorf("failed to read from UDP listener: %v", err)
-					continue
-				}
-
-				// Create a unique identifier for the connection based on IP and port
-				key := addr.String()
-
-				mu.Lock()
-				// Check if the connection is already active
-				if existingConn, exists := activeConnections[key]; exists {
-					if existingConn.IsCongested {
-						s.logger.Debugf("connection with timestamp %d congested. Removing %s from active connections due to network congestion", existingConn.timeCreated, addr.String())
-						// For congested connections, closing the payload channel immediately can cause abrupt TCP disconnection,
-						// potentially leading to data loss. Instead, allow the connection to keep transferring data for 30 more
-						// seconds (or until the payload channel becomes idle). The timer will close the TCP connection once it
-						// times out. Further testing is needed to confirm this strategy's effect on overall performance and congestion handling.
-
-					} else {
-						// If it exists, send the payload to the existing connection's payload channel
-						select {
-						case existingConn.payload <- append([]byte(nil), buf[:n]...): // Copy the packet to avoid data overwriting
-							s.logger.Tracef("buffered %d bytes for existing connection %s", n, addr.String())
-
-						default:
-							s.logger.Warnf("payload channel for connection %s is full, dropping udp packet", addr.String())
-						}
-						mu.Unlock()
-						continue
-					}
-				}
-
-				mu.Unlock()
-
-				// Create a new payload channel for this connection,  Buffer up to 100,0000 packets for the connection
-				// Generally affect the upload speed
-				payloadChan := make(chan []byte, 100_000)
-
-				// build the UDP packet
-				newUDPConn := LocalAcceptUDPConn{
-					timeCreated: time.Now().UnixNano(), // Just for debugging
-					payload:     payloadChan,
-					remoteAddr:  remoteAddr,
-					listener:    listener,
-					clientAddr:  addr,
-					IsCongested: false,
-				}
-
-				mu.Lock()
-				// store the connection info
-				activeConnections[key] = &newUDPConn
-				mu.Unlock()
-
-				select {
-				case udpChan <- &newUDPConn:
-					s.logger.Debugf("accepted UDP connection from %s", addr.String())
-					payloadChan <- append([]byte(nil), buf[:n]...) // send a copy of the new payload to the channel
-
-					select {
-					case s.reqNewConnChan <- struct{}{}: // Successfully requested a new tcp connection
-					default: // The channel is full, do nothing
-						s.logger.Warn("channel is full, cannot request a new connection")
+				if err := batch.ReadBatch(handle); err != nil {
+					if errors.Is(err, net.ErrClosed) {
+						return
 					}
-
-				default:
-					s.logger.Warn("UDP channel is full, dropping packet.")
+					s.logger.Errorf("failed to read from UDP listener: %v", err)
 				}
 			}
 		}
@@ -125,7 +97,7 @@ func (s *TcpTransport) udpListener(localAddr string, remoteAddr string) {
 	<-s.ctx.Done()
 }
 
-func (s *TcpTransport) handleUDPLoop(udpChan chan *LocalAcceptUDPConn, activeConnections *map[string]*LocalAcceptUDPConn, mu *sync.Mutex) {
+func (s *TcpTransport) handleUDPLoop(udpChan chan *LocalAcceptUDPConn) {
 	for {
 		select {
 		case <-s.ctx.Done():
@@ -146,7 +118,7 @@ func (s *TcpTransport) handleUDPLoop(udpChan chan *LocalAcceptUDPConn, activeCon
 					}
 
 					// Handle data exchange between connections
-					go UDPConnectionHandler(localConn, tunnelConn, s.logger, s.usageMonitor, localConn.listener.LocalAddr().(*net.UDPAddr).Port, s.config.Sniffer, s.rtt, activeConnections, mu)
+					go UDPConnectionHandler(localConn, tunnelConn, s.logger, s.usageMonitor, localConn.listener.LocalAddr().(*net.UDPAddr).Port, s.config.Sniffer, s.rtt)
 
 					s.logger.Debugf("initiate new handler for connection %s with timestamp %d", localConn.clientAddr.String(), localConn.timeCreated)
 					break loop
@@ -156,7 +128,7 @@ func (s *TcpTransport) handleUDPLoop(udpChan chan *LocalAcceptUDPConn, activeCon
 	}
 }
 
-func UDPConnectionHandler(udp *LocalAcceptUDPConn, tcp net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool, rtt int64, activeConnections *map[string]*LocalAcceptUDPConn, mu *sync.Mutex) {
+func UDPConnectionHandler(udp *LocalAcceptUDPConn, tcp net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool, rtt int64) {
 	done := make(chan struct{})
 
 	if rtt == 0 {
@@ -177,20 +149,22 @@ func UDPConnectionHandler(udp *LocalAcceptUDPConn, tcp net.Conn, logger *logrus.
 
 	<-done
 
-	mu.Lock()
-	close(udp.payload)
+	udp.release()
+}
 
-	if !udp.IsCongested {
-		delete(*activeConnections, udp.clientAddr.String())
-	}
-	mu.Unlock()
+// release removes the UDP client from the sessions of its listener once it is handled
+func (udp *LocalAcceptUDPConn) release() {
+	udp.sessions.remove(udp.udpSession)
 }
 
 func udpToTCP(tcp net.Conn, udp *LocalAcceptUDPConn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
-	// Create a header (2 bytes) to hold the size of the data
-	header := make([]byte, 2)
+	// Frame of a packet, a 2 bytes header holding the size of the data followed by the data
+	frame := utils.GetBuffer(BufferSize)[:2]
+	defer utils.PutBuffer(frame)
 
-	inactivityTimeout := 60 * time.Second // Define a 60-second inactivity timeout
+	inactivityTimeout := udp.sessions.opts.idleTimeout()
+	idle := time.NewTimer(inactivityTimeout)
+	defer idle.Stop()
 
 	for {
 		select {
@@ -198,6 +172,7 @@ func udpToTCP(tcp net.Conn, udp *LocalAcceptUDPConn, logger *logrus.Logger, usag
 			if !ok {
 				return
 			}
+			idle.Reset(inactivityTimeout)
 
 			packetSize := len(data) // Calculate the packet size (data length)
 
@@ -207,10 +182,11 @@ func udpToTCP(tcp net.Conn, udp *LocalAcceptUDPConn, logger *logrus.Logger, usag
 				continue
 			}
 
-			binary.BigEndian.PutUint16(header, uint16(packetSize)) // Store the packet size at 2 bytes
+			binary.BigEndian.PutUint16(frame, uint16(packetSize)) // Store the packet size at 2 bytes
 
-			// Prepend the header to the data
-			packet := append(header, data...)
+			// Prepend the header to the data, the pooled buffer of the data is released right away
+			packet := append(frame[:2], data...)
+			utils.ReleasePacket(data)
 
 			totalWritten := 0
 			for totalWritten < len(packet) { // Use the total packet length (header + data)
@@ -228,15 +204,24 @@ func udpToTCP(tcp net.Conn, udp *LocalAcceptUDPConn, logger *logrus.Logger, usag
 				usage.AddOrUpdatePort(remotePort, uint64(totalWritten))
 			}
 
-		case <-time.After(inactivityTimeout): // Timeout after 30 seconds of inactivity
-			logger.Debugf("connection with timestamp %d and address %s idle for 60 seconds, closing", udp.timeCreated, udp.clientAddr.String())
+		case <-udp.evicted:
+			return
+
+		case <-idle.C:
+			// packets from the tunnel keep the session open as well
+			if remaining := inactivityTimeout - udp.idle(); remaining > 0 {
+				idle.Reset(remaining)
+				continue
+			}
+			logger.Debugf("connection with timestamp %d and address %s idle for %v, closing", udp.timeCreated, udp.clientAddr.String(), inactivityTimeout)
 			return
 		}
 	}
 }
 
 func tcpToUDP(tcp net.Conn, udp *LocalAcceptUDPConn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool, rtt int64) {
-	buf := make([]byte, BufferSize)
+	buf := utils.GetBuffer(BufferSize)
+	defer utils.PutBuffer(buf)
 	lenBuf := make([]byte, 2)       // Buffer to store the 2-byte packet length
 	timestampBuf := make([]byte, 4) // Buffer for timestamp (4 bytes)
 
@@ -262,8 +247,8 @@ func tcpToUDP(tcp net.Conn, udp *LocalAcceptUDPConn, logger *logrus.Logger, usag
 		packetAge := lastMillis - packetTimestamp
 
 		// If the packet age exceeds the threshold (3x RTT), flag the connection as congested
-		if packetAge > 3*rtt {
-			udp.IsCongested = true
+		if packetAge > 3*rtt && udp.congested.CompareAndSwap(false, true) {
+			logger.Debugf("connection %s is congested, packet age %d ms, new packets start a new connection", udp.clientAddr.String(), packetAge)
 		}
 
 		// Read the 2-byte packet length header from the TCP connection
@@ -309,6 +294,7 @@ func tcpToUDP(tcp net.Conn, udp *LocalAcceptUDPConn, logger *logrus.Logger, usag
 
 				totalWritten += w
 			}
+			udp.touch()
 
 			if sniffer {
 				usage.AddOrUpdatePort(remotePort, uint64(totalWritten))
@@ -318,3 +304,128 @@ func tcpToUDP(tcp net.Conn, udp *LocalAcceptUDPConn, logger *logrus.Logger, usag
 		}
 	}
 }
+
+// udpFlowListener is the UDP listener of accept_udp on the mux and websocket transports. Every new client
+// address is queued on localChannel like an accepted TCP connection, and its packets are buffered in the
+// payload channel until a tunnel stream is opened for it.
+func udpFlowListener(ctx context.Context, localAddr string, remoteAddr string, forwardSource bool, localChannel chan LocalTCPConn, opts *UDPSessionOptions, usage *web.Usage, logger *logrus.Logger) {
+	localUDPAddr, err := net.ResolveUDPAddr("udp", localAddr)
+	if err != nil {
+		logger.Fatalf("failed to resolve local address: %v", err)
+	}
+
+	listener, err := listenUDP(ctx, localUDPAddr, logger)
+	if err != nil {
+		if errors.Is(err, context.Canceled) { // stopped while waiting for the address
+			return
+		}
+		logger.Fatalf("failed to listen on local UDP port: %v", err)
+	}
+
+	defer listener.Close()
+
+	logger.Infof("UDP listener started successfully, listening on address: %s", listener.LocalAddr().String())
+
+	// Track active connections
+	sessions := newUDPSessionTable(opts, usage, logger)
+
+	// Datagrams are read in batches, 2 bytes of the buffer size are reserved for the header
+	batch := utils.NewUDPBatch(listener, BufferSize-2)
+
+	handle := func(data []byte, addr *net.UDPAddr) {
+		// A congested connection keeps draining its payload, new packets start a new connection
+		if sessions.push(addr, data) {
+			return
+		}
+
+		newUDPConn := &LocalAcceptUDPConn{
+			udpSession:  sessions.add(addr, data),
+			timeCreated: time.Now().UnixNano(), // Just for debugging
+			remoteAddr:  remoteAddr,
+			listener:    listener,
+			clientAddr:  addr,
+			sessions:    sessions,
+		}
+
+		target := remoteAddr
+		if forwardSource {
+			target = remoteAddr + "#" + addr.String()
+		}
+
+		select {
+		case localChannel <- LocalTCPConn{udp: newUDPConn, remoteAddr: target, timeCreated: time.Now().UnixMilli()}:
+			logger.Debugf("accepted UDP connection from %s", addr.String())
+
+		default: // channel is full, discard the connection
+			logger.Warnf("local listener channel is full, discarding UDP connection from %s", addr.String())
+			newUDPConn.release()
+		}
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+				if err := batch.ReadBatch(handle); err != nil {
+					if errors.Is(err, net.ErrClosed) {
+						return
+					}
+					logger.Errorf("failed to read from UDP listener: %v", err)
+				}
+			}
+		}
+	}()
+
+	<-ctx.Done()
+}
+
+// close closes a local connection that could not be forwarded, a UDP client is released from its listener
+func (c LocalTCPConn) close() {
+	if c.udp != nil {
+		c.udp.release()
+		return
+	}
+	c.conn.Close()
+}
+
+// sendLocalConn sends the target of a local connection over a tunnel stream, marked as TCP or UDP. The
+// target of a TCP connection is also marked when mark is set, its stream is then framed for half-close.
+func sendLocalConn(stream net.Conn, c LocalTCPConn, mark bool) error {
+	if c.udp != nil {
+		return utils.SendBinaryTransportString(stream, c.remoteAddr, utils.SG_UDP)
+	}
+	return utils.SendBinaryTransportString(stream, utils.HalfCloseMark(c.remoteAddr, mark), utils.SG_TCP)
+}
+
+// handleLocalConn exchanges the data of a local connection with its tunnel stream. The packets of a UDP
+// client use the length-prefixed framing of udpToTCP and tcpToUDP. TCP connections are only forwarded over
+// mux streams here, their data is framed so that the stream can be half-closed when halfClose was
+// negotiated with the client.
+func handleLocalConn(stream net.Conn, c LocalTCPConn, logger *logrus.Logger, usage *web.Usage, sniffer bool, halfClose bool, linger time.Duration) {
+	if c.udp == nil {
+		conn, linger := utils.MuxStreamConn(stream, halfClose, linger)
+		utils.TCPConnectionHandler(conn, c.conn, logger, usage, c.conn.LocalAddr().(*net.TCPAddr).Port, sniffer, linger)
+		return
+	}
+
+	remotePort := c.udp.listener.LocalAddr().(*net.UDPAddr).Port
+	done := make(chan struct{})
+
+	go func() {
+		udpToTCP(stream, c.udp, logger, usage, remotePort, sniffer)
+		stream.Close()
+		close(done)
+	}()
+
+	// the stream transports do not measure the RTT, use the default of UDPConnectionHandler
+	tcpToUDP(stream, c.udp, logger, usage, remotePort, sniffer, 100)
+	stream.Close()
+
+	// release the client right away, its next packets start a new stream instead of waiting in the
+	// session of the closed one, and udpToTCP stops with its payload
+	c.udp.release()
+
+	<-done
+}
@@ -0,0 +1,156 @@
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// startTestUDPFlowListener runs the accept_udp listener of the stream transports on a free port
+func startTestUDPFlowListener(t *testing.T, forwardSource bool) (*net.UDPAddr, chan LocalTCPConn) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	probe, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := probe.LocalAddr().(*net.UDPAddr)
+	probe.Close()
+
+	localChannel := make(chan LocalTCPConn, 4)
+	go udpFlowListener(ctx, addr.String(), "5353", forwardSource, localChannel, nil, nil, logger)
+	time.Sleep(50 * time.Millisecond)
+	return addr, localChannel
+}
+
+func acceptTestUDPFlow(t *testing.T, localChannel chan LocalTCPConn) LocalTCPConn {
+	select {
+	case local := <-localChannel:
+		if local.udp == nil {
+			t.Fatal("udp client queued as a tcp connection")
+		}
+		return local
+	case <-time.After(5 * time.Second):
+		t.Fatal("udp client not queued")
+	}
+	return LocalTCPConn{}
+}
+
+// readTestFrame reads a packet framed by udpToTCP
+func readTestFrame(t *testing.T, r io.Reader) string {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatalf("read frame header: %v", err)
+	}
+	data := make([]byte, binary.BigEndian.Uint16(header))
+	if _, err := io.ReadFull(r, data); err != nil {
+		t.Fatalf("read frame: %v", err)
+	}
+	return string(data)
+}
+
+// writeTestFrame writes a packet as the client frames it, with the timestamp of udpToTCP of the client
+func writeTestFrame(w io.Writer, data string) error {
+	frame := make([]byte, 6, 6+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(time.Now().UnixMilli()%(10*60*1000)))
+	binary.BigEndian.PutUint16(frame[4:], uint16(len(data)))
+	_, err := w.Write(append(frame, data...))
+	return err
+}
+
+func TestUDPFlowListener(t *testing.T) {
+	addr, localChannel := startTestUDPFlowListener(t, false)
+
+	client, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// the first packet of a client queues it with its target, the next ones wait in its session
+	client.Write([]byte("first"))
+	local := acceptTestUDPFlow(t, localChannel)
+	client.Write([]byte("second"))
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-localChannel:
+		t.Error("packet of a known client queued as a new client")
+	default:
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	stream, tunnel := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleLocalConn(stream, local, logger, nil, false, false, 0)
+		close(done)
+	}()
+
+	// the packets of the client are framed over the stream in order
+	for _, expected := range []string{"first", "second"} {
+		if data := readTestFrame(t, tunnel); data != expected {
+			t.Errorf("stream received %q, expected %q", data, expected)
+		}
+	}
+
+	// the answers go back to the client
+	for _, answer := range []string{"answer", "again"} {
+		if err := writeTestFrame(tunnel, answer); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 64)
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := client.Read(buf)
+		if err != nil || string(buf[:n]) != answer {
+			t.Errorf("client received %q %v, expected %q", buf[:n], err, answer)
+		}
+	}
+
+	// the end of the stream releases the client, its next packet queues it again
+	tunnel.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("udp client not released at the end of its stream")
+	}
+	client.Write([]byte("later"))
+	acceptTestUDPFlow(t, localChannel)
+}
+
+func TestUDPFlowListenerTarget(t *testing.T) {
+	for _, c := range []struct {
+		name          string
+		forwardSource bool
+	}{
+		{"target", false},
+		{"target with the source", true},
+	} {
+		addr, localChannel := startTestUDPFlowListener(t, c.forwardSource)
+
+		client, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Write([]byte("packet"))
+		local := acceptTestUDPFlow(t, localChannel)
+
+		expected := "5353"
+		if c.forwardSource {
+			expected += "#" + client.LocalAddr().String()
+		}
+		if local.remoteAddr != expected {
+			t.Errorf("%s: %q, expected %q", c.name, local.remoteAddr, expected)
+		}
+		local.close()
+		client.Close()
+	}
+}
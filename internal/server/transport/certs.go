@@ -0,0 +1,300 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	selfSignedName     = "backhaul"          // common name of the generated certificates
+	selfSignedValidity = 90 * 24 * time.Hour // lifetime of a generated certificate
+	selfSignedRenewal  = 30 * 24 * time.Hour // a generated certificate is rotated this long before expiry
+	certCheckInterval  = 10 * time.Second    // how often the files are checked for changes
+	certRenewInterval  = 6 * time.Hour       // how often the expiry is checked
+)
+
+// CertStore serves the certificate of the TLS transports. A self-signed ECDSA certificate is generated
+// when the files do not exist, and it is rotated with the same key before it expires, so the pins of the
+// clients stay valid. The files are reloaded when they change on disk, without restarting the server.
+type CertStore struct {
+	certFile string
+	keyFile  string
+	host     string // name of the generated certificates
+	logger   *logrus.Logger
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time // latest modification time of the loaded files
+}
+
+func NewCertStore(ctx context.Context, certFile string, keyFile string, bindAddr string, logger *logrus.Logger) (*CertStore, error) {
+	host, _, err := net.SplitHostPort(bindAddr)
+	if err != nil || host == "" || net.ParseIP(host).IsUnspecified() {
+		host = "localhost"
+	}
+
+	c := &CertStore{
+		certFile: certFile,
+		keyFile:  keyFile,
+		host:     host,
+		logger:   logger,
+	}
+
+	// generate the certificate on first start, the tunnels using the same files wait for the first one
+	unlock := lockCertFiles(certFile, keyFile)
+	if !fileExists(certFile) && !fileExists(keyFile) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			unlock()
+			return nil, fmt.Errorf("failed to generate key: %w", err)
+		}
+		if err := c.writeSelfSigned(key, true); err != nil {
+			unlock()
+			return nil, err
+		}
+		logger.Infof("generated a self-signed ECDSA certificate in %s", certFile)
+	}
+
+	err = c.load()
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	go c.watch(ctx)
+
+	return c, nil
+}
+
+// certFileLocks serializes the generation and the rotation of the certificates of a pair of files, the
+// listeners of several tunnels may share the default files
+var certFileLocks sync.Map // certificate and key paths -> *sync.Mutex
+
+// lockCertFiles locks a pair of files for the stores of the process and returns the unlock function
+func lockCertFiles(certFile string, keyFile string) func() {
+	pair := [2]string{certFile, keyFile}
+	for i, path := range pair {
+		if abs, err := filepath.Abs(path); err == nil {
+			pair[i] = abs
+		}
+	}
+
+	lock, _ := certFileLocks.LoadOrStore(pair, &sync.Mutex{})
+	mu := lock.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// GetCertificate returns the current certificate, for tls.Config
+func (c *CertStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// load reads the certificate and key files and logs the pin of the certificate
+func (c *CertStore) load() error {
+	modTime := c.filesModTime()
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.modTime = modTime
+	c.mu.Unlock()
+
+	leaf := cert.Leaf
+	pin := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	fingerprint := sha256.Sum256(leaf.Raw)
+	c.logger.Infof("loaded TLS certificate %s, valid until %s", c.certFile, leaf.NotAfter.Format(time.RFC3339))
+	c.logger.Infof("TLS certificate pin: sha256/%s (fingerprint %s)", base64.StdEncoding.EncodeToString(pin[:]), hex.EncodeToString(fingerprint[:]))
+
+	return nil
+}
+
+// watch reloads the files when they change and rotates the generated certificate before it expires
+func (c *CertStore) watch(ctx context.Context) {
+	checkTicker := time.NewTicker(certCheckInterval)
+	defer checkTicker.Stop()
+
+	renewTicker := time.NewTicker(certRenewInterval)
+	defer renewTicker.Stop()
+
+	c.renew()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-checkTicker.C:
+			c.mu.RLock()
+			modTime := c.modTime
+			c.mu.RUnlock()
+
+			if c.filesModTime().Equal(modTime) {
+				continue
+			}
+			// a file may still be half written, keep the current certificate until both are valid
+			if err := c.load(); err != nil {
+				c.logger.Errorf("failed to reload TLS certificate: %v", err)
+			}
+
+		case <-renewTicker.C:
+			c.renew()
+		}
+	}
+}
+
+// renew rotates the generated certificate when it is about to expire, other certificates are only warned about
+func (c *CertStore) renew() {
+	unlock := lockCertFiles(c.certFile, c.keyFile)
+	defer unlock()
+
+	c.mu.RLock()
+	modTime := c.modTime
+	c.mu.RUnlock()
+
+	// another store of the same files may have rotated the certificate already
+	if !c.filesModTime().Equal(modTime) {
+		if err := c.load(); err != nil {
+			c.logger.Errorf("failed to reload TLS certificate: %v", err)
+			return
+		}
+	}
+
+	c.mu.RLock()
+	cert := c.cert
+	c.mu.RUnlock()
+
+	leaf := cert.Leaf
+	if time.Until(leaf.NotAfter) > selfSignedRenewal {
+		return
+	}
+
+	if !isSelfSigned(leaf) {
+		c.logger.Warnf("TLS certificate %s expires on %s, replace it", c.certFile, leaf.NotAfter.Format(time.RFC3339))
+		return
+	}
+
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		c.logger.Errorf("failed to rotate TLS certificate: unsupported key type %T", cert.PrivateKey)
+		return
+	}
+
+	// the key is kept, the pins of the clients are the same for the new certificate
+	if err := c.writeSelfSigned(signer, false); err != nil {
+		c.logger.Errorf("failed to rotate TLS certificate: %v", err)
+		return
+	}
+	if err := c.load(); err != nil {
+		c.logger.Errorf("failed to reload TLS certificate: %v", err)
+		return
+	}
+	c.logger.Infof("rotated self-signed TLS certificate %s", c.certFile)
+}
+
+// writeSelfSigned writes a new self-signed certificate for key, and the key itself when writeKey is set
+func (c *CertStore) writeSelfSigned(key crypto.Signer, writeKey bool) error {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: selfSignedName},
+		NotBefore:             time.Now().Add(-time.Hour), // tolerate clock skew of the clients
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if ip := net.ParseIP(c.host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{c.host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate: %w", err)
+	}
+
+	if writeKey {
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return fmt.Errorf("failed to encode key: %w", err)
+		}
+		if err := writePEM(c.keyFile, "PRIVATE KEY", keyDER, 0o600); err != nil {
+			return err
+		}
+	}
+
+	return writePEM(c.certFile, "CERTIFICATE", der, 0o644)
+}
+
+// filesModTime returns the latest modification time of the certificate and key files
+func (c *CertStore) filesModTime() time.Time {
+	var modTime time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return modTime
+}
+
+// isSelfSigned reports whether cert is a certificate generated by the store
+func isSelfSigned(cert *x509.Certificate) bool {
+	return cert.Subject.CommonName == selfSignedName && bytes.Equal(cert.RawIssuer, cert.RawSubject)
+}
+
+// writePEM writes a PEM block aside and renames it in place, so a reload never sees a partial file
+func writePEM(path string, blockType string, der []byte, mode os.FileMode) error {
+	if dir := filepath.Dir(path); dir != "" && dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+	}
+
+	tmp := path + ".tmp"
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(tmp, data, mode); err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return !errors.Is(err, os.ErrNotExist)
+}
@@ -0,0 +1,134 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestCertStoreGeneration(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "backhaul.crt"), filepath.Join(dir, "backhaul.key")
+
+	// the tunnels sharing the default files start together
+	stores := make([]*CertStore, 16)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range stores {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			store, err := NewCertStore(ctx, certFile, keyFile, "0.0.0.0:443", logger)
+			if err != nil {
+				t.Errorf("store %d: %v", i, err)
+				return
+			}
+			stores[i] = store
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	first, _ := stores[0].GetCertificate(nil)
+	if !isSelfSigned(first.Leaf) {
+		t.Error("generated certificate is not self-signed")
+	}
+	if len(first.Leaf.DNSNames) != 1 || first.Leaf.DNSNames[0] != "localhost" {
+		t.Errorf("generated certificate for %v, expected localhost", first.Leaf.DNSNames)
+	}
+	for i, store := range stores[1:] {
+		cert, _ := store.GetCertificate(nil)
+		if !bytes.Equal(cert.Leaf.Raw, first.Leaf.Raw) {
+			t.Errorf("store %d loaded another certificate than store 0", i+1)
+		}
+	}
+}
+
+func TestCertStoreRotation(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	store, err := NewCertStore(ctx, filepath.Join(dir, "backhaul.crt"), filepath.Join(dir, "backhaul.key"), "127.0.0.1:443", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, _ := store.GetCertificate(nil)
+	key := current.PrivateKey.(crypto.Signer)
+
+	for _, c := range []struct {
+		name       string
+		subject    string
+		rotated    bool
+		notAfter   time.Duration
+		selfSigned bool
+	}{
+		{"valid", selfSignedName, false, selfSignedRenewal + time.Hour, true},
+		{"expiring", selfSignedName, true, time.Hour, true},
+		{"expiring, not generated", "example.com", false, time.Hour, false},
+	} {
+		// replace the certificate by one with the same key
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: c.subject},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(c.notAfter),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writePEM(store.certFile, "CERTIFICATE", der, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.load(); err != nil {
+			t.Fatal(err)
+		}
+
+		store.renew()
+
+		cert, _ := store.GetCertificate(nil)
+		if rotated := !bytes.Equal(cert.Leaf.Raw, der); rotated != c.rotated {
+			t.Errorf("%s: rotated %v, expected %v", c.name, rotated, c.rotated)
+			continue
+		}
+		if !c.rotated {
+			continue
+		}
+
+		// the key is kept so that the pins of the clients stay valid
+		if !bytes.Equal(cert.Leaf.RawSubjectPublicKeyInfo, current.Leaf.RawSubjectPublicKeyInfo) {
+			t.Errorf("%s: rotated certificate has a new key", c.name)
+		}
+		if time.Until(cert.Leaf.NotAfter) < selfSignedValidity-time.Hour {
+			t.Errorf("%s: rotated certificate expires on %v", c.name, cert.Leaf.NotAfter)
+		}
+		if len(cert.Leaf.IPAddresses) != 1 || !cert.Leaf.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")) {
+			t.Errorf("%s: rotated certificate for %v, expected 127.0.0.1", c.name, cert.Leaf.IPAddresses)
+		}
+	}
+}
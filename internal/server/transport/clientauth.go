@@ -0,0 +1,114 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ClientAuthOptions are the mutual TLS settings of the TLS transports. The client certificates are
+// verified against ClientCAs, and the identity of the certificate selects the tenant of the client.
+type ClientAuthOptions struct {
+	ClientCAs *x509.CertPool // CA bundle the client certificates are verified against
+	Required  bool           // reject the clients without a certificate, otherwise the token is enough
+	Tenants   []Tenant       // clients identified by their certificate, with their own ports
+}
+
+// Tenant is a client identified by its certificate, it is only served its own ports
+type Tenant struct {
+	Name     string
+	Identity string   // common name or a DNS, email or URI SAN of the client certificate
+	Ports    []string // port mappings opened for the tenant instead of the server ports
+}
+
+// LoadClientCAs reads a PEM bundle of the certificate authorities of the clients
+func LoadClientCAs(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// apply adds the verification of the client certificates to a server TLS configuration,
+// nil options leave it as it is
+func (o *ClientAuthOptions) apply(config *tls.Config) {
+	if o == nil {
+		return
+	}
+
+	config.ClientCAs = o.ClientCAs
+	if o.Required {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+}
+
+// ports returns the port mappings of the client of a new control channel. The client certificate
+// selects its tenant, the server ports are kept when there are no tenants or no certificate.
+func (o *ClientAuthOptions) ports(state *tls.ConnectionState, ports []string, logger *logrus.Logger) ([]string, error) {
+	if o == nil || len(o.Tenants) == 0 {
+		return ports, nil
+	}
+	if state == nil || len(state.PeerCertificates) == 0 {
+		if o.Required {
+			return nil, fmt.Errorf("no client certificate presented")
+		}
+		return ports, nil
+	}
+
+	// the certificate is already verified by the handshake
+	cert := state.PeerCertificates[0]
+	for i := range o.Tenants {
+		tenant := &o.Tenants[i]
+		if certHasIdentity(cert, tenant.Identity) {
+			logger.Infof("client certificate %s authenticated as tenant %s", cert.Subject.CommonName, tenant.Name)
+			return tenant.Ports, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no tenant for client certificate %s", cert.Subject.CommonName)
+}
+
+// connTLSState returns the TLS state of a tunnel connection, nil when it is not wrapped in TLS
+func connTLSState(conn net.Conn) *tls.ConnectionState {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	return &state
+}
+
+// certHasIdentity reports whether the identity is the common name or one of the SANs of cert
+func certHasIdentity(cert *x509.Certificate, identity string) bool {
+	if cert.Subject.CommonName == identity {
+		return true
+	}
+	for _, name := range cert.DNSNames {
+		if name == identity {
+			return true
+		}
+	}
+	for _, email := range cert.EmailAddresses {
+		if email == identity {
+			return true
+		}
+	}
+	for _, uri := range cert.URIs {
+		if uri.String() == identity {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// testCA issues the certificates of the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// issue returns a certificate of the CA, template sets the names and the usage
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func clientCert(t *testing.T, ca *testCA, template *x509.Certificate) *tls.Certificate {
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	cert := ca.issue(t, template)
+	return &cert
+}
+
+// clientAuthHandshake runs a TLS handshake with the client auth options and returns the ports of the client
+func clientAuthHandshake(t *testing.T, opts *ClientAuthOptions, serverCert tls.Certificate, roots *x509.CertPool, cert *tls.Certificate) ([]string, error) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	opts.apply(serverConfig)
+	clientConfig := &tls.Config{RootCAs: roots, ServerName: "tunnel.example.com"}
+	if cert != nil {
+		clientConfig.Certificates = []tls.Certificate{*cert}
+	}
+
+	clientConn, serverConn := net.Pipe()
+	client := tls.Client(clientConn, clientConfig)
+	server := tls.Server(serverConn, serverConfig)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		// the client reads the answer of the server to its certificate
+		if client.Handshake() == nil {
+			client.Read(make([]byte, 1))
+		}
+		clientConn.Close()
+	}()
+	if err := server.Handshake(); err != nil {
+		return nil, err
+	}
+	return opts.ports(connTLSState(server), []string{"443"}, logger)
+}
+
+func TestClientAuthPorts(t *testing.T) {
+	ca := newTestCA(t, "tunnel clients")
+	otherCA := newTestCA(t, "other clients")
+	serverCert := ca.issue(t, &x509.Certificate{DNSNames: []string{"tunnel.example.com"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+
+	spiffe, _ := url.Parse("spiffe://example.com/branch")
+	alice := clientCert(t, ca, &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}})
+	bob := clientCert(t, ca, &x509.Certificate{Subject: pkix.Name{CommonName: "host-17"}, DNSNames: []string{"bob.example.com"}})
+	carol := clientCert(t, ca, &x509.Certificate{EmailAddresses: []string{"carol@example.com"}})
+	branch := clientCert(t, ca, &x509.Certificate{URIs: []*url.URL{spiffe}})
+	mallory := clientCert(t, otherCA, &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}})
+
+	tenants := []Tenant{
+		{Name: "a", Identity: "alice", Ports: []string{"8001"}},
+		{Name: "b", Identity: "bob.example.com", Ports: []string{"8002"}},
+		{Name: "c", Identity: "carol@example.com", Ports: []string{"8003"}},
+		{Name: "branch", Identity: "spiffe://example.com/branch", Ports: []string{"8004"}},
+	}
+	required := &ClientAuthOptions{ClientCAs: ca.pool(), Required: true, Tenants: tenants}
+	optional := &ClientAuthOptions{ClientCAs: ca.pool(), Tenants: tenants}
+	onlyB := &ClientAuthOptions{ClientCAs: ca.pool(), Required: true, Tenants: tenants[1:2]}
+
+	for _, c := range []struct {
+		name     string
+		opts     *ClientAuthOptions
+		cert     *tls.Certificate
+		accepted bool
+		ports    string
+	}{
+		{"common name", required, alice, true, "8001"},
+		{"dns san", required, bob, true, "8002"},
+		{"email san", required, carol, true, "8003"},
+		{"uri san", required, branch, true, "8004"},
+		{"certificate of another tenant", onlyB, alice, false, ""},
+		{"certificate of another ca", required, mallory, false, ""},
+		{"certificate of another ca when optional", optional, mallory, true, "443"}, // not sent, the server only accepts its ca
+		{"missing certificate", required, nil, false, ""},
+		{"missing certificate when optional", optional, nil, true, "443"},
+		{"without tenants", &ClientAuthOptions{ClientCAs: ca.pool(), Required: true}, alice, true, "443"},
+		{"disabled", nil, nil, true, "443"},
+	} {
+		ports, err := clientAuthHandshake(t, c.opts, serverCert, ca.pool(), c.cert)
+		if (err == nil) != c.accepted {
+			t.Errorf("%s: returned %v, expected accepted %v", c.name, err, c.accepted)
+			continue
+		}
+		if c.accepted && (len(ports) != 1 || ports[0] != c.ports) {
+			t.Errorf("%s: ports %v, expected [%s]", c.name, ports, c.ports)
+		}
+	}
+}
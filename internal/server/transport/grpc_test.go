@@ -0,0 +1,167 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/musix/backhaul/internal/config"
+	"github.com/musix/backhaul/internal/utils"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestGrpcServer serves the tunnel service in memory and returns a grpc client of it
+func newTestGrpcServer(t *testing.T) (*GrpcTransport, *grpc.ClientConn) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	s := NewGrpcServer(ctx, &GrpcConfig{
+		Token:       "secret",
+		ChannelSize: 4,
+		KeepAlive:   time.Minute,
+		Heartbeat:   time.Minute,
+		Mode:        config.GRPC,
+		ServiceName: "tunnel.Service",
+	}, logger)
+
+	listener := bufconn.Listen(1 << 20)
+	server := s.newGrpcServer()
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	client, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(utils.GrpcCodec{})),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return s, client
+}
+
+// openTestStream opens a stream as the client does, released is closed once the stream is released
+func openTestStream(client *grpc.ClientConn, method string, token string) (conn *utils.GrpcConn, released chan struct{}, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+
+	desc := &grpc.StreamDesc{StreamName: method, ServerStreams: true, ClientStreams: true}
+	stream, err := client.NewStream(ctx, desc, "/tunnel.Service/"+method)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	if md, err := stream.Header(); err != nil || md == nil {
+		// a refused stream ends without headers, its status is returned by the next receive
+		var msg []byte
+		err = stream.RecvMsg(&msg)
+		cancel()
+		return nil, nil, err
+	}
+
+	released = make(chan struct{})
+	return utils.NewGrpcConn(stream, func() {
+		stream.CloseSend()
+		cancel()
+		close(released)
+	}, nil, nil), released, nil
+}
+
+func TestGrpcToken(t *testing.T) {
+	s, client := newTestGrpcServer(t)
+
+	for _, c := range []struct {
+		name   string
+		method string
+		token  string
+		code   codes.Code
+	}{
+		{"control channel with a wrong token", "Channel", "wrong", codes.Unauthenticated},
+		{"control channel without a token", "Channel", "", codes.Unauthenticated},
+		{"tunnel with a wrong token", "Tunnel", "wrong", codes.Unauthenticated},
+		{"tunnel", "Tunnel", "secret", codes.OK},
+	} {
+		conn, _, err := openTestStream(client, c.method, c.token)
+		if status.Code(err) != c.code {
+			t.Errorf("%s: returned %v, expected %v", c.name, err, c.code)
+			continue
+		}
+		if err == nil {
+			conn.Close()
+		}
+	}
+
+	// only the stream with the token waits in the pool
+	if n := len(s.tunnelChannel); n != 1 {
+		t.Errorf("%d streams in the pool, expected 1", n)
+	}
+}
+
+func TestGrpcTunnelStream(t *testing.T) {
+	s, client := newTestGrpcServer(t)
+
+	conn, released, err := openTestStream(client, "Tunnel", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tunnel TunnelGrpcConn
+	select {
+	case tunnel = <-s.tunnelChannel:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel stream not accepted")
+	}
+	close(tunnel.ping)
+
+	// larger than the flow control windows, the answer follows the end of the request
+	request := make([]byte, 1<<20+321)
+	rand.Read(request)
+	go func() {
+		for i := 0; i < len(request); i += 16 * 1024 {
+			conn.Write(request[i:min(i+16*1024, len(request))])
+		}
+		conn.CloseWrite()
+	}()
+
+	received, err := io.ReadAll(tunnel.conn)
+	if err != nil || !bytes.Equal(received, request) {
+		t.Fatalf("server received %d bytes %v, expected the %d sent", len(received), err, len(request))
+	}
+	tunnel.conn.Write([]byte("answer"))
+	if err := tunnel.conn.CloseWrite(); err != nil {
+		t.Fatalf("server close write: %v", err)
+	}
+
+	answer, err := io.ReadAll(conn)
+	if err != nil || string(answer) != "answer" {
+		t.Errorf("client received %q %v, expected answer", answer, err)
+	}
+
+	// the stream closed on both sides is released once the server ended it
+	conn.Close()
+	select {
+	case <-released:
+		t.Fatal("stream released before the server ended it")
+	case <-time.After(100 * time.Millisecond):
+	}
+	tunnel.conn.Close()
+	select {
+	case <-released:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not released once the server ended it")
+	}
+}
@@ -0,0 +1,630 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/musix/backhaul/internal/config"
+	"github.com/musix/backhaul/internal/utils"
+	"github.com/musix/backhaul/internal/web"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+type H2Transport struct {
+	config         *H2Config
+	parentctx      context.Context
+	ctx            context.Context
+	cancel         context.CancelFunc
+	logger         *logrus.Logger
+	tunnelChannel  chan TunnelH2Conn
+	localChannel   chan LocalTCPConn
+	reqNewConnChan chan struct{}
+	controlChannel *utils.H2Conn
+	restartMutex   sync.Mutex
+	usageMonitor   *web.Usage
+	ports          []string // port mappings of the connected client
+}
+
+type H2Config struct {
+	BindAddr        string
+	SnifferLog      string
+	Certs           *CertStore         // server certificate, generated on first start and reloaded on change
+	ClientAuth      *ClientAuthOptions // mutual TLS, nil when disabled
+	TunnelStatus    web.TunnelStatus
+	Token           string
+	Ports           []string
+	Nodelay         bool
+	Sniffer         bool
+	KeepAlive       time.Duration
+	HalfCloseLinger time.Duration
+	Socket          *utils.SocketOptions // tcp options of the tunnel and local sockets, nil for the defaults
+	Heartbeat       time.Duration        // in seconds
+	ChannelSize     int
+	WebPort         int
+	Mode            config.TransportType // h2 or h2c
+	ForwardSource   bool
+}
+
+// TunnelH2Conn is an HTTP/2 stream waiting in the pool for a local connection
+type TunnelH2Conn struct {
+	conn *utils.H2Conn
+	ping chan struct{}
+	mu   *sync.Mutex
+}
+
+func NewH2Server(parentCtx context.Context, config *H2Config, logger *logrus.Logger) *H2Transport {
+	// Create a derived context from the parent context
+	ctx, cancel := context.WithCancel(parentCtx)
+
+	// Initialize the H2Transport struct
+	server := &H2Transport{
+		config:         config,
+		parentctx:      parentCtx,
+		ctx:            ctx,
+		cancel:         cancel,
+		logger:         logger,
+		tunnelChannel:  make(chan TunnelH2Conn, config.ChannelSize),
+		localChannel:   make(chan LocalTCPConn, config.ChannelSize),
+		reqNewConnChan: make(chan struct{}, config.ChannelSize),
+		controlChannel: nil, // will be set when a control connection is established
+		usageMonitor:   web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
+	}
+
+	return server
+}
+
+func (s *H2Transport) Start() {
+	// for  webui
+	if s.config.WebPort > 0 {
+		go s.usageMonitor.Monitor()
+	}
+
+	s.config.TunnelStatus.Set(fmt.Sprintf("Disconnected (%s)", s.config.Mode))
+
+	go s.tunnelListener()
+
+}
+func (s *H2Transport) Restart() {
+	if !s.restartMutex.TryLock() {
+		s.logger.Warn("server restart already in progress, skipping restart attempt")
+		return
+	}
+	defer s.restartMutex.Unlock()
+
+	s.logger.Info("restarting server...")
+
+	level := s.logger.Level
+	s.logger.SetLevel(logrus.FatalLevel)
+
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	// Close control channel connection
+	if s.controlChannel != nil {
+		s.controlChannel.Close()
+	}
+
+	time.Sleep(2 * time.Second)
+
+	ctx, cancel := context.WithCancel(s.parentctx)
+	s.ctx = ctx
+	s.cancel = cancel
+
+	// Re-initialize variables
+	s.tunnelChannel = make(chan TunnelH2Conn, s.config.ChannelSize)
+	s.localChannel = make(chan LocalTCPConn, s.config.ChannelSize)
+	s.reqNewConnChan = make(chan struct{}, s.config.ChannelSize)
+	s.controlChannel = nil
+	s.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", s.config.WebPort), ctx, s.config.SnifferLog, s.config.Sniffer, &s.config.TunnelStatus, s.logger)
+	s.config.TunnelStatus.Set("")
+
+	// set the log level again
+	s.logger.SetLevel(level)
+
+	go s.Start()
+}
+
+func (s *H2Transport) channelHandler() {
+	ticker := time.NewTicker(s.config.Heartbeat)
+	defer ticker.Stop()
+
+	// Channel to receive the message or error
+	messageChan := make(chan byte, 10)
+
+	// Separate goroutine to continuously listen for messages
+	go func() {
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+
+			default:
+				msg, err := utils.ReceiveBinaryByte(s.controlChannel)
+				// Exit if there's an error
+				if err != nil {
+					if s.cancel != nil {
+						s.logger.Error("failed to read from channel connection. ", err)
+						go s.Restart()
+					}
+					return
+				}
+				messageChan <- msg
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			_ = utils.SendBinaryByte(s.controlChannel, utils.SG_Closed)
+			return
+		case <-s.reqNewConnChan:
+			err := utils.SendBinaryByte(s.controlChannel, utils.SG_Chan)
+			if err != nil {
+				s.logger.Error("failed to send request new connection signal. ", err)
+				go s.Restart()
+				return
+			}
+
+		case <-ticker.C:
+			err := utils.SendBinaryByte(s.controlChannel, utils.SG_HB)
+			if err != nil {
+				s.logger.Errorf("failed to send heartbeat signal. Error: %v.", err)
+				go s.Restart()
+				return
+			}
+			s.logger.Debug("heartbeat signal sent successfully")
+
+		case msg, ok := <-messageChan:
+			if !ok {
+				s.logger.Error("channel closed, likely due to an error in HTTP/2 stream read")
+				return
+			}
+			switch msg {
+			case utils.SG_HB:
+				s.logger.Trace("heartbeat signal received successfully")
+
+			case utils.SG_Closed:
+				s.logger.Warn("control channel has been closed by the client")
+				s.Restart()
+				return
+
+			default:
+				s.logger.Errorf("unexpected response from channel: %v", msg)
+				go s.Restart()
+				return
+			}
+
+		}
+	}
+}
+
+func (s *H2Transport) tunnelListener() {
+	addr := s.config.BindAddr
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.logger.Tracef("received http request from %s", r.RemoteAddr)
+
+		// Read the "Authorization" header
+		authHeader := r.Header.Get("Authorization")
+		if authHeader != fmt.Sprintf("Bearer %v", s.config.Token) {
+			s.logger.Warnf("unauthorized request from %s, closing connection", r.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized) // Send 401 Unauthorized response
+			return
+		}
+
+		if r.Method != http.MethodPost || (r.URL.Path != "/channel" && !strings.HasPrefix(r.URL.Path, "/tunnel")) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		// the client certificate of the control channel selects the ports of its tenant
+		if r.URL.Path == "/channel" {
+			ports, err := s.config.ClientAuth.ports(r.TLS, s.config.Ports, s.logger)
+			if err != nil {
+				s.logger.Warnf("control channel from %s rejected: %v", r.RemoteAddr, err)
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			s.ports = ports
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			s.logger.Errorf("streaming is not supported for the request from %s", r.RemoteAddr)
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		// Needed when a CDN forwards the stream over HTTP/1.1, HTTP/2 streams are always full duplex
+		_ = http.NewResponseController(w).EnableFullDuplex()
+
+		// Send the response headers right away, the client waits for them before using the stream
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		conn := utils.NewH2Conn(r.Body, w, flusher.Flush, nil, h2LocalAddr(r), h2RemoteAddr(r))
+
+		if r.URL.Path == "/channel" {
+			if s.controlChannel != nil {
+				s.logger.Warn("new control channel requested.")
+				s.controlChannel.Close()
+				conn.Close()
+				go s.Restart()
+				return
+			}
+			s.controlChannel = conn
+
+			s.logger.Info("control channel established successfully")
+
+			numCPU := runtime.NumCPU()
+			if numCPU > 4 {
+				numCPU = 4 // Max allowed handler is 4
+			}
+
+			go s.channelHandler()
+			go s.parsePortMappings()
+
+			s.logger.Infof("starting %d handle loops on each CPU thread", numCPU)
+
+			for i := 0; i < numCPU; i++ {
+				go s.handleLoop()
+			}
+
+			s.config.TunnelStatus.Set(fmt.Sprintf("Connected (%s)", s.config.Mode))
+
+		} else {
+			h2Conn := TunnelH2Conn{
+				conn: conn,
+				ping: make(chan struct{}),
+				mu:   &sync.Mutex{},
+			}
+			select {
+			case s.tunnelChannel <- h2Conn:
+				go s.keepAlive(&h2Conn)
+				s.logger.Debugf("http/2 stream accepted from %s", r.RemoteAddr)
+			default:
+				s.logger.Warnf("http/2 tunnel channel is full, closing stream from %s", r.RemoteAddr)
+				conn.Close()
+				return
+			}
+		}
+
+		// The stream lives as long as the handler, wait for the connection to be closed
+		ctx := s.ctx
+		select {
+		case <-conn.Done():
+		case <-ctx.Done():
+			conn.Close()
+		}
+	})
+
+	// Create an HTTP server
+	server := &http.Server{
+		Addr:        addr,
+		IdleTimeout: -1,
+	}
+
+	if s.config.Mode == config.H2C {
+		// HTTP/2 with prior knowledge over plain TCP
+		server.Handler = h2c.NewHandler(handler, &http2.Server{})
+
+		go func() {
+			s.logger.Infof("h2c server starting, listening on %s", addr)
+			if s.controlChannel == nil {
+				s.logger.Info("waiting for h2c control channel connection")
+			}
+			if err := serveHTTP(server, s.config.Socket, false); err != nil && err != http.ErrServerClosed {
+				s.logger.Fatalf("failed to listen on %s: %v", addr, err)
+			}
+		}()
+	} else {
+		server.Handler = handler
+		server.TLSConfig = serverTLSConfig(s.config.Certs, s.config.ClientAuth)
+		if err := http2.ConfigureServer(server, &http2.Server{}); err != nil {
+			s.logger.Fatalf("failed to configure http/2 server: %v", err)
+		}
+
+		go func() {
+			s.logger.Infof("h2 server starting, listening on %s", addr)
+			if s.controlChannel == nil {
+				s.logger.Info("waiting for h2 control channel connection")
+			}
+			if err := serveHTTP(server, s.config.Socket, true); err != nil && err != http.ErrServerClosed {
+				s.logger.Fatalf("failed to listen on %s: %v", addr, err)
+			}
+		}()
+	}
+
+	<-s.ctx.Done()
+
+	// Streams are long-lived, close them instead of waiting for them to finish
+	s.logger.Infof("shutting down the http/2 server on %s", addr)
+	if err := server.Close(); err != nil {
+		s.logger.Errorf("Failed to close the server: %v", err)
+	}
+
+	if s.controlChannel != nil {
+		s.controlChannel.Close()
+	}
+
+}
+
+func (s *H2Transport) parsePortMappings() {
+	for _, portMapping := range s.ports {
+		parts := strings.Split(portMapping, "=")
+
+		var localAddr, remoteAddr string
+
+		// Check if only a single port or a port range is provided (no "=" present)
+		if len(parts) == 1 {
+			localPortOrRange := strings.TrimSpace(parts[0])
+			remoteAddr = localPortOrRange // If no remote addr is provided, use the local port as the remote port
+
+			// Check if it's a port range
+			if strings.Contains(localPortOrRange, "-") {
+				rangeParts := strings.Split(localPortOrRange, "-")
+				if len(rangeParts) != 2 {
+					s.logger.Fatalf("invalid port range format: %s", localPortOrRange)
+				}
+
+				// Parse and validate start and end ports
+				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
+				if err != nil || startPort < 1 || startPort > 65535 {
+					s.logger.Fatalf("invalid start port in range: %s", rangeParts[0])
+				}
+
+				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
+				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
+					s.logger.Fatalf("invalid end port in range: %s", rangeParts[1])
+				}
+
+				// Create listeners for all ports in the range
+				for port := startPort; port <= endPort; port++ {
+					localAddr = fmt.Sprintf(":%d", port)
+					go s.localListener(localAddr, strconv.Itoa(port)) // Use port as the remoteAddr
+					time.Sleep(1 * time.Millisecond)                  // for wide port ranges
+				}
+				continue
+			} else {
+				// Handle single port case
+				port, err := strconv.Atoi(localPortOrRange)
+				if err != nil || port < 1 || port > 65535 {
+					s.logger.Fatalf("invalid port format: %s", localPortOrRange)
+				}
+				localAddr = fmt.Sprintf(":%d", port)
+			}
+		} else if len(parts) == 2 {
+			// Handle "local=remote" format
+			localPortOrRange := strings.TrimSpace(parts[0])
+			remoteAddr = strings.TrimSpace(parts[1])
+
+			// Check if local port is a range
+			if strings.Contains(localPortOrRange, "-") {
+				rangeParts := strings.Split(localPortOrRange, "-")
+				if len(rangeParts) != 2 {
+					s.logger.Fatalf("invalid port range format: %s", localPortOrRange)
+				}
+
+				// Parse and validate start and end ports
+				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
+				if err != nil || startPort < 1 || startPort > 65535 {
+					s.logger.Fatalf("invalid start port in range: %s", rangeParts[0])
+				}
+
+				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
+				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
+					s.logger.Fatalf("invalid end port in range: %s", rangeParts[1])
+				}
+
+				// Create listeners for all ports in the range
+				for port := startPort; port <= endPort; port++ {
+					localAddr = fmt.Sprintf(":%d", port)
+					go s.localListener(localAddr, remoteAddr)
+					time.Sleep(1 * time.Millisecond) // for wide port ranges
+				}
+				continue
+			} else {
+				// Handle single local port case
+				port, err := strconv.Atoi(localPortOrRange)
+				if err == nil && port > 1 && port < 65535 { // format port=remoteAddress
+					localAddr = fmt.Sprintf(":%d", port)
+				} else {
+					localAddr = localPortOrRange // format ip:port=remoteAddress
+				}
+			}
+		} else {
+			s.logger.Fatalf("invalid port mapping format: %s", portMapping)
+		}
+		// Start listeners for single port
+		go s.localListener(localAddr, remoteAddr)
+	}
+}
+
+func (s *H2Transport) localListener(localAddr string, remoteAddr string) {
+	portListener, err := listenTCP(s.ctx, localAddr, s.config.Socket, s.logger)
+	if err != nil {
+		if errors.Is(err, context.Canceled) { // stopped while waiting for the address
+			return
+		}
+		s.logger.Fatalf("failed to start listener on %s: %v", localAddr, err)
+		return
+	}
+
+	//close local listener after context cancellation
+	defer portListener.Close()
+
+	s.logger.Infof("listener started successfully, listening on address: %s", portListener.Addr().String())
+
+	go s.acceptLocalConn(portListener, remoteAddr)
+
+	<-s.ctx.Done()
+}
+
+func (s *H2Transport) acceptLocalConn(listener net.Listener, remoteAddr string) {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+
+		default:
+			s.logger.Debugf("waiting to accept incoming connection on %s", listener.Addr().String())
+			conn, err := listener.Accept()
+			if err != nil {
+				s.logger.Debugf("failed to accept connection on %s: %v", listener.Addr().String(), err)
+				continue
+			}
+
+			// discard any non-tcp connection
+			tcpConn, ok := conn.(*net.TCPConn)
+			if !ok {
+				s.logger.Warnf("disarded non-TCP connection from %s", conn.RemoteAddr().String())
+				conn.Close()
+				continue
+			}
+
+			// trying to enable tcpnodelay
+			if !s.config.Nodelay {
+				if err := tcpConn.SetNoDelay(s.config.Nodelay); err != nil {
+					s.logger.Warnf("failed to set TCP_NODELAY for %s: %v", tcpConn.RemoteAddr().String(), err)
+				} else {
+					s.logger.Tracef("TCP_NODELAY disabled for %s", tcpConn.RemoteAddr().String())
+				}
+			}
+
+			// Set keep-alive settings
+			if err := tcpConn.SetKeepAlive(true); err != nil {
+				s.logger.Warnf("failed to enable TCP keep-alive for %s: %v", tcpConn.RemoteAddr().String(), err)
+			} else {
+				s.logger.Tracef("TCP keep-alive enabled for %s", tcpConn.RemoteAddr().String())
+			}
+			if err := tcpConn.SetKeepAlivePeriod(s.config.KeepAlive); err != nil {
+				s.logger.Warnf("failed to set TCP keep-alive period for %s: %v", tcpConn.RemoteAddr().String(), err)
+			}
+
+			select {
+			case s.localChannel <- LocalTCPConn{conn: conn, remoteAddr: withSource(remoteAddr, conn, s.config.ForwardSource), timeCreated: time.Now().UnixMilli()}:
+
+				select {
+				case s.reqNewConnChan <- struct{}{}:
+					// Successfully requested a new connection
+				default:
+					// The channel is full, do nothing
+					s.logger.Warn("channel is full, cannot request a new connection")
+				}
+
+				s.logger.Debugf("accepted incoming TCP connection from %s", tcpConn.RemoteAddr().String())
+
+			default: // channel is full, discard the connection
+				s.logger.Warnf("channel with listener %s is full, discarding TCP connection from %s", listener.Addr().String(), tcpConn.LocalAddr().String())
+				conn.Close()
+			}
+		}
+	}
+}
+
+func (s *H2Transport) handleLoop() {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case localConn := <-s.localChannel:
+		loop:
+			for {
+				if time.Now().UnixMilli()-localConn.timeCreated > 3000 { // 3000ms
+					s.logger.Debugf("timeouted local connection: %d ms", time.Now().UnixMilli()-localConn.timeCreated)
+					localConn.conn.Close()
+					break loop
+				}
+
+				select {
+				case <-s.ctx.Done():
+					return
+				case tunnelConnection := <-s.tunnelChannel:
+					close(tunnelConnection.ping)
+					tunnelConnection.mu.Lock()
+
+					// Pings and the remote address share the stream, the address is announced by SG_TCP
+					if err := utils.SendBinaryByte(tunnelConnection.conn, utils.SG_TCP); err != nil {
+						s.logger.Debugf("%v", err) // failed to send port number
+						tunnelConnection.conn.Close()
+						continue loop
+					}
+					if err := utils.SendBinaryString(tunnelConnection.conn, localConn.remoteAddr); err != nil {
+						s.logger.Debugf("%v", err) // failed to send port number
+						tunnelConnection.conn.Close()
+						continue loop
+					}
+					// Handle data exchange between connections
+					go utils.TCPConnectionHandler(tunnelConnection.conn, localConn.conn, s.logger, s.usageMonitor, localConn.conn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer, s.config.HalfCloseLinger)
+					break loop
+				}
+			}
+		}
+	}
+}
+
+func (s *H2Transport) keepAlive(conn *TunnelH2Conn) {
+	ticker := time.NewTicker(s.config.Heartbeat) // Send periodic pings to the client
+
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			conn.conn.Close()
+			return
+		case <-conn.ping:
+			s.logger.Trace("ping channel closed")
+			return
+		case <-conn.conn.Done():
+			return
+		case <-ticker.C:
+			// Try to acquire the lock without blocking
+			locked := conn.mu.TryLock()
+			if !locked {
+				// If the lock is held by another operation, stop the pingSender
+				s.logger.Trace("write operation in progress, stopping pingSender")
+				return
+			}
+
+			if err := utils.SendBinaryByte(conn.conn, utils.SG_Ping); err != nil {
+				conn.mu.Unlock()
+				conn.conn.Close()
+				return
+			}
+			conn.mu.Unlock()
+			s.logger.Trace("ping sent to the client")
+		}
+	}
+}
+
+// h2LocalAddr returns the local address of the connection carrying the request
+func h2LocalAddr(r *http.Request) net.Addr {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+	return &net.TCPAddr{}
+}
+
+// h2RemoteAddr returns the address of the client, or of the CDN edge in front of it
+func h2RemoteAddr(r *http.Request) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return addr
+}
@@ -0,0 +1,641 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/musix/backhaul/internal/utils"
+	"github.com/musix/backhaul/internal/web"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+type KcpTransport struct {
+	config           *KcpConfig
+	smuxConfig       *smux.Config
+	parentctx        context.Context
+	ctx              context.Context
+	cancel           context.CancelFunc
+	logger           *logrus.Logger
+	tunnelChannel    chan *smux.Session
+	handshakeChannel chan net.Conn
+	localChannel     chan LocalTCPConn
+	reqNewConnChan   chan struct{}
+	controlChannel   net.Conn
+	usageMonitor     *web.Usage
+	restartMutex     sync.Mutex
+	streamCounter    int32
+	sessionCounter   int32
+	halfClose        atomic.Bool // the new streams are framed, confirmed by the client
+}
+
+type KcpConfig struct {
+	BindAddr         string
+	TunnelStatus     web.TunnelStatus
+	SnifferLog       string
+	Token            string
+	Ports            []string
+	Nodelay          bool
+	Sniffer          bool
+	ChannelSize      int
+	MuxCon           int
+	MuxVersion       int
+	MaxFrameSize     int
+	MaxReceiveBuffer int
+	MaxStreamBuffer  int
+	WebPort          int
+	KeepAlive        time.Duration
+	HalfCloseLinger  time.Duration
+	Socket           *utils.SocketOptions // tcp options of the tunnel and local sockets, nil for the defaults
+	Heartbeat        time.Duration        // in seconds
+	ForwardSource    bool
+	KcpNodelay       bool // fast retransmission mode
+	Interval         int  // internal update interval in ms
+	Resend           int  // fast resend after this many skipped acks, 0 disables
+	NoCongestion     bool // disable the congestion window
+	SndWnd           int  // send window in packets
+	RcvWnd           int  // receive window in packets
+	MTU              int
+	DataShard        int // FEC data shards
+	ParityShard      int // FEC parity shards, 0 disables FEC
+}
+
+func NewKcpServer(parentCtx context.Context, config *KcpConfig, logger *logrus.Logger) *KcpTransport {
+	// Create a derived context from the parent context
+	ctx, cancel := context.WithCancel(parentCtx)
+
+	// Initialize the TcpTransport struct
+	server := &KcpTransport{
+		smuxConfig: &smux.Config{
+			Version:           config.MuxVersion,
+			KeepAliveInterval: 20 * time.Second,
+			KeepAliveTimeout:  40 * time.Second,
+			MaxFrameSize:      config.MaxFrameSize,
+			MaxReceiveBuffer:  config.MaxReceiveBuffer,
+			MaxStreamBuffer:   config.MaxStreamBuffer,
+		},
+		config:           config,
+		parentctx:        parentCtx,
+		ctx:              ctx,
+		cancel:           cancel,
+		logger:           logger,
+		tunnelChannel:    make(chan *smux.Session, config.ChannelSize),
+		handshakeChannel: make(chan net.Conn),
+		localChannel:     make(chan LocalTCPConn, config.ChannelSize),
+		reqNewConnChan:   make(chan struct{}, config.ChannelSize),
+		controlChannel:   nil, // will be set when a control connection is established
+		streamCounter:    0,
+		sessionCounter:   0,
+		usageMonitor:     web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
+	}
+
+	return server
+}
+
+func (s *KcpTransport) Start() {
+	if s.config.WebPort > 0 {
+		go s.usageMonitor.Monitor()
+	}
+	s.config.TunnelStatus.Set("Disconnected (KCP)")
+
+	go s.tunnelListener()
+
+	s.channelHandshake()
+
+	if s.controlChannel != nil {
+		s.config.TunnelStatus.Set("Connected (KCP)")
+
+		numCPU := runtime.NumCPU()
+		if numCPU > 4 {
+			numCPU = 4 // Max allowed handler is 4
+		}
+
+		go s.parsePortMappings()
+		go s.channelHandler()
+
+		s.logger.Infof("starting %d handle loops on each CPU thread", numCPU)
+
+		for i := 0; i < numCPU; i++ {
+			go s.handleLoop()
+		}
+
+	}
+
+}
+func (s *KcpTransport) Restart() {
+	if !s.restartMutex.TryLock() {
+		s.logger.Warn("server restart already in progress, skipping restart attempt")
+		return
+	}
+	defer s.restartMutex.Unlock()
+
+	s.logger.Info("restarting server...")
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	// for removing timeout logs
+	level := s.logger.Level
+	s.logger.SetLevel(logrus.FatalLevel)
+
+	// Close any open connections in the tunnel channel.
+	if s.controlChannel != nil {
+		s.controlChannel.Close()
+	}
+
+	time.Sleep(2 * time.Second)
+
+	ctx, cancel := context.WithCancel(s.parentctx)
+	s.ctx = ctx
+	s.cancel = cancel
+
+	// Re-initialize variables
+	s.tunnelChannel = make(chan *smux.Session, s.config.ChannelSize)
+	s.localChannel = make(chan LocalTCPConn, s.config.ChannelSize)
+	s.reqNewConnChan = make(chan struct{}, s.config.ChannelSize)
+	s.handshakeChannel = make(chan net.Conn)
+	s.controlChannel = nil
+	s.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", s.config.WebPort), ctx, s.config.SnifferLog, s.config.Sniffer, &s.config.TunnelStatus, s.logger)
+	s.config.TunnelStatus.Set("")
+	s.streamCounter = 0
+	s.sessionCounter = 0
+
+	// set the log level again
+	s.logger.SetLevel(level)
+
+	go s.Start()
+}
+
+func (s *KcpTransport) channelHandshake() {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case conn := <-s.handshakeChannel:
+			// Set a read deadline for the token response
+			if err := conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+				s.logger.Errorf("failed to set read deadline: %v", err)
+				conn.Close()
+				continue
+			}
+			msg, transport, err := utils.ReceiveBinaryTransportString(conn)
+			if transport != utils.SG_Chan {
+				s.logger.Errorf("invalid signal received for channel, Discarding connection")
+				conn.Close()
+				continue
+			} else if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					s.logger.Warn("timeout while waiting for control channel signal")
+				} else {
+					s.logger.Errorf("failed to receive control channel signal: %v", err)
+				}
+				conn.Close() // Close connection on error or timeout
+				continue
+			}
+
+			// Resetting the deadline (removes any existing deadline)
+			conn.SetReadDeadline(time.Time{})
+
+			if msg != s.config.Token {
+				s.logger.Warnf("invalid security token received: %s", msg)
+				conn.Close()
+				continue
+			}
+
+			// the framing of the streams is advertised in the signal of the answer, older clients ignore it
+			signal := utils.SG_Chan
+			if s.config.HalfCloseLinger > 0 {
+				signal = utils.SG_Framed
+			}
+			err = utils.SendBinaryTransportString(conn, s.config.Token, signal)
+			if err != nil {
+				s.logger.Errorf("failed to send security token: %v", err)
+				conn.Close()
+				continue
+			}
+
+			s.halfClose.Store(false) // until the client confirms it
+			s.controlChannel = conn
+
+			s.logger.Info("control channel successfully established.")
+
+			return
+		}
+	}
+}
+
+func (s *KcpTransport) channelHandler() {
+	ticker := time.NewTicker(s.config.Heartbeat)
+	defer ticker.Stop()
+
+	// Channel to receive the message or error
+	messageChan := make(chan byte, 1)
+
+	go func() {
+		for {
+			message, err := utils.ReceiveBinaryByte(s.controlChannel)
+			if err != nil {
+				if s.cancel != nil {
+					s.logger.Error("failed to read from channel connection. ", err)
+					go s.Restart()
+				}
+				return
+			}
+
+			// the client frames the streams marked from now on
+			if message == utils.SG_Framed {
+				s.halfClose.Store(s.config.HalfCloseLinger > 0)
+				s.logger.Debug("half-close framing of the streams confirmed by the client")
+				continue
+			}
+			messageChan <- message
+			return
+		}
+	}()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			_ = utils.SendBinaryByte(s.controlChannel, utils.SG_Closed)
+			return
+
+		case <-s.reqNewConnChan:
+			err := utils.SendBinaryByte(s.controlChannel, utils.SG_Chan)
+			if err != nil {
+				s.logger.Error("failed to send request new connection signal. ", err)
+				go s.Restart()
+				return
+			}
+
+		case <-ticker.C:
+			err := utils.SendBinaryByte(s.controlChannel, utils.SG_HB)
+			if err != nil {
+				s.logger.Error("failed to send heartbeat signal")
+				go s.Restart()
+				return
+			}
+			s.logger.Trace("heartbeat signal sent successfully")
+
+		case message, ok := <-messageChan:
+			if !ok {
+				s.logger.Error("channel closed, likely due to an error in TCP read")
+				return
+			}
+
+			if message == utils.SG_Closed {
+				s.logger.Warn("control channel has been closed by the client")
+				go s.Restart()
+				return
+			}
+		}
+	}
+}
+
+func (s *KcpTransport) tunnelListener() {
+	listener, err := kcp.ListenWithOptions(s.config.BindAddr, nil, s.config.DataShard, s.config.ParityShard)
+	if err != nil {
+		s.logger.Fatalf("failed to start listener on %s: %v", s.config.BindAddr, err)
+		return
+	}
+
+	defer listener.Close()
+
+	s.logger.Infof("server started successfully, listening on address: %s", listener.Addr().String())
+
+	go s.acceptTunnelConn(listener)
+
+	<-s.ctx.Done()
+}
+
+func (s *KcpTransport) acceptTunnelConn(listener *kcp.Listener) {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		default:
+			s.logger.Debugf("waiting for accept incoming tunnel connection on %s", listener.Addr().String())
+			conn, err := listener.AcceptKCP()
+			if err != nil {
+				s.logger.Debugf("failed to accept tunnel connection on %s: %v", listener.Addr().String(), err)
+				continue
+			}
+
+			// Drop all suspicious packets from other address rather than server
+			if s.controlChannel != nil && s.controlChannel.RemoteAddr().(*net.UDPAddr).IP.String() != conn.RemoteAddr().(*net.UDPAddr).IP.String() {
+				s.logger.Debugf("suspicious packet from %v. expected address: %v. discarding packet...", conn.RemoteAddr().(*net.UDPAddr).IP.String(), s.controlChannel.RemoteAddr().(*net.UDPAddr).IP.String())
+				conn.Close()
+				continue
+			}
+
+			// KCP tuning, both sides should use the same values
+			conn.SetStreamMode(true)
+			conn.SetWriteDelay(false)
+			conn.SetNoDelay(boolToInt(s.config.KcpNodelay), s.config.Interval, s.config.Resend, boolToInt(s.config.NoCongestion))
+			conn.SetWindowSize(s.config.SndWnd, s.config.RcvWnd)
+			conn.SetMtu(s.config.MTU)
+			conn.SetACKNoDelay(s.config.KcpNodelay)
+
+			// try to establish a new channel
+			if s.controlChannel == nil {
+				s.logger.Info("control channel not found, attempting to establish a new session")
+				select {
+				case s.handshakeChannel <- conn: // ok
+				default:
+					s.logger.Warnf("control channel handshake in progress...")
+					conn.Close()
+				}
+				continue
+			}
+
+			// the tunnel connections start with a signal, so that the server sees them before the first stream
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if signal, err := utils.ReceiveBinaryByte(conn); err != nil || signal != utils.SG_Chan {
+				s.logger.Debugf("invalid tunnel connection from %s: %v", conn.RemoteAddr().String(), err)
+				conn.Close()
+				continue
+			}
+			conn.SetReadDeadline(time.Time{})
+
+			session, err := smux.Client(conn, s.smuxConfig)
+			if err != nil {
+				s.logger.Errorf("failed to create MUX session for connection %s: %v", conn.RemoteAddr().String(), err)
+				conn.Close()
+				continue
+			}
+
+			select {
+			case s.tunnelChannel <- session: // ok
+			default:
+				s.logger.Warnf("tunnel listener channel is full, discarding KCP connection from %s", conn.RemoteAddr().String())
+				session.Close()
+			}
+		}
+	}
+
+}
+
+func (s *KcpTransport) parsePortMappings() {
+	for _, portMapping := range s.config.Ports {
+		parts := strings.Split(portMapping, "=")
+
+		var localAddr, remoteAddr string
+
+		// Check if only a single port or a port range is provided (no "=" present)
+		if len(parts) == 1 {
+			localPortOrRange := strings.TrimSpace(parts[0])
+			remoteAddr = localPortOrRange // If no remote addr is provided, use the local port as the remote port
+
+			// Check if it's a port range
+			if strings.Contains(localPortOrRange, "-") {
+				rangeParts := strings.Split(localPortOrRange, "-")
+				if len(rangeParts) != 2 {
+					s.logger.Fatalf("invalid port range format: %s", localPortOrRange)
+				}
+
+				// Parse and validate start and end ports
+				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
+				if err != nil || startPort < 1 || startPort > 65535 {
+					s.logger.Fatalf("invalid start port in range: %s", rangeParts[0])
+				}
+
+				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
+				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
+					s.logger.Fatalf("invalid end port in range: %s", rangeParts[1])
+				}
+
+				// Create listeners for all ports in the range
+				for port := startPort; port <= endPort; port++ {
+					localAddr = fmt.Sprintf(":%d", port)
+					go s.localListener(localAddr, strconv.Itoa(port)) // Use port as the remoteAddr
+					time.Sleep(1 * time.Millisecond)                  // for wide port ranges
+				}
+				continue
+			} else {
+				// Handle single port case
+				port, err := strconv.Atoi(localPortOrRange)
+				if err != nil || port < 1 || port > 65535 {
+					s.logger.Fatalf("invalid port format: %s", localPortOrRange)
+				}
+				localAddr = fmt.Sprintf(":%d", port)
+			}
+		} else if len(parts) == 2 {
+			// Handle "local=remote" format
+			localPortOrRange := strings.TrimSpace(parts[0])
+			remoteAddr = strings.TrimSpace(parts[1])
+
+			// Check if local port is a range
+			if strings.Contains(localPortOrRange, "-") {
+				rangeParts := strings.Split(localPortOrRange, "-")
+				if len(rangeParts) != 2 {
+					s.logger.Fatalf("invalid port range format: %s", localPortOrRange)
+				}
+
+				// Parse and validate start and end ports
+				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
+				if err != nil || startPort < 1 || startPort > 65535 {
+					s.logger.Fatalf("invalid start port in range: %s", rangeParts[0])
+				}
+
+				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
+				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
+					s.logger.Fatalf("invalid end port in range: %s", rangeParts[1])
+				}
+
+				// Create listeners for all ports in the range
+				for port := startPort; port <= endPort; port++ {
+					localAddr = fmt.Sprintf(":%d", port)
+					go s.localListener(localAddr, remoteAddr)
+					time.Sleep(1 * time.Millisecond) // for wide port ranges
+				}
+				continue
+			} else {
+				// Handle single local port case
+				port, err := strconv.Atoi(localPortOrRange)
+				if err == nil && port > 1 && port < 65535 { // format port=remoteAddress
+					localAddr = fmt.Sprintf(":%d", port)
+				} else {
+					localAddr = localPortOrRange // format ip:port=remoteAddress
+				}
+			}
+		} else {
+			s.logger.Fatalf("invalid port mapping format: %s", portMapping)
+		}
+		// Start listeners for single port
+		go s.localListener(localAddr, remoteAddr)
+	}
+}
+
+func (s *KcpTransport) localListener(localAddr string, remoteAddr string) {
+	listener, err := listenTCP(s.ctx, localAddr, s.config.Socket, s.logger)
+	if err != nil {
+		if errors.Is(err, context.Canceled) { // stopped while waiting for the address
+			return
+		}
+		s.logger.Fatalf("failed to start listener on %s: %v", localAddr, err)
+		return
+	}
+
+	defer listener.Close()
+
+	s.logger.Infof("listener started successfully, listening on address: %s", listener.Addr().String())
+
+	go s.acceptLocalConn(listener, remoteAddr)
+
+	<-s.ctx.Done()
+}
+
+func (s *KcpTransport) acceptLocalConn(listener net.Listener, remoteAddr string) {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+
+		default:
+			conn, err := listener.Accept()
+			if err != nil {
+				s.logger.Debugf("failed to accept connection on %s: %v", listener.Addr().String(), err)
+				continue
+			}
+
+			// discard any non-tcp connection
+			tcpConn, ok := conn.(*net.TCPConn)
+			if !ok {
+				s.logger.Warnf("disarded non-TCP connection from %s", conn.RemoteAddr().String())
+				conn.Close()
+				continue
+			}
+
+			// trying to disable tcpnodelay
+			if !s.config.Nodelay {
+				if err := tcpConn.SetNoDelay(s.config.Nodelay); err != nil {
+					s.logger.Warnf("failed to set TCP_NODELAY for %s: %v", tcpConn.RemoteAddr().String(), err)
+				} else {
+					s.logger.Tracef("TCP_NODELAY disabled for %s", tcpConn.RemoteAddr().String())
+				}
+			}
+
+			select {
+			case s.localChannel <- LocalTCPConn{conn: conn, remoteAddr: withSource(remoteAddr, conn, s.config.ForwardSource), timeCreated: time.Now().UnixMilli()}:
+				s.logger.Debugf("accepted incoming TCP connection from %s", tcpConn.RemoteAddr().String())
+
+				// +1 for stream counter
+				atomic.AddInt32(&s.streamCounter, 1)
+
+				if atomic.LoadInt32(&s.streamCounter) >= atomic.LoadInt32(&s.sessionCounter)*int32(s.config.MuxCon) {
+					s.logger.Tracef("stream counter: %v, session counter: %v", atomic.LoadInt32(&s.streamCounter), atomic.LoadInt32(&s.sessionCounter))
+
+					select { // Attempt to request a new connection
+					case s.reqNewConnChan <- struct{}{}:
+					default:
+						s.logger.Warn("failed to request new connection. channel is full")
+					}
+				}
+
+			default: // channel is full, discard the connection
+				s.logger.Warnf("local listener channel is full, discarding TCP connection from %s", tcpConn.LocalAddr().String())
+				conn.Close()
+			}
+
+		}
+	}
+
+}
+
+func (s *KcpTransport) handleLoop() {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+
+		case session := <-s.tunnelChannel:
+			// +1 for session counter
+			atomic.AddInt32(&s.sessionCounter, 1)
+
+			go s.handleSession(session)
+		}
+	}
+}
+
+func (s *KcpTransport) handleSession(session *smux.Session) {
+	counter := make(chan struct{}, s.config.MuxCon)
+	defer session.Close()
+	defer close(counter)
+
+	for {
+		// +1 for mux connection counter
+		counter <- struct{}{}
+
+		select {
+		case <-s.ctx.Done():
+			return
+
+		case incomingConn := <-s.localChannel:
+			if time.Now().UnixMilli()-incomingConn.timeCreated > 3000 { // 3000ms
+				s.logger.Debugf("timeouted local connection: %d ms", time.Now().UnixMilli()-incomingConn.timeCreated)
+				incomingConn.conn.Close()
+
+				// Decrement the counter
+				atomic.AddInt32(&s.streamCounter, -1)
+				<-counter
+				continue
+			}
+
+			stream, err := session.OpenStream()
+			if err != nil {
+				s.handleSessionError(&incomingConn, err)
+				return
+			}
+
+			// Send the target port over the tunnel connection, the stream is framed once the client confirmed it
+			framed := s.halfClose.Load()
+			if err := utils.SendBinaryString(stream, utils.HalfCloseMark(incomingConn.remoteAddr, framed)); err != nil {
+				s.logger.Tracef("failed to send address over stream: %v", err)
+				// Put local connection back to local channel
+				s.localChannel <- incomingConn
+				continue
+			}
+
+			// Handle data exchange between connections, framed so that the stream can be half-closed
+			conn, linger := utils.MuxStreamConn(stream, framed, s.config.HalfCloseLinger)
+			go func() {
+				utils.TCPConnectionHandler(conn, incomingConn.conn, s.logger, s.usageMonitor, incomingConn.conn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer, linger)
+				atomic.AddInt32(&s.streamCounter, -1)
+				<-counter // read signal from the channel
+			}()
+		}
+	}
+}
+
+func (s *KcpTransport) handleSessionError(incomingConn *LocalTCPConn, err error) {
+	s.logger.Tracef("failed to handle session: %v", err)
+
+	// decrease session value
+	atomic.AddInt32(&s.sessionCounter, -1)
+
+	// Put local connection back to local channel
+	s.localChannel <- *incomingConn
+
+	// Attempt to request a new connection
+	select {
+	case s.reqNewConnChan <- struct{}{}:
+	default:
+		s.logger.Warn("request new connection channel is full")
+	}
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,192 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/musix/backhaul/internal/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+func newTestKcpServer(t *testing.T) *KcpTransport {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	// a free udp port for the listener
+	probe, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := probe.LocalAddr().String()
+	probe.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return NewKcpServer(ctx, &KcpConfig{
+		BindAddr:         addr,
+		Token:            "secret",
+		ChannelSize:      4,
+		MuxVersion:       2,
+		MaxFrameSize:     32768,
+		MaxReceiveBuffer: 4194304,
+		MaxStreamBuffer:  2097152,
+		HalfCloseLinger:  time.Second,
+		Heartbeat:        time.Minute,
+		KcpNodelay:       true,
+		Interval:         10,
+		Resend:           2,
+		NoCongestion:     true,
+		SndWnd:           1024,
+		RcvWnd:           1024,
+		MTU:              1350,
+		DataShard:        10,
+		ParityShard:      3,
+	}, logger)
+}
+
+// dialTestKcp opens a kcp session to the server, tuned as the client does
+func dialTestKcp(t *testing.T, s *KcpTransport) *kcp.UDPSession {
+	session, err := kcp.DialWithOptions(s.config.BindAddr, nil, s.config.DataShard, s.config.ParityShard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.Close() })
+
+	session.SetStreamMode(true)
+	session.SetWriteDelay(false)
+	session.SetNoDelay(boolToInt(s.config.KcpNodelay), s.config.Interval, s.config.Resend, boolToInt(s.config.NoCongestion))
+	session.SetWindowSize(s.config.SndWnd, s.config.RcvWnd)
+	session.SetMtu(s.config.MTU)
+	session.SetACKNoDelay(s.config.KcpNodelay)
+	return session
+}
+
+// dialTestTunnel opens a tunnel connection starting with signal, the client serves the mux session
+func dialTestTunnel(t *testing.T, s *KcpTransport, signal byte) *smux.Session {
+	conn := dialTestKcp(t, s)
+	if err := utils.SendBinaryByte(conn, signal); err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := smux.Server(conn, s.smuxConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.Close() })
+	return session
+}
+
+// controlChannelFrom stands for the control channel of a client at ip
+func controlChannelFrom(t *testing.T, ip string) net.Conn {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP(ip), Port: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestKcpTunnelSession(t *testing.T) {
+	s := newTestKcpServer(t)
+	s.controlChannel = controlChannelFrom(t, "127.0.0.1")
+	go s.tunnelListener()
+	time.Sleep(50 * time.Millisecond)
+
+	// the client announces its tunnel connection and serves the mux session over it
+	client := dialTestTunnel(t, s, utils.SG_Chan)
+
+	var session *smux.Session
+	select {
+	case session = <-s.tunnelChannel:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel session not accepted")
+	}
+
+	serverStream, err := session.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientStream, err := client.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, _ := utils.MuxStreamConn(serverStream, true, s.config.HalfCloseLinger)
+	clientConn, _ := utils.MuxStreamConn(clientStream, true, s.config.HalfCloseLinger)
+
+	// larger than the windows and the fec groups, the answer follows the end of the request
+	request := make([]byte, 1<<20+321)
+	rand.Read(request)
+	go func() {
+		serverConn.Write(request)
+		serverConn.(utils.CloseWriter).CloseWrite()
+	}()
+
+	received, err := io.ReadAll(clientConn)
+	if err != nil || !bytes.Equal(received, request) {
+		t.Fatalf("client received %d bytes %v, expected the %d sent", len(received), err, len(request))
+	}
+	clientConn.Write([]byte("answer"))
+	clientConn.(utils.CloseWriter).CloseWrite()
+
+	answer, err := io.ReadAll(serverConn)
+	if err != nil || string(answer) != "answer" {
+		t.Errorf("server received %q %v, expected answer", answer, err)
+	}
+}
+
+func TestKcpForeignTunnelSession(t *testing.T) {
+	s := newTestKcpServer(t)
+	s.controlChannel = controlChannelFrom(t, "127.0.0.2")
+	go s.tunnelListener()
+	time.Sleep(50 * time.Millisecond)
+
+	// a connection from another address than the control channel is dropped
+	dialTestTunnel(t, s, utils.SG_Chan)
+	select {
+	case <-s.tunnelChannel:
+		t.Error("tunnel session accepted from another address than the control channel")
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestKcpTunnelSignal(t *testing.T) {
+	s := newTestKcpServer(t)
+	s.controlChannel = controlChannelFrom(t, "127.0.0.1")
+	go s.tunnelListener()
+	time.Sleep(50 * time.Millisecond)
+
+	// a connection starting with something else than the signal of the tunnel connections is dropped
+	dialTestTunnel(t, s, utils.SG_Ping)
+	select {
+	case <-s.tunnelChannel:
+		t.Error("tunnel session accepted without its signal")
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestKcpTokenRejected(t *testing.T) {
+	s := newTestKcpServer(t)
+	go s.channelHandshake()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	s.handshakeChannel <- server
+
+	go utils.SendBinaryTransportString(client, "wrong", utils.SG_Chan)
+
+	// the server closes the connection without answering
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read %d bytes %v, expected the connection closed by the server", n, err)
+	}
+	if s.controlChannel != nil {
+		t.Error("control channel established with an invalid token")
+	}
+}
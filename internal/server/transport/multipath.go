@@ -0,0 +1,263 @@
+package transport
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xtaci/smux"
+)
+
+const (
+	// a path with unacknowledged data and no ack for this long is considered dead
+	deadPathTimeout = 15 * time.Second
+	// smoothing factor of the rtt and loss averages
+	pathEWMA = 0.3
+	// how hard loss is penalized compared to rtt when weighting the paths
+	lossPenalty = 20.0
+)
+
+// tcpStats is the subset of TCP_INFO used to measure a path
+type tcpStats struct {
+	rtt          time.Duration
+	totalRetrans uint32
+	segsOut      uint32
+	unacked      uint32
+	lastAckRecv  time.Duration
+}
+
+type pathSession struct {
+	session *smux.Session
+	conn    *net.TCPConn
+}
+
+// muxPath groups the tunnel connections arriving from the same client address
+type muxPath struct {
+	key         string
+	sessions    []*pathSession
+	rtt         float64 // ms, smoothed
+	loss        float64 // retransmitted / sent segments, smoothed
+	measured    bool
+	lastRetrans uint32
+	lastSegsOut uint32
+}
+
+// pathScheduler spreads new streams over the paths of a bonded tunnel, preferring the paths
+// with low rtt and loss, and removes a path once its connections stop getting acknowledged.
+type pathScheduler struct {
+	mu     sync.Mutex
+	paths  []*muxPath // in order of arrival, so that a draw only depends on the random number
+	stats  func(conn *net.TCPConn) (tcpStats, error)
+	logger *logrus.Logger
+}
+
+func newPathScheduler(logger *logrus.Logger) *pathScheduler {
+	return &pathScheduler{
+		stats:  readTCPStats,
+		logger: logger,
+	}
+}
+
+func (p *pathScheduler) add(conn *net.TCPConn, session *smux.Session) {
+	key := conn.RemoteAddr().(*net.TCPAddr).IP.String()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var path *muxPath
+	for _, existing := range p.paths {
+		if existing.key == key {
+			path = existing
+			break
+		}
+	}
+	if path == nil {
+		path = &muxPath{key: key}
+		p.paths = append(p.paths, path)
+		p.logger.Infof("new tunnel path from %s", key)
+	}
+	path.sessions = append(path.sessions, &pathSession{session: session, conn: conn})
+}
+
+// leastLoaded returns the open session of the path with the fewest streams, nil when all are closed
+func (path *muxPath) leastLoaded() *smux.Session {
+	var session *smux.Session
+	for _, ps := range path.sessions {
+		if ps.session.IsClosed() {
+			continue
+		}
+		if session == nil || ps.session.NumStreams() < session.NumStreams() {
+			session = ps.session
+		}
+	}
+	return session
+}
+
+// pick selects a path at random, weighted by its measured quality, and returns its least loaded session.
+// Only the paths with an open session take part in the draw, the closed ones are pruned by update.
+func (p *pathScheduler) pick() *smux.Session {
+	return p.draw(rand.Float64())
+}
+
+// draw selects the path at r, between 0 and 1, of the cumulated weights of the paths
+func (p *pathScheduler) draw(r float64) *smux.Session {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var total float64
+	sessions := make([]*smux.Session, len(p.paths))
+	weights := make([]float64, len(p.paths))
+	for i, path := range p.paths {
+		sessions[i] = path.leastLoaded()
+		if sessions[i] == nil {
+			continue
+		}
+		weights[i] = path.weight()
+		total += weights[i]
+	}
+	if total == 0 {
+		return nil
+	}
+
+	// the last open path also takes the rounding errors of the sum
+	var selected *smux.Session
+	r *= total
+	for i, weight := range weights {
+		if sessions[i] == nil {
+			continue
+		}
+		selected = sessions[i]
+		r -= weight
+		if r <= 0 {
+			break
+		}
+	}
+	return selected
+}
+
+// weight is the share of the new streams of a path, the paths are even until they are measured
+func (path *muxPath) weight() float64 {
+	if !path.measured {
+		return 1
+	}
+	return 1 / (path.rtt + 1) / (1 + lossPenalty*path.loss)
+}
+
+// remove drops a session that failed to open a stream
+func (p *pathScheduler) remove(session *smux.Session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, path := range p.paths {
+		for i, ps := range path.sessions {
+			if ps.session == session {
+				path.sessions = append(path.sessions[:i], path.sessions[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// update prunes the closed sessions, refreshes the path measurements and drops the dead paths.
+// It returns the number of usable sessions.
+func (p *pathScheduler) update() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	count := 0
+	paths := p.paths[:0]
+	for _, path := range p.paths {
+		key := path.key
+		alive := path.sessions[:0]
+		for _, ps := range path.sessions {
+			if !ps.session.IsClosed() {
+				alive = append(alive, ps)
+			}
+		}
+		path.sessions = alive
+
+		if len(path.sessions) == 0 {
+			p.logger.Infof("tunnel path from %s has no connections left, removing it", key)
+			continue
+		}
+
+		if p.measure(path) {
+			p.logger.Warnf("tunnel path from %s stopped acknowledging data, removing it", key)
+			for _, ps := range path.sessions {
+				ps.session.Close()
+			}
+			continue
+		}
+
+		paths = append(paths, path)
+		count += len(path.sessions)
+	}
+	clear(p.paths[len(paths):])
+	p.paths = paths
+
+	return count
+}
+
+// measure aggregates the TCP_INFO of the connections of a path, it reports whether the path is dead
+func (p *pathScheduler) measure(path *muxPath) bool {
+	var rtt time.Duration
+	var retrans, segsOut uint32
+	stalled, samples := 0, 0
+
+	for _, ps := range path.sessions {
+		stats, err := p.stats(ps.conn)
+		if err != nil {
+			p.logger.Tracef("unable to read tcp info of %s: %v", path.key, err)
+			continue
+		}
+		samples++
+		rtt += stats.rtt
+		retrans += stats.totalRetrans
+		segsOut += stats.segsOut
+
+		if stats.unacked > 0 && stats.lastAckRecv > deadPathTimeout {
+			stalled++
+		}
+	}
+
+	if samples == 0 {
+		return false
+	}
+
+	avgRtt := float64(rtt.Milliseconds()) / float64(samples)
+
+	// counters of a connection that went away make the sums shrink, only use growing deltas
+	loss := path.loss
+	if path.measured && segsOut > path.lastSegsOut && retrans >= path.lastRetrans {
+		loss = float64(retrans-path.lastRetrans) / float64(segsOut-path.lastSegsOut)
+	}
+
+	if path.measured {
+		path.rtt = pathEWMA*avgRtt + (1-pathEWMA)*path.rtt
+		path.loss = pathEWMA*loss + (1-pathEWMA)*path.loss
+	} else {
+		path.rtt = avgRtt
+		path.measured = true
+	}
+	path.lastRetrans = retrans
+	path.lastSegsOut = segsOut
+
+	p.logger.Tracef("tunnel path %s: rtt %.1f ms, loss %.3f, connections %d", path.key, path.rtt, path.loss, len(path.sessions))
+
+	return stalled == samples
+}
+
+// reset closes every path, used on restart
+func (p *pathScheduler) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, path := range p.paths {
+		for _, ps := range path.sessions {
+			ps.session.Close()
+		}
+	}
+	p.paths = nil
+}
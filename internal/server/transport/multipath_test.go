@@ -0,0 +1,165 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xtaci/smux"
+)
+
+func newTestScheduler() *pathScheduler {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return newPathScheduler(logger)
+}
+
+// newTestSession returns the client session of a smux connection over a pipe
+func newTestSession(t *testing.T) *smux.Session {
+	left, right := net.Pipe()
+	client, err := smux.Client(left, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := smux.Server(right, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client
+}
+
+func closedSession(t *testing.T) *smux.Session {
+	session := newTestSession(t)
+	session.Close()
+	return session
+}
+
+func testPath(key string, sessions ...*smux.Session) *muxPath {
+	path := &muxPath{key: key}
+	for _, session := range sessions {
+		path.sessions = append(path.sessions, &pathSession{session: session})
+	}
+	return path
+}
+
+func TestPathSchedulerDraw(t *testing.T) {
+	a, b := newTestSession(t), newTestSession(t)
+
+	measured := func(path *muxPath, rtt float64) *muxPath {
+		path.measured = true
+		path.rtt = rtt
+		return path
+	}
+
+	for _, c := range []struct {
+		name     string
+		paths    []*muxPath
+		draws    []float64
+		expected []*smux.Session
+	}{
+		{"even paths", []*muxPath{testPath("a", a), testPath("b", b)}, []float64{0, 0.25, 0.75, 1}, []*smux.Session{a, a, b, b}},
+		{"measured paths", []*muxPath{measured(testPath("a", a), 9), measured(testPath("b", b), 0)}, []float64{0.05, 0.2, 0.9}, []*smux.Session{a, b, b}},
+		{"closed path", []*muxPath{testPath("a", closedSession(t)), testPath("b", b)}, []float64{0, 0.25, 1}, []*smux.Session{b, b, b}},
+		{"closed last path", []*muxPath{testPath("a", a), testPath("b", closedSession(t))}, []float64{0.75, 1}, []*smux.Session{a, a}},
+		{"closed sessions", []*muxPath{testPath("a", closedSession(t), a)}, []float64{0.5}, []*smux.Session{a}},
+		{"all closed", []*muxPath{testPath("a", closedSession(t)), testPath("b", closedSession(t))}, []float64{0.5}, []*smux.Session{nil}},
+		{"no paths", nil, []float64{0.5}, []*smux.Session{nil}},
+	} {
+		p := newTestScheduler()
+		p.paths = c.paths
+
+		for i, r := range c.draws {
+			if session := p.draw(r); session != c.expected[i] {
+				t.Errorf("%s: draw %.2f returned another session than expected", c.name, r)
+			}
+		}
+	}
+}
+
+func TestPathSchedulerLeastLoaded(t *testing.T) {
+	busy, idle := newTestSession(t), newTestSession(t)
+	if _, err := busy.OpenStream(); err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestScheduler()
+	p.paths = []*muxPath{testPath("a", busy, idle)}
+	if session := p.pick(); session != idle {
+		t.Error("pick did not return the session with the fewest streams")
+	}
+}
+
+func TestPathSchedulerMeasure(t *testing.T) {
+	p := newTestScheduler()
+	path := testPath("a", newTestSession(t))
+
+	for _, c := range []struct {
+		name  string
+		stats tcpStats
+		err   error
+		rtt   float64
+		loss  float64
+		dead  bool
+	}{
+		{"first sample", tcpStats{rtt: 100 * time.Millisecond, segsOut: 1000}, nil, 100, 0, false},
+		{"loss", tcpStats{rtt: 200 * time.Millisecond, segsOut: 2000, totalRetrans: 100}, nil, 130, 0.03, false},
+		{"no tcp info", tcpStats{}, errors.New("unavailable"), 130, 0.03, false},
+		{"connection went away", tcpStats{rtt: 130 * time.Millisecond, segsOut: 500, totalRetrans: 10}, nil, 130, 0.03, false},
+		{"unacknowledged", tcpStats{rtt: 130 * time.Millisecond, segsOut: 600, totalRetrans: 10, unacked: 3, lastAckRecv: time.Second}, nil, 130, 0.021, false},
+		{"stalled", tcpStats{rtt: 130 * time.Millisecond, segsOut: 600, totalRetrans: 10, unacked: 3, lastAckRecv: deadPathTimeout + time.Second}, nil, 130, 0.021, true},
+	} {
+		p.stats = func(*net.TCPConn) (tcpStats, error) { return c.stats, c.err }
+
+		dead := p.measure(path)
+		if dead != c.dead {
+			t.Errorf("%s: dead %v, expected %v", c.name, dead, c.dead)
+		}
+		if math.Abs(path.rtt-c.rtt) > 0.01 || math.Abs(path.loss-c.loss) > 0.0001 {
+			t.Errorf("%s: rtt %.2f loss %.4f, expected %.2f %.4f", c.name, path.rtt, path.loss, c.rtt, c.loss)
+		}
+	}
+}
+
+func TestPathSchedulerUpdate(t *testing.T) {
+	p := newTestScheduler()
+	stalled := newTestSession(t)
+	a, b := newTestSession(t), newTestSession(t)
+	p.paths = []*muxPath{
+		testPath("gone", closedSession(t)),
+		testPath("a", a, closedSession(t)),
+		testPath("stalled", stalled),
+		testPath("b", b),
+	}
+
+	// only the connection of the stalled path is set, it stopped getting acknowledged
+	p.paths[2].sessions[0].conn = &net.TCPConn{}
+	p.stats = func(conn *net.TCPConn) (tcpStats, error) {
+		if conn != nil {
+			return tcpStats{rtt: time.Millisecond, unacked: 1, lastAckRecv: 2 * deadPathTimeout}, nil
+		}
+		return tcpStats{rtt: time.Millisecond}, nil
+	}
+
+	if count := p.update(); count != 2 {
+		t.Errorf("update counted %d usable sessions, expected 2", count)
+	}
+
+	var keys []string
+	for _, path := range p.paths {
+		keys = append(keys, path.key)
+	}
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Errorf("paths after update %v, expected [a b]", keys)
+	}
+	if !stalled.IsClosed() {
+		t.Error("sessions of the stalled path were not closed")
+	}
+}
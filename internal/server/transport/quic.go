@@ -3,12 +3,13 @@ package transport
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/musix/backhaul/internal/utils"
@@ -30,26 +31,33 @@ type QuicTransport struct {
 	getNewConnChan chan struct{}
 	controlChannel quic.Connection
 	usageMonitor   *web.Usage
+	ports          []string // port mappings of the connected client
+	udpFlows       sync.Map // UDP flows of the control channel by flow id
+	udpFlowID      atomic.Uint32
 	restartMutex   sync.Mutex
 	coldStart      bool
 }
 
 type QuicConfig struct {
-	BindAddr     string
-	TunnelStatus string
-	SnifferLog   string
-	Token        string
-	Ports        []string
-	Nodelay      bool
-	Sniffer      bool
-	ChannelSize  int
-	MuxCon       int
-	WebPort      int
-	KeepAlive    time.Duration
-	Heartbeat    time.Duration // in seconds
-	TLSCertFile  string        // Path to the TLS certificate file
-	TLSKeyFile   string        // Path to the TLS key file
-
+	BindAddr        string
+	TunnelStatus    web.TunnelStatus
+	SnifferLog      string
+	Token           string
+	Ports           []string
+	Nodelay         bool
+	Sniffer         bool
+	ChannelSize     int
+	MuxCon          int
+	WebPort         int
+	KeepAlive       time.Duration
+	HalfCloseLinger time.Duration
+	Socket          *utils.SocketOptions // tcp options of the tunnel and local sockets, nil for the defaults
+	Heartbeat       time.Duration        // in seconds
+	Certs           *CertStore           // server certificate, generated on first start and reloaded on change
+	ClientAuth      *ClientAuthOptions   // mutual TLS, nil when disabled
+	ForwardSource   bool
+	AcceptUDP       bool               // UDP port mappings, carried as QUIC datagrams
+	UDPSessions     *UDPSessionOptions // UDP session lifecycle of accept_udp, nil for the defaults
 }
 
 func NewQuicServer(parentCtx context.Context, config *QuicConfig, logger *logrus.Logger) *QuicTransport {
@@ -62,6 +70,7 @@ func NewQuicServer(parentCtx context.Context, config *QuicConfig, logger *logrus
 			Allow0RTT:       true,
 			KeepAlivePeriod: 20 * time.Second,
 			MaxIdleTimeout:  1600 * time.Second,
+			EnableDatagrams: true, // UDP flows, streams are used when the client does not support them
 		},
 		config:         config,
 		parentctx:      parentCtx,
@@ -108,7 +117,7 @@ func (s *QuicTransport) Restart() {
 	s.localChan = make(chan LocalTCPConn, s.config.ChannelSize)
 	s.controlChannel = nil
 	s.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", s.config.WebPort), ctx, s.config.SnifferLog, s.config.Sniffer, &s.config.TunnelStatus, s.logger)
-	s.config.TunnelStatus = ""
+	s.config.TunnelStatus.Set("")
 	s.coldStart = true
 
 	go s.TunnelListener()
@@ -215,7 +224,7 @@ func (s *QuicTransport) keepalive() {
 }
 
 func (s *QuicTransport) portConfigReader() {
-	for _, portMapping := range s.config.Ports {
+	for _, portMapping := range s.ports {
 		var localAddr string
 		parts := strings.Split(portMapping, "=")
 		if len(parts) < 2 {
@@ -234,6 +243,11 @@ func (s *QuicTransport) portConfigReader() {
 		remoteAddr := strings.TrimSpace(parts[1])
 
 		go s.localListener(localAddr, remoteAddr)
+
+		// Start UDP listener if configured
+		if s.config.AcceptUDP {
+			go s.udpListener(localAddr, remoteAddr)
+		}
 	}
 }
 
@@ -274,6 +288,17 @@ func (s *QuicTransport) channelHandshake(qConn quic.Connection) {
 		return
 	}
 
+	// the client certificate selects the ports of its tenant
+	tlsState := qConn.ConnectionState().TLS
+	ports, err := s.config.ClientAuth.ports(&tlsState, s.config.Ports, s.logger)
+	if err != nil {
+		s.logger.Warnf("control channel from %s rejected: %v", qConn.RemoteAddr().String(), err)
+		stream.Close()
+		qConn.CloseWithError(1, "close on rejected client certificate")
+		return
+	}
+	s.ports = ports
+
 	err = utils.SendBinaryString(stream, s.config.Token)
 	if err != nil {
 		s.logger.Errorf("failed to send security token: %v", err)
@@ -295,21 +320,16 @@ func (s *QuicTransport) channelHandshake(qConn quic.Connection) {
 		go s.handleTunConn()
 	}
 	go s.keepalive()
+	go s.udpDatagramReader(qConn)
 
-	s.config.TunnelStatus = "Connected (QUIC)"
+	s.config.TunnelStatus.Set("Connected (QUIC)")
 }
 
 func (s *QuicTransport) generateTLSConfig() *tls.Config {
-	// You should replace this with proper certificate and key files
-	cert, err := tls.LoadX509KeyPair(s.config.TLSCertFile, s.config.TLSKeyFile)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		NextProtos:   []string{"h3"},
-	}
+	// The certificate is generated on first start and reloaded from disk on change
+	tlsConfig := serverTLSConfig(s.config.Certs, s.config.ClientAuth)
+	tlsConfig.NextProtos = []string{"h3"}
+	return tlsConfig
 }
 
 func (s *QuicTransport) TunnelListener() {
@@ -317,7 +337,7 @@ func (s *QuicTransport) TunnelListener() {
 	if s.config.WebPort > 0 {
 		go s.usageMonitor.Monitor()
 	}
-	s.config.TunnelStatus = "Disconnected (QUIC)"
+	s.config.TunnelStatus.Set("Disconnected (QUIC)")
 
 	// Create a UDP connection
 	udpAddr, err := net.ResolveUDPAddr("udp", s.config.BindAddr)
@@ -389,8 +409,11 @@ func (s *QuicTransport) acceptTunCon(listener *quic.Listener) {
 }
 
 func (s *QuicTransport) localListener(localAddr string, remoteAddr string) {
-	listener, err := net.Listen("tcp", localAddr)
+	listener, err := listenTCP(s.ctx, localAddr, s.config.Socket, s.logger)
 	if err != nil {
+		if errors.Is(err, context.Canceled) { // stopped while waiting for the address
+			return
+		}
 		s.logger.Fatalf("failed to start listener on %s: %v", localAddr, err)
 		return
 	}
@@ -439,7 +462,7 @@ func (s *QuicTransport) acceptLocalCon(listener net.Listener, remoteAddr string)
 			tcpConn.SetKeepAlivePeriod(s.config.KeepAlive)
 
 			select {
-			case s.localChan <- LocalTCPConn{conn: conn, remoteAddr: remoteAddr}:
+			case s.localChan <- LocalTCPConn{conn: conn, remoteAddr: withSource(remoteAddr, conn, s.config.ForwardSource)}:
 				s.logger.Debugf("accepted incoming TCP connection from %s", tcpConn.RemoteAddr().String())
 
 			default: // channel is full, discard the connection
@@ -503,7 +526,7 @@ func (s *QuicTransport) handleSession(session quic.Connection, next chan struct{
 
 			// Handle data exchange between connections
 			go func() {
-				utils.QConnectionHandler(incomingConn.conn, stream, s.logger, s.usageMonitor, incomingConn.conn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer)
+				utils.QConnectionHandler(incomingConn.conn, stream, s.logger, s.usageMonitor, incomingConn.conn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer, s.config.HalfCloseLinger)
 				done <- struct{}{}
 			}()
 
@@ -0,0 +1,238 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/musix/backhaul/internal/utils"
+	"github.com/quic-go/quic-go"
+)
+
+// quicUDPFlow is a UDP client of a port mapping, carried over the control connection of the QUIC transport
+type quicUDPFlow struct {
+	*udpSession // packets of the client waiting to be sent to the tunnel
+	id          uint32
+	listener    *net.UDPConn
+	clientAddr  *net.UDPAddr
+	ready       atomic.Bool // the client registered the flow, its packets can be sent as datagrams
+}
+
+func (s *QuicTransport) udpListener(localAddr string, remoteAddr string) {
+	localUDPAddr, err := net.ResolveUDPAddr("udp", localAddr)
+	if err != nil {
+		s.logger.Fatalf("failed to resolve local address: %v", err)
+	}
+
+	listener, err := listenUDP(s.ctx, localUDPAddr, s.logger)
+	if err != nil {
+		if errors.Is(err, context.Canceled) { // stopped while waiting for the address
+			return
+		}
+		s.logger.Fatalf("failed to listen on local UDP port: %v", err)
+	}
+
+	defer listener.Close()
+
+	s.logger.Infof("UDP listener started successfully, listening on address: %s", listener.LocalAddr().String())
+
+	// flows of the listener by client address
+	sessions := newUDPSessionTable(s.config.UDPSessions, s.usageMonitor, s.logger)
+
+	// Datagrams are read in batches, a single system call returns all the packets waiting on the socket
+	batch := utils.NewUDPBatch(listener, BufferSize)
+
+	handle := func(data []byte, addr *net.UDPAddr) {
+		if sessions.push(addr, data) {
+			return
+		}
+
+		flow := &quicUDPFlow{
+			udpSession: sessions.add(addr, data),
+			id:         s.udpFlowID.Add(1),
+			listener:   listener,
+			clientAddr: addr,
+		}
+
+		s.logger.Debugf("accepted UDP connection from %s as flow %d", addr.String(), flow.id)
+		go func() {
+			s.handleUDPFlow(flow, remoteAddr)
+			sessions.remove(flow.udpSession)
+		}()
+	}
+
+	go func() {
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			default:
+				if err := batch.ReadBatch(handle); err != nil {
+					if errors.Is(err, net.ErrClosed) {
+						return
+					}
+					s.logger.Errorf("failed to read from UDP listener: %v", err)
+				}
+			}
+		}
+	}()
+
+	<-s.ctx.Done()
+}
+
+// handleUDPFlow opens the stream of a flow on the control connection and forwards its packets until it is idle
+func (s *QuicTransport) handleUDPFlow(flow *quicUDPFlow, remoteAddr string) {
+	conn := s.controlChannel
+	if conn == nil {
+		s.logger.Warnf("control channel is not established, dropping UDP flow of %s", flow.clientAddr.String())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, 5*time.Second)
+	stream, err := conn.OpenStreamSync(ctx)
+	cancel()
+	if err != nil {
+		s.logger.Errorf("failed to open stream for UDP flow %d: %v", flow.id, err)
+		return
+	}
+	defer stream.Close()
+
+	if s.config.ForwardSource {
+		remoteAddr = remoteAddr + "#" + flow.clientAddr.String()
+	}
+
+	if err := utils.SendFlowID(stream, flow.id); err != nil {
+		s.logger.Errorf("failed to open UDP flow %d: %v", flow.id, err)
+		stream.CancelRead(0)
+		return
+	}
+	if err := utils.SendBinaryString(stream, remoteAddr); err != nil {
+		s.logger.Errorf("failed to send address %v over UDP flow %d: %v", remoteAddr, flow.id, err)
+		stream.CancelRead(0)
+		return
+	}
+
+	// datagrams of the flow are dispatched by the datagram reader of the control connection
+	s.udpFlows.Store(flow.id, flow)
+	defer s.udpFlows.Delete(flow.id)
+
+	remotePort := flow.listener.LocalAddr().(*net.UDPAddr).Port
+
+	// packets sent on the stream, when datagrams are not available
+	go func() {
+		buf := utils.GetBuffer(BufferSize)
+		defer utils.PutBuffer(buf)
+		for {
+			n, err := utils.ReceiveFlowFrame(stream, buf)
+			if err != nil {
+				s.logger.Tracef("UDP flow %d stream closed: %v", flow.id, err)
+				stream.CancelWrite(0)
+				return
+			}
+			// the first frame of the client is the empty ready signal
+			if !flow.ready.Load() {
+				flow.ready.Store(true)
+				s.logger.Tracef("UDP flow %d ready for datagrams", flow.id)
+				continue
+			}
+			s.writeUDPFlow(flow, buf[:n], remotePort)
+		}
+	}()
+
+	inactivityTimeout := s.config.UDPSessions.idleTimeout()
+	idle := time.NewTimer(inactivityTimeout)
+	defer idle.Stop()
+
+	buf := utils.GetBuffer(BufferSize + 4)
+	defer utils.PutBuffer(buf)
+	for {
+		select {
+		case <-s.ctx.Done():
+			stream.CancelRead(0)
+			return
+
+		case <-stream.Context().Done(): // closed by the client
+			s.logger.Debugf("UDP flow %d closed by the client", flow.id)
+			return
+
+		case data, ok := <-flow.payload:
+			if !ok {
+				return
+			}
+			err := utils.SendFlowPacket(conn, stream, flow.id, data, buf, flow.ready.Load())
+			utils.ReleasePacket(data) // the packet is copied by SendFlowPacket
+			if err != nil {
+				s.logger.Errorf("failed to send UDP packet over flow %d: %v", flow.id, err)
+				stream.CancelRead(0)
+				return
+			}
+
+			if s.config.Sniffer {
+				s.usageMonitor.AddOrUpdatePort(remotePort, uint64(len(data)))
+			}
+			idle.Reset(inactivityTimeout)
+
+		case <-flow.evicted:
+			stream.CancelRead(0)
+			return
+
+		case <-idle.C:
+			// packets from the client side keep the flow open as well
+			if remaining := inactivityTimeout - flow.idle(); remaining > 0 {
+				idle.Reset(remaining)
+				continue
+			}
+			s.logger.Debugf("UDP flow %d of %s idle for %v, closing", flow.id, flow.clientAddr.String(), inactivityTimeout)
+			stream.CancelRead(0)
+			return
+		}
+	}
+}
+
+// udpDatagramReader dispatches the datagrams of a control connection to their flows
+func (s *QuicTransport) udpDatagramReader(conn quic.Connection) {
+	// SupportsDatagrams only tells that the client accepts them, the packets it sends may still arrive here
+	if !conn.ConnectionState().SupportsDatagrams {
+		s.logger.Info("QUIC datagrams not supported by the client, UDP packets are sent on streams")
+	}
+
+	for {
+		datagram, err := conn.ReceiveDatagram(s.ctx)
+		if err != nil {
+			s.logger.Tracef("stopped receiving datagrams: %v", err)
+			return
+		}
+
+		id, data, err := utils.ParseFlowDatagram(datagram)
+		if err != nil {
+			s.logger.Debugf("discarding datagram: %v", err)
+			continue
+		}
+
+		value, ok := s.udpFlows.Load(id)
+		if !ok {
+			s.logger.Tracef("discarding datagram of unknown UDP flow %d", id)
+			continue
+		}
+		flow := value.(*quicUDPFlow)
+		s.writeUDPFlow(flow, data, flow.listener.LocalAddr().(*net.UDPAddr).Port)
+	}
+}
+
+// writeUDPFlow forwards a packet of the tunnel to the UDP client of the flow
+func (s *QuicTransport) writeUDPFlow(flow *quicUDPFlow, data []byte, remotePort int) {
+	w, err := flow.listener.WriteToUDP(data, flow.clientAddr)
+	if err != nil {
+		s.logger.Errorf("failed to forward UDP packet to %s: %v", flow.clientAddr.String(), err)
+		return
+	}
+	flow.touch()
+
+	if s.config.Sniffer {
+		s.usageMonitor.AddOrUpdatePort(remotePort, uint64(w))
+	}
+
+	s.logger.Tracef("forwarded %d bytes of UDP flow %d to %s", w, flow.id, flow.clientAddr.String())
+}
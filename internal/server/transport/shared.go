@@ -1,10 +1,18 @@
 package transport
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"net"
+	"net/http"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/musix/backhaul/internal/utils"
+	"github.com/sirupsen/logrus"
 )
 
 type TunnelChannel struct { // for websocket
@@ -15,25 +23,28 @@ type TunnelChannel struct { // for websocket
 
 type LocalTCPConn struct {
 	conn        net.Conn
+	udp         *LocalAcceptUDPConn // set instead of conn for a UDP client of accept_udp
 	remoteAddr  string
 	timeCreated int64
 }
 
 type LocalAcceptUDPConn struct {
+	*udpSession
 	timeCreated int64
-	payload     chan []byte
 	remoteAddr  string
 	listener    *net.UDPConn
 	clientAddr  *net.UDPAddr
-	IsCongested bool // for congested tcp connection
+	sessions    *udpSessionTable // sessions of the listener
 }
 
 type LocalUDPConn struct {
+	*udpSession
 	timeCreated int64
-	payload     chan []byte
 	remoteAddr  string
 	listener    *net.UDPConn
+	batch       *utils.UDPBatch // batched I/O of the listener
 	addr        *net.UDPAddr
+	sessions    *udpSessionTable // sessions of the listener
 }
 
 type TunnelUDPConn struct {
@@ -41,6 +52,106 @@ type TunnelUDPConn struct {
 	payload     chan []byte
 	addr        *net.UDPAddr
 	listener    *net.UDPConn
+	batch       *utils.UDPBatch // batched I/O of the listener
 	ping        chan struct{}
 	mu          *sync.Mutex //mutex for ping channel
 }
+
+// Local ports are only bound while a control channel is established. When the same tunnel
+// listens on several transports, the previous owner may still hold the ports for a moment
+// after the client moved to another transport, so keep retrying while the address is in use.
+// The accepted connections inherit the socket options of the listener.
+func listenTCP(ctx context.Context, localAddr string, socket *utils.SocketOptions, logger *logrus.Logger) (net.Listener, error) {
+	listenConfig := &net.ListenConfig{Control: socket.ControlListen}
+
+	for attempt := 1; ; attempt++ {
+		listener, err := listenConfig.Listen(ctx, "tcp", localAddr)
+		if err == nil || !errors.Is(err, syscall.EADDRINUSE) {
+			return listener, err
+		}
+
+		if attempt%10 == 1 {
+			logger.Warnf("address %s is still in use, waiting for it to be released", localAddr)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// listenTunnel opens the tcp listener of the tunnel connections with the socket options of the tunnel
+func listenTunnel(bindAddr string, socket *utils.SocketOptions) (net.Listener, error) {
+	listenConfig := &net.ListenConfig{Control: socket.ControlListen}
+	return listenConfig.Listen(context.Background(), "tcp", bindAddr)
+}
+
+// serveHTTP serves an http based transport on a listener with the socket options of the tunnel, over TLS
+// with server.TLSConfig when useTLS is set
+func serveHTTP(server *http.Server, socket *utils.SocketOptions, useTLS bool) error {
+	listener, err := listenTunnel(server.Addr, socket)
+	if err != nil {
+		return err
+	}
+
+	if useTLS {
+		return server.ServeTLS(listener, "", "")
+	}
+	return server.Serve(listener)
+}
+
+// listenUDP is the UDP counterpart of listenTCP
+func listenUDP(ctx context.Context, localAddr *net.UDPAddr, logger *logrus.Logger) (*net.UDPConn, error) {
+	for attempt := 1; ; attempt++ {
+		listener, err := net.ListenUDP("udp", localAddr)
+		if err == nil || !errors.Is(err, syscall.EADDRINUSE) {
+			return listener, err
+		}
+
+		if attempt%10 == 1 {
+			logger.Warnf("address %s is still in use, waiting for it to be released", localAddr.String())
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// withSource appends the address of the original client to the target when forward_source is
+// enabled, so the client can balance its backend pools by source.
+func withSource(remoteAddr string, conn net.Conn, forwardSource bool) string {
+	if !forwardSource {
+		return remoteAddr
+	}
+	return remoteAddr + "#" + conn.RemoteAddr().String()
+}
+
+// serverTLSConfig returns the server TLS configuration of the tls transports, the certificate
+// is taken from the store on every handshake so reloads apply to new connections
+func serverTLSConfig(certs *CertStore, clientAuth *ClientAuthOptions) *tls.Config {
+	tlsConfig := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	clientAuth.apply(tlsConfig)
+	return tlsConfig
+}
+
+// tlsServer wraps an accepted tunnel connection in TLS and completes the handshake,
+// so the connection is ready to use once it is pooled
+func tlsServer(conn net.Conn, config *tls.Config, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	tlsConn := tls.Server(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,688 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/musix/backhaul/internal/config"
+	"github.com/musix/backhaul/internal/utils"
+	"github.com/musix/backhaul/internal/web"
+
+	"github.com/sirupsen/logrus"
+)
+
+type SplitHTTPTransport struct {
+	config         *SplitHTTPConfig
+	parentctx      context.Context
+	ctx            context.Context
+	cancel         context.CancelFunc
+	logger         *logrus.Logger
+	tunnelChannel  chan TunnelSplitHTTPConn
+	localChannel   chan LocalTCPConn
+	reqNewConnChan chan struct{}
+	controlChannel *utils.H2Conn
+	sessions       sync.Map // session id -> *utils.SplitUpload
+	restartMutex   sync.Mutex
+	usageMonitor   *web.Usage
+	ports          []string // port mappings of the connected client
+}
+
+type SplitHTTPConfig struct {
+	BindAddr        string
+	SnifferLog      string
+	Certs           *CertStore         // server certificate, generated on first start and reloaded on change
+	ClientAuth      *ClientAuthOptions // mutual TLS, nil when disabled
+	TunnelStatus    web.TunnelStatus
+	Token           string
+	Ports           []string
+	Nodelay         bool
+	Sniffer         bool
+	KeepAlive       time.Duration
+	HalfCloseLinger time.Duration
+	Socket          *utils.SocketOptions // tcp options of the tunnel and local sockets, nil for the defaults
+	Heartbeat       time.Duration        // in seconds
+	ChannelSize     int
+	WebPort         int
+	Mode            config.TransportType // splithttp or splithttps
+	ForwardSource   bool
+	PacketSize      int // max size of an upload POST
+	Concurrency     int // uploads accepted ahead of the reader of a session
+}
+
+// TunnelSplitHTTPConn is a split HTTP session waiting in the pool for a local connection
+type TunnelSplitHTTPConn struct {
+	conn *utils.H2Conn
+	ping chan struct{}
+	mu   *sync.Mutex
+}
+
+func NewSplitHTTPServer(parentCtx context.Context, config *SplitHTTPConfig, logger *logrus.Logger) *SplitHTTPTransport {
+	// Create a derived context from the parent context
+	ctx, cancel := context.WithCancel(parentCtx)
+
+	// Initialize the SplitHTTPTransport struct
+	server := &SplitHTTPTransport{
+		config:         config,
+		parentctx:      parentCtx,
+		ctx:            ctx,
+		cancel:         cancel,
+		logger:         logger,
+		tunnelChannel:  make(chan TunnelSplitHTTPConn, config.ChannelSize),
+		localChannel:   make(chan LocalTCPConn, config.ChannelSize),
+		reqNewConnChan: make(chan struct{}, config.ChannelSize),
+		controlChannel: nil, // will be set when a control connection is established
+		usageMonitor:   web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
+	}
+
+	return server
+}
+
+func (s *SplitHTTPTransport) Start() {
+	// for  webui
+	if s.config.WebPort > 0 {
+		go s.usageMonitor.Monitor()
+	}
+
+	s.config.TunnelStatus.Set(fmt.Sprintf("Disconnected (%s)", s.config.Mode))
+
+	go s.tunnelListener()
+
+}
+func (s *SplitHTTPTransport) Restart() {
+	if !s.restartMutex.TryLock() {
+		s.logger.Warn("server restart already in progress, skipping restart attempt")
+		return
+	}
+	defer s.restartMutex.Unlock()
+
+	s.logger.Info("restarting server...")
+
+	level := s.logger.Level
+	s.logger.SetLevel(logrus.FatalLevel)
+
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	// Close control channel connection
+	if s.controlChannel != nil {
+		s.controlChannel.Close()
+	}
+
+	time.Sleep(2 * time.Second)
+
+	ctx, cancel := context.WithCancel(s.parentctx)
+	s.ctx = ctx
+	s.cancel = cancel
+
+	// Re-initialize variables
+	s.tunnelChannel = make(chan TunnelSplitHTTPConn, s.config.ChannelSize)
+	s.localChannel = make(chan LocalTCPConn, s.config.ChannelSize)
+	s.reqNewConnChan = make(chan struct{}, s.config.ChannelSize)
+	s.controlChannel = nil
+	s.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", s.config.WebPort), ctx, s.config.SnifferLog, s.config.Sniffer, &s.config.TunnelStatus, s.logger)
+	s.config.TunnelStatus.Set("")
+
+	// set the log level again
+	s.logger.SetLevel(level)
+
+	go s.Start()
+}
+
+func (s *SplitHTTPTransport) channelHandler() {
+	ticker := time.NewTicker(s.config.Heartbeat)
+	defer ticker.Stop()
+
+	// Channel to receive the message or error
+	messageChan := make(chan byte, 10)
+
+	// Separate goroutine to continuously listen for messages
+	go func() {
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+
+			default:
+				msg, err := utils.ReceiveBinaryByte(s.controlChannel)
+				// Exit if there's an error
+				if err != nil {
+					if s.cancel != nil {
+						s.logger.Error("failed to read from channel connection. ", err)
+						go s.Restart()
+					}
+					return
+				}
+				messageChan <- msg
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			_ = utils.SendBinaryByte(s.controlChannel, utils.SG_Closed)
+			return
+		case <-s.reqNewConnChan:
+			err := utils.SendBinaryByte(s.controlChannel, utils.SG_Chan)
+			if err != nil {
+				s.logger.Error("failed to send request new connection signal. ", err)
+				go s.Restart()
+				return
+			}
+
+		case <-ticker.C:
+			err := utils.SendBinaryByte(s.controlChannel, utils.SG_HB)
+			if err != nil {
+				s.logger.Errorf("failed to send heartbeat signal. Error: %v.", err)
+				go s.Restart()
+				return
+			}
+			s.logger.Debug("heartbeat signal sent successfully")
+
+		case msg, ok := <-messageChan:
+			if !ok {
+				s.logger.Error("channel closed, likely due to an error in split http session read")
+				return
+			}
+			switch msg {
+			case utils.SG_HB:
+				s.logger.Trace("heartbeat signal received successfully")
+
+			case utils.SG_Closed:
+				s.logger.Warn("control channel has been closed by the client")
+				s.Restart()
+				return
+
+			default:
+				s.logger.Errorf("unexpected response from channel: %v", msg)
+				go s.Restart()
+				return
+			}
+
+		}
+	}
+}
+
+func (s *SplitHTTPTransport) tunnelListener() {
+	addr := s.config.BindAddr
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.logger.Tracef("received http request from %s", r.RemoteAddr)
+
+		// Read the "Authorization" header
+		authHeader := r.Header.Get("Authorization")
+		if authHeader != fmt.Sprintf("Bearer %v", s.config.Token) {
+			s.logger.Warnf("unauthorized request from %s, closing connection", r.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized) // Send 401 Unauthorized response
+			return
+		}
+
+		// Paths are /channel/<session> or /tunnel/<session> for the download,
+		// followed by /<seq> for the uploads
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) < 2 || (parts[0] != "channel" && parts[0] != "tunnel") || parts[1] == "" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		sessionID := parts[0] + "/" + parts[1]
+
+		switch {
+		case r.Method == http.MethodGet && len(parts) == 2:
+			s.downloadHandler(w, r, sessionID, parts[0] == "channel")
+
+		case r.Method == http.MethodPost && len(parts) == 3:
+			s.uploadHandler(w, r, sessionID, parts[2])
+
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	})
+
+	// Create an HTTP server, HTTP/1.1 is enough for every request of a session
+	server := &http.Server{
+		Addr:        addr,
+		Handler:     handler,
+		IdleTimeout: -1,
+	}
+
+	go func() {
+		s.logger.Infof("%s server starting, listening on %s", s.config.Mode, addr)
+		if s.controlChannel == nil {
+			s.logger.Infof("waiting for %s control channel connection", s.config.Mode)
+		}
+
+		var err error
+		if s.config.Mode == config.SPLITHTTPS {
+			server.TLSConfig = serverTLSConfig(s.config.Certs, s.config.ClientAuth)
+			err = serveHTTP(server, s.config.Socket, true)
+		} else {
+			err = serveHTTP(server, s.config.Socket, false)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			s.logger.Fatalf("failed to listen on %s: %v", addr, err)
+		}
+	}()
+
+	<-s.ctx.Done()
+
+	// Downloads are long-lived, close them instead of waiting for them to finish
+	s.logger.Infof("shutting down the split http server on %s", addr)
+	if err := server.Close(); err != nil {
+		s.logger.Errorf("Failed to close the server: %v", err)
+	}
+
+	if s.controlChannel != nil {
+		s.controlChannel.Close()
+	}
+
+}
+
+// downloadHandler serves the streaming GET of a session, the response body carries the data of the server
+func (s *SplitHTTPTransport) downloadHandler(w http.ResponseWriter, r *http.Request, sessionID string, channel bool) {
+	// the client certificate of the control channel selects the ports of its tenant
+	if channel {
+		ports, err := s.config.ClientAuth.ports(r.TLS, s.config.Ports, s.logger)
+		if err != nil {
+			s.logger.Warnf("control channel from %s rejected: %v", r.RemoteAddr, err)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		s.ports = ports
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.logger.Errorf("streaming is not supported for the request from %s", r.RemoteAddr)
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	upload := utils.NewSplitUpload(s.config.Concurrency)
+	if _, loaded := s.sessions.LoadOrStore(sessionID, upload); loaded {
+		http.Error(w, "session already exists", http.StatusConflict)
+		return
+	}
+
+	// Send the response headers right away, the client waits for them before uploading.
+	// Proxies must pass the body through as it is written instead of buffering it.
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	closeSession := func() {
+		s.sessions.Delete(sessionID)
+	}
+	download := &splitDownload{ResponseWriter: w, ended: make(chan struct{})}
+	conn := utils.NewH2Conn(upload, download, flusher.Flush, closeSession, h2LocalAddr(r), h2RemoteAddr(r))
+
+	if channel {
+		if s.controlChannel != nil {
+			s.logger.Warn("new control channel requested.")
+			s.controlChannel.Close()
+			conn.Close()
+			go s.Restart()
+			return
+		}
+		s.controlChannel = conn
+
+		s.logger.Info("control channel established successfully")
+
+		numCPU := runtime.NumCPU()
+		if numCPU > 4 {
+			numCPU = 4 // Max allowed handler is 4
+		}
+
+		go s.channelHandler()
+		go s.parsePortMappings()
+
+		s.logger.Infof("starting %d handle loops on each CPU thread", numCPU)
+
+		for i := 0; i < numCPU; i++ {
+			go s.handleLoop()
+		}
+
+		s.config.TunnelStatus.Set(fmt.Sprintf("Connected (%s)", s.config.Mode))
+
+	} else {
+		splitConn := TunnelSplitHTTPConn{
+			conn: conn,
+			ping: make(chan struct{}),
+			mu:   &sync.Mutex{},
+		}
+		select {
+		case s.tunnelChannel <- splitConn:
+			go s.keepAlive(&splitConn)
+			s.logger.Debugf("split http session accepted from %s", r.RemoteAddr)
+		default:
+			s.logger.Warnf("split http tunnel channel is full, closing session from %s", r.RemoteAddr)
+			conn.Close()
+			return
+		}
+	}
+
+	// The session lives as long as the download, wait for either side to close it. The server can end its
+	// data before, the session then lives on with the uploads until it is closed.
+	ctx := s.ctx
+	select {
+	case <-conn.Done():
+	case <-download.ended:
+	case <-r.Context().Done():
+		// the data uploaded before the client ended the session is still read
+		upload.Drain()
+		conn.Close()
+	case <-ctx.Done():
+		conn.Close()
+	}
+}
+
+// splitDownload is the response of the download of a session, closing its writes ends the response
+type splitDownload struct {
+	http.ResponseWriter
+	ended chan struct{}
+	once  sync.Once
+}
+
+func (d *splitDownload) Write(b []byte) (int, error) {
+	select {
+	case <-d.ended:
+		return 0, net.ErrClosed // the response is done once the handler returned
+	default:
+		return d.ResponseWriter.Write(b)
+	}
+}
+
+func (d *splitDownload) CloseWrite() error {
+	d.once.Do(func() { close(d.ended) })
+	return nil
+}
+
+// uploadHandler passes the body of a POST to its session, the sequence number restores the order
+func (s *SplitHTTPTransport) uploadHandler(w http.ResponseWriter, r *http.Request, sessionID string, seqStr string) {
+	seq, err := strconv.ParseUint(seqStr, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid sequence", http.StatusBadRequest)
+		return
+	}
+
+	value, ok := s.sessions.Load(sessionID)
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(s.config.PacketSize)))
+	if err != nil {
+		s.logger.Debugf("failed to read upload of %s: %v", sessionID, err)
+		http.Error(w, "invalid upload", http.StatusBadRequest)
+		return
+	}
+
+	if err := value.(*utils.SplitUpload).Push(seq, data); err != nil {
+		s.logger.Debugf("failed to push upload of %s: %v", sessionID, err)
+		http.Error(w, "session closed", http.StatusGone)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *SplitHTTPTransport) parsePortMappings() {
+	for _, portMapping := range s.ports {
+		parts := strings.Split(portMapping, "=")
+
+		var localAddr, remoteAddr string
+
+		// Check if only a single port or a port range is provided (no "=" present)
+		if len(parts) == 1 {
+			localPortOrRange := strings.TrimSpace(parts[0])
+			remoteAddr = localPortOrRange // If no remote addr is provided, use the local port as the remote port
+
+			// Check if it's a port range
+			if strings.Contains(localPortOrRange, "-") {
+				rangeParts := strings.Split(localPortOrRange, "-")
+				if len(rangeParts) != 2 {
+					s.logger.Fatalf("invalid port range format: %s", localPortOrRange)
+				}
+
+				// Parse and validate start and end ports
+				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
+				if err != nil || startPort < 1 || startPort > 65535 {
+					s.logger.Fatalf("invalid start port in range: %s", rangeParts[0])
+				}
+
+				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
+				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
+					s.logger.Fatalf("invalid end port in range: %s", rangeParts[1])
+				}
+
+				// Create listeners for all ports in the range
+				for port := startPort; port <= endPort; port++ {
+					localAddr = fmt.Sprintf(":%d", port)
+					go s.localListener(localAddr, strconv.Itoa(port)) // Use port as the remoteAddr
+					time.Sleep(1 * time.Millisecond)                  // for wide port ranges
+				}
+				continue
+			} else {
+				// Handle single port case
+				port, err := strconv.Atoi(localPortOrRange)
+				if err != nil || port < 1 || port > 65535 {
+					s.logger.Fatalf("invalid port format: %s", localPortOrRange)
+				}
+				localAddr = fmt.Sprintf(":%d", port)
+			}
+		} else if len(parts) == 2 {
+			// Handle "local=remote" format
+			localPortOrRange := strings.TrimSpace(parts[0])
+			remoteAddr = strings.TrimSpace(parts[1])
+
+			// Check if local port is a range
+			if strings.Contains(localPortOrRange, "-") {
+				rangeParts := strings.Split(localPortOrRange, "-")
+				if len(rangeParts) != 2 {
+					s.logger.Fatalf("invalid port range format: %s", localPortOrRange)
+				}
+
+				// Parse and validate start and end ports
+				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
+				if err != nil || startPort < 1 || startPort > 65535 {
+					s.logger.Fatalf("invalid start port in range: %s", rangeParts[0])
+				}
+
+				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
+				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
+					s.logger.Fatalf("invalid end port in range: %s", rangeParts[1])
+				}
+
+				// Create listeners for all ports in the range
+				for port := startPort; port <= endPort; port++ {
+					localAddr = fmt.Sprintf(":%d", port)
+					go s.localListener(localAddr, remoteAddr)
+					time.Sleep(1 * time.Millisecond) // for wide port ranges
+				}
+				continue
+			} else {
+				// Handle single local port case
+				port, err := strconv.Atoi(localPortOrRange)
+				if err == nil && port > 1 && port < 65535 { // format port=remoteAddress
+					localAddr = fmt.Sprintf(":%d", port)
+				} else {
+					localAddr = localPortOrRange // format ip:port=remoteAddress
+				}
+			}
+		} else {
+			s.logger.Fatalf("invalid port mapping format: %s", portMapping)
+		}
+		// Start listeners for single port
+		go s.localListener(localAddr, remoteAddr)
+	}
+}
+
+func (s *SplitHTTPTransport) localListener(localAddr string, remoteAddr string) {
+	portListener, err := listenTCP(s.ctx, localAddr, s.config.Socket, s.logger)
+	if err != nil {
+		if errors.Is(err, context.Canceled) { // stopped while waiting for the address
+			return
+		}
+		s.logger.Fatalf("failed to start listener on %s: %v", localAddr, err)
+		return
+	}
+
+	//close local listener after context cancellation
+	defer portListener.Close()
+
+	s.logger.Infof("listener started successfully, listening on address: %s", portListener.Addr().String())
+
+	go s.acceptLocalConn(portListener, remoteAddr)
+
+	<-s.ctx.Done()
+}
+
+func (s *SplitHTTPTransport) acceptLocalConn(listener net.Listener, remoteAddr string) {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+
+		default:
+			s.logger.Debugf("waiting to accept incoming connection on %s", listener.Addr().String())
+			conn, err := listener.Accept()
+			if err != nil {
+				s.logger.Debugf("failed to accept connection on %s: %v", listener.Addr().String(), err)
+				continue
+			}
+
+			// discard any non-tcp connection
+			tcpConn, ok := conn.(*net.TCPConn)
+			if !ok {
+				s.logger.Warnf("disarded non-TCP connection from %s", conn.RemoteAddr().String())
+				conn.Close()
+				continue
+			}
+
+			// trying to enable tcpnodelay
+			if !s.config.Nodelay {
+				if err := tcpConn.SetNoDelay(s.config.Nodelay); err != nil {
+					s.logger.Warnf("failed to set TCP_NODELAY for %s: %v", tcpConn.RemoteAddr().String(), err)
+				} else {
+					s.logger.Tracef("TCP_NODELAY disabled for %s", tcpConn.RemoteAddr().String())
+				}
+			}
+
+			// Set keep-alive settings
+			if err := tcpConn.SetKeepAlive(true); err != nil {
+				s.logger.Warnf("failed to enable TCP keep-alive for %s: %v", tcpConn.RemoteAddr().String(), err)
+			} else {
+				s.logger.Tracef("TCP keep-alive enabled for %s", tcpConn.RemoteAddr().String())
+			}
+			if err := tcpConn.SetKeepAlivePeriod(s.config.KeepAlive); err != nil {
+				s.logger.Warnf("failed to set TCP keep-alive period for %s: %v", tcpConn.RemoteAddr().String(), err)
+			}
+
+			select {
+			case s.localChannel <- LocalTCPConn{conn: conn, remoteAddr: withSource(remoteAddr, conn, s.config.ForwardSource), timeCreated: time.Now().UnixMilli()}:
+
+				select {
+				case s.reqNewConnChan <- struct{}{}:
+					// Successfully requested a new connection
+				default:
+					// The channel is full, do nothing
+					s.logger.Warn("channel is full, cannot request a new connection")
+				}
+
+				s.logger.Debugf("accepted incoming TCP connection from %s", tcpConn.RemoteAddr().String())
+
+			default: // channel is full, discard the connection
+				s.logger.Warnf("channel with listener %s is full, discarding TCP connection from %s", listener.Addr().String(), tcpConn.LocalAddr().String())
+				conn.Close()
+			}
+		}
+	}
+}
+
+func (s *SplitHTTPTransport) handleLoop() {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case localConn := <-s.localChannel:
+		loop:
+			for {
+				if time.Now().UnixMilli()-localConn.timeCreated > 3000 { // 3000ms
+					s.logger.Debugf("timeouted local connection: %d ms", time.Now().UnixMilli()-localConn.timeCreated)
+					localConn.conn.Close()
+					break loop
+				}
+
+				select {
+				case <-s.ctx.Done():
+					return
+				case tunnelConnection := <-s.tunnelChannel:
+					close(tunnelConnection.ping)
+					tunnelConnection.mu.Lock()
+
+					// Pings and the remote address share the stream, the address is announced by SG_TCP
+					if err := utils.SendBinaryByte(tunnelConnection.conn, utils.SG_TCP); err != nil {
+						s.logger.Debugf("%v", err) // failed to send port number
+						tunnelConnection.conn.Close()
+						continue loop
+					}
+					if err := utils.SendBinaryString(tunnelConnection.conn, localConn.remoteAddr); err != nil {
+						s.logger.Debugf("%v", err) // failed to send port number
+						tunnelConnection.conn.Close()
+						continue loop
+					}
+					// Handle data exchange between connections
+					go utils.TCPConnectionHandler(tunnelConnection.conn, localConn.conn, s.logger, s.usageMonitor, localConn.conn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer, s.config.HalfCloseLinger)
+					break loop
+				}
+			}
+		}
+	}
+}
+
+func (s *SplitHTTPTransport) keepAlive(conn *TunnelSplitHTTPConn) {
+	ticker := time.NewTicker(s.config.Heartbeat) // Send periodic pings to the client
+
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			conn.conn.Close()
+			return
+		case <-conn.ping:
+			s.logger.Trace("ping channel closed")
+			return
+		case <-conn.conn.Done():
+			return
+		case <-ticker.C:
+			// Try to acquire the lock without blocking
+			locked := conn.mu.TryLock()
+			if !locked {
+				// If the lock is held by another operation, stop the pingSender
+				s.logger.Trace("write operation in progress, stopping pingSender")
+				return
+			}
+
+			if err := utils.SendBinaryByte(conn.conn, utils.SG_Ping); err != nil {
+				conn.mu.Unlock()
+				conn.conn.Close()
+				return
+			}
+			conn.mu.Unlock()
+			s.logger.Trace("ping sent to the client")
+		}
+	}
+}
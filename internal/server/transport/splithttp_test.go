@@ -0,0 +1,140 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestSplitHTTPServer(t *testing.T) (*SplitHTTPTransport, string) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	s := &SplitHTTPTransport{
+		config:        &SplitHTTPConfig{PacketSize: 1024, Concurrency: 4, Heartbeat: time.Minute},
+		ctx:           ctx,
+		cancel:        cancel,
+		logger:        logger,
+		tunnelChannel: make(chan TunnelSplitHTTPConn, 1),
+	}
+
+	// the routes of tunnelListener
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		sessionID := parts[0] + "/" + parts[1]
+		if len(parts) == 2 {
+			s.downloadHandler(w, r, sessionID, false)
+		} else {
+			s.uploadHandler(w, r, sessionID, parts[2])
+		}
+	}))
+	t.Cleanup(server.Close)
+	return s, server.URL + "/tunnel/test"
+}
+
+func testUpload(t *testing.T, url string, seq int, data string) int {
+	resp, err := http.Post(fmt.Sprintf("%s/%d", url, seq), "application/octet-stream", bytes.NewReader([]byte(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestSplitHTTPSession(t *testing.T) {
+	s, url := newTestSplitHTTPServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	tunnel := <-s.tunnelChannel
+	close(tunnel.ping)
+
+	// uploads out of order, the empty one ends the data
+	for _, u := range []struct {
+		seq  int
+		data string
+	}{
+		{1, "world"}, {0, "hello "}, {2, ""},
+	} {
+		if status := testUpload(t, url, u.seq, u.data); status != http.StatusOK {
+			t.Fatalf("upload %d answered %d", u.seq, status)
+		}
+	}
+	if status := testUpload(t, url, 3, "late"); status != http.StatusGone {
+		t.Errorf("upload after the end of the data answered %d, expected %d", status, http.StatusGone)
+	}
+
+	// the client leaves before the server read the uploads, they are still read
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	data, err := io.ReadAll(tunnel.conn)
+	if err != nil || string(data) != "hello world" {
+		t.Errorf("read %q %v, expected hello world", data, err)
+	}
+
+	select {
+	case <-tunnel.conn.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not closed once its uploads were read")
+	}
+
+	// the session is gone with its download
+	if status := testUpload(t, url, 4, "expired"); status != http.StatusNotFound {
+		t.Errorf("upload to an expired session answered %d, expected %d", status, http.StatusNotFound)
+	}
+}
+
+func TestSplitHTTPCloseWrite(t *testing.T) {
+	s, url := newTestSplitHTTPServer(t)
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	tunnel := <-s.tunnelChannel
+	close(tunnel.ping)
+	defer tunnel.conn.Close()
+
+	// the end of the data of the server ends the download
+	tunnel.conn.Write([]byte("answer"))
+	if err := tunnel.conn.CloseWrite(); err != nil {
+		t.Fatalf("close write: %v", err)
+	}
+	if _, err := tunnel.conn.Write([]byte("late")); err == nil {
+		t.Error("write accepted after the close write")
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil || string(data) != "answer" {
+		t.Errorf("downloaded %q %v, expected answer", data, err)
+	}
+
+	// the session still takes the uploads
+	for seq, data := range []string{"request", ""} {
+		if status := testUpload(t, url, seq, data); status != http.StatusOK {
+			t.Fatalf("upload %d after the end of the download answered %d", seq, status)
+		}
+	}
+	data, err = io.ReadAll(tunnel.conn)
+	if err != nil || string(data) != "request" {
+		t.Errorf("read %q %v, expected request", data, err)
+	}
+}
@@ -2,6 +2,8 @@ package transport
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"runtime"
@@ -10,6 +12,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/musix/backhaul/internal/config"
 	"github.com/musix/backhaul/internal/utils"
 	"github.com/musix/backhaul/internal/web"
 
@@ -28,22 +31,31 @@ type TcpTransport struct {
 	controlChannel net.Conn
 	restartMutex   sync.Mutex
 	usageMonitor   *web.Usage
-	rtt            int64 // in ms, for UDP
+	ports          []string    // port mappings of the connected client
+	rtt            int64       // in ms, for UDP
+	tlsConfig      *tls.Config // set in tcptls mode
 }
 
 type TcpConfig struct {
-	BindAddr     string
-	Token        string
-	SnifferLog   string
-	TunnelStatus string
-	Ports        []string
-	Nodelay      bool
-	Sniffer      bool
-	KeepAlive    time.Duration
-	Heartbeat    time.Duration // in seconds
-	ChannelSize  int
-	WebPort      int
-	AcceptUDP    bool
+	BindAddr        string
+	Token           string
+	SnifferLog      string
+	TunnelStatus    web.TunnelStatus
+	Ports           []string
+	Nodelay         bool
+	Sniffer         bool
+	KeepAlive       time.Duration
+	HalfCloseLinger time.Duration
+	Socket          *utils.SocketOptions // tcp options of the tunnel and local sockets, nil for the defaults
+	Heartbeat       time.Duration        // in seconds
+	ChannelSize     int
+	WebPort         int
+	AcceptUDP       bool
+	ForwardSource   bool
+	UDPSessions     *UDPSessionOptions   // UDP session lifecycle of accept_udp, nil for the defaults
+	Mode            config.TransportType // tcp or tcptls
+	Certs           *CertStore           // server certificate, generated on first start and reloaded on change
+	ClientAuth      *ClientAuthOptions   // mutual TLS, nil when disabled
 }
 
 func NewTCPServer(parentCtx context.Context, config *TcpConfig, logger *logrus.Logger) *TcpTransport {
@@ -69,7 +81,7 @@ func NewTCPServer(parentCtx context.Context, config *TcpConfig, logger *logrus.L
 }
 
 func (s *TcpTransport) Start() {
-	s.config.TunnelStatus = "Disconnected (TCP)"
+	s.config.TunnelStatus.Set("Disconnected (TCP)")
 
 	if s.config.WebPort > 0 {
 		go s.usageMonitor.Monitor()
@@ -80,7 +92,7 @@ func (s *TcpTransport) Start() {
 	s.channelHandshake()
 
 	if s.controlChannel != nil {
-		s.config.TunnelStatus = "Connected (TCP)"
+		s.config.TunnelStatus.Set("Connected (TCP)")
 
 		numCPU := runtime.NumCPU()
 		if numCPU > 4 {
@@ -130,7 +142,7 @@ func (s *TcpTransport) Restart() {
 	s.localChannel = make(chan LocalTCPConn, s.config.ChannelSize)
 	s.reqNewConnChan = make(chan struct{}, s.config.ChannelSize)
 	s.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", s.config.WebPort), ctx, s.config.SnifferLog, s.config.Sniffer, &s.config.TunnelStatus, s.logger)
-	s.config.TunnelStatus = ""
+	s.config.TunnelStatus.Set("")
 	s.controlChannel = nil
 
 	// set the log level again
@@ -176,6 +188,15 @@ func (s *TcpTransport) channelHandshake() {
 				continue
 			}
 
+			// in tls mode the client certificate selects the ports of its tenant
+			ports, err := s.config.ClientAuth.ports(connTLSState(conn), s.config.Ports, s.logger)
+			if err != nil {
+				s.logger.Warnf("control channel from %s rejected: %v", conn.RemoteAddr().String(), err)
+				conn.Close()
+				continue
+			}
+			s.ports = ports
+
 			err = utils.SendBinaryTransportString(conn, s.config.Token, utils.SG_Chan)
 			if err != nil {
 				s.logger.Errorf("failed to send security token: %v", err)
@@ -270,7 +291,11 @@ func (s *TcpTransport) channelHandler() {
 }
 
 func (s *TcpTransport) tunnelListener() {
-	listener, err := net.Listen("tcp", s.config.BindAddr)
+	if s.config.Mode == config.TCPTLS {
+		s.tlsConfig = serverTLSConfig(s.config.Certs, s.config.ClientAuth)
+	}
+
+	listener, err := listenTunnel(s.config.BindAddr, s.config.Socket)
 	if err != nil {
 		s.logger.Fatalf("failed to start listener on %s: %v", s.config.BindAddr, err)
 		return
@@ -332,6 +357,26 @@ func (s *TcpTransport) acceptTunnelConn(listener net.Listener) {
 				s.logger.Warnf("failed to set TCP keep-alive period for %s: %v", tcpConn.RemoteAddr().String(), err)
 			}
 
+			// in tcptls mode the handshake is completed before the connection is pooled,
+			// without blocking the other incoming connections
+			if s.tlsConfig != nil {
+				go func() {
+					tlsConn, err := tlsServer(conn, s.tlsConfig, 5*time.Second)
+					if err != nil {
+						s.logger.Debugf("tls handshake with %s failed: %v", conn.RemoteAddr().String(), err)
+						return
+					}
+
+					select {
+					case s.tunnelChannel <- tlsConn:
+					default: // The channel is full, do nothing
+						s.logger.Warnf("tunnel listener channel is full, discarding TCP connection from %s", tlsConn.LocalAddr().String())
+						tlsConn.Close()
+					}
+				}()
+				continue
+			}
+
 			select {
 			case s.tunnelChannel <- conn:
 			default: // The channel is full, do nothing
@@ -343,7 +388,7 @@ func (s *TcpTransport) acceptTunnelConn(listener net.Listener) {
 }
 
 func (s *TcpTransport) parsePortMappings() {
-	for _, portMapping := range s.config.Ports {
+	for _, portMapping := range s.ports {
 		parts := strings.Split(portMapping, "=")
 
 		var localAddr, remoteAddr string
@@ -446,8 +491,11 @@ func (s *TcpTransport) startListeners(localAddr, remoteAddr string) {
 }
 
 func (s *TcpTransport) localListener(localAddr string, remoteAddr string) {
-	listener, err := net.Listen("tcp", localAddr)
+	listener, err := listenTCP(s.ctx, localAddr, s.config.Socket, s.logger)
 	if err != nil {
+		if errors.Is(err, context.Canceled) { // stopped while waiting for the address
+			return
+		}
 		s.logger.Fatalf("failed to listen on %s: %v", localAddr, err)
 		return
 	}
@@ -493,7 +541,7 @@ func (s *TcpTransport) acceptLocalConn(listener net.Listener, remoteAddr string)
 			}
 
 			select {
-			case s.localChannel <- LocalTCPConn{conn: conn, remoteAddr: remoteAddr, timeCreated: time.Now().UnixMilli()}:
+			case s.localChannel <- LocalTCPConn{conn: conn, remoteAddr: withSource(remoteAddr, conn, s.config.ForwardSource), timeCreated: time.Now().UnixMilli()}:
 
 				select {
 				case s.reqNewConnChan <- struct{}{}:
@@ -540,7 +588,7 @@ func (s *TcpTransport) handleLoop() {
 					}
 
 					// Handle data exchange between connections
-					go utils.TCPConnectionHandler(localConn.conn, tunnelConn, s.logger, s.usageMonitor, localConn.conn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer)
+					go utils.TCPConnectionHandler(localConn.conn, tunnelConn, s.logger, s.usageMonitor, localConn.conn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer, s.config.HalfCloseLinger)
 					break loop
 
 				}
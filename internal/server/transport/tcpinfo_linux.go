@@ -0,0 +1,38 @@
+//go:build linux
+
+package transport
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// readTCPStats reads the kernel TCP_INFO of a connection
+func readTCPStats(conn *net.TCPConn) (tcpStats, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return tcpStats{}, err
+	}
+
+	var info *unix.TCPInfo
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		info, sockErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil {
+		return tcpStats{}, err
+	}
+	if sockErr != nil {
+		return tcpStats{}, sockErr
+	}
+
+	return tcpStats{
+		rtt:          time.Duration(info.Rtt) * time.Microsecond,
+		totalRetrans: info.Total_retrans,
+		segsOut:      info.Segs_out,
+		unacked:      info.Unacked,
+		lastAckRecv:  time.Duration(info.Last_ack_recv) * time.Millisecond,
+	}, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package transport
+
+import (
+	"errors"
+	"net"
+)
+
+// readTCPStats is only supported on linux, paths are then weighted equally
+func readTCPStats(conn *net.TCPConn) (tcpStats, error) {
+	return tcpStats{}, errors.New("TCP_INFO is not supported on this platform")
+}
@@ -2,6 +2,8 @@ package transport
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"runtime"
@@ -11,6 +13,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/musix/backhaul/internal/config"
 	"github.com/musix/backhaul/internal/utils"
 	"github.com/musix/backhaul/internal/web"
 
@@ -31,14 +34,18 @@ type TcpMuxTransport struct {
 	reqNewConnChan   chan struct{}
 	controlChannel   net.Conn
 	usageMonitor     *web.Usage
+	ports            []string // port mappings of the connected client
 	restartMutex     sync.Mutex
 	streamCounter    int32
 	sessionCounter   int32
+	paths            *pathScheduler
+	tlsConfig        *tls.Config // set in tcpmuxtls mode
+	halfClose        atomic.Bool // the new streams are framed, confirmed by the client
 }
 
 type TcpMuxConfig struct {
 	BindAddr         string
-	TunnelStatus     string
+	TunnelStatus     web.TunnelStatus
 	SnifferLog       string
 	Token            string
 	Ports            []string
@@ -52,8 +59,16 @@ type TcpMuxConfig struct {
 	MaxStreamBuffer  int
 	WebPort          int
 	KeepAlive        time.Duration
-	Heartbeat        time.Duration // in seconds
-
+	HalfCloseLinger  time.Duration
+	Socket           *utils.SocketOptions // tcp options of the tunnel and local sockets, nil for the defaults
+	Heartbeat        time.Duration        // in seconds
+	AcceptUDP        bool
+	ForwardSource    bool
+	UDPSessions      *UDPSessionOptions   // UDP session lifecycle of accept_udp, nil for the defaults
+	Multipath        bool                 // accept tunnel connections from several client addresses and bond them
+	Mode             config.TransportType // tcpmux or tcpmuxtls
+	Certs            *CertStore           // server certificate, generated on first start and reloaded on change
+	ClientAuth       *ClientAuthOptions   // mutual TLS, nil when disabled
 }
 
 func NewTcpMuxServer(parentCtx context.Context, config *TcpMuxConfig, logger *logrus.Logger) *TcpMuxTransport {
@@ -82,6 +97,7 @@ func NewTcpMuxServer(parentCtx context.Context, config *TcpMuxConfig, logger *lo
 		controlChannel:   nil, // will be set when a control connection is established
 		streamCounter:    0,
 		sessionCounter:   0,
+		paths:            newPathScheduler(logger),
 		usageMonitor:     web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
 	}
 
@@ -92,14 +108,14 @@ func (s *TcpMuxTransport) Start() {
 	if s.config.WebPort > 0 {
 		go s.usageMonitor.Monitor()
 	}
-	s.config.TunnelStatus = "Disconnected (TCPMux)"
+	s.config.TunnelStatus.Set("Disconnected (TCPMux)")
 
 	go s.tunnelListener()
 
 	s.channelHandshake()
 
 	if s.controlChannel != nil {
-		s.config.TunnelStatus = "Connected (TCPMux)"
+		s.config.TunnelStatus.Set("Connected (TCPMux)")
 
 		numCPU := runtime.NumCPU()
 		if numCPU > 4 {
@@ -109,6 +125,13 @@ func (s *TcpMuxTransport) Start() {
 		go s.parsePortMappings()
 		go s.channelHandler()
 
+		if s.config.Multipath {
+			s.logger.Info("multipath enabled, spreading streams over the tunnel paths")
+			go s.pathMonitor()
+			go s.dispatchLoop()
+			return
+		}
+
 		s.logger.Infof("starting %d handle loops on each CPU thread", numCPU)
 
 		for i := 0; i < numCPU; i++ {
@@ -152,9 +175,10 @@ func (s *TcpMuxTransport) Restart() {
 	s.handshakeChannel = make(chan net.Conn)
 	s.controlChannel = nil
 	s.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", s.config.WebPort), ctx, s.config.SnifferLog, s.config.Sniffer, &s.config.TunnelStatus, s.logger)
-	s.config.TunnelStatus = ""
+	s.config.TunnelStatus.Set("")
 	s.streamCounter = 0
 	s.sessionCounter = 0
+	s.paths.reset()
 
 	// set the log level again
 	s.logger.SetLevel(level)
@@ -198,7 +222,21 @@ func (s *TcpMuxTransport) channelHandshake() {
 				continue
 			}
 
-			err = utils.SendBinaryTransportString(conn, s.config.Token, utils.SG_Chan)
+			// in tls mode the client certificate selects the ports of its tenant
+			ports, err := s.config.ClientAuth.ports(connTLSState(conn), s.config.Ports, s.logger)
+			if err != nil {
+				s.logger.Warnf("control channel from %s rejected: %v", conn.RemoteAddr().String(), err)
+				conn.Close()
+				continue
+			}
+			s.ports = ports
+
+			// the framing of the streams is advertised in the signal of the answer, older clients ignore it
+			signal := utils.SG_Chan
+			if s.config.HalfCloseLinger > 0 {
+				signal = utils.SG_Framed
+			}
+			err = utils.SendBinaryTransportString(conn, s.config.Token, signal)
 			if err != nil {
 				s.logger.Errorf("failed to send security token: %v", err)
 				conn.Close()
@@ -206,7 +244,11 @@ func (s *TcpMuxTransport) channelHandshake() {
 			}
 
 			//FORCE CONTROL CHANNEL TO BE TCP_NODELAY
-			tcpConn, ok := conn.(*net.TCPConn)
+			rawConn := conn
+			if tlsConn, ok := conn.(*tls.Conn); ok { // tcpmuxtls
+				rawConn = tlsConn.NetConn()
+			}
+			tcpConn, ok := rawConn.(*net.TCPConn)
 			if !ok {
 				conn.Close()
 				continue
@@ -215,6 +257,7 @@ func (s *TcpMuxTransport) channelHandshake() {
 				s.logger.Warnf("failed to set TCP_NODELAY for Control Channel %s: %v", tcpConn.RemoteAddr().String(), err)
 			}
 
+			s.halfClose.Store(false) // until the client confirms it
 			s.controlChannel = conn
 
 			s.logger.Info("control channel successfully established.")
@@ -232,15 +275,25 @@ func (s *TcpMuxTransport) channelHandler() {
 	messageChan := make(chan byte, 1)
 
 	go func() {
-		message, err := utils.ReceiveBinaryByte(s.controlChannel)
-		if err != nil {
-			if s.cancel != nil {
-				s.logger.Error("failed to read from channel connection. ", err)
-				go s.Restart()
+		for {
+			message, err := utils.ReceiveBinaryByte(s.controlChannel)
+			if err != nil {
+				if s.cancel != nil {
+					s.logger.Error("failed to read from channel connection. ", err)
+					go s.Restart()
+				}
+				return
 			}
+
+			// the client frames the streams marked from now on
+			if message == utils.SG_Framed {
+				s.halfClose.Store(s.config.HalfCloseLinger > 0)
+				s.logger.Debug("half-close framing of the streams confirmed by the client")
+				continue
+			}
+			messageChan <- message
 			return
 		}
-		messageChan <- message
 	}()
 
 	for {
@@ -282,7 +335,11 @@ func (s *TcpMuxTransport) channelHandler() {
 }
 
 func (s *TcpMuxTransport) tunnelListener() {
-	listener, err := net.Listen("tcp", s.config.BindAddr)
+	if s.config.Mode == config.TCPMUXTLS {
+		s.tlsConfig = serverTLSConfig(s.config.Certs, s.config.ClientAuth)
+	}
+
+	listener, err := listenTunnel(s.config.BindAddr, s.config.Socket)
 	if err != nil {
 		s.logger.Fatalf("failed to start listener on %s: %v", s.config.BindAddr, err)
 		return
@@ -319,7 +376,8 @@ func (s *TcpMuxTransport) acceptTunnelConn(listener net.Listener) {
 			}
 
 			// Drop all suspicious packets from other address rather than server
-			if s.controlChannel != nil && s.controlChannel.RemoteAddr().(*net.TCPAddr).IP.String() != tcpConn.RemoteAddr().(*net.TCPAddr).IP.String() {
+			// in multipath mode the paths come from other addresses, they are authenticated by token instead
+			if s.controlChannel != nil && !s.config.Multipath && s.controlChannel.RemoteAddr().(*net.TCPAddr).IP.String() != tcpConn.RemoteAddr().(*net.TCPAddr).IP.String() {
 				s.logger.Debugf("suspicious packet from %v. expected address: %v. discarding packet...", tcpConn.RemoteAddr().(*net.TCPAddr).IP.String(), s.controlChannel.RemoteAddr().(*net.TCPAddr).IP.String())
 				tcpConn.Close()
 				continue
@@ -344,38 +402,63 @@ func (s *TcpMuxTransport) acceptTunnelConn(listener net.Listener) {
 				s.logger.Warnf("failed to set TCP keep-alive period for %s: %v", tcpConn.RemoteAddr().String(), err)
 			}
 
-			// try to establish a new channel
-			if s.controlChannel == nil {
-				s.logger.Info("control channel not found, attempting to establish a new session")
-				select {
-				case s.handshakeChannel <- conn: // ok
-				default:
-					s.logger.Warnf("control channel handshake in progress...")
-					conn.Close()
-				}
+			// in tcpmuxtls mode the handshake is completed before the session is created,
+			// without blocking the other incoming connections
+			if s.tlsConfig != nil {
+				go func() {
+					tlsConn, err := tlsServer(conn, s.tlsConfig, 5*time.Second)
+					if err != nil {
+						s.logger.Debugf("tls handshake with %s failed: %v", conn.RemoteAddr().String(), err)
+						return
+					}
+					s.handleTunnelConn(tlsConn, tcpConn)
+				}()
 				continue
 			}
 
-			session, err := smux.Client(conn, s.smuxConfig)
-			if err != nil {
-				s.logger.Errorf("failed to create MUX session for connection %s: %v", conn.RemoteAddr().String(), err)
-				conn.Close()
-				continue
-			}
+			s.handleTunnelConn(conn, tcpConn)
+		}
+	}
 
-			select {
-			case s.tunnelChannel <- session: // ok
-			default:
-				s.logger.Warnf("tunnel listener channel is full, discarding TCP connection from %s", conn.LocalAddr().String())
-				session.Close()
-			}
+}
+
+// handleTunnelConn hands an accepted tunnel connection to the control channel handshake, or
+// creates its mux session. tcpConn is the underlying TCP connection, used for the path stats.
+func (s *TcpMuxTransport) handleTunnelConn(conn net.Conn, tcpConn *net.TCPConn) {
+	// try to establish a new channel
+	if s.controlChannel == nil {
+		s.logger.Info("control channel not found, attempting to establish a new session")
+		select {
+		case s.handshakeChannel <- conn: // ok
+		default:
+			s.logger.Warnf("control channel handshake in progress...")
+			conn.Close()
 		}
+		return
+	}
+
+	if s.config.Multipath {
+		go s.acceptPath(conn, tcpConn)
+		return
 	}
 
+	session, err := smux.Client(conn, s.smuxConfig)
+	if err != nil {
+		s.logger.Errorf("failed to create MUX session for connection %s: %v", conn.RemoteAddr().String(), err)
+		conn.Close()
+		return
+	}
+
+	select {
+	case s.tunnelChannel <- session: // ok
+	default:
+		s.logger.Warnf("tunnel listener channel is full, discarding TCP connection from %s", conn.LocalAddr().String())
+		session.Close()
+	}
 }
 
 func (s *TcpMuxTransport) parsePortMappings() {
-	for _, portMapping := range s.config.Ports {
+	for _, portMapping := range s.ports {
 		parts := strings.Split(portMapping, "=")
 
 		var localAddr, remoteAddr string
@@ -406,8 +489,8 @@ func (s *TcpMuxTransport) parsePortMappings() {
 				// Create listeners for all ports in the range
 				for port := startPort; port <= endPort; port++ {
 					localAddr = fmt.Sprintf(":%d", port)
-					go s.localListener(localAddr, strconv.Itoa(port)) // Use port as the remoteAddr
-					time.Sleep(1 * time.Millisecond)                  // for wide port ranges
+					go s.startListeners(localAddr, strconv.Itoa(port)) // Use port as the remoteAddr
+					time.Sleep(1 * time.Millisecond)                   // for wide port ranges
 				}
 				continue
 			} else {
@@ -444,7 +527,7 @@ func (s *TcpMuxTransport) parsePortMappings() {
 				// Create listeners for all ports in the range
 				for port := startPort; port <= endPort; port++ {
 					localAddr = fmt.Sprintf(":%d", port)
-					go s.localListener(localAddr, remoteAddr)
+					go s.startListeners(localAddr, remoteAddr)
 					time.Sleep(1 * time.Millisecond) // for wide port ranges
 				}
 				continue
@@ -461,13 +544,26 @@ func (s *TcpMuxTransport) parsePortMappings() {
 			s.logger.Fatalf("invalid port mapping format: %s", portMapping)
 		}
 		// Start listeners for single port
-		go s.localListener(localAddr, remoteAddr)
+		go s.startListeners(localAddr, remoteAddr)
+	}
+}
+
+func (s *TcpMuxTransport) startListeners(localAddr, remoteAddr string) {
+	// Start TCP listener
+	go s.localListener(localAddr, remoteAddr)
+
+	// Start UDP listener if configured, its clients are queued with the TCP connections
+	if s.config.AcceptUDP {
+		go udpFlowListener(s.ctx, localAddr, remoteAddr, s.config.ForwardSource, s.localChannel, s.config.UDPSessions, s.usageMonitor, s.logger)
 	}
 }
 
 func (s *TcpMuxTransport) localListener(localAddr string, remoteAddr string) {
-	listener, err := net.Listen("tcp", localAddr)
+	listener, err := listenTCP(s.ctx, localAddr, s.config.Socket, s.logger)
 	if err != nil {
+		if errors.Is(err, context.Canceled) { // stopped while waiting for the address
+			return
+		}
 		s.logger.Fatalf("failed to start listener on %s: %v", localAddr, err)
 		return
 	}
@@ -512,7 +608,7 @@ func (s *TcpMuxTransport) acceptLocalConn(listener net.Listener, remoteAddr stri
 			}
 
 			select {
-			case s.localChannel <- LocalTCPConn{conn: conn, remoteAddr: remoteAddr, timeCreated: time.Now().UnixMilli()}:
+			case s.localChannel <- LocalTCPConn{conn: conn, remoteAddr: withSource(remoteAddr, conn, s.config.ForwardSource), timeCreated: time.Now().UnixMilli()}:
 				s.logger.Debugf("accepted incoming TCP connection from %s", tcpConn.RemoteAddr().String())
 
 				// +1 for stream counter
@@ -569,7 +665,7 @@ func (s *TcpMuxTransport) handleSession(session *smux.Session) {
 		case incomingConn := <-s.localChannel:
 			if time.Now().UnixMilli()-incomingConn.timeCreated > 3000 { // 3000ms
 				s.logger.Debugf("timeouted local connection: %d ms", time.Now().UnixMilli()-incomingConn.timeCreated)
-				incomingConn.conn.Close()
+				incomingConn.close()
 
 				// Decrement the counter
 				atomic.AddInt32(&s.streamCounter, -1)
@@ -583,8 +679,9 @@ func (s *TcpMuxTransport) handleSession(session *smux.Session) {
 				return
 			}
 
-			// Send the target port over the tunnel connection
-			if err := utils.SendBinaryString(stream, incomingConn.remoteAddr); err != nil {
+			// Send the target port over the tunnel connection, the stream is framed once the client confirmed it
+			framed := s.halfClose.Load()
+			if err := sendLocalConn(stream, incomingConn, framed); err != nil {
 				s.logger.Tracef("failed to send address over stream: %v", err)
 				// Put local connection back to local channel
 				s.localChannel <- incomingConn
@@ -593,7 +690,7 @@ func (s *TcpMuxTransport) handleSession(session *smux.Session) {
 
 			// Handle data exchange between connections
 			go func() {
-				utils.TCPConnectionHandler(stream, incomingConn.conn, s.logger, s.usageMonitor, incomingConn.conn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer)
+				handleLocalConn(stream, incomingConn, s.logger, s.usageMonitor, s.config.Sniffer, framed, s.config.HalfCloseLinger)
 				atomic.AddInt32(&s.streamCounter, -1)
 				<-counter // read signal from the channel
 			}()
@@ -617,3 +714,126 @@ func (s *TcpMuxTransport) handleSessionError(incomingConn *LocalTCPConn, err err
 		s.logger.Warn("request new connection channel is full")
 	}
 }
+
+// acceptPath verifies the token of a multipath tunnel connection and adds it to the scheduler
+func (s *TcpMuxTransport) acceptPath(conn net.Conn, tcpConn *net.TCPConn) {
+	if err := conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		s.logger.Errorf("failed to set read deadline: %v", err)
+		conn.Close()
+		return
+	}
+
+	msg, transport, err := utils.ReceiveBinaryTransportString(conn)
+	if err != nil {
+		s.logger.Debugf("failed to receive path token from %s: %v", conn.RemoteAddr().String(), err)
+		conn.Close()
+		return
+	}
+	if transport != utils.SG_Path || msg != s.config.Token {
+		s.logger.Warnf("invalid path token received from %s, discarding connection", conn.RemoteAddr().String())
+		conn.Close()
+		return
+	}
+
+	// Resetting the deadline (removes any existing deadline)
+	conn.SetReadDeadline(time.Time{})
+
+	session, err := smux.Client(conn, s.smuxConfig)
+	if err != nil {
+		s.logger.Errorf("failed to create MUX session for connection %s: %v", conn.RemoteAddr().String(), err)
+		conn.Close()
+		return
+	}
+
+	s.paths.add(tcpConn, session)
+
+	// +1 for session counter
+	atomic.AddInt32(&s.sessionCounter, 1)
+}
+
+// pathMonitor measures the paths every second and keeps the session counter in sync with them
+func (s *TcpMuxTransport) pathMonitor() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			atomic.StoreInt32(&s.sessionCounter, int32(s.paths.update()))
+		}
+	}
+}
+
+// dispatchLoop replaces the handle loops in multipath mode, every local connection is opened as a
+// stream on the session the scheduler picks instead of the session that happens to be free
+func (s *TcpMuxTransport) dispatchLoop() {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+
+		case incomingConn := <-s.localChannel:
+			if time.Now().UnixMilli()-incomingConn.timeCreated > 3000 { // 3000ms
+				s.logger.Debugf("timeouted local connection: %d ms", time.Now().UnixMilli()-incomingConn.timeCreated)
+				incomingConn.close()
+
+				// Decrement the counter
+				atomic.AddInt32(&s.streamCounter, -1)
+				continue
+			}
+
+			session := s.paths.pick()
+			if session == nil {
+				s.requeue(incomingConn)
+				continue
+			}
+
+			stream, err := session.OpenStream()
+			if err != nil {
+				s.logger.Tracef("failed to open stream: %v", err)
+				s.paths.remove(session)
+				session.Close()
+				atomic.AddInt32(&s.sessionCounter, -1)
+				s.requeue(incomingConn)
+				continue
+			}
+
+			// Send the target port over the tunnel connection, the stream is framed once the client confirmed it
+			framed := s.halfClose.Load()
+			if err := sendLocalConn(stream, incomingConn, framed); err != nil {
+				s.logger.Tracef("failed to send address over stream: %v", err)
+				stream.Close()
+				s.requeue(incomingConn)
+				continue
+			}
+
+			// Handle data exchange between connections
+			go func() {
+				handleLocalConn(stream, incomingConn, s.logger, s.usageMonitor, s.config.Sniffer, framed, s.config.HalfCloseLinger)
+				atomic.AddInt32(&s.streamCounter, -1)
+			}()
+		}
+	}
+}
+
+// requeue puts a local connection back while no path is usable and asks the client for a new one
+func (s *TcpMuxTransport) requeue(incomingConn LocalTCPConn) {
+	select {
+	case s.reqNewConnChan <- struct{}{}:
+	default:
+		s.logger.Warn("request new connection channel is full")
+	}
+
+	// give the client some time to dial before the connection is dispatched again
+	time.Sleep(10 * time.Millisecond)
+
+	select {
+	case s.localChannel <- incomingConn:
+	default:
+		s.logger.Warnf("local listener channel is full, discarding connection to %s", incomingConn.remoteAddr)
+		incomingConn.close()
+		atomic.AddInt32(&s.streamCounter, -1)
+	}
+}
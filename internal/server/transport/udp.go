@@ -2,6 +2,7 @@ package transport
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
@@ -27,19 +28,23 @@ type UdpTransport struct {
 	controlChannel    net.Conn
 	restartMutex      sync.Mutex
 	usageMonitor      *web.Usage
-	rtt               int64 // for Fun!
+	rtt               int64            // for Fun!
+	fec               *utils.FECConfig // negotiated with the client, nil when disabled
 }
 
 type UdpConfig struct {
 	BindAddr     string
 	Token        string
 	SnifferLog   string
-	TunnelStatus string
+	TunnelStatus web.TunnelStatus
 	Ports        []string
 	Sniffer      bool
 	Heartbeat    time.Duration // in seconds, for udp conn and control channel
 	ChannelSize  int
 	WebPort      int
+	FEC          *utils.FECConfig     // nil disables forward error correction on the tunnel
+	UDPSessions  *UDPSessionOptions   // UDP session lifecycle of the local ports, nil for the defaults
+	Socket       *utils.SocketOptions // tcp options of the control channel, nil for the defaults
 }
 
 func NewUDPServer(parentCtx context.Context, config *UdpConfig, logger *logrus.Logger) *UdpTransport {
@@ -65,7 +70,7 @@ func NewUDPServer(parentCtx context.Context, config *UdpConfig, logger *logrus.L
 	return server
 }
 func (s *UdpTransport) Start() {
-	s.config.TunnelStatus = "Disconnected (UDP)"
+	s.config.TunnelStatus.Set("Disconnected (UDP)")
 
 	if s.config.WebPort > 0 {
 		go s.usageMonitor.Monitor()
@@ -106,10 +111,11 @@ func (s *UdpTransport) Restart() {
 	s.tunnelChannel = make(chan *TunnelUDPConn, s.config.ChannelSize)
 	s.reqNewConnChan = make(chan struct{}, s.config.ChannelSize)
 	s.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", s.config.WebPort), ctx, s.config.SnifferLog, s.config.Sniffer, &s.config.TunnelStatus, s.logger)
-	s.config.TunnelStatus = ""
+	s.config.TunnelStatus.Set("")
 	s.controlChannel = nil
 	s.activeConnections = map[string]*TunnelUDPConn{}
 	s.activeMu = sync.Mutex{}
+	s.fec = nil
 
 	// set the log level again
 	s.logger.SetLevel(level)
@@ -118,7 +124,7 @@ func (s *UdpTransport) Restart() {
 }
 
 func (s *UdpTransport) channelHandshake() {
-	listener, err := net.Listen("tcp", s.config.BindAddr)
+	listener, err := listenTunnel(s.config.BindAddr, s.config.Socket)
 	if err != nil {
 		s.logger.Fatalf("failed to start listener on %s: %v", s.config.BindAddr, err)
 		return
@@ -166,13 +172,32 @@ loop:
 			// Resetting the deadline (removes any existing deadline)
 			conn.SetReadDeadline(time.Time{})
 
-			if msg != s.config.Token {
-				s.logger.Warnf("invalid security token received: %s", msg)
+			// the client appends its FEC parameters to the token when it wants FEC
+			token, offer, err := utils.ParseFECOffer(msg)
+			if err != nil {
+				s.logger.Warnf("failed to parse FEC parameters of the client: %v", err)
+				conn.Close()
+				continue
+			}
+
+			if token != s.config.Token {
+				s.logger.Warnf("invalid security token received: %s", token)
 				conn.Close()
 				continue
 			}
 
-			err = utils.SendBinaryTransportString(conn, s.config.Token, utils.SG_Chan)
+			// FEC is used only when both sides enable it, the parameters of the server win
+			reply := s.config.Token
+			s.fec = nil
+			if offer != nil && s.config.FEC != nil {
+				s.fec = s.config.FEC
+				reply = s.fec.Offer(s.config.Token)
+				s.logger.Infof("FEC enabled on the tunnel: %d data shards, %d parity shards, group timeout %v", s.fec.DataShards, s.fec.ParityShards, s.fec.GroupTimeout)
+			} else if offer != nil || s.config.FEC != nil {
+				s.logger.Warn("FEC is not enabled on both sides, continuing without it")
+			}
+
+			err = utils.SendBinaryTransportString(conn, reply, utils.SG_Chan)
 			if err != nil {
 				s.logger.Errorf("failed to send security token: %v", err)
 				conn.Close()
@@ -183,6 +208,8 @@ loop:
 
 			s.logger.Info("control channel successfully established.")
 
+			s.config.TunnelStatus.Set("Connected (UDP)")
+
 			break loop
 		}
 	}
@@ -293,73 +320,82 @@ func (s *UdpTransport) tunnelListener() {
 }
 
 func (s *UdpTransport) acceptTunnelConn(listener *net.UDPConn) {
-	// Buffer for UDP reads
-	buf := make([]byte, 16*1024)
-
-	for {
-		select {
-		case <-s.ctx.Done():
-			return
-		default:
-			n, addr, err := listener.ReadFromUDP(buf)
-			if err != nil {
-				s.logger.Errorf("failed to read from tunnel UDP listener: %v", err)
-				continue
-			}
-
-			// Create a unique identifier for the connection based on IP and port
-			key := addr.String()
-
-			s.activeMu.Lock()
-			// Check if the connection is already active
-			if existingConn, exists := s.activeConnections[key]; exists {
-				// Send the payload to the existing connection's payload channel
-				select {
-				case existingConn.payload <- append([]byte(nil), buf[:n]...): // Copy the packet to avoid data overwriting
-					s.logger.Tracef("buffered %d bytes for existing connection %s", n, addr.String())
+	// Datagrams are read in batches, a single system call returns all the packets waiting on the socket.
+	// The packets to a client are coalesced with GSO and received coalesced with GRO, when the kernel
+	// supports them.
+	batch := utils.NewUDPBatch(listener, 16*1024)
+	gso, gro := batch.EnableOffload()
+	s.logger.Debugf("UDP offload on the tunnel listener: GSO %v, GRO %v", gso, gro)
+
+	handle := func(data []byte, addr *net.UDPAddr) {
+		// Create a unique identifier for the connection based on IP and port
+		key := addr.String()
+
+		s.activeMu.Lock()
+		// Check if the connection is already active
+		if existingConn, exists := s.activeConnections[key]; exists {
+			// Send the payload to the existing connection's payload channel
+			select {
+			case existingConn.payload <- utils.CopyPacket(data): // Copy the packet to avoid data overwriting
+				s.logger.Tracef("buffered %d bytes for existing connection %s", len(data), addr.String())
 
-				default:
-					s.logger.Warnf("payload channel for connection %s is full, dropping UDP packet", addr.String())
-				}
-				s.activeMu.Unlock()
-				continue
+			default:
+				s.usageMonitor.AddUDPDrop()
+				s.logger.Warnf("payload channel for connection %s is full, dropping UDP packet", addr.String())
 			}
-
 			s.activeMu.Unlock()
+			return
+		}
 
-			if string(buf[:n]) != s.config.Token { // For new connections, validate the token
-				s.logger.Errorf("invalid token received from %s", addr.String())
-				continue
-			}
+		s.activeMu.Unlock()
 
-			// Initialize the payload channel for the new connection
-			payloadChan := make(chan []byte, 100_000)
+		if string(data) != s.config.Token { // For new connections, validate the token
+			s.logger.Errorf("invalid token received from %s", addr.String())
+			return
+		}
 
-			// Create a new TunnelUDPConn
-			tunnelConn := TunnelUDPConn{
-				timeCreated: time.Now().UnixNano(), // Just for debugging
-				payload:     payloadChan,
-				addr:        addr,
-				listener:    listener,
-				ping:        make(chan struct{}, 1), // Initialize the ping channel
-				mu:          &sync.Mutex{},
-			}
+		// Initialize the payload channel for the new connection
+		payloadChan := make(chan []byte, 100_000)
+
+		// Create a new TunnelUDPConn
+		tunnelConn := TunnelUDPConn{
+			timeCreated: time.Now().UnixNano(), // Just for debugging
+			payload:     payloadChan,
+			addr:        addr,
+			listener:    listener,
+			batch:       batch,
+			ping:        make(chan struct{}, 1), // Initialize the ping channel
+			mu:          &sync.Mutex{},
+		}
 
-			s.activeMu.Lock()
-			// Add the new connection to the active connections map
-			s.activeConnections[key] = &tunnelConn
-			s.activeMu.Unlock()
+		s.activeMu.Lock()
+		// Add the new connection to the active connections map
+		s.activeConnections[key] = &tunnelConn
+		s.activeMu.Unlock()
 
-			// Send the new tunnel connection to the tunnel channel
-			select {
-			case s.tunnelChannel <- &tunnelConn:
-				go s.keepAlive(&tunnelConn)
-				s.logger.Debugf("accepted tunnel connection from %s", addr.String())
-			default:
-				s.logger.Warn("UDP tunnel channel is full")
-				// Close the newly created connection as it couldn't be added
-				close(tunnelConn.payload)
-				delete(s.activeConnections, key)
+		// Send the new tunnel connection to the tunnel channel
+		select {
+		case s.tunnelChannel <- &tunnelConn:
+			go s.keepAlive(&tunnelConn)
+			s.logger.Debugf("accepted tunnel connection from %s", addr.String())
+		default:
+			s.logger.Warn("UDP tunnel channel is full")
+			// Close the newly created connection as it couldn't be added
+			close(tunnelConn.payload)
+			delete(s.activeConnections, key)
+		}
+	}
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		default:
+			if err := batch.ReadBatch(handle); err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				s.logger.Errorf("failed to read from tunnel UDP listener: %v", err)
 			}
 		}
 	}
@@ -462,8 +498,11 @@ func (s *UdpTransport) localListener(localAddr, remoteAddr string) {
 		s.logger.Fatalf("failed to resolve local address: %v", err)
 	}
 
-	listener, err := net.ListenUDP("udp", localUDPAddr)
+	listener, err := listenUDP(s.ctx, localUDPAddr, s.logger)
 	if err != nil {
+		if errors.Is(err, context.Canceled) { // stopped while waiting for the address
+			return
+		}
 		s.logger.Fatalf("failed to listen on local UDP port: %v", err)
 	}
 
@@ -471,20 +510,54 @@ func (s *UdpTransport) localListener(localAddr, remoteAddr string) {
 
 	s.logger.Infof("UDP listener started successfully, listening on address: %s", listener.LocalAddr().String())
 
-	// Buffer for UDP reads
-	buf := make([]byte, 16*1024)
+	// Datagrams are read in batches, a single system call returns all the packets waiting on the socket
+	batch := utils.NewUDPBatch(listener, 16*1024)
 
 	// Track active connections
-	activeConnections := map[string]*LocalUDPConn{}
-
-	// mutex
-	mu := &sync.Mutex{}
+	sessions := newUDPSessionTable(s.config.UDPSessions, s.usageMonitor, s.logger)
 
 	// make a new channel for recieve udp packets
 	udpChan := make(chan *LocalUDPConn, s.config.ChannelSize)
 
 	// handle channel
-	go s.handleLoop(udpChan, &activeConnections, mu)
+	go s.handleLoop(udpChan)
+
+	handle := func(data []byte, addr *net.UDPAddr) {
+		// Send the payload to the existing connection of the client
+		if sessions.push(addr, data) {
+			return
+		}
+
+		// Build the UDP connection object, its buffer is sized by udp_session_buffer
+		newUDPConn := LocalUDPConn{
+			udpSession:  sessions.add(addr, data),
+			timeCreated: time.Now().UnixMilli(), // Just for debugging
+			remoteAddr:  remoteAddr,
+			listener:    listener,
+			batch:       batch,
+			addr:        addr,
+			sessions:    sessions,
+		}
+
+		select {
+		case udpChan <- &newUDPConn:
+			s.logger.Debugf("accepted UDP connection from %s", addr.String())
+
+			// Request a new TCP connection
+			select {
+			case s.reqNewConnChan <- struct{}{}:
+				// Successfully requested a new TCP connection
+			default:
+				// The channel is full, do nothing
+				s.logger.Warn("channel is full, cannot request a new connection")
+			}
+
+		default:
+			s.logger.Warn("UDP channel is full, dropping packet.")
+			// Close the newly created connection as it couldn't be added
+			sessions.remove(newUDPConn.udpSession)
+		}
+	}
 
 	go func() {
 		for {
@@ -492,67 +565,11 @@ func (s *UdpTransport) localListener(localAddr, remoteAddr string) {
 			case <-s.ctx.Done():
 				return
 			default:
-				n, addr, err := listener.ReadFromUDP(buf)
-				if err != nil {
-					s.logger.Errorf("failed to read from UDP listener: %v", err)
-					continue
-				}
-
-				// Create a unique identifier for the connection based on IP and port
-				key := addr.String()
-
-				mu.Lock()
-				// Check if the connection is already active
-				if existingConn, exists := activeConnections[key]; exists {
-					// If connection is active and not closed, send payload
-					select {
-					case existingConn.payload <- append([]byte(nil), buf[:n]...):
-						s.logger.Tracef("buffered %d bytes for existing connection %s", n, addr.String())
-					default:
-						s.logger.Warnf("payload channel for connection %s is full, dropping UDP packet", addr.String())
-					}
-					mu.Unlock()
-					continue
-				}
-
-				mu.Unlock()
-
-				// Create a new payload channel for this connection, Buffer up to 100,000 packets for the connection
-				payloadChan := make(chan []byte, 100_000)
-
-				// Build the UDP connection object
-				newUDPConn := LocalUDPConn{
-					timeCreated: time.Now().UnixMilli(), // Just for debugging
-					payload:     payloadChan,
-					remoteAddr:  remoteAddr,
-					listener:    listener,
-					addr:        addr,
-				}
-
-				mu.Lock()
-				// Store the new connection
-				activeConnections[key] = &newUDPConn
-				mu.Unlock()
-
-				select {
-				case udpChan <- &newUDPConn:
-					s.logger.Debugf("accepted UDP connection from %s", addr.String())
-					payloadChan <- append([]byte(nil), buf[:n]...) // Send a copy of the new payload to the channel
-
-					// Request a new TCP connection
-					select {
-					case s.reqNewConnChan <- struct{}{}:
-						// Successfully requested a new TCP connection
-					default:
-						// The channel is full, do nothing
-						s.logger.Warn("channel is full, cannot request a new connection")
+				if err := batch.ReadBatch(handle); err != nil {
+					if errors.Is(err, net.ErrClosed) {
+						return
 					}
-
-				default:
-					s.logger.Warn("UDP channel is full, dropping packet.")
-					// Close the newly created connection as it couldn't be added
-					close(newUDPConn.payload)
-					delete(activeConnections, key)
+					s.logger.Errorf("failed to read from UDP listener: %v", err)
 				}
 			}
 		}
@@ -562,7 +579,7 @@ func (s *UdpTransport) localListener(localAddr, remoteAddr string) {
 
 }
 
-func (s *UdpTransport) handleLoop(udpChan chan *LocalUDPConn, activeConnections *map[string]*LocalUDPConn, mu *sync.Mutex) {
+func (s *UdpTransport) handleLoop(udpChan chan *LocalUDPConn) {
 	for {
 		select {
 		case <-s.ctx.Done():
@@ -570,6 +587,7 @@ func (s *UdpTransport) handleLoop(udpChan chan *LocalUDPConn, activeConnections
 		case localConn := <-udpChan:
 			if time.Now().UnixMilli()-localConn.timeCreated > 3000 { // 3000ms
 				s.logger.Debugf("timeouted local connection: %d ms", time.Now().UnixMilli()-localConn.timeCreated)
+				localConn.sessions.remove(localConn.udpSession)
 				continue
 			}
 
@@ -590,7 +608,7 @@ func (s *UdpTransport) handleLoop(udpChan chan *LocalUDPConn, activeConnections
 					}
 
 					// Handle data exchange between connections
-					go s.udpCopy(localConn, tunnelConn, activeConnections, mu)
+					go s.udpCopy(localConn, tunnelConn)
 
 					s.logger.Debugf("initiate new handler for connection %s with timestamp %d", localConn.addr.String(), localConn.timeCreated)
 					break loop
@@ -600,26 +618,57 @@ func (s *UdpTransport) handleLoop(udpChan chan *LocalUDPConn, activeConnections
 	}
 }
 
-func (s *UdpTransport) udpCopy(udpLocal *LocalUDPConn, udpTunnel *TunnelUDPConn, activeConnections *map[string]*LocalUDPConn, mu *sync.Mutex) {
+func (s *UdpTransport) udpCopy(udpLocal *LocalUDPConn, udpTunnel *TunnelUDPConn) {
 	done := make(chan struct{})
 
+	// Packets are written as they are, in batches, unless FEC was negotiated
+	writer := udpTunnel.batch.Writer()
+	toTunnel := func(packets [][]byte) error {
+		_, err := writer.WriteTo(packets, udpTunnel.addr)
+		return err
+	}
+	var decoder *utils.FECDecoder
+
+	if fec := s.fec; fec != nil {
+		encoder, err := utils.NewFECEncoder(*fec, func(data []byte) error {
+			_, err := udpTunnel.listener.WriteToUDP(data, udpTunnel.addr)
+			return err
+		})
+		if err != nil {
+			s.logger.Errorf("failed to create FEC encoder: %v", err)
+			return
+		}
+		defer encoder.Close()
+		toTunnel = func(packets [][]byte) error {
+			for _, packet := range packets {
+				if err := encoder.Write(packet); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		decoder, err = utils.NewFECDecoder(*fec)
+		if err != nil {
+			s.logger.Errorf("failed to create FEC decoder: %v", err)
+			return
+		}
+	}
+
 	// Handle data from local to tunnel
 	go func() {
 		defer close(done)
-		s.udpLocalCopy(udpLocal, udpTunnel)
+		s.udpLocalCopy(udpLocal, toTunnel)
 	}()
 
 	// Handle data from tunnel to local
-	s.udpTunnelCopy(udpTunnel, udpLocal)
+	s.udpTunnelCopy(udpTunnel, udpLocal, decoder)
 
 	// Wait until one of the directions is done (connection closed or idle)
 	<-done
 
 	// Remove local connection from active connections and close the channel
-	mu.Lock()
-	close(udpLocal.payload)
-	delete(*activeConnections, udpLocal.addr.String())
-	mu.Unlock()
+	udpLocal.sessions.remove(udpLocal.udpSession)
 
 	// Remove tunnel connection from active connections and close the channel
 	s.activeMu.Lock()
@@ -629,8 +678,12 @@ func (s *UdpTransport) udpCopy(udpLocal *LocalUDPConn, udpTunnel *TunnelUDPConn,
 
 }
 
-func (s *UdpTransport) udpLocalCopy(from *LocalUDPConn, to *TunnelUDPConn) {
-	inactivityTimeout := 60 * time.Second // Define a 60-second inactivity timeout
+func (s *UdpTransport) udpLocalCopy(from *LocalUDPConn, toTunnel func([][]byte) error) {
+	inactivityTimeout := s.config.UDPSessions.idleTimeout()
+	idle := time.NewTimer(inactivityTimeout)
+	defer idle.Stop()
+
+	packets := make([][]byte, 0, utils.UDPBatchSize)
 
 	for {
 		select {
@@ -638,35 +691,55 @@ func (s *UdpTransport) udpLocalCopy(from *LocalUDPConn, to *TunnelUDPConn) {
 			if !ok {
 				return
 			}
+			idle.Reset(inactivityTimeout)
 
-			packetSize := len(data)
+			// The packets already waiting are written with the same system call
+			packets = drainPayload(from.payload, append(packets[:0], data))
 
-			totalWritten := 0
-			for totalWritten < packetSize {
-				// Write the packet to the tunnel
-				w, err := to.listener.WriteToUDP(data[totalWritten:], to.addr)
-				if err != nil {
-					s.logger.Errorf("failed to write UDP payload to tunnel: %v", err)
-					return
-				}
-				totalWritten += w
+			packetSize := 0
+			for _, packet := range packets {
+				packetSize += len(packet)
+			}
+
+			// Write the packets to the tunnel
+			err := toTunnel(packets)
+			for _, packet := range packets {
+				utils.ReleasePacket(packet)
+			}
+			if err != nil {
+				s.logger.Errorf("failed to write UDP payload to tunnel: %v", err)
+				return
 			}
 
 			if s.config.Sniffer {
-				s.usageMonitor.AddOrUpdatePort(from.listener.LocalAddr().(*net.UDPAddr).Port, uint64(totalWritten))
+				s.usageMonitor.AddOrUpdatePort(from.listener.LocalAddr().(*net.UDPAddr).Port, uint64(packetSize))
 			}
 
-			s.logger.Debugf("forwarded %d bytes from local connection %s to tunnel", packetSize, from.addr.String())
+			s.logger.Debugf("forwarded %d packets, %d bytes from local connection %s to tunnel", len(packets), packetSize, from.addr.String())
 
-		case <-time.After(inactivityTimeout): // Timeout after 30 seconds of inactivity
-			s.logger.Debugf("connection idle for 60 seconds, closing UDP connection for %s", from.addr.String())
+		case <-from.evicted:
+			return
+
+		case <-idle.C:
+			// packets from the tunnel keep the connection open as well
+			if remaining := inactivityTimeout - from.idle(); remaining > 0 {
+				idle.Reset(remaining)
+				continue
+			}
+			s.logger.Debugf("connection idle for %v, closing UDP connection for %s", inactivityTimeout, from.addr.String())
 			return
 		}
 	}
 }
 
-func (s *UdpTransport) udpTunnelCopy(from *TunnelUDPConn, to *LocalUDPConn) {
-	inactivityTimeout := 60 * time.Second // Define a 60-second inactivity timeout
+func (s *UdpTransport) udpTunnelCopy(from *TunnelUDPConn, to *LocalUDPConn, decoder *utils.FECDecoder) {
+	inactivityTimeout := s.config.UDPSessions.idleTimeout()
+	idle := time.NewTimer(inactivityTimeout)
+	defer idle.Stop()
+
+	writer := to.batch.Writer()
+	received := make([][]byte, 0, utils.UDPBatchSize)
+	var packets [][]byte
 
 	for {
 		select {
@@ -675,27 +748,51 @@ func (s *UdpTransport) udpTunnelCopy(from *TunnelUDPConn, to *LocalUDPConn) {
 				return
 			}
 
-			packetSize := len(data)
-
-			totalWritten := 0
-			for totalWritten < packetSize {
-				// Write the packet to the tunnel
-				w, err := to.listener.WriteToUDP(data[totalWritten:], to.addr)
-				if err != nil {
-					s.logger.Errorf("failed to write UDP payload to tunnel: %v", err)
-					return
+			// The packets already waiting are written with the same system call
+			received = drainPayload(from.payload, append(received[:0], data))
+
+			packets = append(packets[:0], received...)
+			if decoder != nil {
+				packets = packets[:0]
+				for _, packet := range received {
+					payloads, err := decoder.Decode(packet)
+					if err != nil {
+						s.logger.Debugf("dropping tunnel packet from %s: %v", from.addr.String(), err)
+						continue
+					}
+					packets = append(packets, payloads...)
 				}
-				totalWritten += w
+				s.usageMonitor.AddFECStats(decoder.TakeStats())
 			}
 
+			// Write the packets to the local connection, the decoded payloads point into the received packets
+			packetSize, err := writer.WriteTo(packets, to.addr)
+			for _, packet := range received {
+				utils.ReleasePacket(packet)
+			}
+			if err != nil {
+				s.logger.Errorf("failed to write UDP payload to tunnel: %v", err)
+				return
+			}
+			to.touch()
+			idle.Reset(inactivityTimeout)
+
 			if s.config.Sniffer {
-				s.usageMonitor.AddOrUpdatePort(to.listener.LocalAddr().(*net.UDPAddr).Port, uint64(totalWritten))
+				s.usageMonitor.AddOrUpdatePort(to.listener.LocalAddr().(*net.UDPAddr).Port, uint64(packetSize))
 			}
 
-			s.logger.Debugf("forwarded %d bytes from local connection %s to tunnel", packetSize, from.addr.String())
+			s.logger.Debugf("forwarded %d packets, %d bytes from tunnel to local connection %s", len(packets), packetSize, to.addr.String())
 
-		case <-time.After(inactivityTimeout): // Timeout after 30 seconds of inactivity
-			s.logger.Debugf("connection idle for 60 seconds, closing UDP connection for %s", from.addr.String())
+		case <-to.evicted:
+			return
+
+		case <-idle.C:
+			// packets from the local client keep the connection open as well
+			if remaining := inactivityTimeout - to.idle(); remaining > 0 {
+				idle.Reset(remaining)
+				continue
+			}
+			s.logger.Debugf("connection idle for %v, closing UDP connection for %s", inactivityTimeout, from.addr.String())
 			return
 		}
 	}
@@ -0,0 +1,242 @@
+package transport
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/musix/backhaul/internal/utils"
+	"github.com/musix/backhaul/internal/web"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultUDPIdleTimeout   = 60 * time.Second
+	defaultUDPSessionBuffer = 1024 // packets
+)
+
+// UDPSessionOptions are the lifecycle settings of the UDP sessions, one session per client address of a
+// local UDP port. Nil options keep the defaults: 60s idle timeout, 1024 buffered packets per session,
+// newest packets dropped when the buffer is full and no session limits.
+type UDPSessionOptions struct {
+	IdleTimeout  time.Duration // a session without packets is closed after this long
+	MaxSessions  int           // sessions per local port, 0 for no limit
+	MaxPerSource int           // sessions per client IP on a local port, 0 for no limit
+	BufferSize   int           // packets buffered per session while they wait for the tunnel
+	DropOldest   bool          // drop the oldest buffered packet when the buffer is full, instead of the new one
+}
+
+func (o *UDPSessionOptions) idleTimeout() time.Duration {
+	if o == nil || o.IdleTimeout <= 0 {
+		return defaultUDPIdleTimeout
+	}
+	return o.IdleTimeout
+}
+
+func (o *UDPSessionOptions) bufferSize() int {
+	if o == nil || o.BufferSize <= 0 {
+		return defaultUDPSessionBuffer
+	}
+	return o.BufferSize
+}
+
+// newPayload returns the packet buffer of a new session
+func (o *UDPSessionOptions) newPayload() chan []byte {
+	return make(chan []byte, o.bufferSize())
+}
+
+// enqueue buffers a packet of a session. When the buffer is full a packet is dropped by the drop policy,
+// the drop is counted and false is returned. The caller must be the only sender of the payload channel.
+func (o *UDPSessionOptions) enqueue(payload chan []byte, data []byte, usage *web.Usage) bool {
+	select {
+	case payload <- data:
+		return true
+	default:
+	}
+
+	usage.AddUDPDrop()
+
+	if o == nil || !o.DropOldest {
+		utils.ReleasePacket(data)
+		return false
+	}
+
+	// make room by dropping the packet waiting the longest, the reader may have emptied it meanwhile
+	select {
+	case oldest := <-payload:
+		utils.ReleasePacket(oldest)
+	default:
+	}
+	select {
+	case payload <- data:
+	default:
+		utils.ReleasePacket(data)
+	}
+	return false
+}
+
+// drainPayload appends the packets waiting in a payload channel to packets, up to its capacity, so they
+// are sent together
+func drainPayload(payload chan []byte, packets [][]byte) [][]byte {
+	for len(packets) < cap(packets) {
+		select {
+		case data, ok := <-payload:
+			if !ok {
+				return packets
+			}
+			packets = append(packets, data)
+		default:
+			return packets
+		}
+	}
+	return packets
+}
+
+// udpSession is the lifecycle state shared by the UDP sessions of the local listeners
+type udpSession struct {
+	key        string // address of the client
+	source     string // IP of the client
+	payload    chan []byte
+	lastActive atomic.Int64  // unix nano of the latest packet in either direction
+	congested  atomic.Bool   // the tunnel falls behind, new packets go to a new session
+	evicted    chan struct{} // closed when the session is evicted by the limits, its handler must stop
+	evictOnce  sync.Once
+	closeOnce  sync.Once
+}
+
+// touch records a packet of the session
+func (u *udpSession) touch() {
+	u.lastActive.Store(time.Now().UnixNano())
+}
+
+// idle returns how long the session has been without packets
+func (u *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, u.lastActive.Load()))
+}
+
+// udpSessionTable holds the UDP sessions of a local listener, keyed by client address, and enforces the
+// session limits by evicting the least recently active session
+type udpSessionTable struct {
+	opts     *UDPSessionOptions
+	usage    *web.Usage
+	logger   *logrus.Logger
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+}
+
+func newUDPSessionTable(opts *UDPSessionOptions, usage *web.Usage, logger *logrus.Logger) *udpSessionTable {
+	return &udpSessionTable{
+		opts:     opts,
+		usage:    usage,
+		logger:   logger,
+		sessions: map[string]*udpSession{},
+	}
+}
+
+// push buffers a packet for the session of addr. It returns false when there is no session for addr yet.
+func (t *udpSessionTable) push(addr *net.UDPAddr, data []byte) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	session, exists := t.sessions[addr.String()]
+	if !exists || session.congested.Load() {
+		return false
+	}
+
+	session.touch()
+	if !t.opts.enqueue(session.payload, utils.CopyPacket(data), t.usage) { // Copy the packet to avoid data overwriting
+		t.logger.Debugf("payload buffer for connection %s is full, dropping udp packet", session.key)
+	} else {
+		t.logger.Tracef("buffered %d bytes for existing connection %s", len(data), session.key)
+	}
+	return true
+}
+
+// add creates the session of addr with its first packet, the least recently active sessions are
+// evicted first when the limits are reached
+func (t *udpSessionTable) add(addr *net.UDPAddr, data []byte) *udpSession {
+	session := &udpSession{
+		key:     addr.String(),
+		source:  addr.IP.String(),
+		payload: t.opts.newPayload(),
+		evicted: make(chan struct{}),
+	}
+	session.touch()
+	session.payload <- utils.CopyPacket(data) // send a copy of the new payload to the channel
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// a congested session is superseded: it leaves the table, so that the new packets go to the new
+	// session and it does not count against the limits, but it is not evicted. Its handler keeps
+	// transferring the buffered packets until the session is idle.
+	if previous, exists := t.sessions[session.key]; exists {
+		delete(t.sessions, previous.key)
+		t.logger.Debugf("UDP connection %s is congested, superseded by a new connection", previous.key)
+	}
+
+	if t.opts != nil && t.opts.MaxPerSource > 0 {
+		for t.count(session.source) >= t.opts.MaxPerSource {
+			t.evictLocked(t.oldest(session.source), "the per source session limit")
+		}
+	}
+	if t.opts != nil && t.opts.MaxSessions > 0 {
+		for len(t.sessions) >= t.opts.MaxSessions {
+			t.evictLocked(t.oldest(""), "the session limit")
+		}
+	}
+
+	t.sessions[session.key] = session
+	return session
+}
+
+// evictLocked removes a session that can no longer take packets and stops its handler, t.mu must be held
+func (t *udpSessionTable) evictLocked(session *udpSession, reason string) {
+	if t.sessions[session.key] == session {
+		delete(t.sessions, session.key)
+	}
+	session.evictOnce.Do(func() {
+		close(session.evicted)
+		t.usage.AddUDPEviction()
+		t.logger.Debugf("evicted UDP connection %s idle for %v due to %s", session.key, session.idle().Round(time.Millisecond), reason)
+	})
+}
+
+// remove releases a session once its handler is done, or when it could not be handled
+func (t *udpSessionTable) remove(session *udpSession) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.sessions[session.key] == session {
+		delete(t.sessions, session.key)
+	}
+	session.closeOnce.Do(func() {
+		close(session.payload)
+	})
+}
+
+// count returns the number of sessions of a client IP
+func (t *udpSessionTable) count(source string) int {
+	n := 0
+	for _, session := range t.sessions {
+		if session.source == source {
+			n++
+		}
+	}
+	return n
+}
+
+// oldest returns the least recently active session, of a client IP when source is set
+func (t *udpSessionTable) oldest(source string) *udpSession {
+	var oldest *udpSession
+	for _, session := range t.sessions {
+		if source != "" && session.source != source {
+			continue
+		}
+		if oldest == nil || session.lastActive.Load() < oldest.lastActive.Load() {
+			oldest = session
+		}
+	}
+	return oldest
+}
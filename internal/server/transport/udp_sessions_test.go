@@ -0,0 +1,158 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/musix/backhaul/internal/web"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestSessionTable(opts *UDPSessionOptions) (*udpSessionTable, *web.Usage) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	usage := &web.Usage{}
+	return newUDPSessionTable(opts, usage, logger), usage
+}
+
+// addSession adds the session of addr, active at the given time so that the eviction order is known
+func addSession(table *udpSessionTable, addr string, active int64) *udpSession {
+	session := table.add(udpAddr(addr), []byte(addr))
+	session.lastActive.Store(active)
+	return session
+}
+
+func udpAddr(addr string) *net.UDPAddr {
+	a, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+func isEvicted(session *udpSession) bool {
+	select {
+	case <-session.evicted:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestUDPSessionLimits(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		opts    *UDPSessionOptions
+		addrs   []string
+		evicted []bool
+	}{
+		{"no limits", nil, []string{"10.0.0.1:1", "10.0.0.1:2", "10.0.0.2:1"}, []bool{false, false, false}},
+		{"session limit", &UDPSessionOptions{MaxSessions: 2}, []string{"10.0.0.1:1", "10.0.0.2:1", "10.0.0.3:1"}, []bool{true, false, false}},
+		{"per source limit", &UDPSessionOptions{MaxPerSource: 1}, []string{"10.0.0.1:1", "10.0.0.2:1", "10.0.0.1:2"}, []bool{true, false, false}},
+		{"both limits", &UDPSessionOptions{MaxSessions: 3, MaxPerSource: 2}, []string{"10.0.0.1:1", "10.0.0.2:1", "10.0.0.1:2", "10.0.0.1:3", "10.0.0.3:1"}, []bool{true, true, false, false, false}},
+	} {
+		table, usage := newTestSessionTable(c.opts)
+
+		var sessions []*udpSession
+		for i, addr := range c.addrs {
+			sessions = append(sessions, addSession(table, addr, int64(i+1)))
+		}
+
+		expectedEvictions := 0
+		for i, session := range sessions {
+			if isEvicted(session) != c.evicted[i] {
+				t.Errorf("%s: session %s evicted %v, expected %v", c.name, session.key, isEvicted(session), c.evicted[i])
+			}
+			if _, exists := table.sessions[session.key]; exists == c.evicted[i] {
+				t.Errorf("%s: session %s in the table %v, expected %v", c.name, session.key, exists, !c.evicted[i])
+			}
+			if c.evicted[i] {
+				expectedEvictions++
+			}
+		}
+
+		if _, evictions := usage.UDPCounters(); evictions != uint64(expectedEvictions) {
+			t.Errorf("%s: counted %d evictions, expected %d", c.name, evictions, expectedEvictions)
+		}
+	}
+}
+
+func TestUDPSessionCongestion(t *testing.T) {
+	table, usage := newTestSessionTable(&UDPSessionOptions{MaxSessions: 1})
+	addr := udpAddr("10.0.0.1:1")
+
+	congested := table.add(addr, []byte("first"))
+	if !table.push(addr, []byte("second")) {
+		t.Fatal("packet not buffered by the existing session")
+	}
+
+	// the new packets of a congested session start a new one
+	congested.congested.Store(true)
+	if table.push(addr, []byte("third")) {
+		t.Fatal("packet buffered by a congested session")
+	}
+	replacement := table.add(addr, []byte("third"))
+
+	if isEvicted(congested) {
+		t.Error("congested session evicted by its replacement")
+	}
+	if _, evictions := usage.UDPCounters(); evictions != 0 {
+		t.Errorf("replacement of a congested session counted %d evictions", evictions)
+	}
+	if table.sessions[addr.String()] != replacement {
+		t.Error("new packets do not go to the replacement")
+	}
+
+	// the congested session still drains its buffered packets
+	for _, expected := range []string{"first", "second"} {
+		select {
+		case data := <-congested.payload:
+			if string(data) != expected {
+				t.Errorf("congested session drained %q, expected %q", data, expected)
+			}
+		default:
+			t.Errorf("congested session lost %q", expected)
+		}
+	}
+
+	// the end of the congested session leaves its replacement in the table
+	table.remove(congested)
+	if table.sessions[addr.String()] != replacement {
+		t.Error("replacement removed with the congested session")
+	}
+}
+
+func TestUDPSessionDropPolicy(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		opts     *UDPSessionOptions
+		expected []string
+	}{
+		{"drop newest", &UDPSessionOptions{BufferSize: 2}, []string{"1", "2"}},
+		{"drop oldest", &UDPSessionOptions{BufferSize: 2, DropOldest: true}, []string{"3", "4"}},
+	} {
+		table, usage := newTestSessionTable(c.opts)
+		addr := udpAddr("10.0.0.1:1")
+
+		session := table.add(addr, []byte("1"))
+		for _, data := range []string{"2", "3", "4"} {
+			if !table.push(addr, []byte(data)) {
+				t.Fatalf("%s: packet %s not handled by the session", c.name, data)
+			}
+		}
+
+		if dropped, _ := usage.UDPCounters(); dropped != 2 {
+			t.Errorf("%s: counted %d drops, expected 2", c.name, dropped)
+		}
+
+		table.remove(session)
+		var buffered []string
+		for data := range session.payload {
+			buffered = append(buffered, string(data))
+		}
+		if len(buffered) != len(c.expected) || buffered[0] != c.expected[0] || buffered[1] != c.expected[1] {
+			t.Errorf("%s: buffered %v, expected %v", c.name, buffered, c.expected)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package transport
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -31,24 +32,29 @@ type WsTransport struct {
 	controlChannel *websocket.Conn
 	restartMutex   sync.Mutex
 	usageMonitor   *web.Usage
+	ports          []string // port mappings of the connected client
 }
 
 type WsConfig struct {
-	BindAddr     string
-	SnifferLog   string
-	TLSCertFile  string // Path to the TLS certificate file
-	TLSKeyFile   string // Path to the TLS key file
-	TunnelStatus string
-	Token        string
-	Ports        []string
-	Nodelay      bool
-	Sniffer      bool
-	KeepAlive    time.Duration
-	Heartbeat    time.Duration // in seconds
-	ChannelSize  int
-	WebPort      int
-	Mode         config.TransportType // ws or wss
-
+	BindAddr        string
+	SnifferLog      string
+	Certs           *CertStore         // server certificate, generated on first start and reloaded on change
+	ClientAuth      *ClientAuthOptions // mutual TLS, nil when disabled
+	TunnelStatus    web.TunnelStatus
+	Token           string
+	Ports           []string
+	Nodelay         bool
+	Sniffer         bool
+	KeepAlive       time.Duration
+	HalfCloseLinger time.Duration
+	Socket          *utils.SocketOptions // tcp options of the tunnel and local sockets, nil for the defaults
+	Heartbeat       time.Duration        // in seconds
+	ChannelSize     int
+	WebPort         int
+	Mode            config.TransportType // ws or wss
+	AcceptUDP       bool
+	ForwardSource   bool
+	UDPSessions     *UDPSessionOptions // UDP session lifecycle of accept_udp, nil for the defaults
 }
 
 func NewWSServer(parentCtx context.Context, config *WsConfig, logger *logrus.Logger) *WsTransport {
@@ -78,7 +84,7 @@ func (s *WsTransport) Start() {
 		go s.usageMonitor.Monitor()
 	}
 
-	s.config.TunnelStatus = fmt.Sprintf("Disconnected (%s)", s.config.Mode)
+	s.config.TunnelStatus.Set(fmt.Sprintf("Disconnected (%s)", s.config.Mode))
 
 	go s.tunnelListener()
 
@@ -116,7 +122,7 @@ func (s *WsTransport) Restart() {
 	s.reqNewConnChan = make(chan struct{}, s.config.ChannelSize)
 	s.controlChannel = nil
 	s.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", s.config.WebPort), ctx, s.config.SnifferLog, s.config.Sniffer, &s.config.TunnelStatus, s.logger)
-	s.config.TunnelStatus = ""
+	s.config.TunnelStatus.Set("")
 
 	// set the log level again
 	s.logger.SetLevel(level)
@@ -225,6 +231,17 @@ func (s *WsTransport) tunnelListener() {
 				return
 			}
 
+			// the client certificate of the control channel selects the ports of its tenant
+			if r.URL.Path == "/channel" {
+				ports, err := s.config.ClientAuth.ports(r.TLS, s.config.Ports, s.logger)
+				if err != nil {
+					s.logger.Warnf("control channel from %s rejected: %v", r.RemoteAddr, err)
+					http.Error(w, "forbidden", http.StatusForbidden)
+					return
+				}
+				s.ports = ports
+			}
+
 			conn, err := upgrader.Upgrade(w, r, nil)
 			if err != nil {
 				s.logger.Errorf("failed to upgrade connection from %s: %v", r.RemoteAddr, err)
@@ -257,7 +274,7 @@ func (s *WsTransport) tunnelListener() {
 					go s.handleLoop()
 				}
 
-				s.config.TunnelStatus = fmt.Sprintf("Connected (%s)", s.config.Mode)
+				s.config.TunnelStatus.Set(fmt.Sprintf("Connected (%s)", s.config.Mode))
 
 			} else if strings.HasPrefix(r.URL.Path, "/tunnel") {
 				wsConn := TunnelChannel{
@@ -283,7 +300,7 @@ func (s *WsTransport) tunnelListener() {
 			if s.controlChannel == nil {
 				s.logger.Info("waiting for ws control channel connection")
 			}
-			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			if err := serveHTTP(server, s.config.Socket, false); err != nil && err != http.ErrServerClosed {
 				s.logger.Fatalf("failed to listen on %s: %v", addr, err)
 			}
 		}()
@@ -293,7 +310,8 @@ func (s *WsTransport) tunnelListener() {
 			if s.controlChannel == nil {
 				s.logger.Info("waiting for wss control channel connection")
 			}
-			if err := server.ListenAndServeTLS(s.config.TLSCertFile, s.config.TLSKeyFile); err != nil && err != http.ErrServerClosed {
+			server.TLSConfig = serverTLSConfig(s.config.Certs, s.config.ClientAuth)
+			if err := serveHTTP(server, s.config.Socket, true); err != nil && err != http.ErrServerClosed {
 				s.logger.Fatalf("failed to listen on %s: %v", addr, err)
 			}
 		}()
@@ -314,7 +332,7 @@ func (s *WsTransport) tunnelListener() {
 }
 
 func (s *WsTransport) parsePortMappings() {
-	for _, portMapping := range s.config.Ports {
+	for _, portMapping := range s.ports {
 		parts := strings.Split(portMapping, "=")
 
 		var localAddr, remoteAddr string
@@ -345,8 +363,8 @@ func (s *WsTransport) parsePortMappings() {
 				// Create listeners for all ports in the range
 				for port := startPort; port <= endPort; port++ {
 					localAddr = fmt.Sprintf(":%d", port)
-					go s.localListener(localAddr, strconv.Itoa(port)) // Use port as the remoteAddr
-					time.Sleep(1 * time.Millisecond)                  // for wide port ranges
+					go s.startListeners(localAddr, strconv.Itoa(port)) // Use port as the remoteAddr
+					time.Sleep(1 * time.Millisecond)                   // for wide port ranges
 				}
 				continue
 			} else {
@@ -383,7 +401,7 @@ func (s *WsTransport) parsePortMappings() {
 				// Create listeners for all ports in the range
 				for port := startPort; port <= endPort; port++ {
 					localAddr = fmt.Sprintf(":%d", port)
-					go s.localListener(localAddr, remoteAddr)
+					go s.startListeners(localAddr, remoteAddr)
 					time.Sleep(1 * time.Millisecond) // for wide port ranges
 				}
 				continue
@@ -400,13 +418,26 @@ func (s *WsTransport) parsePortMappings() {
 			s.logger.Fatalf("invalid port mapping format: %s", portMapping)
 		}
 		// Start listeners for single port
-		go s.localListener(localAddr, remoteAddr)
+		go s.startListeners(localAddr, remoteAddr)
+	}
+}
+
+func (s *WsTransport) startListeners(localAddr, remoteAddr string) {
+	// Start TCP listener
+	go s.localListener(localAddr, remoteAddr)
+
+	// Start UDP listener if configured, its clients are queued with the TCP connections
+	if s.config.AcceptUDP {
+		go udpFlowListener(s.ctx, localAddr, remoteAddr, s.config.ForwardSource, s.localChannel, s.config.UDPSessions, s.usageMonitor, s.logger)
 	}
 }
 
 func (s *WsTransport) localListener(localAddr string, remoteAddr string) {
-	portListener, err := net.Listen("tcp", localAddr)
+	portListener, err := listenTCP(s.ctx, localAddr, s.config.Socket, s.logger)
 	if err != nil {
+		if errors.Is(err, context.Canceled) { // stopped while waiting for the address
+			return
+		}
 		s.logger.Fatalf("failed to start listener on %s: %v", localAddr, err)
 		return
 	}
@@ -463,7 +494,7 @@ func (s *WsTransport) acceptLocalConn(listener net.Listener, remoteAddr string)
 			}
 
 			select {
-			case s.localChannel <- LocalTCPConn{conn: conn, remoteAddr: remoteAddr, timeCreated: time.Now().UnixMilli()}:
+			case s.localChannel <- LocalTCPConn{conn: conn, remoteAddr: withSource(remoteAddr, conn, s.config.ForwardSource), timeCreated: time.Now().UnixMilli()}:
 
 				select {
 				case s.reqNewConnChan <- struct{}{}:
@@ -493,7 +524,7 @@ func (s *WsTransport) handleLoop() {
 			for {
 				if time.Now().UnixMilli()-localConn.timeCreated > 3000 { // 3000ms
 					s.logger.Debugf("timeouted local connection: %d ms", time.Now().UnixMilli()-localConn.timeCreated)
-					localConn.conn.Close()
+					localConn.close()
 					break loop
 				}
 
@@ -503,13 +534,25 @@ func (s *WsTransport) handleLoop() {
 				case tunnelConnection := <-s.tunnelChannel:
 					close(tunnelConnection.ping)
 					tunnelConnection.mu.Lock()
+					if localConn.udp != nil {
+						// the target of a UDP client is sent as a binary message marked with SG_UDP, and the
+						// packets are framed over the websocket as on the tcp transport
+						if err := tunnelConnection.conn.WriteMessage(websocket.BinaryMessage, append([]byte{utils.SG_UDP}, localConn.remoteAddr...)); err != nil {
+							s.logger.Debugf("%v", err) // failed to send port number
+							tunnelConnection.conn.Close()
+							continue loop
+						}
+						go handleLocalConn(utils.NewWSConn(tunnelConnection.conn), localConn, s.logger, s.usageMonitor, s.config.Sniffer, false, 0)
+						break loop
+					}
+
 					if err := tunnelConnection.conn.WriteMessage(websocket.TextMessage, []byte(localConn.remoteAddr)); err != nil {
 						s.logger.Debugf("%v", err) // failed to send port number
 						tunnelConnection.conn.Close()
 						continue loop
 					}
 					// Handle data exchange between connections
-					go utils.WSConnectionHandler(tunnelConnection.conn, localConn.conn, s.logger, s.usageMonitor, localConn.conn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer)
+					go utils.WSConnectionHandler(tunnelConnection.conn, localConn.conn, s.logger, s.usageMonitor, localConn.conn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer, s.config.HalfCloseLinger)
 					break loop
 				}
 			}
@@ -2,6 +2,7 @@ package transport
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -33,23 +34,27 @@ type WsMuxTransport struct {
 	reqNewConnChan chan struct{}
 	controlChannel *websocket.Conn
 	usageMonitor   *web.Usage
+	ports          []string // port mappings of the connected client
 	restartMutex   sync.Mutex
 	streamCounter  int32
 	sessionCounter int32
+	halfClose      atomic.Bool // the streams are framed, negotiated with the client
 }
 
 type WsMuxConfig struct {
 	BindAddr         string
 	Token            string
 	SnifferLog       string
-	TLSCertFile      string // Path to the TLS certificate file
-	TLSKeyFile       string // Path to the TLS key file
-	TunnelStatus     string
+	Certs            *CertStore         // server certificate, generated on first start and reloaded on change
+	ClientAuth       *ClientAuthOptions // mutual TLS, nil when disabled
+	TunnelStatus     web.TunnelStatus
 	Ports            []string
 	Nodelay          bool
 	Sniffer          bool
 	KeepAlive        time.Duration
-	Heartbeat        time.Duration // in seconds
+	HalfCloseLinger  time.Duration
+	Socket           *utils.SocketOptions // tcp options of the tunnel and local sockets, nil for the defaults
+	Heartbeat        time.Duration        // in seconds
 	ChannelSize      int
 	MuxCon           int
 	MuxVersion       int
@@ -58,7 +63,9 @@ type WsMuxConfig struct {
 	MaxStreamBuffer  int
 	WebPort          int
 	Mode             config.TransportType // ws or wss
-
+	AcceptUDP        bool
+	ForwardSource    bool
+	UDPSessions      *UDPSessionOptions // UDP session lifecycle of accept_udp, nil for the defaults
 }
 
 func NewWSMuxServer(parentCtx context.Context, config *WsMuxConfig, logger *logrus.Logger) *WsMuxTransport {
@@ -98,7 +105,7 @@ func (s *WsMuxTransport) Start() {
 		go s.usageMonitor.Monitor()
 	}
 
-	s.config.TunnelStatus = fmt.Sprintf("Disconnected (%s)", s.config.Mode)
+	s.config.TunnelStatus.Set(fmt.Sprintf("Disconnected (%s)", s.config.Mode))
 
 	go s.tunnelListener()
 
@@ -138,7 +145,7 @@ func (s *WsMuxTransport) Restart() {
 	s.reqNewConnChan = make(chan struct{}, s.config.ChannelSize)
 	s.controlChannel = nil
 	s.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", s.config.WebPort), ctx, s.config.SnifferLog, s.config.Sniffer, &s.config.TunnelStatus, s.logger)
-	s.config.TunnelStatus = ""
+	s.config.TunnelStatus.Set("")
 	s.streamCounter = 0
 	s.sessionCounter = 0
 
@@ -234,6 +241,11 @@ func (s *WsMuxTransport) tunnelListener() {
 		},
 	}
 
+	// the control channels that frame their streams offer the half-close subprotocol
+	if s.config.HalfCloseLinger > 0 {
+		upgrader.Subprotocols = []string{utils.HalfCloseProtocol}
+	}
+
 	// Create an HTTP server
 	server := &http.Server{
 		Addr:        addr,
@@ -249,6 +261,17 @@ func (s *WsMuxTransport) tunnelListener() {
 				return
 			}
 
+			// the client certificate of the control channel selects the ports of its tenant
+			if r.URL.Path == "/channel" {
+				ports, err := s.config.ClientAuth.ports(r.TLS, s.config.Ports, s.logger)
+				if err != nil {
+					s.logger.Warnf("control channel from %s rejected: %v", r.RemoteAddr, err)
+					http.Error(w, "forbidden", http.StatusForbidden)
+					return
+				}
+				s.ports = ports
+			}
+
 			conn, err := upgrader.Upgrade(w, r, nil)
 			if err != nil {
 				s.logger.Errorf("failed to upgrade connection from %s: %v", r.RemoteAddr, err)
@@ -264,6 +287,7 @@ func (s *WsMuxTransport) tunnelListener() {
 					return
 				}
 
+				s.halfClose.Store(conn.Subprotocol() == utils.HalfCloseProtocol)
 				s.controlChannel = conn
 
 				s.logger.Info("control channel established successfully")
@@ -282,7 +306,7 @@ func (s *WsMuxTransport) tunnelListener() {
 					go s.handleLoop()
 				}
 
-				s.config.TunnelStatus = fmt.Sprintf("Connected (%s)", s.config.Mode)
+				s.config.TunnelStatus.Set(fmt.Sprintf("Connected (%s)", s.config.Mode))
 
 			} else if strings.HasPrefix(r.URL.Path, "/tunnel") {
 				session, err := smux.Client(conn.NetConn(), s.smuxConfig)
@@ -307,7 +331,7 @@ func (s *WsMuxTransport) tunnelListener() {
 			if s.controlChannel == nil {
 				s.logger.Infof("waiting for %s control channel connection", s.config.Mode)
 			}
-			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			if err := serveHTTP(server, s.config.Socket, false); err != nil && err != http.ErrServerClosed {
 				s.logger.Fatalf("failed to listen on %s: %v", addr, err)
 			}
 		}()
@@ -317,7 +341,8 @@ func (s *WsMuxTransport) tunnelListener() {
 			if s.controlChannel == nil {
 				s.logger.Infof("waiting for %s control channel connection", s.config.Mode)
 			}
-			if err := server.ListenAndServeTLS(s.config.TLSCertFile, s.config.TLSKeyFile); err != nil && err != http.ErrServerClosed {
+			server.TLSConfig = serverTLSConfig(s.config.Certs, s.config.ClientAuth)
+			if err := serveHTTP(server, s.config.Socket, true); err != nil && err != http.ErrServerClosed {
 				s.logger.Fatalf("failed to listen on %s: %v", addr, err)
 			}
 		}()
@@ -338,7 +363,7 @@ func (s *WsMuxTransport) tunnelListener() {
 }
 
 func (s *WsMuxTransport) parsePortMappings() {
-	for _, portMapping := range s.config.Ports {
+	for _, portMapping := range s.ports {
 		parts := strings.Split(portMapping, "=")
 
 		var localAddr, remoteAddr string
@@ -369,8 +394,8 @@ func (s *WsMuxTransport) parsePortMappings() {
 				// Create listeners for all ports in the range
 				for port := startPort; port <= endPort; port++ {
 					localAddr = fmt.Sprintf(":%d", port)
-					go s.localListener(localAddr, strconv.Itoa(port)) // Use port as the remoteAddr
-					time.Sleep(1 * time.Millisecond)                  // for wide port ranges
+					go s.startListeners(localAddr, strconv.Itoa(port)) // Use port as the remoteAddr
+					time.Sleep(1 * time.Millisecond)                   // for wide port ranges
 				}
 				continue
 			} else {
@@ -407,7 +432,7 @@ func (s *WsMuxTransport) parsePortMappings() {
 				// Create listeners for all ports in the range
 				for port := startPort; port <= endPort; port++ {
 					localAddr = fmt.Sprintf(":%d", port)
-					go s.localListener(localAddr, remoteAddr)
+					go s.startListeners(localAddr, remoteAddr)
 					time.Sleep(1 * time.Millisecond) // for wide port ranges
 				}
 				continue
@@ -424,13 +449,26 @@ func (s *WsMuxTransport) parsePortMappings() {
 			s.logger.Fatalf("invalid port mapping format: %s", portMapping)
 		}
 		// Start listeners for single port
-		go s.localListener(localAddr, remoteAddr)
+		go s.startListeners(localAddr, remoteAddr)
+	}
+}
+
+func (s *WsMuxTransport) startListeners(localAddr, remoteAddr string) {
+	// Start TCP listener
+	go s.localListener(localAddr, remoteAddr)
+
+	// Start UDP listener if configured, its clients are queued with the TCP connections
+	if s.config.AcceptUDP {
+		go udpFlowListener(s.ctx, localAddr, remoteAddr, s.config.ForwardSource, s.localChannel, s.config.UDPSessions, s.usageMonitor, s.logger)
 	}
 }
 
 func (s *WsMuxTransport) localListener(localAddr string, remoteAddr string) {
-	listener, err := net.Listen("tcp", localAddr)
+	listener, err := listenTCP(s.ctx, localAddr, s.config.Socket, s.logger)
 	if err != nil {
+		if errors.Is(err, context.Canceled) { // stopped while waiting for the address
+			return
+		}
 		s.logger.Fatalf("failed to start listener on %s: %v", localAddr, err)
 		return
 	}
@@ -486,7 +524,7 @@ func (s *WsMuxTransport) acceptLocalConn(listener net.Listener, remoteAddr strin
 			}
 
 			select {
-			case s.localChannel <- LocalTCPConn{conn: conn, remoteAddr: remoteAddr, timeCreated: time.Now().UnixMilli()}:
+			case s.localChannel <- LocalTCPConn{conn: conn, remoteAddr: withSource(remoteAddr, conn, s.config.ForwardSource), timeCreated: time.Now().UnixMilli()}:
 				s.logger.Debugf("accepted incoming TCP connection from %s", tcpConn.RemoteAddr().String())
 
 				// +1 for stream counter
@@ -542,7 +580,7 @@ func (s *WsMuxTransport) handleSession(session *smux.Session) {
 		case incomingConn := <-s.localChannel:
 			if time.Now().UnixMilli()-incomingConn.timeCreated > 3000 { // 3000ms
 				s.logger.Debugf("timeouted local connection: %d ms", time.Now().UnixMilli()-incomingConn.timeCreated)
-				incomingConn.conn.Close()
+				incomingConn.close()
 
 				// Decrement the counter
 				atomic.AddInt32(&s.streamCounter, -1)
@@ -557,7 +595,7 @@ func (s *WsMuxTransport) handleSession(session *smux.Session) {
 			}
 
 			// Send the target port over the tunnel connection
-			if err := utils.SendBinaryString(stream, incomingConn.remoteAddr); err != nil {
+			if err := sendLocalConn(stream, incomingConn, false); err != nil {
 				s.logger.Tracef("failed to send address over stream: %v", err)
 				// Put local connection back to local channel
 				s.localChannel <- incomingConn
@@ -566,7 +604,7 @@ func (s *WsMuxTransport) handleSession(session *smux.Session) {
 
 			// Handle data exchange between connections
 			go func() {
-				utils.TCPConnectionHandler(stream, incomingConn.conn, s.logger, s.usageMonitor, incomingConn.conn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer)
+				handleLocalConn(stream, incomingConn, s.logger, s.usageMonitor, s.config.Sniffer, s.halfClose.Load(), s.config.HalfCloseLinger)
 				atomic.AddInt32(&s.streamCounter, -1)
 				<-counter // read signal from the channel
 			}()
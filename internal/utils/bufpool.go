@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"math/bits"
+	"sync"
+	"unsafe"
+)
+
+// Data buffers are shared by all the transports through pools of power of two size classes, from 2 KB,
+// enough for a datagram of a 1500 bytes MTU, to 64 KB, the largest UDP datagram.
+const (
+	minBufferShift = 11
+	maxBufferShift = 16
+
+	// MaxPooledBufferSize is the size of the largest pooled buffer, larger buffers are allocated
+	MaxPooledBufferSize = 1 << maxBufferShift
+)
+
+// CopyBufferSize is the size of the buffers of the Read/Write copy loops
+const CopyBufferSize = 16 * 1024
+
+// The pools hold a pointer to the first byte of a buffer, the size is known from its class. A slice
+// would be allocated on every Put once it is converted to an interface.
+var bufferPools [maxBufferShift - minBufferShift + 1]sync.Pool
+
+// bufferClass returns the index of the smallest class holding size bytes, -1 when it is too large
+func bufferClass(size int) int {
+	if size > MaxPooledBufferSize {
+		return -1
+	}
+	if size <= 1<<minBufferShift {
+		return 0
+	}
+	return bits.Len(uint(size-1)) - minBufferShift
+}
+
+// GetBuffer returns a buffer of size bytes from the pool of its class, its capacity is the size of the
+// class. It is handed back with PutBuffer once it is not used anymore.
+func GetBuffer(size int) []byte {
+	class := bufferClass(size)
+	if class < 0 {
+		return make([]byte, size)
+	}
+
+	if ptr, ok := bufferPools[class].Get().(*byte); ok {
+		return unsafe.Slice(ptr, 1<<(class+minBufferShift))[:size]
+	}
+	return make([]byte, size, 1<<(class+minBufferShift))
+}
+
+// PutBuffer returns a buffer of GetBuffer to its pool, it must not be used afterwards. Buffers that do not
+// have the capacity of a class are left to the garbage collector.
+func PutBuffer(buf []byte) {
+	size := cap(buf)
+	if size < 1<<minBufferShift || size > MaxPooledBufferSize || size&(size-1) != 0 {
+		return
+	}
+	bufferPools[bits.Len(uint(size))-1-minBufferShift].Put(unsafe.SliceData(buf[:1]))
+}
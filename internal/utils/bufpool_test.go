@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"bytes"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+const (
+	benchStreams     = 10000
+	benchStreamBytes = 64 * 1024 // data copied by every stream
+	benchPackets     = 16        // datagrams queued by every stream
+)
+
+func TestBufferClasses(t *testing.T) {
+	for _, c := range []struct{ size, capacity int }{
+		{0, 2048}, {100, 2048}, {2048, 2048}, {2049, 4096}, {CopyBufferSize, CopyBufferSize},
+		{CopyBufferSize + 4, 32 * 1024}, {MaxPooledBufferSize, MaxPooledBufferSize}, {MaxPooledBufferSize + 1, MaxPooledBufferSize + 1},
+	} {
+		buf := GetBuffer(c.size)
+		if len(buf) != c.size || cap(buf) != c.capacity {
+			t.Errorf("GetBuffer(%d) returned len %d cap %d, expected cap %d", c.size, len(buf), cap(buf), c.capacity)
+		}
+		PutBuffer(buf)
+	}
+}
+
+// stream copies data through a copy buffer and queues a few datagrams, like a forwarded connection
+func stream(payload []byte, getBuffer func(int) []byte, putBuffer func([]byte)) {
+	buf := getBuffer(CopyBufferSize)
+	defer putBuffer(buf)
+
+	src := bytes.NewReader(payload)
+	for {
+		n, _ := src.Read(buf)
+		if n == 0 {
+			break
+		}
+	}
+
+	for i := 0; i < benchPackets; i++ {
+		packet := getBuffer(1200)
+		copy(packet, payload)
+		putBuffer(packet)
+	}
+}
+
+// benchmarkStreams runs benchStreams concurrent streams per iteration and reports the collections
+func benchmarkStreams(b *testing.B, getBuffer func(int) []byte, putBuffer func([]byte)) {
+	payload := make([]byte, benchStreamBytes)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		wg.Add(benchStreams)
+		for s := 0; s < benchStreams; s++ {
+			go func() {
+				defer wg.Done()
+				stream(payload, getBuffer, putBuffer)
+			}()
+		}
+		wg.Wait()
+	}
+
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.NumGC-before.NumGC)/float64(b.N), "gc/op")
+	b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(b.N), "gc-pause-ns/op")
+}
+
+// BenchmarkStreamBuffers compares allocating the buffers of every stream with the pooled buffers
+func BenchmarkStreamBuffers(b *testing.B) {
+	b.Run("Alloc", func(b *testing.B) {
+		benchmarkStreams(b, func(size int) []byte { return make([]byte, size) }, func([]byte) {})
+	})
+
+	b.Run("Pool", func(b *testing.B) {
+		benchmarkStreams(b, GetBuffer, PutBuffer)
+	})
+}
+
+func BenchmarkGetBuffer(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			PutBuffer(GetBuffer(CopyBufferSize))
+		}
+	})
+}
@@ -0,0 +1,439 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// FEC packet layout on the tunnel: kind(1) group(4) index(1) count(1) shard
+// A data shard is the payload prefixed with its 2-byte length, parity shards are as long as the
+// longest data shard of their group and carry the number of data shards in count.
+const (
+	fecData       byte = 0xF0
+	fecParity     byte = 0xF1
+	fecHeaderSize      = 7
+	fecLenSize         = 2
+	fecMaxGroups       = 64              // groups kept for reconstruction
+	fecGroupTTL        = 3 * time.Second // incomplete groups are dropped after this
+)
+
+// FECMaxShards bounds the data and parity shards of a group in total
+const FECMaxShards = 255
+
+// FEC parameters are appended to the control channel token during the handshake
+const fecOfferSeparator = "\x1ffec="
+
+type FECConfig struct {
+	DataShards   int
+	ParityShards int
+	GroupTimeout time.Duration // parity of an incomplete group is sent after this
+}
+
+// Offer appends the FEC parameters to the handshake token
+func (c FECConfig) Offer(token string) string {
+	return fmt.Sprintf("%s%s%d,%d,%d", token, fecOfferSeparator, c.DataShards, c.ParityShards, c.GroupTimeout.Milliseconds())
+}
+
+// ParseFECOffer splits a handshake message into the token and the FEC parameters, nil when none were sent
+func ParseFECOffer(msg string) (string, *FECConfig, error) {
+	token, offer, found := strings.Cut(msg, fecOfferSeparator)
+	if !found {
+		return msg, nil, nil
+	}
+
+	parts := strings.Split(offer, ",")
+	if len(parts) != 3 {
+		return token, nil, fmt.Errorf("invalid FEC offer: %q", offer)
+	}
+
+	values := make([]int, len(parts))
+	for i, part := range parts {
+		value, err := strconv.Atoi(part)
+		if err != nil || value < 0 {
+			return token, nil, fmt.Errorf("invalid FEC offer: %q", offer)
+		}
+		values[i] = value
+	}
+	if values[0] < 1 || values[1] < 1 || values[0]+values[1] > FECMaxShards {
+		return token, nil, fmt.Errorf("invalid FEC shards: %d data, %d parity", values[0], values[1])
+	}
+
+	return token, &FECConfig{
+		DataShards:   values[0],
+		ParityShards: values[1],
+		GroupTimeout: time.Duration(values[2]) * time.Millisecond,
+	}, nil
+}
+
+// FECEncoder sends every payload right away as a data shard and the parity shards once a group
+// is full or its timeout expired.
+type FECEncoder struct {
+	config FECConfig
+	rs     reedsolomon.Encoder
+	write  func([]byte) error
+	mu     sync.Mutex
+	group  uint32
+	shards [][]byte
+	timer  *time.Timer
+	closed bool
+}
+
+// NewFECEncoder creates an encoder sending its packets with write, the packets are pooled buffers that
+// must not be kept once write returns
+func NewFECEncoder(config FECConfig, write func([]byte) error) (*FECEncoder, error) {
+	rs, err := reedsolomon.New(config.DataShards, config.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FECEncoder{
+		config: config,
+		rs:     rs,
+		write:  write,
+		shards: make([][]byte, 0, config.DataShards),
+	}, nil
+}
+
+// Write sends a payload over the tunnel
+func (e *FECEncoder) Write(payload []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return fmt.Errorf("FEC encoder is closed")
+	}
+
+	// the shard is kept for the parity of its group, it is released once the group is flushed
+	shard := GetBuffer(fecLenSize + len(payload))
+	binary.BigEndian.PutUint16(shard, uint16(len(payload)))
+	copy(shard[fecLenSize:], payload)
+
+	index := len(e.shards)
+	e.shards = append(e.shards, shard)
+
+	if err := e.writePacket(fecData, e.group, index, 0, shard); err != nil {
+		return err
+	}
+
+	if len(e.shards) == e.config.DataShards {
+		return e.flush()
+	}
+
+	if index == 0 && e.config.GroupTimeout > 0 {
+		group := e.group
+		e.timer = time.AfterFunc(e.config.GroupTimeout, func() {
+			e.mu.Lock()
+			defer e.mu.Unlock()
+
+			// the group may have been completed in the meantime
+			if !e.closed && e.group == group && len(e.shards) > 0 {
+				e.flush()
+			}
+		})
+	}
+
+	return nil
+}
+
+// flush sends the parity shards of the current group and starts a new one, e.mu must be held
+func (e *FECEncoder) flush() error {
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+
+	count := len(e.shards)
+	size := 0
+	for _, shard := range e.shards {
+		if len(shard) > size {
+			size = len(shard)
+		}
+	}
+
+	// missing data shards of an incomplete group are encoded as empty payloads
+	shards := make([][]byte, e.config.DataShards+e.config.ParityShards)
+	for i := range shards {
+		shards[i] = GetBuffer(size)
+		if i < count {
+			n := copy(shards[i], e.shards[i])
+			clear(shards[i][n:])
+		} else {
+			clear(shards[i])
+		}
+	}
+	defer releaseShards(shards)
+
+	group := e.group
+	e.group++
+	e.releaseShards()
+
+	if err := e.rs.Encode(shards); err != nil {
+		return err
+	}
+
+	for i := e.config.DataShards; i < len(shards); i++ {
+		if err := e.writePacket(fecParity, group, i, count, shards[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// releaseShards hands the data shards of the current group back to the pool, e.mu must be held
+func (e *FECEncoder) releaseShards() {
+	releaseShards(e.shards)
+	e.shards = e.shards[:0]
+}
+
+func releaseShards(shards [][]byte) {
+	for i, shard := range shards {
+		PutBuffer(shard)
+		shards[i] = nil
+	}
+}
+
+func (e *FECEncoder) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.closed = true
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+	e.releaseShards()
+}
+
+// writePacket sends a shard with its header through a pooled buffer
+func (e *FECEncoder) writePacket(kind byte, group uint32, index int, count int, shard []byte) error {
+	packet := fecPacket(GetBuffer(fecHeaderSize+len(shard)), kind, group, index, count, shard)
+	defer PutBuffer(packet)
+	return e.write(packet)
+}
+
+// fecPacket writes the header and the shard into packet, which holds fecHeaderSize+len(shard) bytes
+func fecPacket(packet []byte, kind byte, group uint32, index int, count int, shard []byte) []byte {
+	packet[0] = kind
+	binary.BigEndian.PutUint32(packet[1:5], group)
+	packet[5] = byte(index)
+	packet[6] = byte(count)
+	copy(packet[fecHeaderSize:], shard)
+	return packet
+}
+
+type fecGroup struct {
+	shards    [][]byte
+	received  int // data and parity shards
+	count     int // data shards sent, known once a parity shard arrived
+	highest   int // highest data shard index seen
+	delivered []bool
+	done      bool // all data shards are delivered or rebuilt
+	created   time.Time
+}
+
+// FECDecoder delivers data shards as they arrive and rebuilds the lost ones from the parity.
+type FECDecoder struct {
+	config    FECConfig
+	rs        reedsolomon.Encoder
+	mu        sync.Mutex
+	groups    map[uint32]*fecGroup
+	lost      uint64 // data shards that never arrived
+	recovered uint64 // data shards rebuilt from the parity
+}
+
+func NewFECDecoder(config FECConfig) (*FECDecoder, error) {
+	rs, err := reedsolomon.New(config.DataShards, config.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FECDecoder{
+		config: config,
+		rs:     rs,
+		groups: make(map[uint32]*fecGroup),
+	}, nil
+}
+
+// Decode takes a packet received from the tunnel and returns the payloads to deliver
+func (d *FECDecoder) Decode(packet []byte) ([][]byte, error) {
+	if len(packet) < fecHeaderSize || (packet[0] != fecData && packet[0] != fecParity) {
+		return nil, fmt.Errorf("invalid FEC packet of %d bytes", len(packet))
+	}
+
+	kind := packet[0]
+	groupID := binary.BigEndian.Uint32(packet[1:5])
+	index := int(packet[5])
+	count := int(packet[6])
+	shard := packet[fecHeaderSize:]
+
+	total := d.config.DataShards + d.config.ParityShards
+	if index >= total || (kind == fecData) != (index < d.config.DataShards) {
+		return nil, fmt.Errorf("invalid FEC shard index %d", index)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.expire()
+
+	group, ok := d.groups[groupID]
+	if !ok {
+		group = &fecGroup{
+			shards:    make([][]byte, total),
+			delivered: make([]bool, d.config.DataShards),
+			highest:   -1,
+			created:   time.Now(),
+		}
+		d.groups[groupID] = group
+	}
+
+	if group.shards[index] != nil {
+		return nil, nil // duplicate
+	}
+	group.shards[index] = append([]byte(nil), shard...)
+	group.received++
+
+	var payloads [][]byte
+	if kind == fecData {
+		if index > group.highest {
+			group.highest = index
+		}
+		if payload, ok := fecPayload(shard); ok && !group.done {
+			group.delivered[index] = true
+			payloads = append(payloads, payload)
+		}
+	} else {
+		group.count = count
+	}
+
+	if !group.done && group.count > 0 {
+		payloads = append(payloads, d.reconstruct(group)...)
+	}
+
+	return payloads, nil
+}
+
+// reconstruct rebuilds the missing data shards of a group once enough shards arrived
+func (d *FECDecoder) reconstruct(group *fecGroup) [][]byte {
+	missing := 0
+	for i := 0; i < group.count; i++ {
+		if !group.delivered[i] {
+			missing++
+		}
+	}
+	if missing == 0 {
+		group.done = true
+		return nil
+	}
+
+	// shards after count were never sent, they are known to be empty
+	available := group.received + d.config.DataShards - group.count
+	for i := group.count; i < d.config.DataShards; i++ {
+		if group.shards[i] != nil {
+			available--
+		}
+	}
+	if available < d.config.DataShards {
+		return nil
+	}
+
+	size := 0
+	for _, shard := range group.shards[d.config.DataShards:] {
+		if shard != nil {
+			size = len(shard)
+			break
+		}
+	}
+
+	shards := make([][]byte, len(group.shards))
+	for i, shard := range group.shards {
+		switch {
+		case i >= group.count && i < d.config.DataShards:
+			shards[i] = make([]byte, size)
+		case shard != nil:
+			shards[i] = make([]byte, size)
+			copy(shards[i], shard)
+		}
+	}
+
+	if err := d.rs.ReconstructData(shards); err != nil {
+		return nil
+	}
+
+	var payloads [][]byte
+	for i := 0; i < group.count; i++ {
+		if group.delivered[i] {
+			continue
+		}
+		group.delivered[i] = true
+		if payload, ok := fecPayload(shards[i]); ok {
+			payloads = append(payloads, payload)
+			atomic.AddUint64(&d.recovered, 1)
+			atomic.AddUint64(&d.lost, 1)
+		}
+	}
+	group.done = true
+
+	return payloads
+}
+
+// expire drops the old groups and counts their data shards that never arrived, d.mu must be held
+func (d *FECDecoder) expire() {
+	if len(d.groups) < fecMaxGroups {
+		oldest := time.Now().Add(-fecGroupTTL)
+		expired := false
+		for _, group := range d.groups {
+			if group.created.Before(oldest) {
+				expired = true
+				break
+			}
+		}
+		if !expired {
+			return
+		}
+	}
+
+	oldest := time.Now().Add(-fecGroupTTL)
+	for id, group := range d.groups {
+		if len(d.groups) < fecMaxGroups/2 && !group.created.Before(oldest) {
+			continue
+		}
+
+		if !group.done {
+			count := group.count
+			if count == 0 {
+				count = group.highest + 1
+			}
+			for i := 0; i < count; i++ {
+				if !group.delivered[i] {
+					atomic.AddUint64(&d.lost, 1)
+				}
+			}
+		}
+		delete(d.groups, id)
+	}
+}
+
+// TakeStats returns the lost and recovered counters since the previous call
+func (d *FECDecoder) TakeStats() (uint64, uint64) {
+	return atomic.SwapUint64(&d.lost, 0), atomic.SwapUint64(&d.recovered, 0)
+}
+
+// fecPayload extracts the payload of a data shard
+func fecPayload(shard []byte) ([]byte, bool) {
+	if len(shard) < fecLenSize {
+		return nil, false
+	}
+	length := int(binary.BigEndian.Uint16(shard))
+	if length > len(shard)-fecLenSize {
+		return nil, false
+	}
+	return shard[fecLenSize : fecLenSize+length], true
+}
@@ -0,0 +1,217 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseFECOffer(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		msg   string
+		valid bool
+	}{
+		{"offer", FECConfig{DataShards: 10, ParityShards: 3, GroupTimeout: 20 * time.Millisecond}.Offer("secret"), true},
+		{"largest group", FECConfig{DataShards: 250, ParityShards: 5}.Offer("secret"), true},
+		{"long group timeout", FECConfig{DataShards: 10, ParityShards: 3, GroupTimeout: time.Second}.Offer("secret"), true},
+		{"too many shards", FECConfig{DataShards: 250, ParityShards: 6}.Offer("secret"), false},
+		{"no parity", FECConfig{DataShards: 10}.Offer("secret"), false},
+		{"negative timeout", "secret\x1ffec=10,3,-1", false},
+		{"missing value", "secret\x1ffec=10,3", false},
+	} {
+		token, config, err := ParseFECOffer(c.msg)
+		if (err == nil) != c.valid {
+			t.Errorf("%s: parsed with %v, expected valid %v", c.name, err, c.valid)
+			continue
+		}
+		if token != "secret" {
+			t.Errorf("%s: parsed token %q", c.name, token)
+		}
+		if c.valid && config.Offer(token) != c.msg {
+			t.Errorf("%s: parsed as %+v", c.name, *config)
+		}
+	}
+
+	if token, config, err := ParseFECOffer("secret"); token != "secret" || config != nil || err != nil {
+		t.Errorf("token without an offer parsed as %q %v %v", token, config, err)
+	}
+}
+
+// fecLink connects an encoder to a decoder, dropping the packets selected by drop
+type fecLink struct {
+	mu       sync.Mutex
+	decoder  *FECDecoder
+	drop     func(kind byte, index int) bool
+	received []string
+}
+
+func newFECLink(t *testing.T, config FECConfig, drop func(kind byte, index int) bool) (*FECEncoder, *fecLink) {
+	decoder, err := NewFECDecoder(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := &fecLink{decoder: decoder, drop: drop}
+
+	encoder, err := NewFECEncoder(config, link.write)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(encoder.Close)
+	return encoder, link
+}
+
+func (l *fecLink) write(packet []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.drop(packet[0], int(packet[5])) {
+		return nil
+	}
+	payloads, err := l.decoder.Decode(packet)
+	if err != nil {
+		return err
+	}
+	for _, payload := range payloads {
+		l.received = append(l.received, string(payload))
+	}
+	return nil
+}
+
+// payloads returns the received payloads, sorted as the rebuilt ones come after the others
+func (l *fecLink) payloads() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	payloads := append([]string(nil), l.received...)
+	sort.Strings(payloads)
+	return payloads
+}
+
+func dropData(indexes ...int) func(kind byte, index int) bool {
+	return func(kind byte, index int) bool {
+		for _, i := range indexes {
+			if kind == fecData && index == i {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func TestFECRoundTrip(t *testing.T) {
+	config := FECConfig{DataShards: 4, ParityShards: 2}
+	dropParity := func(kind byte, index int) bool { return kind == fecParity || dropData(1)(kind, index) }
+
+	for _, c := range []struct {
+		name      string
+		payloads  int
+		drop      func(kind byte, index int) bool
+		expected  int // payloads received
+		recovered uint64
+	}{
+		{"no loss", 8, dropData(), 8, 0},
+		{"lost shards rebuilt", 8, dropData(1, 3), 8, 4},
+		{"as many losses as parity", 4, dropData(0, 2), 4, 2},
+		{"too many losses", 4, dropData(0, 1, 2), 1, 0},
+		{"lost parity", 4, dropParity, 3, 0},
+	} {
+		encoder, link := newFECLink(t, config, c.drop)
+		for i := 0; i < c.payloads; i++ {
+			// payloads of different lengths, the parity covers the longest
+			if err := encoder.Write([]byte(fmt.Sprintf("payload %d%s", i, make([]byte, i)))); err != nil {
+				t.Fatalf("%s: write: %v", c.name, err)
+			}
+		}
+
+		payloads := link.payloads()
+		if len(payloads) != c.expected {
+			t.Errorf("%s: received %d payloads, expected %d", c.name, len(payloads), c.expected)
+		}
+		for _, payload := range payloads {
+			var i int
+			if _, err := fmt.Sscanf(payload, "payload %d", &i); err != nil || len(payload) != len("payload 0")+i {
+				t.Errorf("%s: received a corrupted payload %q", c.name, payload)
+			}
+		}
+
+		if _, recovered := link.decoder.TakeStats(); recovered != c.recovered {
+			t.Errorf("%s: counted %d recovered payloads, expected %d", c.name, recovered, c.recovered)
+		}
+	}
+}
+
+func TestFECGroupTimeout(t *testing.T) {
+	config := FECConfig{DataShards: 10, ParityShards: 2, GroupTimeout: 10 * time.Millisecond}
+	encoder, link := newFECLink(t, config, dropData(0))
+
+	// the parity of the incomplete group follows the timeout
+	for _, payload := range []string{"a", "b", "c"} {
+		if err := encoder.Write([]byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(10 * config.GroupTimeout)
+
+	if payloads := link.payloads(); len(payloads) != 3 || payloads[0] != "a" {
+		t.Errorf("received %v, expected [a b c]", payloads)
+	}
+	if lost, recovered := link.decoder.TakeStats(); lost != 1 || recovered != 1 {
+		t.Errorf("counted %d lost and %d recovered payloads, expected 1 and 1", lost, recovered)
+	}
+}
+
+func TestFECExpiry(t *testing.T) {
+	config := FECConfig{DataShards: 4, ParityShards: 1}
+	encoder, link := newFECLink(t, config, dropData(0, 1))
+
+	// a group that cannot be rebuilt is counted as lost once it expires
+	for i := 0; i < config.DataShards; i++ {
+		encoder.Write([]byte("lost group"))
+	}
+	if lost, recovered := link.decoder.TakeStats(); lost != 0 || recovered != 0 {
+		t.Errorf("counted %d lost and %d recovered payloads before the expiry", lost, recovered)
+	}
+
+	link.mu.Lock()
+	for _, group := range link.decoder.groups {
+		group.created = time.Now().Add(-fecGroupTTL - time.Second)
+	}
+	link.mu.Unlock()
+
+	// the next packet expires the old group
+	link.drop = dropData()
+	encoder.Write([]byte("next group"))
+
+	if lost, recovered := link.decoder.TakeStats(); lost != 2 || recovered != 0 {
+		t.Errorf("counted %d lost and %d recovered payloads, expected 2 and 0", lost, recovered)
+	}
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	if len(link.decoder.groups) != 1 {
+		t.Errorf("decoder keeps %d groups, expected 1", len(link.decoder.groups))
+	}
+}
+
+func TestFECDecodeInvalid(t *testing.T) {
+	decoder, err := NewFECDecoder(FECConfig{DataShards: 4, ParityShards: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name   string
+		packet []byte
+	}{
+		{"short", []byte{fecData, 0, 0}},
+		{"unknown kind", []byte{0x01, 0, 0, 0, 0, 0, 0}},
+		{"index out of range", []byte{fecParity, 0, 0, 0, 0, 6, 4}},
+		{"parity index for data", []byte{fecData, 0, 0, 0, 0, 4, 0}},
+	} {
+		if _, err := decoder.Decode(c.packet); err == nil {
+			t.Errorf("%s: packet decoded", c.name)
+		}
+	}
+}
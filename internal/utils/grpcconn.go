@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// grpcDrainTimeout is how long a stream closed on both sides waits for the server to end it
+const grpcDrainTimeout = 10 * time.Second
+
+// GrpcCodec sends the tunnel data as raw bytes, there are no protobuf definitions behind the streams.
+// It keeps the name of the protobuf codec, so the requests look like those of any other gRPC service.
+type GrpcCodec struct{}
+
+func (GrpcCodec) Marshal(v any) ([]byte, error) {
+	data, ok := v.(*[]byte)
+	if !ok {
+		return nil, fmt.Errorf("unsupported message type: %T", v)
+	}
+	return *data, nil
+}
+
+func (GrpcCodec) Unmarshal(data []byte, v any) error {
+	msg, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("unsupported message type: %T", v)
+	}
+	// the buffer belongs to grpc once Unmarshal returns
+	*msg = append((*msg)[:0], data...)
+	return nil
+}
+
+func (GrpcCodec) Name() string {
+	return "proto"
+}
+
+// grpcStream is the part shared by the client and the server streams
+type grpcStream interface {
+	SendMsg(m any) error
+	RecvMsg(m any) error
+}
+
+// GrpcConn is a bidirectional gRPC stream used as a net.Conn, every write is sent as one message.
+// Deadlines are ignored, the connections are kept alive by the gRPC keepalive pings. The client closes
+// its side of the stream at the end of its data, the server can not close its side without ending the
+// stream and sends an empty message instead.
+type GrpcConn struct {
+	stream  grpcStream
+	onClose func() // releases the stream
+	local   net.Addr
+	remote  net.Addr
+	pending []byte      // rest of the last received message
+	eof     atomic.Bool // the peer closed its writes
+	ended   atomic.Bool // the writes were closed
+	mu      sync.Mutex
+	closed  atomic.Bool
+	once    sync.Once
+	done    chan struct{}
+}
+
+func NewGrpcConn(stream grpcStream, onClose func(), local net.Addr, remote net.Addr) *GrpcConn {
+	return &GrpcConn{
+		stream:  stream,
+		onClose: onClose,
+		local:   local,
+		remote:  remote,
+		done:    make(chan struct{}),
+	}
+}
+
+func (c *GrpcConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.closed.Load() {
+			return 0, net.ErrClosed
+		}
+		if c.eof.Load() {
+			return 0, io.EOF
+		}
+
+		var msg []byte
+		if err := c.stream.RecvMsg(&msg); err != nil {
+			return 0, err
+		}
+		if len(msg) == 0 {
+			c.eof.Store(true)
+			return 0, io.EOF
+		}
+		c.pending = msg
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *GrpcConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	if len(b) == 0 {
+		return 0, nil // an empty message is the end of the data
+	}
+
+	// grpc may still use the message after SendMsg returns
+	msg := append([]byte(nil), b...)
+	if err := c.stream.SendMsg(&msg); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// CloseWrite sends the end of the data, the stream can still be read until the peer closes its writes
+func (c *GrpcConn) CloseWrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed.Load() {
+		return net.ErrClosed
+	}
+
+	c.ended.Store(true)
+
+	// the server keeps sending the data queued on a stream closed by the client once it returns
+	if cs, ok := c.stream.(interface{ CloseSend() error }); ok {
+		return cs.CloseSend()
+	}
+
+	msg := []byte{}
+	return c.stream.SendMsg(&msg)
+}
+
+func (c *GrpcConn) Close() error {
+	c.once.Do(func() {
+		c.closed.Store(true)
+		if c.onClose != nil {
+			if c.eof.Load() && c.ended.Load() {
+				// both sides are done, releasing the stream now would reset it before the peer read the end
+				// of the data, it is released once the server ended it
+				go c.drain()
+			} else {
+				c.onClose()
+			}
+		}
+
+		// wait for a write in progress before releasing the stream
+		c.mu.Lock()
+		close(c.done)
+		c.mu.Unlock()
+	})
+	return nil
+}
+
+// drain waits for the end of a stream closed on both sides, for grpcDrainTimeout at most, and releases it
+func (c *GrpcConn) drain() {
+	var release sync.Once
+	timer := time.AfterFunc(grpcDrainTimeout, func() { release.Do(c.onClose) })
+
+	var msg []byte
+	for c.stream.RecvMsg(&msg) == nil {
+	}
+
+	timer.Stop()
+	release.Do(c.onClose)
+}
+
+// Done is closed once the connection is closed
+func (c *GrpcConn) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *GrpcConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *GrpcConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *GrpcConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *GrpcConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *GrpcConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
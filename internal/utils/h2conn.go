@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// H2Conn is an HTTP/2 stream used as a net.Conn, the request body carries the data of the client
+// and the response body the data of the server. Deadlines are not supported by the streams and
+// are ignored, the connections are kept alive by the HTTP/2 pings of the underlying connection.
+// The split HTTP transport uses it as well, with the download and the uploads of a session.
+// It can be half-closed when its writer implements CloseWriter.
+type H2Conn struct {
+	reader  io.ReadCloser
+	writer  io.Writer
+	flush   func() // pushes written data to the peer, nil when writes are not buffered
+	onClose func() // releases the stream
+	local   net.Addr
+	remote  net.Addr
+	mu      sync.Mutex // serializes writes with close
+	closed  atomic.Bool
+	once    sync.Once
+	done    chan struct{}
+}
+
+func NewH2Conn(reader io.ReadCloser, writer io.Writer, flush func(), onClose func(), local net.Addr, remote net.Addr) *H2Conn {
+	return &H2Conn{
+		reader:  reader,
+		writer:  writer,
+		flush:   flush,
+		onClose: onClose,
+		local:   local,
+		remote:  remote,
+		done:    make(chan struct{}),
+	}
+}
+
+func (c *H2Conn) Read(b []byte) (int, error) {
+	if c.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	return c.reader.Read(b)
+}
+
+func (c *H2Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// the response writer of the server must not be used once the stream is released
+	if c.closed.Load() {
+		return 0, net.ErrClosed
+	}
+
+	n, err := c.writer.Write(b)
+	if err != nil {
+		return n, err
+	}
+	if c.flush != nil {
+		c.flush()
+	}
+	return n, nil
+}
+
+// CloseWrite ends the data sent on the stream, which can still be read. It fails when the writer can not
+// be closed on its own, like the response of the server which only ends with the stream.
+func (c *H2Conn) CloseWrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed.Load() {
+		return net.ErrClosed
+	}
+	cw, ok := c.writer.(CloseWriter)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return cw.CloseWrite()
+}
+
+func (c *H2Conn) Close() error {
+	c.once.Do(func() {
+		c.closed.Store(true)
+		c.reader.Close()
+		if c.onClose != nil {
+			c.onClose()
+		}
+
+		// wait for a write in progress before releasing the stream
+		c.mu.Lock()
+		close(c.done)
+		c.mu.Unlock()
+	})
+	return nil
+}
+
+// Done is closed once the connection is closed
+func (c *H2Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *H2Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *H2Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *H2Conn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *H2Conn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *H2Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
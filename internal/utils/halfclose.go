@@ -0,0 +1,202 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CloseWriter is implemented by the connections that can be half-closed, like *net.TCPConn and *tls.Conn
+type CloseWriter interface {
+	CloseWrite() error
+}
+
+// closeWriteOf returns the CloseWrite method of a connection, nil when it can not be half-closed
+func closeWriteOf(conn any) func() error {
+	if cw, ok := conn.(CloseWriter); ok {
+		return cw.CloseWrite
+	}
+	return nil
+}
+
+// halfCloser closes the two sides of a proxied connection. When a direction reaches the end of its data,
+// only the writes of its destination are closed and the other direction goes on, so that protocols relying
+// on TCP half-close keep working. Both sides are closed once the other direction is done as well, or
+// linger after the first one. A direction that failed closes both sides right away, as does the end of a
+// direction whose destination can not be half-closed, or any direction when linger is not positive.
+type halfCloser struct {
+	close  func()
+	linger time.Duration
+	mu     sync.Mutex
+	ended  int // directions that reached the end of their data
+	timer  *time.Timer
+	once   sync.Once
+}
+
+func newHalfCloser(linger time.Duration, close func()) *halfCloser {
+	return &halfCloser{
+		close:  close,
+		linger: linger,
+	}
+}
+
+// closeWrite is called by a direction once its source reached the end of its data, closeWrite ends the
+// writes of its destination and is nil when the destination can not be half-closed
+func (h *halfCloser) closeWrite(closeWrite func() error) {
+	if h.linger <= 0 || closeWrite == nil {
+		h.closeAll()
+		return
+	}
+
+	if err := closeWrite(); err != nil {
+		h.closeAll()
+		return
+	}
+
+	h.mu.Lock()
+	h.ended++
+	last := h.ended == 2
+	if !last {
+		h.timer = time.AfterFunc(h.linger, h.closeAll)
+	}
+	h.mu.Unlock()
+
+	if last {
+		h.closeAll()
+	}
+}
+
+// closeAll closes both sides of the connection
+func (h *halfCloser) closeAll() {
+	h.once.Do(func() {
+		h.mu.Lock()
+		if h.timer != nil {
+			h.timer.Stop()
+		}
+		h.mu.Unlock()
+
+		h.close()
+	})
+}
+
+// The half-close framing of the tcpmux and kcp streams is negotiated without changing the handshake that
+// older ends check: a server framing its streams answers the token with SG_Framed instead of SG_Chan,
+// which older clients ignore, and a client framing its streams confirms it with SG_Framed on the control
+// channel. The server then marks the target of every stream it frames, so that the streams opened before the
+// confirmation arrived are told apart.
+const halfCloseMark = "\x1fhalfclose"
+
+// HalfCloseProtocol is the websocket subprotocol of the wsmux control channels that frame their mux streams.
+// Older ends ignore it and the streams are then left unframed.
+const HalfCloseProtocol = "backhaul-halfclose"
+
+// HalfCloseMark returns the target of a stream, followed by the mark of the framing when it is framed
+func HalfCloseMark(target string, framed bool) string {
+	if !framed {
+		return target
+	}
+	return target + halfCloseMark
+}
+
+// ParseHalfCloseMark splits the target of a stream from the mark of the framing
+func ParseHalfCloseMark(msg string) (target string, framed bool) {
+	return strings.CutSuffix(msg, halfCloseMark)
+}
+
+// MuxStreamConn returns the connection of a mux stream and the linger of its handler. The stream is framed
+// when the half-close was negotiated on its tunnel, otherwise it is returned as is and closed at once.
+func MuxStreamConn(stream net.Conn, halfClose bool, linger time.Duration) (net.Conn, time.Duration) {
+	if !halfClose || linger <= 0 {
+		return stream, 0
+	}
+	return NewMuxStream(stream), linger
+}
+
+// muxFrameSize is the largest data frame of a MuxStream, its length must fit in 2 bytes
+const muxFrameSize = 65535
+
+// MuxStream wraps a smux stream so that it can be half-closed. smux closes both directions of a stream at
+// once and drops the data sent to a closed stream, the end of the data is signaled in band instead: every
+// write is framed with a 2 bytes length and an empty frame marks the end of the writes. Both ends of a
+// stream have to wrap it, once the target address was exchanged, so the framing is negotiated by the
+// handshake of the control channel.
+type MuxStream struct {
+	net.Conn
+	header    [2]byte
+	remaining int  // bytes left in the frame being read
+	eof       bool // the peer closed its writes
+	mu        sync.Mutex
+}
+
+func NewMuxStream(stream net.Conn) *MuxStream {
+	return &MuxStream{Conn: stream}
+}
+
+func (s *MuxStream) Read(b []byte) (int, error) {
+	if s.remaining == 0 {
+		if s.eof {
+			return 0, io.EOF
+		}
+
+		if _, err := io.ReadFull(s.Conn, s.header[:]); err != nil {
+			// the stream was closed without the end of the data, the peer did not finish its writes
+			if errors.Is(err, io.EOF) {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+
+		s.remaining = int(binary.BigEndian.Uint16(s.header[:]))
+		if s.remaining == 0 {
+			s.eof = true
+			return 0, io.EOF
+		}
+	}
+
+	if len(b) > s.remaining {
+		b = b[:s.remaining]
+	}
+	n, err := s.Conn.Read(b)
+	s.remaining -= n
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (s *MuxStream) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), muxFrameSize)]
+
+		// the frame is written at once, smux sends every write in its own frames
+		frame := GetBuffer(2 + len(chunk))
+		binary.BigEndian.PutUint16(frame, uint16(len(chunk)))
+		copy(frame[2:], chunk)
+		_, err := s.Conn.Write(frame)
+		PutBuffer(frame)
+		if err != nil {
+			return written, err
+		}
+
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+// CloseWrite sends the end of the data, the stream can still be read until the peer closes its writes
+func (s *MuxStream) CloseWrite() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.Conn.Write([]byte{0, 0})
+	return err
+}
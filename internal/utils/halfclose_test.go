@@ -0,0 +1,158 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHalfCloseMark(t *testing.T) {
+	for _, c := range []struct {
+		target string
+		framed bool
+	}{
+		{"127.0.0.1:8080", true}, {"127.0.0.1:8080", false}, {"web#203.0.113.7:5000", true},
+	} {
+		target, framed := ParseHalfCloseMark(HalfCloseMark(c.target, c.framed))
+		if target != c.target || framed != c.framed {
+			t.Errorf("mark of %q %v parsed as %q %v", c.target, c.framed, target, framed)
+		}
+	}
+
+	// the targets sent by older servers are not framed
+	if target, framed := ParseHalfCloseMark("8080"); target != "8080" || framed {
+		t.Errorf("unmarked target parsed as %q %v", target, framed)
+	}
+}
+
+func TestMuxStreamConn(t *testing.T) {
+	stream, _ := net.Pipe()
+	defer stream.Close()
+
+	for _, c := range []struct {
+		halfClose bool
+		linger    time.Duration
+		framed    bool
+		expected  time.Duration
+	}{
+		{true, time.Second, true, time.Second},
+		{false, time.Second, false, 0},
+		{true, 0, false, 0},
+		{true, -time.Second, false, 0},
+	} {
+		conn, linger := MuxStreamConn(stream, c.halfClose, c.linger)
+		_, framed := conn.(*MuxStream)
+		if framed != c.framed || linger != c.expected {
+			t.Errorf("MuxStreamConn(%v, %v) returned framed %v linger %v, expected %v %v", c.halfClose, c.linger, framed, linger, c.framed, c.expected)
+		}
+	}
+}
+
+func TestMuxStreamCloseWrite(t *testing.T) {
+	left, right := net.Pipe()
+	defer left.Close()
+	defer right.Close()
+	a, b := NewMuxStream(left), NewMuxStream(right)
+
+	// larger than a frame, so that it is split
+	payload := bytes.Repeat([]byte("backhaul"), muxFrameSize/4)
+
+	go func() {
+		if _, err := a.Write(payload); err != nil {
+			t.Errorf("write: %v", err)
+		}
+		if err := a.CloseWrite(); err != nil {
+			t.Errorf("close write: %v", err)
+		}
+	}()
+
+	received, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatalf("read until the end of the data: %v", err)
+	}
+	if !bytes.Equal(received, payload) {
+		t.Fatalf("received %d bytes, expected %d", len(received), len(payload))
+	}
+	if n, err := b.Read(make([]byte, 16)); n != 0 || err != io.EOF {
+		t.Errorf("read after the end of the data returned %d %v, expected io.EOF", n, err)
+	}
+
+	// the other direction still works after the half-close
+	go func() {
+		b.Write([]byte("answer"))
+		b.CloseWrite()
+	}()
+
+	answer, err := io.ReadAll(a)
+	if err != nil || string(answer) != "answer" {
+		t.Errorf("answer after the half-close: %q %v", answer, err)
+	}
+}
+
+func TestMuxStreamUnexpectedEOF(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		data []byte
+	}{
+		{"between frames", []byte{0, 3, 'a', 'b', 'c'}},
+		{"inside a frame", []byte{0, 5, 'a', 'b'}},
+	} {
+		left, right := net.Pipe()
+		go func() {
+			left.Write(c.data)
+			left.Close()
+		}()
+
+		_, err := io.ReadAll(NewMuxStream(right))
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("%s: stream closed without the end of the data returned %v, expected io.ErrUnexpectedEOF", c.name, err)
+		}
+		right.Close()
+	}
+}
+
+func TestHalfCloser(t *testing.T) {
+	const linger = 50 * time.Millisecond
+	closeWrite := func() error { return nil }
+	failure := func() error { return errors.New("failed") }
+
+	for _, c := range []struct {
+		name    string
+		linger  time.Duration
+		ends    []func() error // closeWrite of the directions that ended
+		closed  bool           // both sides closed right after the ends
+		lingers bool           // both sides closed after linger
+	}{
+		{"one end", linger, []func() error{closeWrite}, false, true},
+		{"both ends", linger, []func() error{closeWrite, closeWrite}, true, false},
+		{"disabled", 0, []func() error{closeWrite}, true, false},
+		{"negative linger", -linger, []func() error{closeWrite}, true, false},
+		{"no half-close", linger, []func() error{nil}, true, false},
+		{"failed half-close", linger, []func() error{failure}, true, false},
+	} {
+		var closes atomic.Int32
+		closer := newHalfCloser(c.linger, func() { closes.Add(1) })
+		for _, end := range c.ends {
+			closer.closeWrite(end)
+		}
+
+		if closed := closes.Load() == 1; closed != c.closed {
+			t.Errorf("%s: closed %v right after the ends, expected %v", c.name, closed, c.closed)
+		}
+
+		time.Sleep(2 * linger)
+		if closed := closes.Load() == 1; closed != (c.closed || c.lingers) {
+			t.Errorf("%s: closed %v after the linger, expected %v", c.name, closed, c.closed || c.lingers)
+		}
+
+		// a failed direction closes both sides only once
+		closer.closeAll()
+		if n := closes.Load(); n != 1 {
+			t.Errorf("%s: closed %d times", c.name, n)
+		}
+	}
+}
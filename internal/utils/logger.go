@@ -8,7 +8,9 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-type CustomFormatter struct{}
+type CustomFormatter struct {
+	Prefix string // tunnel name, empty for single tunnel setups
+}
 
 func (f *CustomFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 	timestamp := entry.Time.Format("02-Jan 15:04:05")
@@ -17,6 +19,9 @@ func (f *CustomFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 	coloredLevel := f.colorize(entry.Level, level)
 
 	logMessage := fmt.Sprintf("%s [%s] %s\n", timestamp, coloredLevel, entry.Message)
+	if f.Prefix != "" {
+		logMessage = fmt.Sprintf("%s [%s] [%s] %s\n", timestamp, coloredLevel, f.Prefix, entry.Message)
+	}
 
 	return []byte(logMessage), nil
 }
@@ -58,3 +63,12 @@ func NewLogger(logLevel string) *logrus.Logger {
 
 	return log
 }
+
+// NewTunnelLogger creates a logger that tags every line with the tunnel name
+func NewTunnelLogger(logLevel string, name string) *logrus.Logger {
+	log := NewLogger(logLevel)
+
+	log.SetFormatter(&CustomFormatter{Prefix: name})
+
+	return log
+}
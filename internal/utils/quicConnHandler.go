@@ -4,41 +4,43 @@ import (
 	"errors"
 	"io"
 	"net"
+	"time"
 
 	"github.com/musix/backhaul/internal/web"
 	"github.com/quic-go/quic-go"
 	"github.com/sirupsen/logrus"
 )
 
-func QConnectionHandler(from net.Conn, to quic.Stream, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
+// The end of the data of the TCP connection closes the send direction of the stream, which the peer reads
+// as the end of the data, and the end of the stream half-closes the TCP connection.
+func QConnectionHandler(from net.Conn, to quic.Stream, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool, linger time.Duration) {
+	closer := newHalfCloser(linger, func() {
+		from.Close()
+		to.CancelRead(0)
+		to.Close()
+	})
+
 	done := make(chan struct{})
 
 	go func() {
 		defer close(done)
-		q1transferData(from, to, from, to, logger, usage, remotePort, sniffer)
+		// Close of a stream only closes its send direction
+		q1transferData(from, to, to.Close, closer, logger, usage, remotePort, sniffer)
 	}()
 
-	q1transferData(to, from, from, to, logger, usage, remotePort, sniffer)
+	q1transferData(to, from, closeWriteOf(from), closer, logger, usage, remotePort, sniffer)
 
 	<-done
 }
 
-// Using direct Read and Write for transferring data
-func q1transferData(from io.ReadWriter, to io.ReadWriter, tcp net.Conn, quic quic.Stream, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
-	buf := make([]byte, 16*1024) // 16K
+// Using direct Read and Write for transferring data, closeWrite ends the writes of the destination
+func q1transferData(from io.Reader, to io.Writer, closeWrite func() error, closer *halfCloser, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
+	buf := GetBuffer(CopyBufferSize) // 16K
+	defer PutBuffer(buf)
+
 	for {
 		// Read data from the source connection
-		r, err := from.Read(buf)
-		if err != nil {
-			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
-				logger.Trace("reader stream closed or EOF received")
-			} else {
-				logger.Trace("unable to read from the connection: ", err)
-			}
-			tcp.Close()
-			quic.Close()
-			return
-		}
+		r, readErr := from.Read(buf)
 
 		totalWritten := 0
 		for totalWritten < r {
@@ -50,8 +52,7 @@ func q1transferData(from io.ReadWriter, to io.ReadWriter, tcp net.Conn, quic qui
 				} else {
 					logger.Trace("unable to write to the connection: ", err)
 				}
-				tcp.Close()
-				quic.Close()
+				closer.closeAll()
 				return
 			}
 			totalWritten += w
@@ -61,6 +62,23 @@ func q1transferData(from io.ReadWriter, to io.ReadWriter, tcp net.Conn, quic qui
 		if sniffer {
 			usage.AddOrUpdatePort(remotePort, uint64(totalWritten))
 		}
+
+		// the data read along with an error is written first, a stream may return it with EOF
+		if readErr != nil {
+			if errors.Is(readErr, io.EOF) {
+				// the source is done, the other direction goes on until it is done as well
+				logger.Trace("EOF received, closing the writes of the destination")
+				closer.closeWrite(closeWrite)
+				return
+			}
+			if errors.Is(readErr, net.ErrClosed) {
+				logger.Trace("reader stream closed")
+			} else {
+				logger.Trace("unable to read from the connection: ", readErr)
+			}
+			closer.closeAll()
+			return
+		}
 	}
 
 }
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/quic-go/quic-go"
+)
+
+// UDP mappings over QUIC are carried as flows. The server opens a stream on the control connection for
+// every UDP client, writes the flow id and the target address on it, and the packets of the flow are then
+// sent as DATAGRAM frames (RFC 9221) prefixed by the flow id. When datagrams were not negotiated, or a
+// packet does not fit in a datagram, it is sent on the flow stream with a 2-byte length header instead.
+// The client answers a new flow with an empty frame once it is ready for its datagrams, the packets
+// sent before are kept on the stream so they are not dropped. Closing the stream ends the flow.
+
+const flowIDSize = 4
+
+// SendFlowID writes the id of a new flow at the start of its stream
+func SendFlowID(stream quic.Stream, id uint32) error {
+	buf := make([]byte, flowIDSize)
+	binary.BigEndian.PutUint32(buf, id)
+	if _, err := stream.Write(buf); err != nil {
+		return fmt.Errorf("failed to send flow id: %w", err)
+	}
+	return nil
+}
+
+// ReceiveFlowID reads the id of a flow from its stream
+func ReceiveFlowID(stream quic.Stream) (uint32, error) {
+	buf := make([]byte, flowIDSize)
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		return 0, fmt.Errorf("failed to read flow id: %w", err)
+	}
+	return binary.BigEndian.Uint32(buf), nil
+}
+
+// SendFlowReady tells the server that the flow is registered and its datagrams can be sent
+func SendFlowReady(stream quic.Stream) error {
+	if _, err := stream.Write([]byte{0, 0}); err != nil {
+		return fmt.Errorf("failed to send flow ready: %w", err)
+	}
+	return nil
+}
+
+// SendFlowPacket sends a UDP packet of a flow, as a datagram when datagram is set and they are supported by
+// the peer, on the flow stream otherwise. buf is a scratch buffer of at least len(data)+4 bytes, reused
+// between calls.
+func SendFlowPacket(conn quic.Connection, stream quic.Stream, id uint32, data []byte, buf []byte, datagram bool) error {
+	if len(data) > 65535 { // 2 bytes can only store values up to 65535 ~ 64KB
+		return fmt.Errorf("packet too large to send, size: %d bytes", len(data))
+	}
+
+	if datagram && conn.ConnectionState().SupportsDatagrams {
+		binary.BigEndian.PutUint32(buf, id)
+		n := copy(buf[flowIDSize:], data)
+
+		// the payload is copied by quic-go, buf can be reused right away
+		err := conn.SendDatagram(buf[:flowIDSize+n])
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, &quic.DatagramTooLargeError{}) {
+			return err
+		}
+		// the packet exceeds the datagram size of the path, it goes reliably on the stream
+	}
+
+	binary.BigEndian.PutUint16(buf, uint16(len(data)))
+	n := copy(buf[2:], data)
+	if _, err := stream.Write(buf[:2+n]); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReceiveFlowFrame reads a packet sent on a flow stream into buf and returns its size
+func ReceiveFlowFrame(stream quic.Stream, buf []byte) (int, error) {
+	if _, err := io.ReadFull(stream, buf[:2]); err != nil {
+		return 0, err
+	}
+
+	packetSize := int(binary.BigEndian.Uint16(buf[:2]))
+	if packetSize > len(buf) {
+		return 0, fmt.Errorf("packet size %d exceeds buffer size %d", packetSize, len(buf))
+	}
+
+	if _, err := io.ReadFull(stream, buf[:packetSize]); err != nil {
+		return 0, err
+	}
+	return packetSize, nil
+}
+
+// ParseFlowDatagram splits a received datagram into its flow id and the UDP packet
+func ParseFlowDatagram(datagram []byte) (uint32, []byte, error) {
+	if len(datagram) < flowIDSize {
+		return 0, nil, fmt.Errorf("datagram too short: %d bytes", len(datagram))
+	}
+	return binary.BigEndian.Uint32(datagram), datagram[flowIDSize:], nil
+}
@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// newTestQuicPair returns both ends of a QUIC connection, each end enables datagrams as given
+func newTestQuicPair(t *testing.T, serverDatagrams bool, clientDatagrams bool) (quic.Connection, quic.Connection) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{"test"},
+	}, &quic.Config{EnableDatagrams: serverDatagrams})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := quic.DialAddr(ctx, listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"test"}}, &quic.Config{EnableDatagrams: clientDatagrams})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.CloseWithError(0, "") })
+
+	server, err := listener.Accept(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.CloseWithError(0, "") })
+	return server, client
+}
+
+// openTestFlow opens a flow from the server and accepts it on the client
+func openTestFlow(t *testing.T, server quic.Connection, client quic.Connection, id uint32) (quic.Stream, quic.Stream) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	serverStream, err := server.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SendFlowID(serverStream, id); err != nil {
+		t.Fatal(err)
+	}
+
+	clientStream, err := client.AcceptStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received, err := ReceiveFlowID(clientStream); err != nil || received != id {
+		t.Fatalf("flow id %d %v, expected %d", received, err, id)
+	}
+	return serverStream, clientStream
+}
+
+func TestFlowReady(t *testing.T) {
+	server, client := newTestQuicPair(t, true, true)
+	serverStream, clientStream := openTestFlow(t, server, client, 7)
+
+	// the ready signal is an empty frame, the packets sent on the stream follow it
+	if err := SendFlowReady(clientStream); err != nil {
+		t.Fatal(err)
+	}
+	if err := SendFlowPacket(client, clientStream, 7, []byte("packet"), make([]byte, 64), false); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 64)
+	serverStream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := ReceiveFlowFrame(serverStream, buf); err != nil || n != 0 {
+		t.Fatalf("ready frame of %d bytes %v, expected an empty frame", n, err)
+	}
+	if n, err := ReceiveFlowFrame(serverStream, buf); err != nil || string(buf[:n]) != "packet" {
+		t.Errorf("frame %q %v, expected packet", buf[:n], err)
+	}
+}
+
+func TestFlowPacket(t *testing.T) {
+	for _, c := range []struct {
+		name            string
+		clientDatagrams bool
+		ready           bool
+		size            int
+		datagram        bool
+	}{
+		{"datagram", true, true, 1000, true},
+		{"flow not ready", true, false, 1000, false},
+		{"peer without datagrams", false, true, 1000, false},
+		{"larger than a datagram", true, true, 4000, false},
+	} {
+		server, client := newTestQuicPair(t, true, c.clientDatagrams)
+		serverStream, clientStream := openTestFlow(t, server, client, 42)
+
+		packet := make([]byte, c.size)
+		rand.Read(packet)
+		if err := SendFlowPacket(server, serverStream, 42, packet, make([]byte, c.size+4), c.ready); err != nil {
+			t.Errorf("%s: send: %v", c.name, err)
+			continue
+		}
+
+		if c.datagram {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			datagram, err := client.ReceiveDatagram(ctx)
+			cancel()
+			if err != nil {
+				t.Errorf("%s: datagram not received: %v", c.name, err)
+				continue
+			}
+			id, data, err := ParseFlowDatagram(datagram)
+			if err != nil || id != 42 || !bytes.Equal(data, packet) {
+				t.Errorf("%s: datagram of flow %d with %d bytes %v, expected flow 42 with the %d sent", c.name, id, len(data), err, len(packet))
+			}
+			continue
+		}
+
+		buf := make([]byte, 16*1024)
+		clientStream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := ReceiveFlowFrame(clientStream, buf)
+		if err != nil || !bytes.Equal(buf[:n], packet) {
+			t.Errorf("%s: frame of %d bytes %v, expected the %d sent", c.name, n, err, len(packet))
+		}
+	}
+}
+
+func TestParseFlowDatagram(t *testing.T) {
+	if _, _, err := ParseFlowDatagram([]byte{0, 0, 1}); err == nil {
+		t.Error("datagram shorter than the flow id accepted")
+	}
+	if id, data, err := ParseFlowDatagram([]byte{0, 0, 1, 2, 'u', 'd', 'p'}); err != nil || id != 258 || string(data) != "udp" {
+		t.Errorf("parsed flow %d %q %v, expected flow 258 udp", id, data, err)
+	}
+}
@@ -8,4 +8,6 @@ const (
 	SG_TCP                // TCP Transport ID
 	SG_UDP                // TCP Transport ID
 	SG_RTT                // For RTT measurment
+	SG_Path               // for additional multipath tunnel connections
+	SG_Framed             // half-close framing of the mux streams, advertised by the server and confirmed by the client
 )
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// fastOpenQueue is the length of the TCP_FASTOPEN queue of the listeners
+const fastOpenQueue = 256
+
+// SocketOptions are the TCP options of a tunnel, they are set on its tunnel and local sockets. The zero
+// values keep the system defaults, and nil options leave the sockets untouched.
+type SocketOptions struct {
+	Congestion   string        // TCP_CONGESTION, the congestion control algorithm like bbr or cubic
+	NotSentLowat int           // TCP_NOTSENT_LOWAT, unsent bytes queued in the socket before it stops being writable
+	UserTimeout  time.Duration // TCP_USER_TIMEOUT, how long sent data may stay unacknowledged before the connection is dropped
+	FastOpen     bool          // TCP_FASTOPEN, accept data in the SYN of the clients, listeners only
+	DSCP         int           // DSCP marking of the packets, in IP_TOS or IPV6_TCLASS
+}
+
+// Validate checks the values of the options
+func (o *SocketOptions) Validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.DSCP < 0 || o.DSCP > 63 {
+		return fmt.Errorf("invalid dscp %d, it must be between 0 and 63", o.DSCP)
+	}
+	if o.NotSentLowat < 0 {
+		return fmt.Errorf("invalid tcp_notsent_lowat %d", o.NotSentLowat)
+	}
+	if o.UserTimeout < 0 {
+		return fmt.Errorf("invalid tcp_user_timeout %v", o.UserTimeout)
+	}
+	return nil
+}
+
+// ControlDial sets the options on a dialed socket, it can be used as the Control of a net.Dialer
+func (o *SocketOptions) ControlDial(network, address string, s syscall.RawConn) error {
+	return o.control(network, s, false)
+}
+
+// ControlListen sets the options on a listening socket, the accepted connections inherit them. It can
+// be used as the Control of a net.ListenConfig.
+func (o *SocketOptions) ControlListen(network, address string, s syscall.RawConn) error {
+	return o.control(network, s, true)
+}
+
+// control sets the options of a tcp socket, the other networks are left untouched
+func (o *SocketOptions) control(network string, s syscall.RawConn, listener bool) error {
+	if o == nil || *o == (SocketOptions{}) || !strings.HasPrefix(network, "tcp") {
+		return nil
+	}
+
+	var controlErr error
+	err := s.Control(func(fd uintptr) {
+		controlErr = setSocketOptions(int(fd), network, o, listener)
+	})
+	if err != nil {
+		return err
+	}
+
+	return controlErr
+}
@@ -0,0 +1,55 @@
+//go:build linux
+
+package utils
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// setSocketOptions sets the options on a tcp socket, network tells an ipv4 socket from an ipv6 one
+func setSocketOptions(fd int, network string, o *SocketOptions, listener bool) error {
+	if o.Congestion != "" {
+		// the algorithm must be listed in net.ipv4.tcp_allowed_congestion_control, or loaded with CAP_NET_ADMIN
+		if err := unix.SetsockoptString(fd, unix.IPPROTO_TCP, unix.TCP_CONGESTION, o.Congestion); err != nil {
+			return fmt.Errorf("failed to set TCP_CONGESTION %s: %v", o.Congestion, err)
+		}
+	}
+
+	if o.NotSentLowat > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_NOTSENT_LOWAT, o.NotSentLowat); err != nil {
+			return fmt.Errorf("failed to set TCP_NOTSENT_LOWAT: %v", err)
+		}
+	}
+
+	if o.UserTimeout > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(o.UserTimeout.Milliseconds())); err != nil {
+			return fmt.Errorf("failed to set TCP_USER_TIMEOUT: %v", err)
+		}
+	}
+
+	if o.FastOpen && listener {
+		// only the listeners enable fast open: TCP_FASTOPEN_CONNECT delays the handshake of a dialed socket
+		// until its first write, and the pooled tunnel connections wait for the server to speak first
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_FASTOPEN, fastOpenQueue); err != nil {
+			return fmt.Errorf("failed to set TCP_FASTOPEN: %v", err)
+		}
+	}
+
+	if o.DSCP > 0 {
+		// the DSCP is the upper 6 bits of the TOS byte, the lower 2 are left to ECN
+		tos := o.DSCP << 2
+		if network == "tcp6" {
+			if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos); err != nil {
+				return fmt.Errorf("failed to set IPV6_TCLASS: %v", err)
+			}
+			// a dual stack socket may carry ipv4 connections as well
+			_ = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS, tos)
+		} else if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS, tos); err != nil {
+			return fmt.Errorf("failed to set IP_TOS: %v", err)
+		}
+	}
+
+	return nil
+}
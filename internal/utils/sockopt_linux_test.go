@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// socketOption reads an option of a connection or a listener
+func socketOption(t *testing.T, conn syscall.Conn, level, name int) int {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var value int
+	var optErr error
+	if err := raw.Control(func(fd uintptr) {
+		value, optErr = unix.GetsockoptInt(int(fd), level, name)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if optErr != nil {
+		t.Fatalf("getsockopt %d: %v", name, optErr)
+	}
+	return value
+}
+
+func congestion(t *testing.T, conn syscall.Conn) string {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var value string
+	var optErr error
+	if err := raw.Control(func(fd uintptr) {
+		value, optErr = unix.GetsockoptString(int(fd), unix.IPPROTO_TCP, unix.TCP_CONGESTION)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if optErr != nil {
+		t.Fatalf("getsockopt TCP_CONGESTION: %v", optErr)
+	}
+	return value
+}
+
+func TestSocketOptions(t *testing.T) {
+	// reno is always allowed without CAP_NET_ADMIN
+	opts := &SocketOptions{Congestion: "reno", NotSentLowat: 16384, UserTimeout: 5 * time.Second, FastOpen: true, DSCP: 46}
+
+	for _, c := range []struct {
+		network  string
+		addr     string
+		tosLevel int // level and name of the DSCP option
+		tosName  int
+	}{
+		{"tcp4", "127.0.0.1:0", unix.IPPROTO_IP, unix.IP_TOS},
+		{"tcp6", "[::1]:0", unix.IPPROTO_IPV6, unix.IPV6_TCLASS},
+	} {
+		listenConfig := net.ListenConfig{Control: opts.ControlListen}
+		listener, err := listenConfig.Listen(context.Background(), c.network, c.addr)
+		if err != nil {
+			if c.network == "tcp6" {
+				t.Logf("skipping ipv6: %v", err)
+				continue
+			}
+			t.Fatal(err)
+		}
+		defer listener.Close()
+
+		dialer := net.Dialer{Control: opts.ControlDial}
+		conn, err := dialer.Dial(c.network, listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		tcpListener := listener.(*net.TCPListener)
+		tcpConn := conn.(*net.TCPConn)
+
+		for _, s := range []struct {
+			name     string
+			conn     syscall.Conn
+			fastOpen int
+		}{
+			{"listener", tcpListener, fastOpenQueue},
+			{"dialed connection", tcpConn, 0}, // fast open is only enabled on the listeners
+		} {
+			if algorithm := congestion(t, s.conn); algorithm != "reno" {
+				t.Errorf("%s %s: congestion control %s, expected reno", c.network, s.name, algorithm)
+			}
+			for _, o := range []struct {
+				option   string
+				level    int
+				name     int
+				expected int
+			}{
+				{"TCP_NOTSENT_LOWAT", unix.IPPROTO_TCP, unix.TCP_NOTSENT_LOWAT, 16384},
+				{"TCP_USER_TIMEOUT", unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, 5000},
+				{"TCP_FASTOPEN", unix.IPPROTO_TCP, unix.TCP_FASTOPEN, s.fastOpen},
+				{"DSCP", c.tosLevel, c.tosName, 46 << 2},
+			} {
+				if value := socketOption(t, s.conn, o.level, o.name); value != o.expected {
+					t.Errorf("%s %s: %s %d, expected %d", c.network, s.name, o.option, value, o.expected)
+				}
+			}
+		}
+	}
+}
+
+func TestSocketOptionsErrors(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// an unknown algorithm fails the dial instead of being ignored
+	opts := &SocketOptions{Congestion: "backhaul"}
+	dialer := net.Dialer{Control: opts.ControlDial}
+	if conn, err := dialer.Dial("tcp4", listener.Addr().String()); err == nil {
+		conn.Close()
+		t.Error("dial with an unknown congestion control succeeded")
+	}
+
+	// the udp sockets are left untouched
+	listenConfig := net.ListenConfig{Control: opts.ControlListen}
+	packetConn, err := listenConfig.ListenPacket(context.Background(), "udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("udp socket with tcp options: %v", err)
+	}
+	packetConn.Close()
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package utils
+
+import "errors"
+
+// the tcp socket options are only supported on linux
+func setSocketOptions(fd int, network string, o *SocketOptions, listener bool) error {
+	return errors.New("tcp socket options are only supported on linux")
+}
@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/musix/backhaul/internal/web"
+	"github.com/sirupsen/logrus"
+)
+
+// spliceAccountingInterval is how often the bytes of a spliced connection are counted for the sniffer
+const spliceAccountingInterval = time.Second
+
+// spliceData copies between two TCP connections with (*net.TCPConn).ReadFrom, which moves the data inside
+// the kernel with splice(2) on Linux instead of copying it through a user space buffer. Since the data is
+// not seen by the process, the sniffer counts the bytes acknowledged to the destination from its TCP_INFO
+// while the copy runs, and the exact total once it is done.
+func spliceData(from *net.TCPConn, to *net.TCPConn, closer *halfCloser, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
+	var counter *spliceCounter
+	if sniffer {
+		counter = newSpliceCounter(to, usage, remotePort)
+	}
+
+	n, err := to.ReadFrom(from)
+
+	if counter != nil {
+		counter.stop(n)
+	}
+
+	logger.Tracef("spliced data: %d bytes", n)
+
+	// ReadFrom returns no error at the end of the data of the source
+	if err == nil {
+		closer.closeWrite(to.CloseWrite)
+		return
+	}
+
+	if errors.Is(err, net.ErrClosed) {
+		logger.Trace("stream closed")
+	} else {
+		logger.Trace("unable to splice the connection: ", err)
+	}
+	closer.closeAll()
+}
+
+// spliceCounter reports the bytes of a spliced connection to the sniffer periodically
+type spliceCounter struct {
+	conn       *net.TCPConn
+	usage      *web.Usage
+	remotePort int
+	baseline   uint64 // acknowledged bytes written before the copy started, like the tunnel handshake
+	reported   uint64
+	mu         sync.Mutex
+	done       chan struct{}
+	stopped    chan struct{}
+}
+
+func newSpliceCounter(conn *net.TCPConn, usage *web.Usage, remotePort int) *spliceCounter {
+	c := &spliceCounter{
+		conn:       conn,
+		usage:      usage,
+		remotePort: remotePort,
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+
+	baseline, err := tcpBytesAcked(conn)
+	if err != nil {
+		// TCP_INFO is not available, the bytes are only counted once the copy is done
+		close(c.stopped)
+		return c
+	}
+	c.baseline = baseline
+
+	go c.run()
+	return c
+}
+
+func (c *spliceCounter) run() {
+	defer close(c.stopped)
+
+	ticker := time.NewTicker(spliceAccountingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			acked, err := tcpBytesAcked(c.conn)
+			if err != nil {
+				return
+			}
+			c.report(acked - c.baseline)
+		}
+	}
+}
+
+// report counts the bytes copied so far that were not reported yet
+func (c *spliceCounter) report(total uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if total <= c.reported {
+		return
+	}
+	c.usage.AddOrUpdatePort(c.remotePort, total-c.reported)
+	c.reported = total
+}
+
+// stop ends the periodic counting and reports the rest of the n bytes copied
+func (c *spliceCounter) stop(n int64) {
+	close(c.done)
+	<-c.stopped
+	c.report(uint64(n))
+}
@@ -0,0 +1,288 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// splitCloseTimeout is how long a closed session waits for its last uploads to be sent or read
+const splitCloseTimeout = 10 * time.Second
+
+// SplitUpload is the upload side of a split HTTP session on the server. The client sends its data as
+// numbered POST requests which may arrive out of order over different connections, they are put back
+// in order here and read like a stream. An empty POST ends the data.
+type SplitUpload struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	next    uint64            // sequence number of the next POST in order
+	read    uint64            // number of POSTs fully read
+	pending map[uint64][]byte // POSTs received ahead of the next one
+	queue   [][]byte          // POSTs in order, not read yet
+	window  int               // POSTs accepted ahead of the reader, the rest wait for it
+	data    bool              // data was uploaded
+	ended   bool              // the end of the data was queued
+	eof     bool              // the end of the data was read
+	closed  bool
+}
+
+func NewSplitUpload(window int) *SplitUpload {
+	if window < 1 {
+		window = 1
+	}
+	u := &SplitUpload{
+		pending: make(map[uint64][]byte),
+		window:  window,
+	}
+	u.cond = sync.NewCond(&u.mu)
+	return u
+}
+
+// Push adds the body of a POST, it blocks while the POST is too far ahead of the reader
+func (u *SplitUpload) Push(seq uint64, data []byte) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for !u.closed && seq >= u.read+uint64(u.window) {
+		u.cond.Wait()
+	}
+	if u.closed {
+		return net.ErrClosed
+	}
+	if _, ok := u.pending[seq]; ok || seq < u.next {
+		return fmt.Errorf("duplicate upload %d", seq)
+	}
+	if u.ended {
+		return fmt.Errorf("upload %d after the end of the data", seq)
+	}
+
+	u.pending[seq] = data
+	for !u.ended {
+		data, ok := u.pending[u.next]
+		if !ok {
+			break
+		}
+		delete(u.pending, u.next)
+		u.queue = append(u.queue, data)
+		u.next++
+		u.data = u.data || len(data) > 0
+		u.ended = len(data) == 0
+	}
+	u.cond.Broadcast()
+	return nil
+}
+
+func (u *SplitUpload) Read(b []byte) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for !u.closed && len(u.queue) == 0 {
+		u.cond.Wait()
+	}
+	if len(u.queue) == 0 {
+		return 0, io.EOF
+	}
+	if len(u.queue[0]) == 0 {
+		// the empty POST that ends the data
+		u.eof = true
+		u.cond.Broadcast()
+		return 0, io.EOF
+	}
+
+	n := copy(b, u.queue[0])
+	u.queue[0] = u.queue[0][n:]
+	if len(u.queue[0]) == 0 {
+		u.queue = u.queue[1:]
+		u.read++
+		u.cond.Broadcast() // wake up the POSTs waiting for the reader
+	}
+	return n, nil
+}
+
+// Drain waits for the data of a session ended by the client to be read, for splitCloseTimeout at most.
+// It returns right away when the client left without ending its data, or had none to send.
+func (u *SplitUpload) Drain() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	timedOut := false
+	timer := time.AfterFunc(splitCloseTimeout, func() {
+		u.mu.Lock()
+		timedOut = true
+		u.cond.Broadcast()
+		u.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	for !u.closed && !timedOut && u.ended && u.data && !u.eof {
+		u.cond.Wait()
+	}
+}
+
+func (u *SplitUpload) Close() error {
+	u.mu.Lock()
+	u.closed = true
+	u.queue = nil
+	u.pending = nil
+	u.cond.Broadcast()
+	u.mu.Unlock()
+	return nil
+}
+
+// SplitUploader is the upload side of a split HTTP session on the client. Writes are buffered and sent
+// as numbered POST requests of up to size bytes, at most concurrency of them at the same time. Data
+// written while the POSTs are in flight is batched into the next ones. The end of the data is sent as
+// an empty POST once the others are done.
+type SplitUploader struct {
+	post        func(seq uint64, data []byte) error
+	size        int
+	concurrency int
+	mu          sync.Mutex
+	cond        *sync.Cond
+	buf         []byte
+	seq         uint64
+	inflight    int
+	ended       bool // the writes were closed
+	endOnce     sync.Once
+	endErr      error
+	closed      bool
+	err         error
+}
+
+func NewSplitUploader(size int, concurrency int, post func(seq uint64, data []byte) error) *SplitUploader {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	u := &SplitUploader{
+		post:        post,
+		size:        size,
+		concurrency: concurrency,
+	}
+	u.cond = sync.NewCond(&u.mu)
+
+	go u.sender()
+
+	return u
+}
+
+func (u *SplitUploader) Write(b []byte) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	// keep at most one round of POSTs buffered
+	for !u.closed && !u.ended && len(u.buf) >= u.size*u.concurrency {
+		u.cond.Wait()
+	}
+	if u.err != nil {
+		return 0, u.err
+	}
+	if u.closed || u.ended {
+		return 0, net.ErrClosed
+	}
+
+	u.buf = append(u.buf, b...)
+	u.cond.Broadcast()
+	return len(b), nil
+}
+
+func (u *SplitUploader) sender() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for {
+		for !u.closed && (len(u.buf) == 0 || u.inflight >= u.concurrency) {
+			u.cond.Wait()
+		}
+		if u.closed {
+			return
+		}
+
+		n := len(u.buf)
+		if n > u.size {
+			n = u.size
+		}
+		data := make([]byte, n)
+		copy(data, u.buf)
+		u.buf = u.buf[n:]
+		if len(u.buf) == 0 {
+			u.buf = nil // release the buffer once it is drained
+		}
+
+		seq := u.seq
+		u.seq++
+		u.inflight++
+		u.cond.Broadcast() // room for the writers
+
+		go func() {
+			err := u.post(seq, data)
+
+			u.mu.Lock()
+			u.inflight--
+			if err != nil && !u.closed {
+				// a lost POST breaks the stream, fail the following writes
+				u.err = err
+				u.closed = true
+			}
+			u.cond.Broadcast()
+			u.mu.Unlock()
+		}()
+	}
+}
+
+// CloseWrite sends the buffered data and the end of the data, once the POSTs in flight are done. It gives
+// up after splitCloseTimeout, when the server does not take the uploads anymore.
+func (u *SplitUploader) CloseWrite() error {
+	u.endOnce.Do(func() {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+
+		u.ended = true
+		u.cond.Broadcast()
+
+		timedOut := false
+		timer := time.AfterFunc(splitCloseTimeout, func() {
+			u.mu.Lock()
+			timedOut = true
+			u.cond.Broadcast()
+			u.mu.Unlock()
+		})
+		defer timer.Stop()
+
+		for !u.closed && !timedOut && (len(u.buf) > 0 || u.inflight > 0) {
+			u.cond.Wait()
+		}
+		switch {
+		case u.err != nil:
+			u.endErr = u.err
+			return
+		case u.closed:
+			u.endErr = net.ErrClosed
+			return
+		case timedOut:
+			u.endErr = fmt.Errorf("timeout while sending the last uploads")
+			return
+		}
+
+		// the sender is idle, the end follows every other POST
+		seq := u.seq
+		u.seq++
+		u.mu.Unlock()
+		u.endErr = u.post(seq, nil)
+		u.mu.Lock()
+	})
+	return u.endErr
+}
+
+// Close sends the data written so far and its end before releasing the uploader
+func (u *SplitUploader) Close() error {
+	err := u.CloseWrite()
+
+	u.mu.Lock()
+	u.closed = true
+	u.buf = nil
+	u.cond.Broadcast()
+	u.mu.Unlock()
+	return err
+}
@@ -0,0 +1,188 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSplitUploadOrder(t *testing.T) {
+	upload := NewSplitUpload(8)
+
+	// the POSTs arrive out of order, the end of the data first
+	for _, seq := range []uint64{4, 2, 0, 3, 1} {
+		data := []byte{byte('a' + seq)}
+		if seq == 4 {
+			data = []byte{}
+		}
+		if err := upload.Push(seq, data); err != nil {
+			t.Fatalf("push %d: %v", seq, err)
+		}
+	}
+	if err := upload.Push(2, []byte("c")); err == nil {
+		t.Error("duplicate upload accepted")
+	}
+	if err := upload.Push(5, []byte("f")); err == nil {
+		t.Error("upload after the end of the data accepted")
+	}
+
+	data, err := io.ReadAll(upload)
+	if err != nil || string(data) != "abcd" {
+		t.Errorf("read %q %v, expected abcd", data, err)
+	}
+
+	upload.Close()
+	if err := upload.Push(6, []byte("g")); err == nil {
+		t.Error("upload to a closed session accepted")
+	}
+}
+
+func TestSplitUploadWindow(t *testing.T) {
+	upload := NewSplitUpload(2)
+
+	// a POST too far ahead of the reader waits for it
+	pushed := make(chan error, 1)
+	go func() { pushed <- upload.Push(2, []byte("c")) }()
+
+	upload.Push(0, []byte("a"))
+	upload.Push(1, []byte("b"))
+	select {
+	case <-pushed:
+		t.Fatal("upload accepted ahead of the window")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	b := make([]byte, 1)
+	upload.Read(b)
+	if err := <-pushed; err != nil {
+		t.Fatalf("push after the read: %v", err)
+	}
+
+	// closing the session releases the POSTs waiting for the reader
+	go func() { pushed <- upload.Push(4, []byte("e")) }()
+	time.Sleep(10 * time.Millisecond)
+	upload.Close()
+	if err := <-pushed; err == nil {
+		t.Error("waiting upload accepted by a closed session")
+	}
+}
+
+// uploaderLink sends the POSTs of an uploader to an upload, in a random order
+func uploaderLink(upload *SplitUpload, fail uint64) func(seq uint64, data []byte) error {
+	return func(seq uint64, data []byte) error {
+		time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+		if seq == fail {
+			return errors.New("upload lost")
+		}
+		return upload.Push(seq, data)
+	}
+}
+
+func TestSplitUploaderClose(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		closeWrite bool
+	}{
+		{"close", false},
+		{"close write", true},
+	} {
+		upload := NewSplitUpload(16)
+		uploader := NewSplitUploader(1024, 4, uploaderLink(upload, ^uint64(0)))
+
+		// not a multiple of the size of the POSTs
+		payload := make([]byte, 5000)
+		rand.Read(payload)
+
+		received := make(chan []byte, 1)
+		go func() {
+			data, _ := io.ReadAll(upload)
+			received <- data
+		}()
+
+		for i := 0; i < len(payload); i += 700 {
+			if _, err := uploader.Write(payload[i:min(i+700, len(payload))]); err != nil {
+				t.Fatalf("%s: write: %v", c.name, err)
+			}
+		}
+
+		var err error
+		if c.closeWrite {
+			err = uploader.CloseWrite()
+			if _, werr := uploader.Write([]byte("late")); werr == nil {
+				t.Errorf("%s: write after the end of the data accepted", c.name)
+			}
+			uploader.Close()
+		} else {
+			err = uploader.Close()
+		}
+		if err != nil {
+			t.Errorf("%s: close returned %v", c.name, err)
+		}
+
+		select {
+		case data := <-received:
+			if !bytes.Equal(data, payload) {
+				t.Errorf("%s: received %d bytes, expected the %d written", c.name, len(data), len(payload))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: end of the data not received", c.name)
+		}
+	}
+}
+
+func TestSplitUploaderLostPost(t *testing.T) {
+	upload := NewSplitUpload(16)
+	uploader := NewSplitUploader(100, 2, uploaderLink(upload, 1))
+
+	uploader.Write(make([]byte, 250))
+	if err := uploader.Close(); err == nil {
+		t.Error("close succeeded with a lost upload")
+	}
+	if _, err := uploader.Write([]byte("late")); err == nil {
+		t.Error("write accepted after a lost upload")
+	}
+}
+
+func TestSplitUploadDrain(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		pushes  [][]byte
+		drained bool // Drain waits for the reader
+	}{
+		{"ended with data", [][]byte{[]byte("data"), {}}, true},
+		{"ended without data", [][]byte{{}}, false},
+		{"not ended", [][]byte{[]byte("data")}, false},
+	} {
+		upload := NewSplitUpload(4)
+		for seq, data := range c.pushes {
+			upload.Push(uint64(seq), data)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		var read []byte
+		go func() {
+			defer wg.Done()
+			time.Sleep(50 * time.Millisecond)
+			read = make([]byte, 16)
+			n, _ := upload.Read(read)
+			read = read[:n]
+			upload.Read(make([]byte, 16))
+		}()
+
+		start := time.Now()
+		upload.Drain()
+		if waited := time.Since(start) >= 50*time.Millisecond; waited != c.drained {
+			t.Errorf("%s: drain waited %v, expected to wait %v", c.name, time.Since(start), c.drained)
+		}
+		if c.drained && string(read) != "data" {
+			t.Errorf("%s: drain returned before the data %q was read", c.name, read)
+		}
+		upload.Close()
+		wg.Wait()
+	}
+}
@@ -4,40 +4,57 @@ import (
 	"errors"
 	"io"
 	"net"
+	"time"
 
 	"github.com/musix/backhaul/internal/web"
 	"github.com/sirupsen/logrus"
 )
 
-func TCPConnectionHandler(from net.Conn, to net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
+// TCPConnectionHandler exchanges the data of two connections. The end of the data of one side half-closes
+// the other one when it supports it, both are closed linger later unless the other direction ended before.
+func TCPConnectionHandler(from net.Conn, to net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool, linger time.Duration) {
+	closer := newHalfCloser(linger, func() {
+		from.Close()
+		to.Close()
+	})
+
+	// Plain TCP on both sides, the data is spliced inside the kernel
+	fromTCP, fromOK := from.(*net.TCPConn)
+	toTCP, toOK := to.(*net.TCPConn)
+	if fromOK && toOK {
+		done := make(chan struct{})
+
+		go func() {
+			defer close(done)
+			spliceData(fromTCP, toTCP, closer, logger, usage, remotePort, sniffer)
+		}()
+
+		spliceData(toTCP, fromTCP, closer, logger, usage, remotePort, sniffer)
+
+		<-done
+		return
+	}
+
 	done := make(chan struct{})
 
 	go func() {
 		defer close(done)
-		transferData(from, to, logger, usage, remotePort, sniffer)
+		transferData(from, to, closer, logger, usage, remotePort, sniffer)
 	}()
 
-	transferData(to, from, logger, usage, remotePort, sniffer)
+	transferData(to, from, closer, logger, usage, remotePort, sniffer)
 
 	<-done
 }
 
 // Using direct Read and Write for transferring data
-func transferData(from net.Conn, to net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
-	buf := make([]byte, 16*1024) // 16K
+func transferData(from net.Conn, to net.Conn, closer *halfCloser, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
+	buf := GetBuffer(CopyBufferSize) // 16K
+	defer PutBuffer(buf)
+
 	for {
 		// Read data from the source connection
-		r, err := from.Read(buf)
-		if err != nil {
-			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
-				logger.Trace("reader stream closed or EOF received")
-			} else {
-				logger.Trace("unable to read from the connection: ", err)
-			}
-			from.Close()
-			to.Close()
-			return
-		}
+		r, readErr := from.Read(buf)
 
 		totalWritten := 0
 		for totalWritten < r {
@@ -49,8 +66,7 @@ func transferData(from net.Conn, to net.Conn, logger *logrus.Logger, usage *web.
 				} else {
 					logger.Trace("unable to write to the connection: ", err)
 				}
-				from.Close()
-				to.Close()
+				closer.closeAll()
 				return
 
 			}
@@ -61,6 +77,23 @@ func transferData(from net.Conn, to net.Conn, logger *logrus.Logger, usage *web.
 		if sniffer {
 			usage.AddOrUpdatePort(remotePort, uint64(totalWritten))
 		}
+
+		// the data read along with an error is written first, a stream may return it with EOF
+		if readErr != nil {
+			if errors.Is(readErr, io.EOF) {
+				// the source is done, the other direction goes on until it is done as well
+				logger.Trace("EOF received, closing the writes of the destination")
+				closer.closeWrite(closeWriteOf(to))
+				return
+			}
+			if errors.Is(readErr, net.ErrClosed) {
+				logger.Trace("reader stream closed")
+			} else {
+				logger.Trace("unable to read from the connection: ", readErr)
+			}
+			closer.closeAll()
+			return
+		}
 	}
 
 }
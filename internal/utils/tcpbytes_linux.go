@@ -0,0 +1,31 @@
+//go:build linux
+
+package utils
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// tcpBytesAcked reads the bytes written to a connection and acknowledged by the peer from its TCP_INFO
+func tcpBytesAcked(conn *net.TCPConn) (uint64, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var info *unix.TCPInfo
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		info, sockErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if sockErr != nil {
+		return 0, sockErr
+	}
+
+	return info.Bytes_acked, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package utils
+
+import (
+	"errors"
+	"net"
+)
+
+// tcpBytesAcked is only supported on linux, spliced connections are then counted once they are closed
+func tcpBytesAcked(conn *net.TCPConn) (uint64, error) {
+	return 0, errors.New("TCP_INFO is not supported on this platform")
+}
@@ -0,0 +1,280 @@
+package utils
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// UDPBatchSize is the number of datagrams read or written by one system call
+const UDPBatchSize = 64
+
+// CopyPacket returns a copy of a datagram in a pooled buffer, it is handed back with ReleasePacket once
+// it is sent.
+func CopyPacket(data []byte) []byte {
+	buf := GetBuffer(len(data))
+	copy(buf, data)
+	return buf
+}
+
+// ReleasePacket returns a packet of CopyPacket to the pool, it must not be used afterwards
+func ReleasePacket(data []byte) {
+	PutBuffer(data)
+}
+
+// With GSO the packets of a batch going to the same address are coalesced into one datagram, the kernel
+// splits it into segments of the size of the first packet. All the segments but the last one must have
+// that size, and the kernel limits the segments and the total size of a datagram.
+const (
+	maxGSOSegments = 64
+	maxGSOBytes    = 65000
+)
+
+// groBufferSize holds the largest datagram GRO can coalesce
+const groBufferSize = 64 * 1024
+
+// batchConn is implemented by the ipv4 and ipv6 packet connections of x/net
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// UDPBatch reads the datagrams of a UDP socket in batches, with recvmmsg on Linux. On the other
+// platforms it reads one datagram at a time with ReadFromUDP.
+type UDPBatch struct {
+	conn *net.UDPConn
+	bc   batchConn // nil when batches are not supported
+	msgs []ipv4.Message
+	buf  []byte      // read buffer, used when batches are not supported
+	gso  atomic.Bool // coalesce the written packets, disabled when the path does not support it
+	gro  bool        // received datagrams may be coalesced by the kernel
+}
+
+// NewUDPBatch prepares the batch reads of conn, every datagram is read into a buffer of bufferSize bytes
+func NewUDPBatch(conn *net.UDPConn, bufferSize int) *UDPBatch {
+	b := &UDPBatch{conn: conn}
+
+	if runtime.GOOS != "linux" {
+		b.buf = make([]byte, bufferSize)
+		return b
+	}
+
+	b.bc = newBatchConn(conn)
+	b.msgs = make([]ipv4.Message, UDPBatchSize)
+	for i := range b.msgs {
+		b.msgs[i].Buffers = [][]byte{make([]byte, bufferSize)}
+	}
+	return b
+}
+
+func newBatchConn(conn *net.UDPConn) batchConn {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		return ipv4.NewPacketConn(conn)
+	}
+	return ipv6.NewPacketConn(conn)
+}
+
+// EnableOffload turns on UDP segmentation offload (GSO) for the writes and generic receive offload (GRO)
+// for the reads, when the kernel supports them. It must be called before the batch is used.
+func (b *UDPBatch) EnableOffload() (gso bool, gro bool) {
+	if b.bc == nil {
+		return false, false
+	}
+
+	if supportsGSO(b.conn) {
+		b.gso.Store(true)
+	}
+
+	if enableGRO(b.conn) {
+		b.gro = true
+		// a coalesced datagram does not fit in the read buffers, the control message holds its segment size
+		for i := range b.msgs {
+			b.msgs[i].Buffers[0] = make([]byte, groBufferSize)
+			b.msgs[i].OOB = make([]byte, 64)
+		}
+	}
+
+	return b.gso.Load(), b.gro
+}
+
+// ReadBatch waits for datagrams and calls handle for each of them, data is only valid until the next call.
+// addr is nil on a connected socket when the kernel does not report the source.
+func (b *UDPBatch) ReadBatch(handle func(data []byte, addr *net.UDPAddr)) error {
+	if b.bc == nil {
+		n, addr, err := b.conn.ReadFromUDP(b.buf)
+		if err != nil {
+			return err
+		}
+		handle(b.buf[:n], addr)
+		return nil
+	}
+
+	n, err := b.bc.ReadBatch(b.msgs, 0)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < n; i++ {
+		msg := &b.msgs[i]
+		addr, _ := msg.Addr.(*net.UDPAddr)
+		data := msg.Buffers[0][:msg.N]
+
+		// split a datagram coalesced by GRO into the datagrams of the sender
+		size := 0
+		if b.gro {
+			size = groSize(msg.OOB[:msg.NN])
+		}
+		if size <= 0 {
+			handle(data, addr)
+			continue
+		}
+		for len(data) > 0 {
+			segment := min(size, len(data))
+			handle(data[:segment], addr)
+			data = data[segment:]
+		}
+	}
+	return nil
+}
+
+// Writer returns a batch writer of the socket, every goroutine writing to it needs its own writer
+func (b *UDPBatch) Writer() *UDPBatchWriter {
+	w := &UDPBatchWriter{batch: b}
+	if b.bc != nil {
+		w.msgs = make([]ipv4.Message, UDPBatchSize)
+		w.counts = make([]int, UDPBatchSize)
+		for i := range w.msgs {
+			w.msgs[i].Buffers = make([][]byte, 0, maxGSOSegments)
+			w.msgs[i].OOB = make([]byte, 0, 64)
+		}
+	}
+	return w
+}
+
+// UDPBatchWriter writes datagrams of a UDP socket in batches, with sendmmsg on Linux
+type UDPBatchWriter struct {
+	batch  *UDPBatch
+	msgs   []ipv4.Message
+	counts []int // packets coalesced in every message
+}
+
+// WriteTo sends the packets to addr, nil on a connected socket, and returns the number of bytes written
+func (w *UDPBatchWriter) WriteTo(packets [][]byte, addr *net.UDPAddr) (int, error) {
+	written := 0
+
+	if w.batch.bc == nil {
+		for _, packet := range packets {
+			n, err := w.writeOne(packet, addr)
+			written += n
+			if err != nil {
+				return written, err
+			}
+		}
+		return written, nil
+	}
+
+	for len(packets) > 0 {
+		gso := w.batch.gso.Load()
+		count, used := w.prepare(packets, addr, gso)
+
+		// sendmmsg may send only a part of the batch, the rest goes with the next call
+		n, err := w.batch.bc.WriteBatch(w.msgs[:count], 0)
+		for i := 0; i < n; i++ {
+			for _, packet := range w.msgs[i].Buffers {
+				written += len(packet)
+			}
+			packets = packets[w.counts[i]:]
+			used -= w.counts[i]
+		}
+		if err != nil {
+			unsupported, failed := isGSOError(err)
+			if !gso || !failed || n >= count || w.counts[n] == 1 {
+				w.reset()
+				return written, err
+			}
+			if unsupported {
+				w.batch.gso.Store(false)
+			}
+
+			// the coalesced datagram was refused, its packets are sent one by one
+			for _, packet := range packets[:w.counts[n]] {
+				sent, err := w.writeOne(packet, addr)
+				written += sent
+				if err != nil {
+					w.reset()
+					return written, err
+				}
+			}
+			packets = packets[w.counts[n]:]
+			continue
+		}
+		if n == 0 && used > 0 {
+			w.reset()
+			return written, io.ErrShortWrite
+		}
+	}
+
+	w.reset()
+	return written, nil
+}
+
+// prepare fills the messages with the packets, coalesced by GSO when gso is set. It returns the number of
+// messages and of packets they hold.
+func (w *UDPBatchWriter) prepare(packets [][]byte, addr *net.UDPAddr, gso bool) (int, int) {
+	count, used := 0, 0
+
+	for used < len(packets) && count < len(w.msgs) {
+		msg := &w.msgs[count]
+		msg.Buffers = append(msg.Buffers[:0], packets[used])
+		msg.OOB = msg.OOB[:0]
+		msg.Addr = nil // a nil *net.UDPAddr would not be a nil net.Addr
+		if addr != nil {
+			msg.Addr = addr
+		}
+
+		size, total := len(packets[used]), len(packets[used])
+		used++
+
+		if gso {
+			// the following packets of the same size are added, a smaller one ends the datagram
+			for used < len(packets) && len(msg.Buffers) < maxGSOSegments && total+len(packets[used]) <= maxGSOBytes {
+				next := len(packets[used])
+				if next > size {
+					break
+				}
+				msg.Buffers = append(msg.Buffers, packets[used])
+				total += next
+				used++
+				if next < size {
+					break
+				}
+			}
+			if len(msg.Buffers) > 1 {
+				msg.OOB = gsoControl(msg.OOB[:cap(msg.OOB)], size)
+			}
+		}
+
+		w.counts[count] = len(msg.Buffers)
+		count++
+	}
+	return count, used
+}
+
+// reset drops the references to the packets, they are released by the caller
+func (w *UDPBatchWriter) reset() {
+	for i := range w.msgs {
+		clear(w.msgs[i].Buffers)
+		w.msgs[i].Buffers = w.msgs[i].Buffers[:0]
+	}
+}
+
+func (w *UDPBatchWriter) writeOne(packet []byte, addr *net.UDPAddr) (int, error) {
+	if addr == nil {
+		return w.batch.conn.Write(packet)
+	}
+	return w.batch.conn.WriteToUDP(packet, addr)
+}
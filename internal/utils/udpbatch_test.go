@@ -0,0 +1,223 @@
+package utils
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+const benchPacketSize = 512
+
+func listenLoopback(b *testing.B) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatalf("failed to listen: %v", err)
+	}
+	conn.SetReadBuffer(4 * 1024 * 1024)
+	conn.SetWriteBuffer(4 * 1024 * 1024)
+	return conn
+}
+
+// flood sends packets to addr until done is closed
+func flood(conn *net.UDPConn, addr *net.UDPAddr, done chan struct{}) {
+	packets := make([][]byte, UDPBatchSize)
+	for i := range packets {
+		packets[i] = make([]byte, benchPacketSize)
+	}
+	writer := NewUDPBatch(conn, benchPacketSize).Writer()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			writer.WriteTo(packets, addr)
+		}
+	}
+}
+
+func reportPPS(b *testing.B, start time.Time) {
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "pps")
+}
+
+// BenchmarkUDPRead compares reading a datagram per system call, copying every packet like the listeners
+// did, with batched reads into pooled packet buffers
+func BenchmarkUDPRead(b *testing.B) {
+	b.Run("ReadFromUDP", func(b *testing.B) {
+		receiver := listenLoopback(b)
+		defer receiver.Close()
+		sender := listenLoopback(b)
+		defer sender.Close()
+
+		done := make(chan struct{})
+		defer close(done)
+		go flood(sender, receiver.LocalAddr().(*net.UDPAddr), done)
+
+		buf := make([]byte, 16*1024)
+		b.ReportAllocs()
+		b.ResetTimer()
+		start := time.Now()
+
+		for i := 0; i < b.N; i++ {
+			n, _, err := receiver.ReadFromUDP(buf)
+			if err != nil {
+				b.Fatalf("read failed: %v", err)
+			}
+			_ = append([]byte(nil), buf[:n]...)
+		}
+		reportPPS(b, start)
+	})
+
+	b.Run("ReadBatch", func(b *testing.B) {
+		receiver := listenLoopback(b)
+		defer receiver.Close()
+		sender := listenLoopback(b)
+		defer sender.Close()
+
+		done := make(chan struct{})
+		defer close(done)
+		go flood(sender, receiver.LocalAddr().(*net.UDPAddr), done)
+
+		batch := NewUDPBatch(receiver, 16*1024)
+		received := 0
+		handle := func(data []byte, addr *net.UDPAddr) {
+			ReleasePacket(CopyPacket(data))
+			received++
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		start := time.Now()
+
+		for received < b.N {
+			if err := batch.ReadBatch(handle); err != nil {
+				b.Fatalf("read failed: %v", err)
+			}
+		}
+		reportPPS(b, start)
+	})
+}
+
+// BenchmarkUDPWrite compares writing a datagram per system call with batched writes
+func BenchmarkUDPWrite(b *testing.B) {
+	packets := make([][]byte, UDPBatchSize)
+	for i := range packets {
+		packets[i] = make([]byte, benchPacketSize)
+	}
+
+	b.Run("WriteToUDP", func(b *testing.B) {
+		receiver := listenLoopback(b)
+		defer receiver.Close()
+		sender := listenLoopback(b)
+		defer sender.Close()
+		addr := receiver.LocalAddr().(*net.UDPAddr)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		start := time.Now()
+
+		for i := 0; i < b.N; i++ {
+			if _, err := sender.WriteToUDP(packets[0], addr); err != nil {
+				b.Fatalf("write failed: %v", err)
+			}
+		}
+		reportPPS(b, start)
+	})
+
+	b.Run("WriteBatch", func(b *testing.B) {
+		receiver := listenLoopback(b)
+		defer receiver.Close()
+		sender := listenLoopback(b)
+		defer sender.Close()
+		addr := receiver.LocalAddr().(*net.UDPAddr)
+		writer := NewUDPBatch(sender, benchPacketSize).Writer()
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		start := time.Now()
+
+		for sent := 0; sent < b.N; sent += len(packets) {
+			if _, err := writer.WriteTo(packets[:min(len(packets), b.N-sent)], addr); err != nil {
+				b.Fatalf("write failed: %v", err)
+			}
+		}
+		reportPPS(b, start)
+	})
+
+	b.Run("WriteGSO", func(b *testing.B) {
+		receiver := listenLoopback(b)
+		defer receiver.Close()
+		sender := listenLoopback(b)
+		defer sender.Close()
+		addr := receiver.LocalAddr().(*net.UDPAddr)
+		batch := NewUDPBatch(sender, benchPacketSize)
+		if gso, _ := batch.EnableOffload(); !gso {
+			b.Skip("UDP GSO is not supported")
+		}
+		writer := batch.Writer()
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		start := time.Now()
+
+		for sent := 0; sent < b.N; sent += len(packets) {
+			if _, err := writer.WriteTo(packets[:min(len(packets), b.N-sent)], addr); err != nil {
+				b.Fatalf("write failed: %v", err)
+			}
+		}
+		reportPPS(b, start)
+	})
+}
+
+// TestUDPOffload sends packets coalesced by GSO and checks they are received as they were sent, when GRO
+// coalesces them on the receiving side as well
+func TestUDPOffload(t *testing.T) {
+	receiver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer receiver.Close()
+	sender, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer sender.Close()
+
+	out := NewUDPBatch(sender, 16*1024)
+	gso, _ := out.EnableOffload()
+	in := NewUDPBatch(receiver, 16*1024)
+	_, gro := in.EnableOffload()
+	t.Logf("GSO: %v, GRO: %v", gso, gro)
+
+	// segments of the same size followed by a shorter one, then a larger packet that starts a new datagram
+	var packets [][]byte
+	for i := 0; i < 100; i++ {
+		packets = append(packets, bytes.Repeat([]byte{byte(i)}, 1200))
+	}
+	packets = append(packets, []byte("short"), bytes.Repeat([]byte{'x'}, 3000))
+
+	n, err := out.Writer().WriteTo(packets, receiver.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if want := 100*1200 + 5 + 3000; n != want {
+		t.Fatalf("wrote %d bytes, expected %d", n, want)
+	}
+
+	receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var received [][]byte
+	for len(received) < len(packets) {
+		err := in.ReadBatch(func(data []byte, addr *net.UDPAddr) {
+			received = append(received, append([]byte(nil), data...))
+		})
+		if err != nil {
+			t.Fatalf("read failed after %d packets: %v", len(received), err)
+		}
+	}
+
+	for i := range packets {
+		if !bytes.Equal(received[i], packets[i]) {
+			t.Fatalf("packet %d mismatch, got %d bytes, expected %d", i, len(received[i]), len(packets[i]))
+		}
+	}
+}
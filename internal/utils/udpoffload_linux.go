@@ -0,0 +1,80 @@
+//go:build linux
+
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// supportsGSO tells whether the kernel accepts UDP_SEGMENT on the socket, available since Linux 4.18
+func supportsGSO(conn *net.UDPConn) bool {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		_, sockErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_SEGMENT)
+	})
+	return err == nil && sockErr == nil
+}
+
+// enableGRO asks the kernel to coalesce the received datagrams of a flow, available since Linux 5.0
+func enableGRO(conn *net.UDPConn) bool {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_GRO, 1)
+	})
+	return err == nil && sockErr == nil
+}
+
+// gsoControl writes the UDP_SEGMENT control message of a segment size into oob and returns it
+func gsoControl(oob []byte, size int) []byte {
+	oob = oob[:unix.CmsgSpace(2)]
+	for i := range oob {
+		oob[i] = 0
+	}
+
+	hdr := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	hdr.Level = unix.IPPROTO_UDP
+	hdr.Type = unix.UDP_SEGMENT
+	hdr.SetLen(unix.CmsgLen(2))
+	binary.NativeEndian.PutUint16(oob[unix.CmsgLen(0):], uint16(size))
+	return oob
+}
+
+// groSize returns the segment size of a datagram coalesced by GRO, 0 when it was not coalesced
+func groSize(oob []byte) int {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+
+	for _, msg := range msgs {
+		if msg.Header.Level == unix.IPPROTO_UDP && msg.Header.Type == unix.UDP_GRO && len(msg.Data) >= 4 {
+			return int(binary.NativeEndian.Uint32(msg.Data))
+		}
+	}
+	return 0
+}
+
+// isGSOError tells whether a send failed because the path can not segment the datagram. EIO is returned
+// when the device does not support checksum offload, GSO can not be used on the socket at all then.
+func isGSOError(err error) (unsupported bool, failed bool) {
+	if errors.Is(err, unix.EIO) {
+		return true, true
+	}
+	// the segment size is larger than the path MTU
+	return false, errors.Is(err, unix.EINVAL) || errors.Is(err, unix.EMSGSIZE)
+}
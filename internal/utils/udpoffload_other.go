@@ -0,0 +1,26 @@
+//go:build !linux
+
+package utils
+
+import "net"
+
+// UDP GSO and GRO are only supported on linux, the datagrams are then sent and received one by one
+func supportsGSO(conn *net.UDPConn) bool {
+	return false
+}
+
+func enableGRO(conn *net.UDPConn) bool {
+	return false
+}
+
+func gsoControl(oob []byte, size int) []byte {
+	return nil
+}
+
+func groSize(oob []byte) int {
+	return 0
+}
+
+func isGSOError(err error) (unsupported bool, failed bool) {
+	return false, false
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"io"
 	"net"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/musix/backhaul/internal/web"
@@ -11,67 +12,111 @@ import (
 )
 
 // WebSocketToTCPConnectionHandler handles data transfer between a WebSocket and a TCP connection
-func WSConnectionHandler(wsConn *websocket.Conn, tcpConn net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
+// The end of the data of the TCP connection is sent as a close frame, the peer half-closes its TCP
+// connection when it receives it and keeps sending its data until it is done as well.
+func WSConnectionHandler(wsConn *websocket.Conn, tcpConn net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool, linger time.Duration) {
+	closer := newHalfCloser(linger, func() {
+		wsConn.Close()
+		tcpConn.Close()
+	})
+
+	// The close frame of the peer only ends its direction, it is not answered with a close frame
+	// which would end ours as well. Ours is sent once the TCP connection is done.
+	wsConn.SetCloseHandler(func(code int, text string) error {
+		return nil
+	})
+
 	done := make(chan struct{})
 
 	go func() {
 		defer close(done)
-		transferWebSocketToTCP(wsConn, tcpConn, logger, usage, remotePort, sniffer)
+		transferWebSocketToTCP(wsConn, tcpConn, closer, logger, usage, remotePort, sniffer)
 	}()
 
-	transferTCPToWebSocket(tcpConn, wsConn, logger, usage, remotePort, sniffer)
+	transferTCPToWebSocket(tcpConn, wsConn, closer, logger, usage, remotePort, sniffer)
 
 	<-done
 }
 
 // transferWebSocketToTCP transfers data from a WebSocket connection to a TCP connection
-func transferWebSocketToTCP(wsConn *websocket.Conn, tcpConn net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
+func transferWebSocketToTCP(wsConn *websocket.Conn, tcpConn net.Conn, closer *halfCloser, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
+	// Messages are copied through a pooled buffer instead of being read whole into a new one
+	buf := GetBuffer(CopyBufferSize) // 16K buffer size
+	defer PutBuffer(buf)
+
 	for {
 		// Read message from the WebSocket connection
-		messageType, message, err := wsConn.ReadMessage()
+		messageType, message, err := wsConn.NextReader()
 		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				// the peer is done, the other direction goes on until it is done as well
+				logger.Trace("WebSocket close frame received, closing the writes of the TCP connection")
+				closer.closeWrite(closeWriteOf(tcpConn))
+				return
+			}
 			if errors.Is(err, websocket.ErrCloseSent) || errors.Is(err, io.EOF) {
 				logger.Trace("WebSocket reader stream closed or EOF received")
 			} else {
 				logger.Trace("unable to read from the WebSocket connection: ", err)
 			}
-			wsConn.Close()
-			tcpConn.Close()
+			closer.closeAll()
 			return
 		}
 
 		// Only handle text or binary messages (ignore control messages like pings)
 		if messageType == websocket.TextMessage || messageType == websocket.BinaryMessage {
-			// Write the message to the TCP connection
-			w, err := tcpConn.Write(message)
-			if err != nil {
-				logger.Trace("unable to write to the TCP connection: ", err)
-				wsConn.Close()
-				tcpConn.Close()
-				return
-			}
-			logger.Tracef("transferred data from WebSocket to TCP: %d bytes", w)
-			if sniffer {
-				usage.AddOrUpdatePort(remotePort, uint64(w))
+			// Write the message to the TCP connection, a buffer at a time
+			for {
+				r, err := message.Read(buf)
+				if r > 0 {
+					w, err := tcpConn.Write(buf[:r])
+					if err != nil {
+						logger.Trace("unable to write to the TCP connection: ", err)
+						closer.closeAll()
+						return
+					}
+					logger.Tracef("transferred data from WebSocket to TCP: %d bytes", w)
+					if sniffer {
+						usage.AddOrUpdatePort(remotePort, uint64(w))
+					}
+				}
+				if err == io.EOF {
+					break // end of the message
+				}
+				if err != nil {
+					logger.Trace("unable to read from the WebSocket connection: ", err)
+					closer.closeAll()
+					return
+				}
 			}
 		}
 	}
 }
 
 // transferTCPToWebSocket transfers data from a TCP connection to a WebSocket connection
-func transferTCPToWebSocket(tcpConn net.Conn, wsConn *websocket.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
-	buf := make([]byte, 16*1024) // 16K buffer size
+func transferTCPToWebSocket(tcpConn net.Conn, wsConn *websocket.Conn, closer *halfCloser, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
+	buf := GetBuffer(CopyBufferSize) // 16K buffer size
+	defer PutBuffer(buf)
+
 	for {
 		// Read data from the TCP connection
 		n, err := tcpConn.Read(buf)
 		if err != nil {
-			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
-				logger.Trace("TCP reader stream closed or EOF received")
+			if errors.Is(err, io.EOF) {
+				// a close frame ends the messages, the peer can still send its own
+				logger.Trace("TCP EOF received, sending the WebSocket close frame")
+				closer.closeWrite(func() error {
+					message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+					return wsConn.WriteControl(websocket.CloseMessage, message, time.Now().Add(5*time.Second))
+				})
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				logger.Trace("TCP reader stream closed")
 			} else {
 				logger.Trace("unable to read from the TCP connection: ", err)
 			}
-			tcpConn.Close()
-			wsConn.Close()
+			closer.closeAll()
 			return
 		}
 
@@ -83,8 +128,7 @@ func transferTCPToWebSocket(tcpConn net.Conn, wsConn *websocket.Conn, logger *lo
 			} else {
 				logger.Trace("unable to write to the WebSocket connection: ", err)
 			}
-			tcpConn.Close()
-			wsConn.Close()
+			closer.closeAll()
 			return
 		}
 
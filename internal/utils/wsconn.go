@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WSConn is a websocket connection used as a net.Conn, every write is sent as one binary message.
+// It allows one reader and one writer at a time, like the websocket connection itself.
+type WSConn struct {
+	conn    *websocket.Conn
+	pending []byte // rest of the last received message
+}
+
+func NewWSConn(conn *websocket.Conn) *WSConn {
+	return &WSConn{conn: conn}
+}
+
+func (c *WSConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		messageType, message, err := c.conn.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+
+		// Only handle text or binary messages (ignore control messages like pings)
+		if messageType == websocket.TextMessage || messageType == websocket.BinaryMessage {
+			c.pending = message
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *WSConn) Write(b []byte) (int, error) {
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *WSConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *WSConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *WSConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *WSConn) SetDeadline(t time.Time) error {
+	if err := c.conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *WSConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *WSConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWSConn(t *testing.T) {
+	// the server sends messages of its own, then echoes the data it reads
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+
+		ws.WriteMessage(websocket.TextMessage, []byte("hello "))
+		ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+		ws.WriteMessage(websocket.BinaryMessage, []byte("world"))
+
+		conn := NewWSConn(ws)
+		buf := make([]byte, 4)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			conn.Write(buf[:n])
+		}
+	}))
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := NewWSConn(ws)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// the messages are read as one stream, the pings in between are skipped
+	greeting := make([]byte, len("hello world"))
+	if _, err := io.ReadFull(conn, greeting); err != nil || string(greeting) != "hello world" {
+		t.Fatalf("read %q %v, expected hello world", greeting, err)
+	}
+
+	// a message read in parts by the server comes back in parts
+	if n, err := conn.Write([]byte("a longer packet")); err != nil || n != len("a longer packet") {
+		t.Fatalf("wrote %d %v", n, err)
+	}
+	echo := make([]byte, len("a longer packet"))
+	if _, err := io.ReadFull(conn, echo); err != nil || string(echo) != "a longer packet" {
+		t.Errorf("read %q %v, expected a longer packet", echo, err)
+	}
+}
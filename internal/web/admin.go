@@ -0,0 +1,113 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Admin is a single http endpoint shared by all tunnels running in the process
+type Admin struct {
+	listenAddr  string
+	pprof       bool
+	shutdownCtx context.Context
+	logger      *logrus.Logger
+	mu          sync.Mutex
+	tunnels     []TunnelInfo
+}
+
+// TunnelInfo describes a registered tunnel, Status is polled on every request
+type TunnelInfo struct {
+	Name      string
+	Role      string // server or client
+	Transport string
+	Address   string
+	WebPort   int
+	Status    func() string
+}
+
+type tunnelState struct {
+	Name      string `json:"name"`
+	Role      string `json:"role"`
+	Transport string `json:"transport"`
+	Address   string `json:"address"`
+	WebPort   int    `json:"webPort"`
+	Status    string `json:"status"`
+}
+
+func NewAdmin(listenAddr string, pprof bool, shutdownCtx context.Context, logger *logrus.Logger) *Admin {
+	return &Admin{
+		listenAddr:  listenAddr,
+		pprof:       pprof,
+		shutdownCtx: shutdownCtx,
+		logger:      logger,
+	}
+}
+
+// Register adds a tunnel to the admin endpoint
+func (a *Admin) Register(info TunnelInfo) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.tunnels = append(a.tunnels, info)
+}
+
+func (a *Admin) Start() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tunnels", a.handleTunnels)
+
+	if a.pprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	server := &http.Server{
+		Addr:    a.listenAddr,
+		Handler: mux,
+	}
+
+	go func() {
+		<-a.shutdownCtx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			a.logger.Errorf("admin server shutdown error: %v", err)
+		}
+	}()
+
+	a.logger.Info("admin service listening on: ", a.listenAddr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		a.logger.Errorf("admin server error: %v", err)
+	}
+}
+
+func (a *Admin) handleTunnels(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	states := make([]tunnelState, 0, len(a.tunnels))
+	for _, t := range a.tunnels {
+		states = append(states, tunnelState{
+			Name:      t.Name,
+			Role:      t.Role,
+			Transport: t.Transport,
+			Address:   t.Address,
+			WebPort:   t.WebPort,
+			Status:    t.Status(),
+		})
+	}
+	a.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(states); err != nil {
+		a.logger.Errorf("error encoding JSON response: %v", err)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"os"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/shirou/gopsutil/v4/cpu"
@@ -31,7 +32,11 @@ type Usage struct {
 	snifferLog   string
 	mu           sync.Mutex
 	totalTraffic uint64
-	tunnelStatus *string
+	tunnelStatus *TunnelStatus
+	fecLost      uint64 // udp packets lost on the tunnel, when FEC is enabled
+	fecRecovered uint64 // lost udp packets rebuilt from the FEC parity
+	udpDropped   uint64 // udp packets dropped by the drop policy of full session buffers
+	udpEvicted   uint64 // udp sessions evicted for the session limits
 }
 
 type PortUsage struct {
@@ -51,9 +56,32 @@ type SystemStats struct {
 	BackhaulTraffic string `json:"backhaulTraffic"`
 	Sniffer         string `json:"sniffer"`
 	AllConnections  string `json:"allConnections"`
+	FECLost         string `json:"fecLost"`
+	FECRecovered    string `json:"fecRecovered"`
+	UDPDropped      string `json:"udpDropped"`
+	UDPEvicted      string `json:"udpEvicted"`
 }
 
-func NewDataStore(listenAddr string, shutdownCtx context.Context, snifferLog string, sniffer bool, tunnelStatus *string, logger *logrus.Logger) *Usage {
+// TunnelStatus is the status of a tunnel, like "Connected (TCP)". It is set by the transport and read
+// concurrently by the web interface and the admin endpoints.
+type TunnelStatus struct {
+	value atomic.Pointer[string]
+}
+
+// Set replaces the status
+func (t *TunnelStatus) Set(status string) {
+	t.value.Store(&status)
+}
+
+// Get returns the status, empty until the transport set it
+func (t *TunnelStatus) Get() string {
+	if status := t.value.Load(); status != nil {
+		return *status
+	}
+	return ""
+}
+
+func NewDataStore(listenAddr string, shutdownCtx context.Context, snifferLog string, sniffer bool, tunnelStatus *TunnelStatus, logger *logrus.Logger) *Usage {
 	ctx, cancel := context.WithCancel(shutdownCtx)
 	u := &Usage{
 		listenAddr:   listenAddr,
@@ -175,6 +203,27 @@ func (m *Usage) AddOrUpdatePort(port int, usage uint64) {
 	}
 }
 
+// AddFECStats accumulates the lost and recovered packet counters of the UDP FEC decoders
+func (m *Usage) AddFECStats(lost, recovered uint64) {
+	atomic.AddUint64(&m.fecLost, lost)
+	atomic.AddUint64(&m.fecRecovered, recovered)
+}
+
+// AddUDPDrop counts a udp packet dropped because the buffer of its session was full
+func (m *Usage) AddUDPDrop() {
+	atomic.AddUint64(&m.udpDropped, 1)
+}
+
+// AddUDPEviction counts a udp session evicted to make room for a new one
+func (m *Usage) AddUDPEviction() {
+	atomic.AddUint64(&m.udpEvicted, 1)
+}
+
+// UDPCounters returns the udp packets dropped and the udp sessions evicted so far
+func (m *Usage) UDPCounters() (dropped, evicted uint64) {
+	return atomic.LoadUint64(&m.udpDropped), atomic.LoadUint64(&m.udpEvicted)
+}
+
 func (m *Usage) saveUsageData() {
 	// Step 1: Load existing usage data from the JSON file
 	var existingUsageData []PortUsage
@@ -404,7 +453,7 @@ func (m *Usage) getSystemStats() (*SystemStats, error) {
 	downloadSpeed := float64(finalStats.BytesRecv - initialStats.BytesRecv)
 
 	stats := &SystemStats{
-		TunnelStatus:    *m.tunnelStatus,
+		TunnelStatus:    m.tunnelStatus.Get(),
 		CPUUsage:        m.formatFloat(cpuPercent[0]),
 		RAMUsage:        m.convertBytesToReadable(memStats.Used),
 		DiskUsage:       m.convertBytesToReadable(diskStats.Used),
@@ -415,6 +464,10 @@ func (m *Usage) getSystemStats() (*SystemStats, error) {
 		BackhaulTraffic: m.convertBytesToReadable(m.totalTraffic),
 		Sniffer:         map[bool]string{true: "Running", false: "Not running"}[m.sniffer],
 		AllConnections:  fmt.Sprintf("%d", len(connections)),
+		FECLost:         fmt.Sprintf("%d", atomic.LoadUint64(&m.fecLost)),
+		FECRecovered:    fmt.Sprintf("%d", atomic.LoadUint64(&m.fecRecovered)),
+		UDPDropped:      fmt.Sprintf("%d", atomic.LoadUint64(&m.udpDropped)),
+		UDPEvicted:      fmt.Sprintf("%d", atomic.LoadUint64(&m.udpEvicted)),
 	}
 
 	return stats, nil
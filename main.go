@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 
@@ -19,6 +20,8 @@ var (
 	configPath *string
 	ctx        context.Context
 	cancel     context.CancelFunc
+	done       chan struct{} // closed once the running instance returned
+	mu         sync.Mutex    // guards cancel and done between a reload and the shutdown
 )
 
 // Define the version of the application
@@ -41,9 +44,6 @@ func main() {
 		logger.Fatalf("Usage: %s -c /path/to/config.toml", flag.CommandLine.Name())
 	}
 
-	// Apply temporary TCP optimizations at startup
-	cmd.ApplyTCPTuning()
-
 	// Create a context for graceful shutdown handling
 	ctx, cancel = context.WithCancel(context.Background())
 
@@ -51,14 +51,31 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
-	go cmd.Run(*configPath, ctx)
+	done = run(ctx)
 	go hotReload()
 
 	<-sigChan
 
+	mu.Lock()
 	cancel()
+	running := done
+	mu.Unlock()
 
-	time.Sleep(1 * time.Second)
+	// Wait for the tunnels to stop and the tuning of the host to be restored, a second signal exits right away
+	select {
+	case <-running:
+	case <-sigChan:
+	}
+}
+
+// run starts an instance with the configuration file, the returned channel is closed once it returned
+func run(ctx context.Context) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cmd.Run(*configPath, ctx)
+	}()
+	return done
 }
 
 func hotReload() {
@@ -86,19 +103,20 @@ func hotReload() {
 			if modTime.After(lastModTime) {
 				logger.Info("Config file changed, reloading application")
 
-				// Cancel the previous context to stop the old running instance
+				// Cancel the previous context and wait for the old running instance to return
+				mu.Lock()
 				cancel()
-
-				time.Sleep(2 * time.Second)
+				<-done
 
 				// Create a new context for the new instance
 				newCtx, newCancel := context.WithCancel(context.Background())
-				go cmd.Run(*configPath, newCtx)
+				done = run(newCtx)
 
 				// Update the last modification time and the context
 				lastModTime = modTime
 				ctx = newCtx
 				cancel = newCancel
+				mu.Unlock()
 			}
 		}
 	}